@@ -0,0 +1,119 @@
+package essh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var DefaultBenchCount = 10
+
+// BenchResult is latencies of a host that are measured by --bench.
+type BenchResult struct {
+	Host *Host
+	// Connect is a time to establish a connection and authenticate.
+	Connect []time.Duration
+	// Exec is a time to run a trivial command over the established connection.
+	Exec   []time.Duration
+	Errors int
+}
+
+// benchHost opens a connection and runs a trivial command over it repeatedly.
+// The connection is a master connection, so the command's latency doesn't include the handshake.
+func benchHost(config string, host *Host, count int) *BenchResult {
+	result := &BenchResult{Host: host}
+
+	for i := 0; i < count; i++ {
+		c, err := newControlMasters(config)
+		if err != nil {
+			result.Errors++
+			continue
+		}
+
+		start := time.Now()
+		if err := c.Open([]string{"-q", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}, host); err != nil {
+			if debugFlag {
+				debugf("%v\n", err)
+			}
+			result.Errors++
+			c.Close()
+			continue
+		}
+		result.Connect = append(result.Connect, time.Since(start))
+
+		args := append([]string{"-F", config, "-o", "BatchMode=yes"}, c.SSHOptions()...)
+		args = append(args, host.Name, "true")
+
+		start = time.Now()
+		if err := exec.Command("ssh", args...).Run(); err != nil {
+			if debugFlag {
+				debugf("failed to run a command on '%s': %v\n", host.Name, err)
+			}
+			result.Errors++
+		} else {
+			result.Exec = append(result.Exec, time.Since(start))
+		}
+
+		c.Close()
+	}
+
+	return result
+}
+
+// runBench measures the latencies of the hosts one by one, so that the hosts don't affect each other's results.
+func runBench(config string, hosts []*Host, count int, format string) error {
+	listing := &Listing{Header: []string{"NAME", "CONNECT P50", "CONNECT P95", "EXEC P50", "EXEC P95", "ERRORS"}}
+	records := []interface{}{}
+
+	for _, host := range hosts {
+		result := benchHost(config, host, count)
+
+		row := []string{host.Name}
+		record := map[string]interface{}{
+			"name":   host.Name,
+			"count":  count,
+			"errors": result.Errors,
+		}
+		for _, l := range []struct {
+			name      string
+			latencies []time.Duration
+		}{
+			{"connect", result.Connect},
+			{"exec", result.Exec},
+		} {
+			for _, p := range []int{50, 95} {
+				key := fmt.Sprintf("%s_p%d_ms", l.name, p)
+				if len(l.latencies) == 0 {
+					row = append(row, "-")
+					record[key] = nil
+					continue
+				}
+
+				d := percentile(sortedLatencies(l.latencies), p)
+				row = append(row, formatLatency(d))
+				record[key] = d.Nanoseconds() / int64(time.Millisecond)
+			}
+		}
+		row = append(row, strconv.Itoa(result.Errors))
+
+		listing.Append(row)
+		records = append(records, record)
+	}
+	listing.Data = records
+
+	return listing.Write(os.Stdout, format, false)
+}
+
+func sortedLatencies(latencies []time.Duration) []time.Duration {
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -0,0 +1,148 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// CertificateOptions is a host's setting to get a short-lived ssh certificate from a CA before connecting.
+type CertificateOptions struct {
+	// IdentityFile is a private key to be signed. The public key is "IdentityFile.pub".
+	IdentityFile string
+	// Command is a command that outputs a signed certificate to stdout.
+	// It is a text/template that can use {{.PublicKey}} and {{.Host.Name}}.
+	Command string
+	// VaultPath is a path of Vault's SSH CA signing endpoint like "ssh-client-signer/sign/my-role".
+	VaultPath string
+	// TTL is a duration to reuse the certificate that was signed before. 0 means that it signs every time.
+	TTL time.Duration
+}
+
+func toCertificateOptions(tb *lua.LTable) (*CertificateOptions, error) {
+	cert := &CertificateOptions{}
+
+	var err error
+	tb.ForEach(func(key lua.LValue, value lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch lua.LVAsString(key) {
+		case "identity_file":
+			cert.IdentityFile = lua.LVAsString(value)
+		case "command":
+			cert.Command = lua.LVAsString(value)
+		case "vault":
+			cert.VaultPath = lua.LVAsString(value)
+		case "ttl":
+			cert.TTL, err = time.ParseDuration(lua.LVAsString(value))
+		default:
+			err = fmt.Errorf("unsupported certificate's field '%s'.", lua.LVAsString(key))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.IdentityFile == "" {
+		return nil, fmt.Errorf("certificate requires 'identity_file'.")
+	}
+
+	if (cert.Command == "") == (cert.VaultPath == "") {
+		return nil, fmt.Errorf("certificate requires either 'command' or 'vault'.")
+	}
+
+	return cert, nil
+}
+
+func (c *CertificateOptions) PublicKeyFile() string {
+	return c.IdentityFile + ".pub"
+}
+
+// CertificateFile returns a path of the certificate. It is the same name that ssh uses by default.
+func (c *CertificateOptions) CertificateFile() string {
+	return c.IdentityFile + "-cert.pub"
+}
+
+func (c *CertificateOptions) command(host *Host) (string, error) {
+	if c.VaultPath != "" {
+		return "vault write -field=signed_key " + ShellEscape(c.VaultPath) + " public_key=@" + ShellEscape(expandHomeDir(c.PublicKeyFile())), nil
+	}
+
+	tmpl, err := template.New("T").Parse(c.Command)
+	if err != nil {
+		return "", err
+	}
+
+	dict := map[string]interface{}{
+		"PublicKey": expandHomeDir(c.PublicKeyFile()),
+		"Host":      host,
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, dict); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Sign gets a certificate from the CA and writes it next to the identity file.
+func (c *CertificateOptions) Sign(host *Host) error {
+	certFile := expandHomeDir(c.CertificateFile())
+
+	if c.TTL > 0 {
+		if fi, err := os.Stat(certFile); err == nil && time.Since(fi.ModTime()) < c.TTL {
+			if debugFlag {
+				debugf("reuse the certificate: %s\n", certFile)
+			}
+			return nil
+		}
+	}
+
+	command, err := c.command(host)
+	if err != nil {
+		return err
+	}
+
+	if debugFlag {
+		debugf("sign the certificate for '%s': %s\n", host.Name, command)
+	}
+
+	var stdout bytes.Buffer
+	cmd := shellCommand(command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to get a certificate for '%s': %v", host.Name, err)
+	}
+
+	cert := strings.TrimSpace(stdout.String())
+	if cert == "" {
+		return fmt.Errorf("failed to get a certificate for '%s': the command output nothing.", host.Name)
+	}
+
+	return ioutil.WriteFile(certFile, []byte(cert+"\n"), 0600)
+}
+
+// signCertificates gets certificates of the hosts that have certificate settings.
+func signCertificates(hosts []*Host) error {
+	for _, host := range hosts {
+		if host.Certificate == nil {
+			continue
+		}
+
+		if err := host.Certificate.Sign(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
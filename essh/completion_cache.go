@@ -0,0 +1,96 @@
+package essh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CompletionCache stores outputs of the completion commands (like --zsh-completion-hosts)
+// in a file to avoid evaluating all the config files every time.
+// The cache is keyed by the paths and modification times of the config files,
+// so it is invalidated when any config file is changed or the TTL expires.
+type CompletionCache struct {
+	Dir string
+	TTL time.Duration
+	Key string
+}
+
+func NewCompletionCache(dir string, ttl time.Duration, kind string) *CompletionCache {
+	parts := []string{
+		kind,
+		WorkingDir,
+		fmt.Sprintf("global=%v", globalFlag),
+		fmt.Sprintf("all=%v", allFlag),
+	}
+
+	for _, file := range []string{
+		WorkingDirConfigFile,
+		WorkingDirOverrideConfigFile,
+		UserConfigFile,
+		UserOverrideConfigFile,
+	} {
+		mtime := "-"
+		if fi, err := os.Stat(file); err == nil {
+			mtime = strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+		}
+		parts = append(parts, file+"@"+mtime)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+
+	return &CompletionCache{
+		Dir: dir,
+		TTL: ttl,
+		Key: hex.EncodeToString(sum[:]),
+	}
+}
+
+func (c *CompletionCache) Path() string {
+	return filepath.Join(c.Dir, c.Key)
+}
+
+// Get returns the cached output. The second value is false if the cache doesn't exist or has expired.
+func (c *CompletionCache) Get() (string, bool) {
+	fi, err := os.Stat(c.Path())
+	if err != nil {
+		return "", false
+	}
+
+	if time.Since(fi.ModTime()) > c.TTL {
+		return "", false
+	}
+
+	b, err := ioutil.ReadFile(c.Path())
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+func (c *CompletionCache) Set(content string) error {
+	if err := os.MkdirAll(c.Dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.Path(), []byte(content), os.FileMode(0600))
+}
+
+func parseCompletionCacheTTL(s string) (time.Duration, error) {
+	if sec, err := strconv.Atoi(s); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("--completion-cache-ttl requires seconds or a duration (like '30s', '5m') but got '%s'.", s)
+}
@@ -0,0 +1,193 @@
+package essh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigCache stores the generated ssh_config in a file to connect to a host without evaluating the config files.
+// The cache is keyed by the contents of the config files and the Lua libraries,
+// so it is invalidated when any of them is changed. The other inputs of the config files (like the files
+// that are loaded by dofile, the environment variables and the outputs of commands) aren't tracked,
+// so it is used only if the config files enable it by essh.config_cache.
+type ConfigCache struct {
+	Dir string
+	Key string
+}
+
+// ConfigCacheEntry is a cached result of evaluating the config files.
+type ConfigCacheEntry struct {
+	Content string `json:"content"`
+	// ConfigFile is a path of the ssh_config when it was generated. It may be in the content (like ProxyCommand).
+	ConfigFile string `json:"config_file"`
+	// Tasks are the names of the enabled tasks. "essh <task>" always evaluates the config files.
+	Tasks []string `json:"tasks"`
+	// Hosts are the names of the hosts. The value is true if essh can connect to the host only with the ssh_config.
+	Hosts map[string]bool `json:"hosts"`
+}
+
+func NewConfigCache(dir string, libDirs []string) *ConfigCache {
+	// the caches are stored in a directory for each working directory, and only the latest one is kept in it.
+	context := sha256.Sum256([]byte(WorkingDir + "\n" + fmt.Sprintf("global=%v", globalFlag)))
+	dir = filepath.Join(dir, hex.EncodeToString(context[:8]))
+
+	parts := []string{Version}
+
+	files := []string{
+		WorkingDirConfigFile,
+		WorkingDirOverrideConfigFile,
+		UserConfigFile,
+		UserOverrideConfigFile,
+	}
+	for _, dir := range libDirs {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() && strings.HasSuffix(path, ".lua") {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+
+	for _, file := range files {
+		hash := "-"
+		if b, err := ioutil.ReadFile(file); err == nil {
+			sum := sha256.Sum256(b)
+			hash = hex.EncodeToString(sum[:])
+		}
+		parts = append(parts, file+"@"+hash)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+
+	return &ConfigCache{
+		Dir: dir,
+		Key: hex.EncodeToString(sum[:]),
+	}
+}
+
+func (c *ConfigCache) Path() string {
+	return filepath.Join(c.Dir, c.Key+".json")
+}
+
+func (c *ConfigCache) Get() (*ConfigCacheEntry, bool) {
+	b, err := ioutil.ReadFile(c.Path())
+	if err != nil {
+		return nil, false
+	}
+
+	entry := &ConfigCacheEntry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (c *ConfigCache) Set(entry *ConfigCacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.Dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	// the old cache is never used again after the config files are changed.
+	if files, err := filepath.Glob(filepath.Join(c.Dir, "*.json")); err == nil {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+
+	return writeFileAtomic(c.Path(), b, os.FileMode(0600))
+}
+
+// newConfigCacheEntry creates an entry from the evaluated hosts and tasks.
+func newConfigCacheEntry(content []byte, configFile string) *ConfigCacheEntry {
+	entry := &ConfigCacheEntry{
+		Content:    string(content),
+		ConfigFile: configFile,
+		Tasks:      []string{},
+		Hosts:      map[string]bool{},
+	}
+
+	for _, t := range NewTaskQuery().GetTasksOrderByName() {
+		if !t.Disabled {
+			entry.Tasks = append(entry.Tasks, t.PublicName())
+		}
+	}
+
+	for name, host := range Hosts {
+		// hooks, certificates, host key verification and the warning of the expiry need the evaluated config.
+		entry.Hosts[name] = host.Expires.IsZero() &&
+			len(host.HooksBeforeConnect) == 0 &&
+			len(host.HooksAfterConnect) == 0 &&
+			len(host.HooksAfterDisconnect) == 0 &&
+			host.Certificate == nil &&
+			!isHostKeyFingerprint(host.HostKey)
+	}
+
+	return entry
+}
+
+// CanConnect reports whether essh can run ssh command with the args only with the cached ssh_config.
+func (e *ConfigCacheEntry) CanConnect(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	for _, name := range e.Tasks {
+		if name == args[0] {
+			return false
+		}
+	}
+
+	// the same as sshArgsHosts. ssh connects to only one host.
+	for _, arg := range args {
+		name := arg
+		if at := strings.LastIndex(name, "@"); at >= 0 {
+			name = name[at+1:]
+		}
+
+		if direct, ok := e.Hosts[name]; ok {
+			return direct
+		}
+	}
+
+	// the host that isn't in the cache may be defined by the config files now.
+	return false
+}
+
+// runSSHWithConfigCache runs ssh command with the cached ssh_config. The hosts that need
+// the evaluated config (like hooks) are never connected here, so it doesn't need any Lua state.
+func runSSHWithConfigCache(entry *ConfigCacheEntry, args []string) (error, int) {
+	config, err := newTempSSHConfig()
+	if err != nil {
+		return err, ExitErr
+	}
+	defer removeTempSSHConfig(config)
+
+	// the content may refer the old config file by essh.ssh_config.
+	content := strings.Replace(entry.Content, entry.ConfigFile, config, -1)
+	if err := ioutil.WriteFile(config, []byte(content), 0600); err != nil {
+		return err, ExitErr
+	}
+
+	// the hosts aren't registered, so the usage is counted by the names in the entry.
+	for _, arg := range args {
+		name := arg[strings.LastIndex(arg, "@")+1:]
+		if _, ok := entry.Hosts[name]; ok {
+			recordHostUsage(name)
+			break
+		}
+	}
+
+	return runSSH(nil, config, args)
+}
@@ -0,0 +1,157 @@
+package essh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"sort"
+)
+
+// ConfigSnapshot is the records of the hosts and the tasks that are defined by the config files.
+// It is used by --diff-config to compare two configs.
+type ConfigSnapshot struct {
+	Hosts map[string]map[string]interface{}
+	Tasks map[string]map[string]interface{}
+}
+
+// takeConfigSnapshot takes the snapshot of the hosts and the tasks that are currently loaded.
+func takeConfigSnapshot() *ConfigSnapshot {
+	snapshot := &ConfigSnapshot{
+		Hosts: map[string]map[string]interface{}{},
+		Tasks: map[string]map[string]interface{}{},
+	}
+
+	for _, h := range Hosts {
+		snapshot.Hosts[h.Name] = hostRecord(h)
+	}
+	for _, t := range Tasks {
+		record := taskRecord(t)
+		// the changes of the scripts are the most important in reviewing.
+		record["script"] = t.Script
+		record["file"] = t.File
+		snapshot.Tasks[t.PublicName()] = record
+	}
+
+	return snapshot
+}
+
+// loadConfigSnapshot evaluates the config file alone with a new Lua state and takes its snapshot.
+// The files that are compared are evaluated in the same way, without the other config files like the override files.
+// It replaces the loaded hosts and tasks, so it must be called after the current config is used.
+func loadConfigSnapshot(file string, sshConfig string) (*ConfigSnapshot, error) {
+	Hosts = map[string]*Host{}
+	Tasks = map[string]*Task{}
+	NamedGroups = map[string]*Group{}
+	ConnectionSettings = map[string]string{}
+	HostProviders = []*HostProvider{}
+	Roles = map[string]*Role{}
+
+	L := lua.NewState()
+	defer L.Close()
+	InitLuaState(L)
+
+	if lessh, ok := toLTable(L.GetGlobal("essh")); ok {
+		lessh.RawSetString("ssh_config", lua.LString(sshConfig))
+	}
+
+	CurrentRegistry = LocalRegistry
+
+	if debugFlag {
+		debugf("loading config file to compare: %s\n", file)
+	}
+
+	if err := L.DoFile(file); err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	loadHostProviders(L, false)
+
+	if err := validateResources(NewTaskQuery().Datasource, NewHostQuery().Datasource); err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+
+	return takeConfigSnapshot(), nil
+}
+
+// writeConfigDiff writes the hosts and the tasks that are added, removed and changed in the other config.
+// It returns false if there are any differences.
+func writeConfigDiff(w io.Writer, current *ConfigSnapshot, other *ConfigSnapshot) bool {
+	same := writeRecordsDiff(w, "hosts", current.Hosts, other.Hosts)
+	return writeRecordsDiff(w, "tasks", current.Tasks, other.Tasks) && same
+}
+
+func writeRecordsDiff(w io.Writer, kind string, current map[string]map[string]interface{}, other map[string]map[string]interface{}) bool {
+	names := []string{}
+	for name := range current {
+		names = append(names, name)
+	}
+	for name := range other {
+		if _, ok := current[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		c, inCurrent := current[name]
+		o, inOther := other[name]
+		switch {
+		case !inCurrent:
+			lines = append(lines, color.FgG("  + %s", name))
+		case !inOther:
+			lines = append(lines, color.FgR("  - %s", name))
+		default:
+			changes := recordChanges(c, o)
+			if len(changes) == 0 {
+				continue
+			}
+			lines = append(lines, color.FgY("  ~ %s", name))
+			lines = append(lines, changes...)
+		}
+	}
+
+	if len(lines) == 0 {
+		fmt.Fprintf(w, "%s: no changes\n", kind)
+		return true
+	}
+
+	fmt.Fprintf(w, "%s:\n", kind)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return false
+}
+
+// recordChanges returns the lines of the fields that have different values in the records.
+func recordChanges(current map[string]interface{}, other map[string]interface{}) []string {
+	keys := []string{}
+	for key := range current {
+		keys = append(keys, key)
+	}
+	for key := range other {
+		if _, ok := current[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []string{}
+	for _, key := range keys {
+		c, o := diffValue(current[key]), diffValue(other[key])
+		if c != o {
+			changes = append(changes, fmt.Sprintf("      %s: %s -> %s", key, c, o))
+		}
+	}
+	return changes
+}
+
+// diffValue formats the value to compare. The keys of the maps are sorted by json.
+func diffValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
@@ -0,0 +1,90 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"unicode"
+)
+
+// ConnectionSettings are ssh_config parameters that are applied to all hosts as defaults.
+// They are output as a "Host *" section at the end of the generated ssh_config,
+// so the parameters defined in each host take precedence over them.
+var ConnectionSettings map[string]string
+
+// connectionKeys maps the snake_case keys of the connection settings to the ssh_config keywords.
+var connectionKeys = map[string]string{
+	"server_alive_interval":  "ServerAliveInterval",
+	"server_alive_count_max": "ServerAliveCountMax",
+	"connect_timeout":        "ConnectTimeout",
+	"connection_attempts":    "ConnectionAttempts",
+	"tcp_keep_alive":         "TCPKeepAlive",
+	"compression":            "Compression",
+	"control_master":         "ControlMaster",
+	"control_path":           "ControlPath",
+	"control_persist":        "ControlPersist",
+}
+
+func esshConnection(L *lua.LState) int {
+	tb := L.CheckTable(1)
+
+	tb.ForEach(func(key lua.LValue, value lua.LValue) {
+		keyStr, ok := toString(key)
+		if !ok {
+			L.RaiseError("connection's key must be a string: %v", key)
+		}
+
+		name, err := connectionKeyword(keyStr)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		switch v := value.(type) {
+		case lua.LBool:
+			if v {
+				ConnectionSettings[name] = "yes"
+			} else {
+				ConnectionSettings[name] = "no"
+			}
+		case lua.LNumber, lua.LString:
+			ConnectionSettings[name] = lua.LVAsString(v)
+		default:
+			L.RaiseError("connection's value must be a string, number or boolean: %v", value)
+		}
+	})
+
+	return 0
+}
+
+// connectionKeyword returns the ssh_config keyword of the key.
+// A key that starts with an upper case letter is used as a ssh_config keyword as it is.
+func connectionKeyword(key string) (string, error) {
+	for _, c := range key {
+		if unicode.IsUpper(c) {
+			return key, nil
+		}
+		break
+	}
+
+	if name, ok := connectionKeys[key]; ok {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("unsupported connection's field '%s'.", key)
+}
+
+// SortedConnectionSettings returns the connection settings sorted by the keys in the same format as Host.SortedSSHConfig.
+func SortedConnectionSettings() []map[string]string {
+	names := []string{}
+	for name := range ConnectionSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := []map[string]string{}
+	for _, name := range names {
+		values = append(values, map[string]string{name: ConnectionSettings[name]})
+	}
+
+	return values
+}
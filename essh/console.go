@@ -0,0 +1,261 @@
+package essh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ConsoleSession is a shell on a host in --console mode.
+type ConsoleSession struct {
+	Host  *Host
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan error
+}
+
+// Console connects to the hosts at once and sends the input lines to all of them or the focused one.
+// The remote shells run with pty to be interrupted by Ctrl-C, but their output is prefixed line by line,
+// so the commands that need a terminal (like editors) can't be used.
+type Console struct {
+	Sessions []*ConsoleSession
+	// Focus is the session that receives the input. nil means all the sessions.
+	Focus *ConsoleSession
+	mutex *sync.Mutex
+}
+
+const consoleHelp = `essh console: the input lines are sent to all the hosts. the following commands are available.
+  :hosts          list the hosts and the focus.
+  :focus <host>   send the input only to the host.
+  :all            send the input to all the hosts.
+  :quit           close the connections. (or Ctrl-D)
+Ctrl-C interrupts the running commands on the hosts that receive the input.
+`
+
+// consoleSetup is the first input of the remote shells. It disables the echo back of the input, the prompts
+// and the escape sequences of bash's bracketed paste, and outputs consoleReadyMarker.
+// The output before the marker like the login message is dropped.
+const consoleSetup = "stty -echo -onlcr 2>/dev/null; bind 'set enable-bracketed-paste off' 2>/dev/null; PS1=''; PS2=''; PROMPT_COMMAND=''; echo '" + consoleReadyMarker + "'\n"
+
+const consoleReadyMarker = "##essh:console-ready"
+
+// runConsole runs the console until the input is closed or ":quit" is entered.
+// It connects to the hosts in the same way as the tasks: it verifies the host keys, gets the certificates
+// and runs the hooks of the hosts.
+func runConsole(L *lua.LState, config string, hosts []*Host, in io.Reader) error {
+	if err := prepareConnection(config, hosts); err != nil {
+		return err
+	}
+
+	console := &Console{mutex: &sync.Mutex{}}
+	for _, host := range hosts {
+		if err := runHostHooks(L, host, "before_connect", host.HooksBeforeConnect); err != nil {
+			console.close(L)
+			return err
+		}
+
+		afterConnectScript := ""
+		if !hooksDisabled() {
+			script, err := getHookScript(L, host, host.HooksAfterConnect)
+			if err != nil {
+				console.close(L)
+				return &ConfigError{Err: fmt.Errorf("after_connect hook of '%s' failed: %v", host.Name, err)}
+			}
+			afterConnectScript = script
+		}
+
+		session, err := console.start(config, host, hosts, afterConnectScript)
+		if err != nil {
+			console.close(L)
+			return err
+		}
+		console.Sessions = append(console.Sessions, session)
+	}
+
+	// Ctrl-C is sent to the remote shells instead of stopping essh and the connections.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	atomic.StoreInt32(&interruptHandled, 1)
+	defer func() {
+		signal.Stop(sigCh)
+		atomic.StoreInt32(&interruptHandled, 0)
+	}()
+	go func() {
+		for range sigCh {
+			console.send("\x03")
+		}
+	}()
+
+	fmt.Fprint(os.Stderr, consoleHelp)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if quit := console.command(line); quit {
+			break
+		}
+	}
+
+	return console.close(L)
+}
+
+func (c *Console) start(config string, host *Host, hosts []*Host, afterConnectScript string) (*ConsoleSession, error) {
+	cmd := exec.Command("ssh", "-F", config, "-tt", host.Name)
+	// the terminal sends SIGINT to essh only, and essh sends it to the remote shells.
+	detachProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if debugFlag {
+		debugf("real ssh command: %v \n", cmd.Args)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	prefix := "[" + host.Name + "]" + HostnameAlignString(host, hosts)(" ")
+	outputDone := &sync.WaitGroup{}
+	outputDone.Add(2)
+	go func() {
+		defer outputDone.Done()
+		r := bufio.NewReader(stdout)
+		for {
+			line, err := r.ReadString('\n')
+			// the marker may follow the escape sequences that are output before the command.
+			if strings.HasSuffix(strings.TrimRight(line, "\r\n"), consoleReadyMarker) || err != nil {
+				break
+			}
+		}
+		scanLines(ioutil.NopCloser(r), os.Stdout, prefix, newLineFilter(host.OutputFilters, "--console", host, "stdout"), c.mutex)
+	}()
+	go func() {
+		defer outputDone.Done()
+		scanLines(stderr, os.Stderr, prefix, newLineFilter(host.OutputFilters, "--console", host, "stderr"), c.mutex)
+	}()
+
+	// the after_connect hooks run after the setup, so that their output isn't dropped.
+	if _, err := io.WriteString(stdin, consoleSetup+afterConnectScript); err != nil && debugFlag {
+		debugf("failed to write to '%s': %v\n", host.Name, err)
+	}
+
+	session := &ConsoleSession{Host: host, cmd: cmd, stdin: stdin, done: make(chan error, 1)}
+	go func() {
+		outputDone.Wait()
+		err := cmd.Wait()
+		if err != nil {
+			printProgress(VERBOSITY_NORMAL, "the connection to '%s' was closed: %v", host.Name, err)
+		}
+		session.done <- err
+	}()
+
+	return session, nil
+}
+
+// command handles a line of the input. It returns true to quit.
+func (c *Console) command(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		switch fields[0] {
+		case ":quit":
+			return true
+		case ":all":
+			c.setFocus(nil)
+			printProgress(VERBOSITY_NORMAL, "sending the input to all the hosts")
+			return false
+		case ":focus":
+			if len(fields) != 2 {
+				printError("usage: :focus <host>")
+				return false
+			}
+			for _, session := range c.Sessions {
+				if session.Host.Name == fields[1] {
+					c.setFocus(session)
+					printProgress(VERBOSITY_NORMAL, "sending the input only to '%s'", session.Host.Name)
+					return false
+				}
+			}
+			printError(fmt.Errorf("host '%s' is not connected in the console.", fields[1]))
+			return false
+		case ":hosts":
+			for _, session := range c.Sessions {
+				mark := " "
+				if c.Focus == nil || c.Focus == session {
+					mark = "*"
+				}
+				fmt.Fprintf(os.Stderr, "%s %s\n", mark, session.Host.Name)
+			}
+			return false
+		}
+	}
+
+	c.send(line + "\n")
+
+	return false
+}
+
+// setFocus changes the session that receives the input. The focus is read by the handler of Ctrl-C too.
+func (c *Console) setFocus(session *ConsoleSession) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Focus = session
+}
+
+// send writes the input to all the sessions or the focused one.
+func (c *Console) send(input string) {
+	c.mutex.Lock()
+	focus := c.Focus
+	c.mutex.Unlock()
+
+	for _, session := range c.Sessions {
+		if focus != nil && focus != session {
+			continue
+		}
+		if _, err := io.WriteString(session.stdin, input); err != nil && debugFlag {
+			debugf("failed to write to '%s': %v\n", session.Host.Name, err)
+		}
+	}
+}
+
+// close exits the shells and waits for them, and runs the after_disconnect hooks of the hosts.
+// The shells with pty don't exit by the end of the input, so "exit" is sent before it.
+func (c *Console) close(L *lua.LState) error {
+	for _, session := range c.Sessions {
+		io.WriteString(session.stdin, "exit\n")
+		session.stdin.Close()
+	}
+
+	failed := []string{}
+	for _, session := range c.Sessions {
+		if err := <-session.done; err != nil {
+			failed = append(failed, session.Host.Name)
+		}
+		if err := runHostHooks(L, session.Host, "after_disconnect", session.Host.HooksAfterDisconnect); err != nil {
+			printError(err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ConnectionError{Err: fmt.Errorf("the console failed on %s.", strings.Join(failed, ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package essh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ControlMasters are ssh master connections that are opened one by one before running a task in parallel.
+// Authentication prompts (like keyboard-interactive and OTP) are asked while opening them,
+// and the parallel ssh processes reuse the authenticated connections without prompting.
+type ControlMasters struct {
+	Dir    string
+	Config string
+	Hosts  []*Host
+	// restore restores the ssh_config of the hosts that are changed to use the master connections.
+	restore func()
+}
+
+// ControlPath returns a ssh_config ControlPath of the master connections.
+func (c *ControlMasters) ControlPath() string {
+	return filepath.Join(c.Dir, "%C")
+}
+
+// SSHOptions returns ssh options to use the master connections.
+func (c *ControlMasters) SSHOptions() []string {
+	return []string{"-o", "ControlMaster=no", "-o", "ControlPath=" + c.ControlPath()}
+}
+
+func newControlMasters(config string) (*ControlMasters, error) {
+	// unix domain socket path has a short length limit, so it doesn't use TMPDIR that may be long (ex: macOS).
+	base := ""
+	if os.PathSeparator == '/' {
+		base = "/tmp"
+	}
+
+	dir, err := ioutil.TempDir(base, "essh.cm.")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ControlMasters{
+		Dir:    dir,
+		Config: config,
+		Hosts:  []*Host{},
+	}, nil
+}
+
+// Open opens a master connection to the host.
+func (c *ControlMasters) Open(sshOptions []string, host *Host) error {
+	if debugFlag {
+		debugf("open master connection: %s\n", host.Name)
+	}
+
+	args := append([]string{}, sshOptions...)
+	args = append(args, "-F", c.Config, "-o", "ControlMaster=yes", "-o", "ControlPath="+c.ControlPath(), "-o", "ControlPersist=yes", "-N", "-f", host.Name)
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to authenticate to '%s': %v", host.Name, err)
+	}
+
+	c.Hosts = append(c.Hosts, host)
+	return nil
+}
+
+func openControlMasters(config string, task *Task, hosts []*Host) (*ControlMasters, error) {
+	c, err := newControlMasters(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, host := range hosts {
+		if err := c.Open(task.SSHOptions, host); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// commonJumpHost returns the jump host (ProxyJump) that all the hosts share.
+// It returns nil if the hosts don't have the same jump host or the jump host isn't defined in essh.
+func commonJumpHost(hosts []*Host) *Host {
+	name := ""
+	for _, host := range hosts {
+		jump, ok := host.SSHConfig["ProxyJump"]
+		if !ok || strings.Contains(jump, ",") {
+			return nil
+		}
+
+		// "user@host:port" -> "host"
+		if at := strings.LastIndex(jump, "@"); at >= 0 {
+			jump = jump[at+1:]
+		}
+		if colon := strings.Index(jump, ":"); colon >= 0 {
+			jump = jump[:colon]
+		}
+
+		if name == "" {
+			name = jump
+		} else if name != jump {
+			return nil
+		}
+	}
+
+	return Hosts[name]
+}
+
+// multiplexJumpHost opens a master connection to the jump host, and lets the connections through the jump host use it.
+// ControlPath is written in the generated ssh_config, because the command line options don't apply to the jump host.
+func multiplexJumpHost(config string, jump *Host) (*ControlMasters, error) {
+	c, err := newControlMasters(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the jump host is shared in the process, so its ControlPath is restored when the connection is closed.
+	orig, ok := jump.SSHConfig["ControlPath"]
+	c.restore = func() {
+		if ok {
+			jump.SSHConfig["ControlPath"] = orig
+		} else {
+			delete(jump.SSHConfig, "ControlPath")
+		}
+	}
+
+	jump.SSHConfig["ControlPath"] = c.ControlPath()
+	if _, err := UpdateSSHConfig(config, NewHostQuery().GetHostsOrderByName()); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.Open([]string{}, jump); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the master connections and removes the directory of the sockets.
+func (c *ControlMasters) Close() {
+	for _, host := range c.Hosts {
+		if debugFlag {
+			debugf("close master connection: %s\n", host.Name)
+		}
+
+		cmd := exec.Command("ssh", "-F", c.Config, "-o", "ControlPath="+c.ControlPath(), "-O", "exit", host.Name)
+		if err := cmd.Run(); err != nil && debugFlag {
+			debugf("failed to close master connection: %s: %v\n", host.Name, err)
+		}
+	}
+
+	os.RemoveAll(c.Dir)
+
+	if c.restore != nil {
+		c.restore()
+	}
+}
@@ -0,0 +1,33 @@
+package essh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// debugWriter is the destination of the debug log. It is stderr by default
+// not to be mixed with the output of the commands, or the file that is specified by --debug-file.
+var debugWriter io.Writer
+
+// debugf writes the debug log. The secrets in the message are masked.
+func debugf(format string, a ...interface{}) {
+	fmt.Fprint(debugWriter, redact(fmt.Sprintf("[essh debug] "+format, a...)))
+}
+
+// debugPhase writes the elapsed time of the phase like the config loading to the debug log.
+func debugPhase(phase string, start time.Time) {
+	if debugFlag {
+		debugf("phase '%s' took %v\n", phase, roundDuration(time.Since(start), time.Microsecond))
+	}
+}
+
+// openDebugFile opens the file of --debug-file. The debug log is appended to the file.
+func openDebugFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(expandHomeDir(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the debug file: %v", err)
+	}
+	return f, nil
+}
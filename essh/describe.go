@@ -0,0 +1,74 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DescribeHost writes everything known about the host.
+func DescribeHost(w io.Writer, host *Host) {
+	fmt.Fprintf(w, "Name:        %s\n", host.Name)
+	fmt.Fprintf(w, "Description: %s\n", host.Description)
+	fmt.Fprintf(w, "Hidden:      %v\n", host.Hidden)
+	fmt.Fprintf(w, "Tags:        %s\n", strings.Join(host.Tags, ","))
+	fmt.Fprintf(w, "Groups:      %s\n", strings.Join(host.GroupNames(), ","))
+	if host.Registry != nil {
+		fmt.Fprintf(w, "Registry:    %s\n", host.Registry.TypeString())
+	}
+	fmt.Fprintf(w, "Defined in:\n")
+	for h := host; h != nil; h = h.Child {
+		fmt.Fprintf(w, "    %s\n", h.Source)
+	}
+
+	fmt.Fprintf(w, "SSH Config:\n")
+	for _, kv := range host.SortedSSHConfig() {
+		for k, v := range kv {
+			fmt.Fprintf(w, "    %s %s\n", k, v)
+		}
+	}
+
+	if host.Transfer != nil {
+		fmt.Fprintf(w, "Transfer:\n")
+		fmt.Fprintf(w, "    bwlimit = %d KB/s\n", host.Transfer.BWLimit)
+		fmt.Fprintf(w, "    compress = %v\n", host.Transfer.Compress)
+		fmt.Fprintf(w, "    resume = %v\n", host.Transfer.Resume)
+	}
+
+	fmt.Fprintf(w, "Props:\n")
+	keys := []string{}
+	for k := range host.Props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "    %s = %s\n", k, host.Props[k])
+	}
+
+	describeHooks(w, "Hooks Before Connect", host.HooksBeforeConnect)
+	describeHooks(w, "Hooks After Connect", host.HooksAfterConnect)
+	describeHooks(w, "Hooks After Disconnect", host.HooksAfterDisconnect)
+}
+
+func describeHooks(w io.Writer, title string, hooks []interface{}) {
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, hook := range hooks {
+		fmt.Fprintf(w, "    %s\n", describeHook(hook))
+	}
+}
+
+func describeHook(hook interface{}) string {
+	switch h := hook.(type) {
+	case string:
+		return h
+	case *lua.LFunction:
+		if h.Proto != nil {
+			return fmt.Sprintf("function (%s:%d)", h.Proto.SourceName, h.Proto.LineDefined)
+		}
+		return "function"
+	default:
+		return fmt.Sprintf("%v", h)
+	}
+}
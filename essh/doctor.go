@@ -0,0 +1,272 @@
+package essh
+
+import (
+	"context"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DOCTOR_OK    = "ok"
+	DOCTOR_WARN  = "warn"
+	DOCTOR_ERROR = "error"
+)
+
+// DefaultDoctorTimeout is a timeout of the DNS lookups and the connection to the ssh agent of --doctor.
+const DefaultDoctorTimeout = 5 * time.Second
+
+// DoctorFinding is a result of a check of --doctor.
+type DoctorFinding struct {
+	Level   string
+	Check   string
+	Message string
+	// Hint is what the user can do to fix the problem.
+	Hint string
+}
+
+func (f *DoctorFinding) write(w io.Writer) {
+	switch f.Level {
+	case DOCTOR_OK:
+		fmt.Fprintf(w, "%s %s: %s\n", color.FgGB("[ OK ]"), f.Check, f.Message)
+	case DOCTOR_WARN:
+		fmt.Fprintf(w, "%s %s: %s\n", color.FgYB("[WARN]"), f.Check, f.Message)
+	default:
+		fmt.Fprintf(w, "%s %s: %s\n", color.FgRB("[FAIL]"), f.Check, f.Message)
+	}
+	if f.Hint != "" {
+		fmt.Fprintf(w, "       -> %s\n", f.Hint)
+	}
+}
+
+// runDoctor checks the environment that essh depends on and writes the findings.
+// configErrors are the errors in loading the config files. It returns false if any check fails.
+func runDoctor(w io.Writer, configErrors []error, providersOK bool, hosts []*Host) bool {
+	findings := []*DoctorFinding{}
+	findings = append(findings, doctorCommands()...)
+	findings = append(findings, doctorAgent())
+	findings = append(findings, doctorConfig(configErrors, providersOK)...)
+	findings = append(findings, doctorIdentityFiles(hosts)...)
+	findings = append(findings, doctorHostNames(hosts)...)
+
+	ok := true
+	for _, f := range findings {
+		f.write(w)
+		if f.Level == DOCTOR_ERROR {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+func doctorCommands() []*DoctorFinding {
+	findings := []*DoctorFinding{}
+	for _, name := range []string{"ssh", "scp", "rsync"} {
+		path, err := exec.LookPath(name)
+		if err == nil {
+			findings = append(findings, &DoctorFinding{Level: DOCTOR_OK, Check: name, Message: path})
+			continue
+		}
+
+		if name == "ssh" {
+			findings = append(findings, &DoctorFinding{
+				Level:   DOCTOR_ERROR,
+				Check:   name,
+				Message: "not found in PATH.",
+				Hint:    "install OpenSSH client. essh runs ssh to connect to the hosts.",
+			})
+		} else {
+			// scp and rsync are used only by --scp and --rsync.
+			findings = append(findings, &DoctorFinding{
+				Level:   DOCTOR_WARN,
+				Check:   name,
+				Message: "not found in PATH.",
+				Hint:    fmt.Sprintf("install %s to use --%s.", name, name),
+			})
+		}
+	}
+
+	return findings
+}
+
+func doctorAgent() *DoctorFinding {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return &DoctorFinding{
+			Level:   DOCTOR_WARN,
+			Check:   "ssh-agent",
+			Message: "SSH_AUTH_SOCK is not set.",
+			Hint:    "run 'eval $(ssh-agent)' and 'ssh-add' if your keys have passphrases or you use forward_agent.",
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		conn, err := net.DialTimeout("unix", sock, DefaultDoctorTimeout)
+		if err != nil {
+			return &DoctorFinding{
+				Level:   DOCTOR_WARN,
+				Check:   "ssh-agent",
+				Message: fmt.Sprintf("failed to connect to %s: %v", sock, err),
+				Hint:    "the agent may have exited. restart it by 'eval $(ssh-agent)' and 'ssh-add'.",
+			}
+		}
+		conn.Close()
+	}
+
+	return &DoctorFinding{Level: DOCTOR_OK, Check: "ssh-agent", Message: sock}
+}
+
+func doctorConfig(configErrors []error, providersOK bool) []*DoctorFinding {
+	findings := []*DoctorFinding{}
+
+	files := []string{}
+	for _, file := range []string{UserConfigFile, UserOverrideConfigFile, WorkingDirConfigFile, WorkingDirOverrideConfigFile} {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	if len(configErrors) == 0 {
+		message := "no config files."
+		if len(files) > 0 {
+			message = strings.Join(files, ", ")
+		}
+		findings = append(findings, &DoctorFinding{Level: DOCTOR_OK, Check: "config", Message: message})
+	}
+	for _, err := range configErrors {
+		// the stack traceback of Lua isn't helpful here.
+		message := strings.SplitN(err.Error(), "\n", 2)[0]
+		findings = append(findings, &DoctorFinding{
+			Level:   DOCTOR_ERROR,
+			Check:   "config",
+			Message: message,
+			Hint:    "fix the config file. the hosts and tasks after the error are not loaded.",
+		})
+	}
+
+	if !providersOK {
+		findings = append(findings, &DoctorFinding{
+			Level:   DOCTOR_WARN,
+			Check:   "host providers",
+			Message: "some host providers failed. the cached hosts are used if they exist.",
+			Hint:    "check the messages above and run 'essh --refresh-providers' after fixing them.",
+		})
+	}
+
+	return findings
+}
+
+// doctorIdentityFiles checks the IdentityFiles that are referenced by the hosts exist and are not accessible by others.
+// ssh ignores the private keys that are readable by others.
+func doctorIdentityFiles(hosts []*Host) []*DoctorFinding {
+	referrers := map[string][]string{}
+	for _, host := range hosts {
+		for _, config := range effectiveSSHConfig(host) {
+			for key, value := range config {
+				if !strings.EqualFold(key, "IdentityFile") {
+					continue
+				}
+				path := expandHomeDir(strings.Replace(value, "%d", userHomeDir(), -1))
+				if strings.Contains(path, "%") {
+					// the other tokens are expanded by ssh for each connection.
+					continue
+				}
+				referrers[path] = append(referrers[path], host.Name)
+			}
+		}
+	}
+
+	paths := []string{}
+	for path := range referrers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	findings := []*DoctorFinding{}
+	for _, path := range paths {
+		check := "key " + path
+		used := fmt.Sprintf("(used by %s)", strings.Join(referrers[path], ", "))
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			findings = append(findings, &DoctorFinding{
+				Level:   DOCTOR_ERROR,
+				Check:   check,
+				Message: fmt.Sprintf("%v %s", err, used),
+				Hint:    "fix IdentityFile of the hosts or create the key.",
+			})
+			continue
+		}
+
+		if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+			findings = append(findings, &DoctorFinding{
+				Level:   DOCTOR_ERROR,
+				Check:   check,
+				Message: fmt.Sprintf("permissions %04o are too open. ssh ignores the key. %s", fi.Mode().Perm(), used),
+				Hint:    fmt.Sprintf("run 'chmod 600 %s'.", path),
+			})
+			continue
+		}
+
+		findings = append(findings, &DoctorFinding{Level: DOCTOR_OK, Check: check, Message: fmt.Sprintf("%04o %s", fi.Mode().Perm(), used)})
+	}
+
+	return findings
+}
+
+// doctorHostNames checks the HostNames of the hosts are resolved by DNS.
+// The hosts that are connected through ProxyJump or ProxyCommand are skipped,
+// because their names may be resolved only by the jump hosts.
+func doctorHostNames(hosts []*Host) []*DoctorFinding {
+	targets := []*Host{}
+	for _, host := range hosts {
+		if strings.ContainsAny(host.Name, "*?!") || net.ParseIP(hostAddress(host)) != nil {
+			continue
+		}
+
+		proxied := false
+		for _, config := range effectiveSSHConfig(host) {
+			for key := range config {
+				if strings.EqualFold(key, "ProxyJump") || strings.EqualFold(key, "ProxyCommand") {
+					proxied = true
+				}
+			}
+		}
+		if !proxied {
+			targets = append(targets, host)
+		}
+	}
+	if len(targets) == 0 {
+		return []*DoctorFinding{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDoctorTimeout)
+	defer cancel()
+	resolved := lookupHostAddresses(ctx, targets)
+
+	unresolved := []string{}
+	for _, host := range targets {
+		if len(resolved[host]) == 0 {
+			unresolved = append(unresolved, fmt.Sprintf("%s (%s)", host.Name, hostAddress(host)))
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return []*DoctorFinding{{
+			Level:   DOCTOR_WARN,
+			Check:   "dns",
+			Message: fmt.Sprintf("cannot resolve %d of %d hosts: %s", len(unresolved), len(targets), strings.Join(unresolved, ", ")),
+			Hint:    "fix HostName of the hosts, or check your DNS settings and VPN.",
+		}}
+	}
+
+	return []*DoctorFinding{{Level: DOCTOR_OK, Check: "dns", Message: fmt.Sprintf("resolved %d hosts.", len(targets))}}
+}
@@ -38,7 +38,7 @@ func (driver *Driver) MapLValuesToLTable(tb *lua.LTable) {
 	}
 }
 
-func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task, host *Host) (string, error) {
+func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task, host *Host, hosts []*Host) (string, error) {
 	for key, value := range driver.LValues {
 		driver.Props[key] = toGoValue(value)
 	}
@@ -63,6 +63,10 @@ func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task,
 		scripts = task.Script
 	}
 
+	if task.Interpreter != "" {
+		scripts = interpreterScripts(task.Interpreter, scripts)
+	}
+
 	funcMap := template.FuncMap{
 		"ShellEscape":  ShellEscape,
 		"ToUpper":      strings.ToUpper,
@@ -71,6 +75,15 @@ func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task,
 		"Add": func(x, y int) int {
 			return x + y
 		},
+		"Join": strings.Join,
+	}
+
+	hostIndex := 0
+	for i, h := range hosts {
+		if h == host {
+			hostIndex = i + 1
+			break
+		}
 	}
 
 	dict := map[string]interface{}{
@@ -83,6 +96,17 @@ func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task,
 		"Host":          host,
 		"Scripts":       scripts,
 		"SSHConfigPath": sshConfigPath,
+		"RunID":         RunID,
+		"HostIndex":     hostIndex,
+		"HostCount":     len(hosts),
+		"Payload":       task.PayloadForHost(host),
+		"StepHeaders":   []string(nil),
+		"HostEnv":       hostStateVars(host),
+		"EnvFileSize":   len(envFileInput(host)),
+		"SharedEnv":     sharedValueVars(),
+	}
+	if verbosity() >= VERBOSITY_VERBOSE {
+		dict["StepHeaders"] = stepHeaders(scripts)
 	}
 
 	baseTempl, err := template.New("base").Funcs(funcMap).Parse(templateText)
@@ -109,19 +133,44 @@ func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task,
 	return b.String(), nil
 }
 
+// interpreterScripts converts the scripts into shell code that runs them with the interpreter like "python3".
+// Each script is written to a temporary file and the interpreter runs it with the task's args,
+// so the script can read the stdin.
+func interpreterScripts(interpreter string, scripts []map[string]string) []map[string]string {
+	converted := []map[string]string{}
+	for _, script := range scripts {
+		s := map[string]string{}
+		for k, v := range script {
+			s[k] = v
+		}
+		s["code"] = `__essh_script=$(mktemp) && printf '%s\n' ` + ShellEscape(script["code"]) + ` > "$__essh_script" && ` + interpreter + ` "$__essh_script" "$@"; ` +
+			`__essh_exit_status=$?; rm -f "$__essh_script"; (exit $__essh_exit_status)`
+		converted = append(converted, s)
+	}
+
+	return converted
+}
+
 const EnvironmentTemplate = `{{define "environment" -}}
 export ESSH_TASK_NAME={{.Task.Name | ShellEscape}}
+export ESSH_RUN_ID={{.RunID | ShellEscape}}
 export ESSH_SSH_CONFIG={{.SSHConfigPath}}
 export ESSH_DEBUG="{{if .Debug}}1{{end}}"
+export ESSH_PAYLOAD={{.Payload | ShellEscape}}
 {{range $key, $value := .Task.Props -}}
 export ESSH_TASK_PROPS_{{$key | ToUpper | EnvKeyEscape}}={{$value | ShellEscape }}
 {{end -}}
 {{range $index, $value := .Task.Args -}}
 export ESSH_TASK_ARGS_{{Add $index 1 }}={{$value | ShellEscape }}
 {{end -}}
+export ESSH_TASK_ARGS_COUNT={{len .Task.Args}}
+set --{{range .Task.Args}} {{. | ShellEscape}}{{end}}
 {{if .Host -}}
 export ESSH_HOSTNAME={{.Host.Name | ShellEscape}}
 export ESSH_HOST_HOSTNAME={{.Host.Name | ShellEscape}}
+export ESSH_HOST_TAGS={{Join .Host.Tags "," | ShellEscape}}
+export ESSH_HOST_INDEX={{.HostIndex}}
+export ESSH_HOST_COUNT={{.HostCount}}
 {{range $i, $kvpair := .Host.SortedSSHConfig -}}
 {{range $key, $value := $kvpair -}}
 export ESSH_HOST_SSH_{{$key | ToUpper}}={{$value | ShellEscape }}
@@ -133,17 +182,36 @@ export ESSH_HOST_PROPS_{{$key | ToUpper | EnvKeyEscape}}={{$value | ShellEscape
 {{range $i, $value := .Host.Tags -}}
 export ESSH_HOST_TAGS_{{$value | ToUpper | EnvKeyEscape}}=1
 {{end -}}
+{{if .EnvFileSize -}}
+eval "$(dd bs=1 count={{.EnvFileSize}} 2>/dev/null)"
+{{end -}}
+{{range .HostEnv -}}
+export {{.Key}}={{.Value | ShellEscape}}
+{{end -}}
+{{end -}}
+{{range .SharedEnv -}}
+export {{.Key}}={{.Value | ShellEscape}}
+{{end -}}
+{{if .Task.Trace -}}
+set -x
 {{end -}}
 {{end}}
 `
 
 const FunctionsTemplate = `{{define "functions" -}}
-function escp() {
+escp() {
     scp -F {{.SSHConfigPath}} "$@"
 }
-function ersync() {
+ersync() {
     rsync -e "ssh -F {{.SSHConfigPath}}" "$@"
 }
+essh_payload() {
+    if [ $# -eq 0 ]; then
+        printf '%s' "$ESSH_PAYLOAD"
+    else
+        printf '%s' "$ESSH_PAYLOAD" | jq -r "$@"
+    fi
+}
 
 {{end}}
 `
@@ -194,7 +262,7 @@ func esshDriver(L *lua.LState) int {
 
 func registerDriver(L *lua.LState, name string) *Driver {
 	if debugFlag {
-		fmt.Printf("[essh debug] register driver: %s\n", name)
+		debugf("register driver: %s\n", name)
 	}
 
 	d := NewDriver()
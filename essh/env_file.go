@@ -0,0 +1,219 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// EnvVar is a variable that is defined in an env_file.
+type EnvVar struct {
+	Key   string
+	Value string
+}
+
+// EnvFileSecretSuffix is the suffix of the variable names in env_files whose values are secrets.
+const EnvFileSecretSuffix = "_SECRET"
+
+var envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envFilePath returns the path of the host's env_file. A relative path is resolved from the working directory.
+func envFilePath(host *Host) string {
+	path := expandHomeDir(host.EnvFile)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(WorkingDir, path)
+	}
+	return path
+}
+
+// loadHostEnvFiles reads the env_files of the hosts before running scripts.
+// The variables are exported in the scripts of the tasks for each host.
+// The values of the variables that are marked as secrets are registered as secrets. see isEnvFileSecret.
+func loadHostEnvFiles(hosts []*Host) error {
+	for _, host := range hosts {
+		if host.EnvFile == "" {
+			continue
+		}
+
+		path := envFilePath(host)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return &ConfigError{Err: fmt.Errorf("failed to read env_file of '%s': %v", host.Name, err)}
+		}
+
+		vars, err := parseEnvFile(string(b))
+		if err != nil {
+			return &ConfigError{Err: fmt.Errorf("invalid env_file of '%s' (%s): %v", host.Name, path, err)}
+		}
+		for _, v := range vars {
+			if isEnvFileSecret(host, v.Key) {
+				registerSecret(v.Value)
+			}
+		}
+		host.envVars = vars
+	}
+
+	return nil
+}
+
+// isEnvFileSecret reports whether the variable of the host's env_file is a secret.
+// It is a secret if the name ends with "_SECRET" or is listed in the host's env_file_secrets.
+// Not all the values are secrets, because masking common values like "1" and "production" breaks the output.
+func isEnvFileSecret(host *Host, key string) bool {
+	if strings.HasSuffix(key, EnvFileSecretSuffix) {
+		return true
+	}
+	for _, k := range host.EnvFileSecrets {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// envFileInput returns the shell code that exports the variables of the host's env_file.
+// It isn't embedded in the script that is passed to the shell as an argument (and visible in ps),
+// but is sent to the stdin of the script before the task's input, and the script reads it at the beginning.
+func envFileInput(host *Host) []byte {
+	if host == nil || len(host.envVars) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	for _, v := range host.envVars {
+		fmt.Fprintf(&b, "export %s=%s\n", v.Key, ShellEscape(v.Value))
+	}
+	return b.Bytes()
+}
+
+// setTaskStdin connects the input of the task to the stdin of the command after the input of the env_file.
+// see https://github.com/kohkimakimoto/essh/issues/38
+func setTaskStdin(cmd *exec.Cmd, stdinCh chan []byte, input []byte) error {
+	if stdinCh == nil {
+		cmd.Stdin = os.Stdin
+		if len(input) > 0 {
+			cmd.Stdin = io.MultiReader(bytes.NewReader(input), os.Stdin)
+		}
+		return nil
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if len(input) > 0 {
+			if _, err := stdin.Write(input); err != nil {
+				stdin.Close()
+				return
+			}
+		}
+		handleInput(stdinCh, stdin)
+	}()
+
+	return nil
+}
+
+// parseEnvFile parses the content of a dotenv style file like "KEY=value".
+// The lines that start with "#" are comments, and "export " before the key is allowed.
+// A value in single quotes is used as it is. A value in double quotes can have escape sequences
+// like "\n" and span multiple lines. An unquoted value ends at " #".
+// Variables in the values are not expanded.
+func parseEnvFile(content string) ([]*EnvVar, error) {
+	vars := []*EnvVar{}
+	content = strings.Replace(content, "\r\n", "\n", -1)
+
+	lineNum := 0
+	for len(content) > 0 {
+		lineNum++
+		var line string
+		if i := strings.Index(content, "\n"); i >= 0 {
+			line, content = content[:i], content[i+1:]
+		} else {
+			line, content = content, ""
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: '=' is missing.", lineNum)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !envKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid variable name '%s'.", lineNum, key)
+		}
+		value := strings.TrimSpace(line[i+1:])
+
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single quote.", lineNum)
+			}
+			value = value[1 : end+1]
+		case strings.HasPrefix(value, `"`):
+			// the value may continue to the next lines.
+			rest := value[1:] + "\n" + content
+			unquoted, n, ok := unquoteEnvValue(rest)
+			if !ok {
+				return nil, fmt.Errorf("line %d: unterminated double quote.", lineNum)
+			}
+			if lines := strings.Count(rest[:n], "\n"); lines > 0 {
+				lineNum += lines
+				content = rest[n:]
+				if i := strings.Index(content, "\n"); i >= 0 {
+					content = content[i+1:]
+				} else {
+					content = ""
+				}
+			}
+			value = unquoted
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+
+		vars = append(vars, &EnvVar{Key: key, Value: value})
+	}
+
+	return vars, nil
+}
+
+// unquoteEnvValue reads a double quoted value until the closing quote. It returns the value and the number of the consumed bytes.
+func unquoteEnvValue(s string) (string, int, bool) {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			return b.String(), i + 1, true
+		}
+		if c == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return "", 0, false
+}
@@ -0,0 +1,147 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/Songmu/wrapcommander"
+	"os/exec"
+	"strings"
+)
+
+// The exit statuses of essh. The scripts that wrap essh can branch on what went wrong.
+// In running ssh command as a wrapper, essh exits with the exit status of ssh.
+const (
+	// ExitErr is used for the errors that are not classified.
+	ExitErr = 1
+	// ExitConfigErr is used when the config files are invalid.
+	ExitConfigErr = 2
+	// ExitCommandErr is used when the scripts of a task fail.
+	ExitCommandErr = 3
+	// ExitPartialErr is used when a task fails on some of the target hosts and succeeds on the others.
+	ExitPartialErr = 4
+	// ExitConnectionErr is used when essh can't connect to the hosts. It is the same as ssh.
+	ExitConnectionErr = 255
+)
+
+// ConfigError is an error caused by the config files like an invalid value of a task.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// ConnectionError is an error in connecting to the host. ssh exits with 255 in that case.
+type ConnectionError struct {
+	Host string
+	Err  error
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+// CommandError is an error that the script of a task fails or doesn't satisfy the expectation.
+type CommandError struct {
+	Host string
+	Err  error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+// PartialError is an error that a task fails on some of the target hosts and succeeds on the others.
+type PartialError struct {
+	Failed    []string
+	Succeeded []string
+	Err       error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// exitStatusOf returns the exit status of essh for the error.
+func exitStatusOf(err error) int {
+	switch err.(type) {
+	case *ConfigError:
+		return ExitConfigErr
+	case *ConnectionError:
+		return ExitConnectionErr
+	case *CommandError:
+		return ExitCommandErr
+	case *PartialError:
+		return ExitPartialErr
+	default:
+		return ExitErr
+	}
+}
+
+// taskScriptError classifies the error of exec.Cmd.Wait for the script of the task.
+// ssh exits with 255 if it fails to connect, so it is a connection error for the remote scripts.
+func taskScriptError(task *Task, host *Host, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		// it failed before the script runs.
+		return err
+	}
+
+	name := ""
+	if host != nil {
+		name = host.Name
+	}
+	if task.IsRemoteTask() && wrapcommander.ResolveExitCode(err) == ExitConnectionErr {
+		return &ConnectionError{Host: name, Err: err}
+	}
+
+	return &CommandError{Host: name, Err: err}
+}
+
+// taskHostsError merges the errors of the scripts of the task on the hosts.
+// The errors are in the same order as the hosts and nil for the hosts that succeeded.
+func taskHostsError(task *Task, hosts []*Host, errs []error) error {
+	failed := []string{}
+	succeeded := []string{}
+	messages := []string{}
+	connection := true
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			succeeded = append(succeeded, hosts[i].Name)
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		if _, ok := err.(*ConnectionError); !ok {
+			connection = false
+		}
+		failed = append(failed, hosts[i].Name)
+		messages = append(messages, fmt.Sprintf("%s (%v)", hosts[i].Name, err))
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	if len(succeeded) > 0 {
+		return &PartialError{
+			Failed:    failed,
+			Succeeded: succeeded,
+			Err:       fmt.Errorf("the task '%s' failed on %s. it succeeded on %s.", task.Name, strings.Join(messages, ", "), strings.Join(succeeded, ", ")),
+		}
+	}
+
+	if len(failed) == 1 {
+		return first
+	}
+
+	err := fmt.Errorf("the task '%s' failed on all the hosts: %s", task.Name, strings.Join(messages, ", "))
+	if connection {
+		return &ConnectionError{Err: err}
+	}
+	return &CommandError{Err: err}
+}
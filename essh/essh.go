@@ -3,23 +3,26 @@ package essh
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/Songmu/wrapcommander"
 	fatihColor "github.com/fatih/color"
 	"github.com/kardianos/osext"
 	"github.com/kohkimakimoto/essh/support/color"
-	"github.com/kohkimakimoto/essh/support/helper"
 	"github.com/yuin/gopher-lua"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"text/template"
+	"time"
 )
 
 // system configurations.
@@ -32,6 +35,7 @@ var (
 	WorkingDataDir               string
 	WorkingDir                   string
 	Executable                   string
+	RunID                        string
 )
 
 // flags
@@ -41,14 +45,32 @@ var (
 	printFlag   bool
 	colorFlag   bool
 	noColorFlag bool
+	noPagerFlag bool
 	debugFlag   bool
 	hostsFlag   bool
+	pingFlag    bool
+	benchFlag   bool
+	noCacheFlag bool
+	noHooksFlag bool
+	refreshFlag bool
 	quietFlag   bool
 	allFlag     bool
 	tagsFlag    bool
+	rolesFlag   bool
+	switchRole  bool
+	forceUnlock bool
+	importKnown bool
+	freqFlag    bool
+	recentFlag  bool
+	consoleFlag bool
+	promptInfo  bool
+	resolveFlag bool
 	tasksFlag   bool
+	graphFlag   bool
 	genFlag     bool
 	globalFlag  bool
+	doctorFlag  bool
+	profileFlag bool
 
 	zshCompletionModeFlag       bool
 	zshCompletionFlag           bool
@@ -64,43 +86,101 @@ var (
 	bashCompletionTasksFlag      bool
 	bashCompletionNamespacesFlag bool
 
-	aliasesFlag     bool
-	execFlag        bool
-	fileFlag        bool
-	prefixFlag      bool
-	parallelFlag    bool
-	privilegedFlag  bool
-	userVar         string
-	ptyFlag         bool
-	SSHConfigFlag   bool
-	workindDirVar   string
-	configVar       string
-	selectVar       []string
-	targetVar       []string
-	filterVar       []string
-	backendVar      string
-	prefixStringVar string
-	driverVar       string
-)
-
-const (
-	ExitErr = 1
+	aliasesFlag      bool
+	psCompletionFlag bool
+	hostAliasesFlag  bool
+	oneFlag          bool
+	socksVar         string
+	socksStopFlag    bool
+	refreshDmnFlag   bool
+	scpFlag          bool
+	rsyncFlag        bool
+	previewFlag      bool
+	planFlag         bool
+	testFlag         bool
+	updateFlag       bool
+	resumeFlag       bool
+	execFlag         bool
+	fileFlag         bool
+	prefixFlag       bool
+	parallelFlag     bool
+	serialAuthFlag   bool
+	muxJumpFlag      bool
+	privilegedFlag   bool
+	userVar          string
+	ptyFlag          bool
+	fwdAgentFlag     bool
+	traceFlag        bool
+	SSHConfigFlag    bool
+	workindDirVar    string
+	configVar        string
+	selectVar        []string
+	targetVar        []string
+	filterVar        []string
+	excludeVar       []string
+	outFilterVar     []string
+	limitVar         int
+	columnsVar       []string
+	formatVar        string
+	compCacheTTLVar  time.Duration
+	benchCountVar    int
+	verboseVar       int
+	describeVar      string
+	backendVar       string
+	prefixStringVar  string
+	driverVar        string
+	chdirVar         string
+	grepVar          string
+	whoisVar         string
+	showCmdVar       string
+	exportVar        string
+	debugFileVar     string
+	privateTmpFlag   bool
+	genFormatVar     string
+	genOutputVar     string
+	diffConfigVar    string
+	pprofAddrVar     string
+	// usedOptions are the names of the essh options in the command line like "--debug".
+	usedOptions []string
 )
 
 func initResources() {
 	// Flags
+	usedOptions = []string{}
 	helpFlag = false
 	printFlag = false
 	colorFlag = false
 	noColorFlag = false
+	noPagerFlag = false
 	debugFlag = false
 	hostsFlag = false
+	pingFlag = false
+	benchFlag = false
+	noCacheFlag = false
+	noHooksFlag = false
+	refreshFlag = false
+	refreshDmnFlag = false
+	benchCountVar = DefaultBenchCount
+	verboseVar = VERBOSITY_NORMAL
 	quietFlag = false
 	allFlag = false
 	tagsFlag = false
+	rolesFlag = false
+	switchRole = false
+	forceUnlock = false
+	importKnown = false
+	freqFlag = false
+	recentFlag = false
+	consoleFlag = false
+	promptInfo = false
+	resolveFlag = false
 	tasksFlag = false
+	graphFlag = false
 	genFlag = false
 	globalFlag = false
+	doctorFlag = false
+	profileFlag = false
+	profile = nil
 	zshCompletionModeFlag = false
 	zshCompletionFlag = false
 	zshCompletionHostsFlag = false
@@ -114,22 +194,57 @@ func initResources() {
 	bashCompletionTasksFlag = false
 	bashCompletionNamespacesFlag = false
 	aliasesFlag = false
+	psCompletionFlag = false
+	hostAliasesFlag = false
+	oneFlag = false
+	socksVar = ""
+	socksStopFlag = false
+	scpFlag = false
+	rsyncFlag = false
+	previewFlag = false
+	planFlag = false
+	testFlag = false
+	updateFlag = false
+	resumeFlag = false
 	execFlag = false
 	fileFlag = false
 	prefixFlag = false
 	parallelFlag = false
+	serialAuthFlag = false
+	muxJumpFlag = false
 	privilegedFlag = false
 	userVar = ""
 	ptyFlag = false
+	fwdAgentFlag = false
+	traceFlag = false
 	SSHConfigFlag = false
 	workindDirVar = ""
 	configVar = ""
 	selectVar = []string{}
 	targetVar = []string{}
 	filterVar = []string{}
+	excludeVar = []string{}
+	outFilterVar = []string{}
+	limitVar = 0
+	columnsVar = []string{}
+	formatVar = ""
+	compCacheTTLVar = 0
+	describeVar = ""
+	grepVar = ""
+	whoisVar = ""
+	showCmdVar = ""
+	exportVar = ""
 	backendVar = ""
 	prefixStringVar = ""
+	chdirVar = ""
 	driverVar = ""
+	debugFileVar = ""
+	privateTmpFlag = false
+	genFormatVar = ""
+	genOutputVar = ""
+	diffConfigVar = ""
+	pprofAddrVar = ""
+	debugWriter = os.Stderr
 
 	// Registry
 	CurrentRegistry = nil
@@ -138,8 +253,18 @@ func initResources() {
 
 	// Hosts, Tasks, Drivers,
 	Hosts = map[string]*Host{}
+	lazyHosts = false
 	Tasks = map[string]*Task{}
 	Drivers = map[string]*Driver{}
+	NamedGroups = map[string]*Group{}
+	ConnectionSettings = map[string]string{}
+	Secrets = map[string]bool{}
+	GlobalOutputFilters = []*OutputFilter{}
+	hostStates = map[string]map[string]string{}
+	sharedValues = map[string]*SharedValue{}
+	secretReplacer = nil
+	HostProviders = []*HostProvider{}
+	Roles = map[string]*Role{}
 
 	// set built-in drivers
 	driver := NewDriver()
@@ -148,7 +273,8 @@ func initResources() {
 		return `
 {{template "environment" .}}
 {{template "functions" .}}
-{{range $i, $script := .Scripts}}{{$script.code}}
+{{range $i, $script := .Scripts}}{{if $.StepHeaders}}{{index $.StepHeaders $i}}
+{{end}}{{$script.code}}
 {{end}}`, nil
 	}
 	Drivers[DefaultDriverName] = driver
@@ -179,13 +305,30 @@ func Run(osArgs []string) (exitStatus int) {
 		debugFlag = true
 	}
 
+	// use completion cache ttl from environment variable. --completion-cache-ttl option overrides it.
+	if os.Getenv("ESSH_COMPLETION_CACHE_TTL") != "" {
+		ttl, err := parseCompletionCacheTTL(os.Getenv("ESSH_COMPLETION_CACHE_TTL"))
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		compCacheTTLVar = ttl
+	}
+
+	RunID = generateRunID()
+
 	if len(osArgs) == 0 {
 		printUsage()
 		return
 	}
 
+	// expand subcommands like `essh hosts` to the options like `essh --hosts`.
+	osArgs, subcommand := expandSubcommand(osArgs)
+
 	args := []string{}
 	doesNotParseOption := false
+	// index of the end-of-options separator `--` in args. -1 means no separator.
+	separatorIndex := -1
 
 	// parsing options
 	// Essh uses only double dash options like `--print`,
@@ -197,6 +340,10 @@ func Run(osArgs []string) (exitStatus int) {
 
 		arg := osArgs[0]
 
+		if !doesNotParseOption && strings.HasPrefix(arg, "--") && arg != "--" {
+			usedOptions = append(usedOptions, strings.SplitN(arg, "=", 2)[0])
+		}
+
 		if doesNotParseOption {
 			// restructure args to remove essh options.
 			args = append(args, arg)
@@ -212,8 +359,65 @@ func Run(osArgs []string) (exitStatus int) {
 			noColorFlag = true
 		} else if arg == "--debug" {
 			debugFlag = true
+		} else if arg == "--pprof-addr" {
+			if len(osArgs) < 2 {
+				printError("--pprof-addr reguires an argument.")
+				return ExitErr
+			}
+			pprofAddrVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--pprof-addr=") {
+			pprofAddrVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--debug-file" {
+			if len(osArgs) < 2 {
+				printError("--debug-file reguires an argument.")
+				return ExitErr
+			}
+			debugFileVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--debug-file=") {
+			debugFileVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--hosts" {
 			hostsFlag = true
+		} else if arg == "--ping" {
+			pingFlag = true
+		} else if arg == "--bench" {
+			benchFlag = true
+		} else if arg == "--doctor" {
+			doctorFlag = true
+		} else if arg == "--profile" {
+			profileFlag = true
+		} else if arg == "--no-cache" {
+			noCacheFlag = true
+		} else if arg == "--no-pager" {
+			noPagerFlag = true
+		} else if arg == "--private-tmp" {
+			privateTmpFlag = true
+		} else if arg == "--no-hooks" {
+			noHooksFlag = true
+		} else if arg == "--refresh-providers" {
+			refreshFlag = true
+		} else if arg == "--refresh-daemon" {
+			refreshDmnFlag = true
+		} else if arg == "--bench-count" {
+			if len(osArgs) < 2 {
+				printError("--bench-count reguires an argument.")
+				return ExitErr
+			}
+			count, err := parseBenchCount(osArgs[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			benchCountVar = count
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--bench-count=") {
+			count, err := parseBenchCount(strings.SplitN(arg, "=", 2)[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			benchCountVar = count
 		} else if arg == "--ssh-config" {
 			SSHConfigFlag = true
 		} else if arg == "--quiet" {
@@ -222,6 +426,8 @@ func Run(osArgs []string) (exitStatus int) {
 			allFlag = true
 		} else if arg == "--tasks" {
 			tasksFlag = true
+		} else if arg == "--graph" {
+			graphFlag = true
 		} else if arg == "--select" {
 			if len(osArgs) < 2 {
 				printError("--select reguires an argument.")
@@ -230,11 +436,54 @@ func Run(osArgs []string) (exitStatus int) {
 			selectVar = append(selectVar, osArgs[1])
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--select=") {
-			selectVar = append(selectVar, strings.Split(arg, "=")[1])
+			selectVar = append(selectVar, strings.SplitN(arg, "=", 2)[1])
 		} else if arg == "--tags" {
 			tagsFlag = true
+		} else if arg == "--roles" {
+			rolesFlag = true
+		} else if arg == "--switch-role" {
+			switchRole = true
+		} else if arg == "--force-unlock" {
+			forceUnlock = true
+		} else if arg == "--import-known-hosts" {
+			importKnown = true
+		} else if arg == "--frequent" {
+			freqFlag = true
+		} else if arg == "--recent" {
+			recentFlag = true
+		} else if arg == "--console" {
+			consoleFlag = true
+		} else if arg == "--prompt-info" {
+			promptInfo = true
 		} else if arg == "--gen" {
 			genFlag = true
+		} else if arg == "--diff-config" {
+			if len(osArgs) < 2 {
+				printError("--diff-config reguires an argument.")
+				return ExitErr
+			}
+			diffConfigVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--diff-config=") {
+			diffConfigVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--gen-format" {
+			if len(osArgs) < 2 {
+				printError("--gen-format reguires an argument.")
+				return ExitErr
+			}
+			genFormatVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--gen-format=") {
+			genFormatVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--output" {
+			if len(osArgs) < 2 {
+				printError("--output reguires an argument.")
+				return ExitErr
+			}
+			genOutputVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--output=") {
+			genOutputVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--global" {
 			globalFlag = true
 		} else if arg == "--zsh-completion" {
@@ -261,8 +510,31 @@ func Run(osArgs []string) (exitStatus int) {
 		} else if arg == "--bash-completion-tasks" {
 			bashCompletionTasksFlag = true
 			bashCompletionModeFlag = true
+		} else if arg == "--powershell-completion" {
+			psCompletionFlag = true
+		} else if arg == "--completion-cache-ttl" {
+			if len(osArgs) < 2 {
+				printError("--completion-cache-ttl reguires an argument.")
+				return ExitErr
+			}
+			ttl, err := parseCompletionCacheTTL(osArgs[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			compCacheTTLVar = ttl
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--completion-cache-ttl=") {
+			ttl, err := parseCompletionCacheTTL(strings.SplitN(arg, "=", 2)[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			compCacheTTLVar = ttl
 		} else if arg == "--aliases" {
 			aliasesFlag = true
+		} else if arg == "--host-aliases" {
+			hostAliasesFlag = true
 		} else if arg == "--working-dir" {
 			if len(osArgs) < 2 {
 				printError("--working-dir reguires an argument.")
@@ -271,7 +543,7 @@ func Run(osArgs []string) (exitStatus int) {
 			workindDirVar = osArgs[1]
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--working-dir=") {
-			workindDirVar = strings.Split(arg, "=")[1]
+			workindDirVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--config" {
 			if len(osArgs) < 2 {
 				printError("--config reguires an argument.")
@@ -280,9 +552,101 @@ func Run(osArgs []string) (exitStatus int) {
 			configVar = osArgs[1]
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--config=") {
-			configVar = strings.Split(arg, "=")[1]
+			configVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--columns" {
+			if len(osArgs) < 2 {
+				printError("--columns reguires an argument.")
+				return ExitErr
+			}
+			columnsVar = append(columnsVar, strings.Split(osArgs[1], ",")...)
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--columns=") {
+			columnsVar = append(columnsVar, strings.Split(strings.SplitN(arg, "=", 2)[1], ",")...)
+		} else if arg == "--format" {
+			if len(osArgs) < 2 {
+				printError("--format reguires an argument.")
+				return ExitErr
+			}
+			formatVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--format=") {
+			formatVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--describe" {
+			if len(osArgs) < 2 {
+				printError("--describe reguires an argument.")
+				return ExitErr
+			}
+			describeVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--describe=") {
+			describeVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--grep" {
+			if len(osArgs) < 2 {
+				printError("--grep reguires an argument.")
+				return ExitErr
+			}
+			grepVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--grep=") {
+			grepVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--whois" {
+			if len(osArgs) < 2 {
+				printError("--whois reguires an argument.")
+				return ExitErr
+			}
+			whoisVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--whois=") {
+			whoisVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--show-command" {
+			if len(osArgs) < 2 {
+				printError("--show-command reguires an argument.")
+				return ExitErr
+			}
+			showCmdVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--show-command=") {
+			showCmdVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--export" {
+			if len(osArgs) < 2 {
+				printError("--export reguires an argument.")
+				return ExitErr
+			}
+			exportVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--export=") {
+			exportVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--resolve" {
+			resolveFlag = true
+		} else if arg == "--one" {
+			oneFlag = true
+		} else if arg == "--socks" {
+			if len(osArgs) < 2 {
+				printError("--socks reguires an argument.")
+				return ExitErr
+			}
+			socksVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--socks=") {
+			socksVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--socks-stop" {
+			socksStopFlag = true
 		} else if arg == "--exec" {
 			execFlag = true
+		} else if arg == "--scp" {
+			scpFlag = true
+		} else if arg == "--rsync" {
+			rsyncFlag = true
+		} else if arg == "--preview" {
+			previewFlag = true
+		} else if arg == "--plan" {
+			planFlag = true
+		} else if arg == "--test" {
+			testFlag = true
+		} else if arg == "--update" {
+			updateFlag = true
+		} else if arg == "--resume" {
+			resumeFlag = true
 		} else if arg == "--privileged" {
 			privilegedFlag = true
 		} else if arg == "--user" {
@@ -293,9 +657,13 @@ func Run(osArgs []string) (exitStatus int) {
 			userVar = osArgs[1]
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--user=") {
-			userVar = strings.Split(arg, "=")[1]
+			userVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--parallel" {
 			parallelFlag = true
+		} else if arg == "--serialize-auth" {
+			serialAuthFlag = true
+		} else if arg == "--multiplex-jump" {
+			muxJumpFlag = true
 		} else if arg == "--prefix" {
 			prefixFlag = true
 		} else if arg == "--prefix-string" {
@@ -306,7 +674,25 @@ func Run(osArgs []string) (exitStatus int) {
 			prefixStringVar = osArgs[1]
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--prefix-string=") {
-			prefixStringVar = strings.Split(arg, "=")[1]
+			prefixStringVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--output-filter" {
+			if len(osArgs) < 2 {
+				printError("--output-filter reguires an argument.")
+				return ExitErr
+			}
+			outFilterVar = append(outFilterVar, osArgs[1])
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--output-filter=") {
+			outFilterVar = append(outFilterVar, strings.SplitN(arg, "=", 2)[1])
+		} else if arg == "--chdir" {
+			if len(osArgs) < 2 {
+				printError("--chdir reguires an argument.")
+				return ExitErr
+			}
+			chdirVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--chdir=") {
+			chdirVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--driver" {
 			if len(osArgs) < 2 {
 				printError("--driver reguires an argument.")
@@ -315,7 +701,7 @@ func Run(osArgs []string) (exitStatus int) {
 			driverVar = osArgs[1]
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--driver=") {
-			driverVar = strings.Split(arg, "=")[1]
+			driverVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--target" {
 			if len(osArgs) < 2 {
 				printError("--target reguires an argument.")
@@ -324,7 +710,7 @@ func Run(osArgs []string) (exitStatus int) {
 			targetVar = append(targetVar, osArgs[1])
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--target=") {
-			targetVar = append(targetVar, strings.Split(arg, "=")[1])
+			targetVar = append(targetVar, strings.SplitN(arg, "=", 2)[1])
 		} else if arg == "--filter" {
 			if len(osArgs) < 2 {
 				printError("--filter reguires an argument.")
@@ -333,7 +719,35 @@ func Run(osArgs []string) (exitStatus int) {
 			filterVar = append(filterVar, osArgs[1])
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--filter=") {
-			filterVar = append(filterVar, strings.Split(arg, "=")[1])
+			filterVar = append(filterVar, strings.SplitN(arg, "=", 2)[1])
+		} else if arg == "--exclude" {
+			if len(osArgs) < 2 {
+				printError("--exclude reguires an argument.")
+				return ExitErr
+			}
+			excludeVar = append(excludeVar, osArgs[1])
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--exclude=") {
+			excludeVar = append(excludeVar, strings.SplitN(arg, "=", 2)[1])
+		} else if arg == "--limit" {
+			if len(osArgs) < 2 {
+				printError("--limit reguires an argument.")
+				return ExitErr
+			}
+			limit, err := parseLimit(osArgs[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			limitVar = limit
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--limit=") {
+			limit, err := parseLimit(strings.SplitN(arg, "=", 2)[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			limitVar = limit
 		} else if arg == "--backend" {
 			if len(osArgs) < 2 {
 				printError("--backend reguires an argument.")
@@ -342,13 +756,20 @@ func Run(osArgs []string) (exitStatus int) {
 			backendVar = osArgs[1]
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--backend=") {
-			backendVar = strings.Split(arg, "=")[1]
+			backendVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--script-file" {
 			fileFlag = true
-		} else if arg == "--pty" {
+		} else if arg == "--pty" || arg == "--tty" {
 			ptyFlag = true
+		} else if arg == "--forward-agent" {
+			fwdAgentFlag = true
+		} else if arg == "--trace" {
+			traceFlag = true
+		} else if arg == "--verbose" {
+			verboseVar++
 		} else if arg == "--" {
 			doesNotParseOption = true
+			separatorIndex = len(args)
 			// to behave same ssh. pass the `--` to the ssh.
 			args = append(args, arg)
 		} else {
@@ -371,6 +792,60 @@ func Run(osArgs []string) (exitStatus int) {
 		debugFlag = true
 	}
 
+	// --debug-file implies --debug.
+	if debugFileVar != "" {
+		f, err := openDebugFile(debugFileVar)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		defer f.Close()
+
+		debugFlag = true
+		debugWriter = f
+	}
+
+	// report the time of each phase after all the other deferred functions.
+	if profileFlag {
+		profile = NewProfile()
+		defer profile.Write(os.Stderr)
+	}
+
+	if (genFormatVar != "" || genOutputVar != "") && !genFlag {
+		printError("--gen-format and --output must be used with --gen option.")
+		return ExitErr
+	}
+
+	if genFormatVar != "" {
+		if err := validateGenFormat(genFormatVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+	}
+
+	// the host that --one selects is a destination of ssh, so it can't be used with the other modes.
+	if oneFlag && (execFlag || scpFlag || rsyncFlag) {
+		printError("--one can't be used with --exec, --scp and --rsync options.")
+		return ExitErr
+	}
+
+	if hostAliasesFlag && !aliasesFlag {
+		printError("--host-aliases must be used with --aliases option.")
+		return ExitErr
+	}
+
+	if pprofAddrVar != "" && !refreshDmnFlag {
+		printError("--pprof-addr must be used with --refresh-daemon option.")
+		return ExitErr
+	}
+
+	if formatVar != "" {
+		if err := validateFormat(formatVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+	}
+
 	if workindDirVar != "" {
 		err := os.Chdir(workindDirVar)
 		if err != nil {
@@ -455,7 +930,19 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
-	if aliasesFlag {
+	if psCompletionFlag {
+		s, err := sprintPowerShellCompletion()
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		fmt.Print(s)
+		return
+	}
+
+	// the aliases of the hosts need the evaluated config files.
+	if aliasesFlag && !hostAliasesFlag {
 		s, err := sprintByTemplate(ALIASES_CODE)
 		if err != nil {
 			printError(err)
@@ -466,6 +953,53 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	completionKind := completionListKind()
+
+	var completionCache *CompletionCache
+	if completionKind != "" && compCacheTTLVar > 0 && !noCacheFlag {
+		completionCache = NewCompletionCache(filepath.Join(UserDataDir, "cache", "completion"), compCacheTTLVar, completionKind)
+		if content, ok := completionCache.Get(); ok {
+			if debugFlag {
+				debugf("use completion cache: %s\n", completionCache.Path())
+			}
+
+			fmt.Print(orderCompletionByUsage(content, completionKind))
+			return
+		}
+	}
+
+	if socksStopFlag {
+		hostname := ""
+		if len(args) > 0 {
+			hostname = args[0]
+		}
+
+		if err := stopSocks(hostname); err != nil {
+			printError(err)
+			return ExitErr
+		}
+		return
+	}
+
+	// keep the caches of the host providers warm.
+	if refreshDmnFlag {
+		interval := DefaultRefreshInterval
+		if len(args) > 0 {
+			d, err := time.ParseDuration(args[0])
+			if err != nil {
+				printError(fmt.Errorf("invalid interval '%s'.", args[0]))
+				return ExitErr
+			}
+			interval = d
+		}
+
+		if err := runRefreshDaemon(interval, pprofAddrVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+		return
+	}
+
 	// extend lua package path.
 	libdir := filepath.Join(UserDataDir, "lib")
 	libdir2 := filepath.Join(WorkingDataDir, "lib")
@@ -475,35 +1009,64 @@ func Run(osArgs []string) (exitStatus int) {
 		lua.LuaPathDefault = libdir2 + "\\?.lua;" + libdir + "\\?.lua;" + lua.LuaPathDefault
 	}
 
+	// connect to the host with the cached ssh_config without evaluating the config files.
+	var configCache *ConfigCache
+	configCacheHit := false
+	if !noCacheFlag {
+		configCache = NewConfigCache(filepath.Join(UserDataDir, "cache", "config"), []string{libdir, libdir2})
+		if entry, ok := configCache.Get(); ok {
+			configCacheHit = true
+			if isSSHModeFlags() && entry.CanConnect(args) {
+				if debugFlag {
+					debugf("use config cache: %s\n", configCache.Path())
+				}
+
+				err, ex := runSSHWithConfigCache(entry, args)
+				if err != nil {
+					printError(err)
+					return ExitErr
+				}
+				return ex
+			}
+		}
+	}
+
+	lazyHosts = isSSHModeFlags() && len(args) > 0
+
 	// set up the lua state.
+	loadStart := time.Now()
 	L := lua.NewState()
 	defer L.Close()
 	InitLuaState(L)
 
 	if debugFlag {
-		fmt.Printf("[essh debug] init lua state\n")
+		debugf("init lua state\n")
 	}
 
 	// generate temporary ssh config file
-	tmpFile, err := ioutil.TempFile("", "essh.ssh_config.")
+	removeOrphanedTempSSHConfigs()
+	temporarySSHConfigFile, err := newTempSSHConfig()
 	if err != nil {
 		printError(err)
 		return ExitErr
 	}
-	
+
 	defer func() {
-		os.Remove(tmpFile.Name())
+		if previewFlag {
+			// keep the config file to be able to run the previewed command.
+			keepTempSSHConfig(temporarySSHConfigFile)
+			return
+		}
+
+		removeTempSSHConfig(temporarySSHConfigFile)
 
 		if debugFlag {
-			fmt.Printf("[essh debug] deleted config file: %s \n", tmpFile.Name())
+			debugf("deleted config file: %s \n", temporarySSHConfigFile)
 		}
 	}()
-	
-	temporarySSHConfigFile := tmpFile.Name()
-	tmpFile.Close();
 
 	if debugFlag {
-		fmt.Printf("[essh debug] generated config file: %s \n", temporarySSHConfigFile)
+		debugf("generated config file: %s \n", temporarySSHConfigFile)
 	}
 
 	lessh, ok := toLTable(L.GetGlobal("essh"))
@@ -514,6 +1077,9 @@ func Run(osArgs []string) (exitStatus int) {
 
 	// set temporary ssh config file path
 	lessh.RawSetString("ssh_config", lua.LString(temporarySSHConfigFile))
+	if genSSHOutput := genSSHOutputFile(); genSSHOutput != "" {
+		lessh.RawSetString("ssh_config", lua.LString(genSSHOutput))
+	}
 
 	// user context
 	GlobalRegistry = NewRegistry(UserDataDir, RegistryTypeGlobal)
@@ -521,6 +1087,9 @@ func Run(osArgs []string) (exitStatus int) {
 
 	CurrentRegistry = GlobalRegistry
 
+	// the errors in loading the config files are reported by --doctor instead of exiting.
+	configErrors := []error{}
+
 	if _, err := os.Stat(WorkingDirConfigFile); err == nil && !globalFlag {
 		// has working directroy config file
 
@@ -530,16 +1099,22 @@ func Run(osArgs []string) (exitStatus int) {
 		// load working directory config
 		if _, err := os.Stat(WorkingDirConfigFile); err == nil {
 			if debugFlag {
-				fmt.Printf("[essh debug] loading config file: %s\n", WorkingDirConfigFile)
+				debugf("loading config file: %s\n", WorkingDirConfigFile)
 			}
 
+			luaStart := time.Now()
 			if err := L.DoFile(WorkingDirConfigFile); err != nil {
-				printError(err)
-				return ExitErr
+				if !doctorFlag {
+					printError(err)
+					return ExitConfigErr
+				}
+				configErrors = append(configErrors, err)
 			}
 
+			profile.Add(PROFILE_LUA, "", luaStart)
+
 			if debugFlag {
-				fmt.Printf("[essh debug] loaded config file: %s\n", WorkingDirConfigFile)
+				debugf("loaded config file: %s\n", WorkingDirConfigFile)
 			}
 		}
 	} else {
@@ -548,36 +1123,53 @@ func Run(osArgs []string) (exitStatus int) {
 		// load per-user configuration file.
 		if _, err := os.Stat(UserConfigFile); err == nil {
 			if debugFlag {
-				fmt.Printf("[essh debug] loading config file: %s\n", UserConfigFile)
+				debugf("loading config file: %s\n", UserConfigFile)
 			}
 
+			luaStart := time.Now()
 			if err := L.DoFile(UserConfigFile); err != nil {
-				printError(err)
-				return ExitErr
+				if !doctorFlag {
+					printError(err)
+					return ExitConfigErr
+				}
+				configErrors = append(configErrors, err)
 			}
 
+			profile.Add(PROFILE_LUA, "", luaStart)
+
 			if debugFlag {
-				fmt.Printf("[essh debug] loaded config file: %s\n", UserConfigFile)
+				debugf("loaded config file: %s\n", UserConfigFile)
 			}
 		}
 	}
 
+	// fetch the host providers before loading the override config files, so that they can modify the provided hosts.
+	providersStart := time.Now()
+	providersOK := loadHostProviders(L, refreshFlag)
+	profile.Add(PROFILE_PROVIDERS, "", providersStart)
+
 	// change context to working dir context
 	CurrentRegistry = LocalRegistry
 
 	// load working directory override config
 	if _, err := os.Stat(WorkingDirOverrideConfigFile); err == nil && !globalFlag {
 		if debugFlag {
-			fmt.Printf("[essh debug] loading config file: %s\n", WorkingDirOverrideConfigFile)
+			debugf("loading config file: %s\n", WorkingDirOverrideConfigFile)
 		}
 
+		luaStart := time.Now()
 		if err := L.DoFile(WorkingDirOverrideConfigFile); err != nil {
-			printError(err)
-			return ExitErr
+			if !doctorFlag {
+				printError(err)
+				return ExitConfigErr
+			}
+			configErrors = append(configErrors, err)
 		}
 
+		profile.Add(PROFILE_LUA, "", luaStart)
+
 		if debugFlag {
-			fmt.Printf("[essh debug] loaded config file: %s\n", WorkingDirOverrideConfigFile)
+			debugf("loaded config file: %s\n", WorkingDirOverrideConfigFile)
 		}
 	}
 
@@ -587,86 +1179,170 @@ func Run(osArgs []string) (exitStatus int) {
 	// load override global config
 	if _, err := os.Stat(UserOverrideConfigFile); err == nil {
 		if debugFlag {
-			fmt.Printf("[essh debug] loading config file: %s\n", UserOverrideConfigFile)
+			debugf("loading config file: %s\n", UserOverrideConfigFile)
 		}
 
+		luaStart := time.Now()
 		if err := L.DoFile(UserOverrideConfigFile); err != nil {
-			printError(err)
-			return ExitErr
+			if !doctorFlag {
+				printError(err)
+				return ExitConfigErr
+			}
+			configErrors = append(configErrors, err)
 		}
 
+		profile.Add(PROFILE_LUA, "", luaStart)
+
 		if debugFlag {
-			fmt.Printf("[essh debug] loaded config file: %s\n", UserOverrideConfigFile)
+			debugf("loaded config file: %s\n", UserOverrideConfigFile)
+		}
+	}
+
+	// fetch the host providers that are defined in the override config files.
+	providersStart = time.Now()
+	providersOK = loadHostProviders(L, refreshFlag) && providersOK
+	profile.Add(PROFILE_PROVIDERS, "", providersStart)
+
+	// only the hosts that ssh needs are materialized in ssh mode.
+	if lazyHosts {
+		if err := materializeHosts(L, args); err != nil {
+			printError(err)
+			return ExitConfigErr
 		}
 	}
 
 	// validate config
 	if err := validateResources(NewTaskQuery().Datasource, NewHostQuery().Datasource); err != nil {
-		printError(err)
-		return ExitErr
+		if !doctorFlag {
+			printError(err)
+			return ExitConfigErr
+		}
+		configErrors = append(configErrors, err)
 	}
-
-	// show hosts for zsh completion
-	if zshCompletionHostsFlag {
-		for _, host := range NewHostQuery().GetHostsOrderByName() {
-			if !host.Hidden {
-				fmt.Printf("%s\t%s\n", ColonEscape(host.Name), ColonEscape(host.DescriptionOrDefault()))
+	// the global output filters that are applied to the output of all the tasks.
+	if value := lessh.RawGetString("output_filters"); value != lua.LNil {
+		filters, err := toOutputFilters(L, value)
+		if err != nil {
+			printError(fmt.Errorf("invalid essh.output_filters: %v", err))
+			return ExitConfigErr
+		}
+		GlobalOutputFilters = filters
+	}
+	debugPhase("config load", loadStart)
+
+	// a host or a task that has the same name as the subcommand is used instead of the subcommand.
+	// the loaded config is used as it is, because evaluating it again runs its side effects twice.
+	if subcommandIsShadowed(subcommand) {
+		fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: '%s' is treated as the host or the task that is defined in the config, not the subcommand.", subcommand.Name))
+		args = restoreSubcommand(subcommand, args)
+		if separatorIndex >= 0 {
+			separatorIndex += len(subcommand.Words)
+		}
+		if lazyHosts {
+			if err := materializeHosts(L, args); err != nil {
+				printError(err)
+				return ExitConfigErr
 			}
 		}
+	}
 
+	// only check the environment
+	if doctorFlag {
+		if !runDoctor(os.Stdout, configErrors, providersOK, NewHostQuery().GetHostsOrderByName()) {
+			return ExitErr
+		}
 		return
 	}
 
-	if bashCompletionHostsFlag {
-		for _, host := range NewHostQuery().GetHostsOrderByName() {
-			if !host.Hidden {
-				fmt.Printf("%s\n", ColonEscape(host.Name))
-			}
+	if aliasesFlag {
+		s, err := sprintByTemplate(ALIASES_CODE)
+		if err != nil {
+			printError(err)
+			return ExitErr
 		}
 
+		fmt.Print(s)
 		return
 	}
 
-	// show tasks for zsh completion
-	if zshCompletionTasksFlag {
-		for _, t := range NewTaskQuery().GetTasksOrderByName() {
-			hidden := t.Hidden
-			if !t.Disabled && !hidden {
-				fmt.Printf("%s\t%s\n", ColonEscape(t.PublicName()), ColonEscape(t.DescriptionOrDefault()))
-			}
+	// only compare the hosts and the tasks with the other config file.
+	if diffConfigVar != "" {
+		// the current config file is evaluated again alone, so that both sides are comparable.
+		currentFile := UserConfigFile
+		if _, err := os.Stat(WorkingDirConfigFile); err == nil && !globalFlag {
+			currentFile = WorkingDirConfigFile
 		}
-		return
+		current, err := loadConfigSnapshot(currentFile, temporarySSHConfigFile)
+		if err != nil {
+			printError(err)
+			return exitStatusOf(err)
+		}
+		other, err := loadConfigSnapshot(expandHomeDir(diffConfigVar), temporarySSHConfigFile)
+		if err != nil {
+			printError(err)
+			return exitStatusOf(err)
+		}
+
+		if !writeConfigDiff(os.Stdout, current, other) {
+			return ExitErr
+		}
+		return
 	}
 
-	if bashCompletionTasksFlag {
-		for _, t := range NewTaskQuery().GetTasksOrderByName() {
-			hidden := t.Hidden
-			if !t.Disabled && !hidden {
-				fmt.Printf("%s\n", ColonEscape(t.PublicName()))
-			}
+	// only refresh the caches of the host providers.
+	if refreshFlag {
+		if !providersOK {
+			return ExitErr
 		}
 		return
 	}
 
-	if zshCompletionTagsFlag || bashCompletionTagsFlag {
-		for _, tag := range GetTags(Hosts) {
-			fmt.Printf("%s\n", ColonEscape(tag))
+	// show hosts, tasks or tags for completion, or the summary for shell prompts
+	if completionKind != "" {
+		var b bytes.Buffer
+		if promptInfo {
+			if err := writePromptInfo(&b, newPromptInfo(lessh), formatVar); err != nil {
+				printError(err)
+				return ExitErr
+			}
+		} else {
+			writeCompletionList(&b)
+		}
+
+		if completionCache != nil {
+			if err := completionCache.Set(b.String()); err != nil && debugFlag {
+				debugf("failed to save completion cache: %v\n", err)
+			}
 		}
+
+		fmt.Print(orderCompletionByUsage(b.String(), completionKind))
 		return
 	}
 
 	// only print hosts list
 	if hostsFlag {
+		stop := startPager()
+		defer stop()
+
 		if len(selectVar) == 0 && len(filterVar) > 0 {
 			printError("--filter must be used with --select option.")
 			return ExitErr
 		}
 
-		query := NewHostQuery().AppendSelections(selectVar).AppendFilters(filterVar)
+		if len(selectVar) == 0 && len(excludeVar) > 0 {
+			printError("--exclude must be used with --select option.")
+			return ExitErr
+		}
+
+		query := NewHostQuery().AppendSelections(selectVar).AppendFilters(filterVar).AppendExcludes(excludeVar).SetLimit(limitVar)
 		if !allFlag {
 			query = query.isVisible()
 		}
 		filteredHosts := query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			printError(err)
+			return ExitErr
+		}
 
 		if SSHConfigFlag {
 			outputConfig, ok := toString(lessh.RawGetString("ssh_config"))
@@ -684,25 +1360,155 @@ func Run(osArgs []string) (exitStatus int) {
 
 			// print generated config
 			fmt.Println(string(content))
+		} else if formatVar == FormatPrometheusSD {
+			if err := WritePrometheusSD(os.Stdout, filteredHosts); err != nil {
+				printError(err)
+				return ExitErr
+			}
 		} else {
-			tb := helper.NewPlainTable(os.Stdout)
-			if !quietFlag {
-				tb.SetHeader([]string{"NAME", "DESCRIPTION", "TAGS", "HIDDEN"})
+			columns := DefaultHostColumns
+			for _, host := range filteredHosts {
+				// flag the hosts that have expiry dates.
+				if !host.Expires.IsZero() {
+					columns = append(append([]string{}, DefaultHostColumns...), "expires")
+					break
+				}
+			}
+			if quietFlag {
+				columns = []string{"name"}
+			} else if len(columnsVar) > 0 {
+				columns = columnsVar
+			}
+
+			listing := &Listing{Header: []string{}}
+			for _, column := range columns {
+				listing.Header = append(listing.Header, strings.ToUpper(strings.TrimPrefix(column, "props.")))
 			}
 
+			records := []interface{}{}
 			for _, host := range filteredHosts {
+				row := []string{}
+				for _, column := range columns {
+					row = append(row, host.ColumnValue(column))
+				}
+				listing.Append(row)
+
 				if quietFlag {
-					tb.Append([]string{host.Name})
+					records = append(records, host.Name)
 				} else {
-					hidden := "false"
-					if host.Hidden {
-						hidden = "true"
-					}
-					tb.Append([]string{host.Name, host.Description, strings.Join(host.Tags, ","), hidden})
+					records = append(records, hostRecord(host))
 				}
 			}
+			listing.Data = records
+
+			if err := listing.Write(os.Stdout, formatVar, quietFlag); err != nil {
+				printError(err)
+				return ExitErr
+			}
+		}
+
+		return
+	}
+
+	// only print a host's detail
+	if describeVar != "" {
+		host := Hosts[describeVar]
+		if host == nil {
+			printError(fmt.Errorf("host '%s' is not defined.", describeVar))
+			return ExitErr
+		}
+
+		DescribeHost(os.Stdout, host)
+		return
+	}
+
+	// only print the ssh command line that connects to the host without essh
+	if showCmdVar != "" {
+		host := Hosts[showCmdVar]
+		if host == nil {
+			printError(fmt.Errorf("host '%s' is not defined.", showCmdVar))
+			return ExitErr
+		}
+
+		sshArgs, err := standaloneSSHArgs(host, map[string]bool{})
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		fmt.Println(ShellQuote(sshArgs))
+		return
+	}
+
+	// only print the self-contained ssh_config of the host
+	if exportVar != "" {
+		host := Hosts[exportVar]
+		if host == nil {
+			printError(fmt.Errorf("host '%s' is not defined.", exportVar))
+			return ExitErr
+		}
+
+		exportHostConfig(L, os.Stdout, host)
+		return
+	}
+
+	// only print the hosts that match the pattern
+	if grepVar != "" {
+		query := NewHostQuery()
+		if !allFlag {
+			query = query.isVisible()
+		}
+
+		hosts := query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		matches, err := grepHosts(hosts, grepVar)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		if len(matches) == 0 {
+			// like grep, exits with non-zero status if nothing matches.
+			return ExitErr
+		}
+
+		stop := startPager()
+		defer stop()
 
-			tb.Render()
+		if err := grepListing(matches, quietFlag).Write(os.Stdout, formatVar, quietFlag); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// only print the hosts that point to the address
+	if whoisVar != "" {
+		query := NewHostQuery()
+		if !allFlag {
+			query = query.isVisible()
+		}
+
+		hosts := query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		matches := whoisHosts(hosts, whoisVar, resolveFlag)
+		if len(matches) == 0 {
+			printError(fmt.Errorf("no host points to '%s'.", whoisVar))
+			return ExitErr
+		}
+
+		if err := whoisListing(matches, quietFlag).Write(os.Stdout, formatVar, quietFlag); err != nil {
+			printError(err)
+			return ExitErr
 		}
 
 		return
@@ -710,36 +1516,211 @@ func Run(osArgs []string) (exitStatus int) {
 
 	// only print tags list
 	if tagsFlag {
-		tb := helper.NewPlainTable(os.Stdout)
-		if !quietFlag {
-			tb.SetHeader([]string{"NAME"})
+		listing := &Listing{Header: []string{"NAME"}}
+		tags := GetTags(Hosts)
+		for _, tag := range tags {
+			listing.Append([]string{tag})
 		}
-		for _, tag := range GetTags(Hosts) {
-			tb.Append([]string{tag})
+		listing.Data = tags
+
+		if err := listing.Write(os.Stdout, formatVar, quietFlag); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// only print the most used hosts and tasks
+	if freqFlag {
+		entries := frequentEntries(loadUsage())
+		if limitVar > 0 && len(entries) > limitVar {
+			entries = entries[:limitVar]
+		}
+
+		if err := frequentListing(entries, quietFlag).Write(os.Stdout, formatVar, quietFlag); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// select a host or a task that was used recently, and connect to it or run it.
+	if recentFlag {
+		if len(args) > 0 {
+			printError("--recent can't be used with the arguments.")
+			return ExitErr
+		}
+
+		entries := recentEntries(loadUsage())
+		limit := limitVar
+		if limit <= 0 {
+			limit = DefaultRecentCount
+		}
+		if len(entries) > limit {
+			entries = entries[:limit]
+		}
+
+		entry, err := selectRecentEntry(os.Stdin, os.Stderr, entries)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		if entry == nil {
+			return
+		}
+
+		args = []string{entry.Name}
+	}
+
+	// only print roles list
+	if rolesFlag {
+		listing := &Listing{Header: []string{"NAME", "CURRENT", "TARGETS", "DESCRIPTION"}}
+		records := []interface{}{}
+		for _, name := range GetRoleNames() {
+			role := Roles[name]
+			current := role.CurrentSet()
+			if role.TargetsFunc != nil {
+				current = "(function)"
+			}
+
+			targets, err := role.Targets()
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+
+			listing.Append([]string{name, current, strings.Join(targets, ","), role.Description})
+			records = append(records, map[string]interface{}{
+				"name":        name,
+				"current":     current,
+				"sets":        role.Sets,
+				"targets":     targets,
+				"description": role.Description,
+			})
+		}
+		listing.Data = records
+
+		if err := listing.Write(os.Stdout, formatVar, quietFlag); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// switch the current set of the role.
+	if switchRole {
+		if len(args) != 2 {
+			printError("--switch-role requires a role name and a set name.")
+			return ExitErr
+		}
+
+		role := Roles[args[0]]
+		if role == nil {
+			printError(fmt.Errorf("role '%s' is not defined.", args[0]))
+			return ExitErr
+		}
+
+		previous := role.CurrentSet()
+		if err := role.Switch(args[1]); err != nil {
+			printError(err)
+			return ExitErr
 		}
-		tb.Render()
 
+		printProgress(VERBOSITY_NORMAL, "switched the role '%s' from '%s' to '%s'", role.Name, previous, args[1])
+		return
+	}
+
+	// release the locks of the tasks that are held by other runs.
+	if forceUnlock {
+		if len(args) == 0 {
+			printError("--force-unlock requires task names.")
+			return ExitErr
+		}
+
+		for _, name := range args {
+			task := GetEnabledTask(name)
+			if task == nil {
+				printError(fmt.Errorf("task '%s' is not defined.", name))
+				return ExitErr
+			}
+
+			if err := forceUnlockTask(task); err != nil {
+				printError(err)
+				return ExitErr
+			}
+		}
+		return
+	}
+
+	// suggest the host definitions from known_hosts.
+	if importKnown {
+		if err := runImportKnownHosts(os.Stdout, args); err != nil {
+			printError(err)
+			return ExitErr
+		}
 		return
 	}
 
 	// only print tasks list
 	if tasksFlag {
-		tb := helper.NewPlainTable(os.Stdout)
-		if !quietFlag {
-			tb.SetHeader([]string{"NAME", "DESCRIPTION", "HIDDEN"})
+		stop := startPager()
+		defer stop()
+
+		listing := &Listing{Header: []string{"NAME", "DESCRIPTION", "HIDDEN"}}
+		if quietFlag {
+			listing.Header = []string{"NAME"}
 		}
+
+		records := []interface{}{}
 		for _, t := range NewTaskQuery().GetTasksOrderByName() {
 			hidden := t.Hidden
 			if (!hidden && !t.Disabled) || allFlag {
 				if quietFlag {
-					tb.Append([]string{t.PublicName()})
+					listing.Append([]string{t.PublicName()})
+					records = append(records, t.PublicName())
 				} else {
-					tb.Append([]string{t.PublicName(), t.Description, fmt.Sprintf("%v", t.Hidden)})
+					listing.Append([]string{t.PublicName(), t.Description, fmt.Sprintf("%v", t.Hidden)})
+					records = append(records, taskRecord(t))
+				}
+			}
+		}
+		listing.Data = records
+
+		if err := listing.Write(os.Stdout, formatVar, quietFlag); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// only print tasks graph
+	if graphFlag {
+		tasks := []*Task{}
+		if len(args) > 0 {
+			for _, name := range args {
+				task := GetEnabledTask(name)
+				if task == nil {
+					printError(fmt.Errorf("task '%s' is not defined.", name))
+					return ExitErr
+				}
+				tasks = append(tasks, task)
+			}
+		} else {
+			for _, t := range NewTaskQuery().GetTasksOrderByName() {
+				if (!t.Hidden && !t.Disabled) || allFlag {
+					tasks = append(tasks, t)
 				}
 			}
 		}
-		tb.Render()
 
+		if err := WriteTaskGraph(os.Stdout, tasks); err != nil {
+			printError(err)
+			return ExitErr
+		}
 		return
 	}
 
@@ -749,26 +1730,243 @@ func Run(osArgs []string) (exitStatus int) {
 		return ExitErr
 	}
 
+	// --output overrides the file of the generated ssh_config even if the config files change it.
+	if genSSHOutput := genSSHOutputFile(); genSSHOutput != "" {
+		outputConfig = genSSHOutput
+	}
+
 	// generate ssh hosts config
-	content, err := UpdateSSHConfig(outputConfig, NewHostQuery().GetHostsOrderByName())
+	genStart := time.Now()
+	hosts := NewHostQuery().GetHostsOrderByName()
+	if isSSHMode(args) && outputConfig == temporarySSHConfigFile {
+		// ssh connects to only one host, so it doesn't need the config of all the hosts.
+		// the config that the user specifies may be used by other tools, so it is always fully generated.
+		hosts = sshConfigHosts(L, args, hosts)
+		if debugFlag {
+			debugf("generate config only for %d hosts\n", len(hosts))
+		}
+	}
+
+	content, err := UpdateSSHConfig(outputConfig, hosts)
 	if err != nil {
 		printError(err)
 		return ExitErr
 	}
 
+	// save the config of all the hosts to connect without evaluating the config files next time, if it is enabled by essh.config_cache.
+	// the hosts of the providers may be changed without changing the config files, so they aren't cached.
+	// the lifecycle hooks need the evaluated config, so the config that has them isn't cached either.
+	if configCache != nil && !configCacheHit && outputConfig == temporarySSHConfigFile && len(HostProviders) == 0 && !hasLifecycleHooks(lessh) {
+		if v, ok := lessh.RawGetString("config_cache").(lua.LBool); ok && bool(v) {
+			full := content
+			if len(hosts) != len(Hosts) {
+				// materialize all the hosts that aren't needed to connect. (no args)
+				if err = materializeHosts(L, nil); err == nil {
+					full, err = GenHostsConfig(NewHostQuery().GetHostsOrderByName())
+				}
+			}
+			if err == nil {
+				err = configCache.Set(newConfigCacheEntry(full, outputConfig))
+			}
+			if err != nil && debugFlag {
+				debugf("failed to save config cache: %v\n", err)
+			}
+		}
+	}
+	debugPhase("generation", genStart)
+	profile.Add(PROFILE_GENERATION, "", genStart)
+
 	// only print generated config
 	if printFlag {
+		stop := startPager()
+		defer stop()
+
 		fmt.Println(string(content))
 		return
 	}
 
-	// only generating contents
-	if genFlag {
-		return
+	// only generating contents
+	if genFlag {
+		if genFormatVar != "" && genFormatVar != GenFormatSSH {
+			if err := genHostsToFile(expandHomeDir(genOutputVar), genFormatVar, NewHostQuery().GetHostsOrderByName()); err != nil {
+				printError(err)
+				return ExitErr
+			}
+		}
+		return
+	}
+
+	// only test the execution plans of the tasks
+	if testFlag {
+		planFlag = true
+		passed, err := runTaskTests(os.Stdout, outputConfig, args, updateFlag, L)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		if !passed {
+			return ExitErr
+		}
+		return
+	}
+
+	execStart := time.Now()
+	defer debugPhase("execution", execStart)
+	defer profile.Add(PROFILE_EXECUTION, "", execStart)
+
+	// run the global lifecycle hooks once per invocation.
+	if run := newRunInfo(args); run != nil && !previewFlag && !planFlag {
+		if err := runLifecycleHook(L, lessh, "on_before_run", run); err != nil {
+			printError(err)
+			return exitStatusOf(err)
+		}
+		defer func() {
+			run.ExitStatus = exitStatus
+			run.Finished = true
+			if err := runLifecycleHook(L, lessh, "on_after_run", run); err != nil {
+				printError(err)
+			}
+		}()
+	}
+
+	// run scp or rsync with the generated ssh config.
+	if scpFlag || rsyncFlag {
+		name := "scp"
+		if rsyncFlag {
+			name = "rsync"
+		}
+
+		if resumeFlag && name == "scp" {
+			printError("--resume can't be used with --scp option. scp doesn't support resuming transfers. use --rsync instead.")
+			return ExitErr
+		}
+
+		transferArgs := removeSeparator(args, separatorIndex)
+		if previewFlag {
+			if err := previewTransfer(os.Stdout, name, outputConfig, transferArgs); err != nil {
+				printError(err)
+				return ExitErr
+			}
+			return
+		}
+
+		err, ex := runTransfer(L, name, outputConfig, transferArgs)
+		if err != nil {
+			printError(err)
+		}
+		return ex
+	}
+
+	// open a socks proxy through the host.
+	if socksVar != "" {
+		port := DefaultSocksPort
+		if len(args) > 0 {
+			p, err := strconv.Atoi(args[0])
+			if err != nil {
+				printError(fmt.Errorf("invalid port '%s'.", args[0]))
+				return ExitErr
+			}
+			port = p
+		}
+
+		if err := runSocks(outputConfig, socksVar, port); err != nil {
+			printError(err)
+			return ExitErr
+		}
+		return
+	}
+
+	// check the connectivity of the hosts.
+	if pingFlag {
+		hosts, err := argsOrSelectedHosts(args)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		ok, err := runPing(outputConfig, hosts, formatVar)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		if !ok {
+			return ExitConnectionErr
+		}
+		return
+	}
+
+	// connect to the hosts at once and broadcast the input.
+	if consoleFlag {
+		// it doesn't connect to all the hosts by mistake.
+		if len(args) == 0 && len(selectVar) == 0 {
+			printError("--console requires the hosts or --select option.")
+			return ExitErr
+		}
+
+		hosts, err := argsOrSelectedHosts(args)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		if err := runConsole(L, outputConfig, hosts, os.Stdin); err != nil {
+			printError(err)
+			return exitStatusOf(err)
+		}
+		return
+	}
+
+	// measure the connection and command latencies of the hosts.
+	if benchFlag {
+		hosts, err := argsOrSelectedHosts(args)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		if err := runBench(outputConfig, hosts, benchCountVar, formatVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+		return
+	}
+
+	// connect to a host that is randomly selected.
+	if oneFlag {
+		if len(selectVar) == 0 {
+			printError("--one must be used with --select option.")
+			return ExitErr
+		}
+
+		query := NewHostQuery().
+			AppendSelections(selectVar).
+			AppendFilters(filterVar).
+			AppendExcludes(excludeVar).
+			isVisible()
+		hosts := query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			printError(err)
+			return ExitErr
+		}
+		hosts = excludeExpiredHosts(hosts)
+		if len(hosts) == 0 {
+			printError("There are not hosts to connect. you must specify the valid hosts.")
+			return ExitErr
+		}
+
+		host := hosts[rand.New(rand.NewSource(time.Now().UnixNano())).Intn(len(hosts))]
+		printProgress(VERBOSITY_NORMAL, "connecting to '%s'", host.Name)
+
+		args = append([]string{host.Name}, args...)
+		if separatorIndex >= 0 {
+			separatorIndex++
+		}
 	}
 
 	// select running mode and run it.
 	if execFlag {
+		// the separator is only used to stop parsing options. it is not a part of the command.
+		args = removeSeparator(args, separatorIndex)
 		if len(args) == 0 {
 			printError("exec mode requires 1 parameter at latest.")
 			return ExitErr
@@ -780,7 +1978,11 @@ func Run(osArgs []string) (exitStatus int) {
 		task := NewTask()
 		task.Name = "--exec"
 		task.Pty = ptyFlag
+		task.ForwardAgent = fwdAgentFlag
+		task.Trace = traceFlag
 		task.Parallel = parallelFlag
+		task.SerializeAuth = serialAuthFlag
+		task.MultiplexJump = muxJumpFlag
 		task.Privileged = privilegedFlag
 		task.User = userVar
 		task.Driver = driverVar
@@ -800,8 +2002,23 @@ func Run(osArgs []string) (exitStatus int) {
 			return ExitErr
 		}
 
+		if len(targetVar) == 0 && len(excludeVar) > 0 {
+			printError("--exclude must be used with --target option.")
+			return ExitErr
+		}
+
 		task.Targets = targetVar
 		task.Filters = filterVar
+		task.Excludes = excludeVar
+		task.Limit = limitVar
+		task.WorkDir = chdirVar
+
+		filters, err := compileOutputFilters(outFilterVar)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		task.OutputFilters = filters
 
 		if prefixFlag || prefixStringVar != "" {
 			task.UsePrefix = true
@@ -811,10 +2028,10 @@ func Run(osArgs []string) (exitStatus int) {
 			task.Prefix = prefixStringVar
 		}
 
-		err := runTask(outputConfig, task, []string{}, L)
+		err = runTask(outputConfig, task, []string{}, L)
 		if err != nil {
 			printError(err)
-			return ExitErr
+			return exitStatusOf(err)
 		}
 
 		return
@@ -826,7 +2043,8 @@ func Run(osArgs []string) (exitStatus int) {
 			if task != nil {
 				var taskargs []string
 				if len(args) >= 2 {
-					taskargs = args[1:]
+					// `essh task -- --foo bar` passes the args that look like essh options to the task.
+					taskargs = removeSeparator(args, separatorIndex)[1:]
 				} else {
 					taskargs = []string{}
 				}
@@ -834,7 +2052,7 @@ func Run(osArgs []string) (exitStatus int) {
 				err := runTask(outputConfig, task, taskargs, L)
 				if err != nil {
 					printError(err)
-					return ExitErr
+					return exitStatusOf(err)
 				}
 				return
 			}
@@ -859,9 +2077,43 @@ func Run(osArgs []string) (exitStatus int) {
 	return
 }
 
+// isSSHMode reports whether essh runs ssh command with the args, not other modes or a task.
+func isSSHMode(args []string) bool {
+	return isSSHModeFlags() && len(args) > 0 && GetEnabledTask(args[0]) == nil
+}
+
+// sshModeOptions are the options that don't change running ssh command.
+// The other options select other modes like --hosts, or are used only in them.
+var sshModeOptions = map[string]bool{
+	"--color":       true,
+	"--no-color":    true,
+	"--debug":       true,
+	"--debug-file":  true,
+	"--profile":     true,
+	"--no-cache":    true,
+	"--no-pager":    true,
+	"--no-hooks":    true,
+	"--private-tmp": true,
+	"--global":      true,
+	"--working-dir": true,
+	"--config":      true,
+	"--verbose":     true,
+	"--recent":      true,
+}
+
+// isSSHModeFlags reports whether all the options can be used with running ssh command.
+func isSSHModeFlags() bool {
+	for _, option := range usedOptions {
+		if !sshModeOptions[option] {
+			return false
+		}
+	}
+	return true
+}
+
 func UpdateSSHConfig(outputConfig string, enabledHosts []*Host) ([]byte, error) {
 	if debugFlag {
-		fmt.Printf("[essh debug] output ssh_config contents to the file: %s \n", outputConfig)
+		debugf("output ssh_config contents to the file: %s \n", outputConfig)
 	}
 
 	// generate ssh hosts config
@@ -870,19 +2122,29 @@ func UpdateSSHConfig(outputConfig string, enabledHosts []*Host) ([]byte, error)
 		return nil, err
 	}
 
-	// update temporary ssh config file
-	err = ioutil.WriteFile(outputConfig, content, 0644)
+	// update temporary ssh config file.
+	// it is only readable by the user, because it reveals the hosts and the user names.
+	err = ioutil.WriteFile(outputConfig, content, 0600)
 	if err != nil {
 		return nil, err
 	}
 
+	// update known_hosts files of the hosts that pin their host keys
+	if err := writeKnownHosts(enabledHosts); err != nil {
+		return nil, err
+	}
+
 	return content, nil
 }
 
 func runTask(config string, task *Task, args []string, L *lua.LState) error {
 	if debugFlag {
-		fmt.Printf("[essh debug] run task: %s\n", task.Name)
-		fmt.Printf("[essh debug] task's args: %v\n", args)
+		debugf("run task: %s\n", task.Name)
+		debugf("task's args: %v\n", args)
+	}
+
+	if !planFlag {
+		recordTaskUsage(task.PublicName())
 	}
 
 	if task.Registry != nil {
@@ -897,9 +2159,17 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 	}
 	updateTask(L, task, "args", argstb)
 
-	if task.Prepare != nil {
+	lock, err := acquireTaskLock(task)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	// --plan doesn't run the prepare function that may have side effects like deploying an artifact.
+	// the plan says that it is skipped.
+	if task.Prepare != nil && !planFlag {
 		if debugFlag {
-			fmt.Printf("[essh debug] run task's prepare function.\n")
+			debugf("run task's prepare function.\n")
 		}
 
 		err := task.Prepare()
@@ -908,6 +2178,39 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 		}
 	}
 
+	// register the task's private hosts after the prepare function that may create them.
+	privateHosts, err := registerTaskHosts(task)
+	if err != nil {
+		return err
+	}
+	if len(privateHosts) > 0 {
+		defer unregisterTaskHosts(privateHosts)
+
+		if debugFlag {
+			debugf("register %d private hosts of the task.\n", len(privateHosts))
+		}
+
+		if _, err := UpdateSSHConfig(config, NewHostQuery().GetHostsOrderByName()); err != nil {
+			return err
+		}
+	}
+
+	if task.TargetsFunc != nil {
+		if debugFlag {
+			debugf("run task's targets function.\n")
+		}
+
+		targets, err := task.TargetsFunc()
+		if err != nil {
+			return err
+		}
+		task.Targets = targets
+
+		if debugFlag {
+			debugf("task's targets: %v\n", targets)
+		}
+	}
+
 	// get target hosts.
 	if task.IsRemoteTask() {
 		// run remotely.
@@ -915,16 +2218,88 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 		if len(task.TargetsSlice()) == 0 {
 			hosts = []*Host{}
 		} else {
-			hosts = NewHostQuery().
+			query := NewHostQuery().
 				AppendSelections(task.TargetsSlice()).
 				AppendFilters(task.FiltersSlice()).
-				GetHostsOrderByName()
+				AppendExcludes(task.Excludes).
+				skipExpired().
+				SetLimit(task.Limit)
+			hosts = query.GetHostsOrderByName()
+			if err := query.Err(); err != nil {
+				return err
+			}
 		}
 
 		if len(hosts) == 0 {
 			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
 		}
 
+		printTargetHosts(task, hosts)
+
+		if planFlag {
+			return planTask(config, task, hosts)
+		}
+
+		if err := lock.acquireHosts(hosts); err != nil {
+			return err
+		}
+		defer printSharedValues()
+		defer printHostStates(hosts)
+
+		if err := evaluatePayloads(task, hosts); err != nil {
+			return err
+		}
+
+		if err := loadHostEnvFiles(hosts); err != nil {
+			return err
+		}
+
+		if err := runTaskHookScript(config, task, "before_all", task.BeforeAll, hosts); err != nil {
+			return err
+		}
+
+		if err := prepareConnection(config, hosts); err != nil {
+			return err
+		}
+
+		// share a master connection to the jump host to avoid connecting to it for each host.
+		if task.MultiplexJump {
+			if jump := commonJumpHost(hosts); jump != nil {
+				masters, err := multiplexJumpHost(config, jump)
+				if err != nil {
+					return err
+				}
+				defer masters.Close()
+			} else if debugFlag {
+				debugf("target hosts don't have a common jump host that is defined in essh.\n")
+			}
+		}
+
+		// authenticate to the hosts one by one to prevent prompts of the parallel ssh processes from being mixed.
+		if task.Parallel && task.SerializeAuth {
+			masters, err := openControlMasters(config, task, hosts)
+			if err != nil {
+				return err
+			}
+			defer masters.Close()
+
+			task.SSHOptions = append(task.SSHOptions, masters.SSHOptions()...)
+		}
+
+		// the hooks implemented in Lua can't run in the parallel goroutines,
+		// so the after_connect hooks are evaluated here and run at the beginning of the remote scripts.
+		afterConnectScripts := map[string]string{}
+		for _, host := range hosts {
+			if hooksDisabled() {
+				break
+			}
+			hookScript, err := getHookScript(L, host, host.HooksAfterConnect)
+			if err != nil {
+				return &ConfigError{Err: fmt.Errorf("after_connect hook of '%s' failed: %v", host.Name, err)}
+			}
+			afterConnectScripts[host.Name] = hookScript
+		}
+
 		// see https://github.com/kohkimakimoto/essh/issues/38
 		//// handle stdin
 		stdinChs := make([]chan ([]byte), len(hosts))
@@ -935,93 +2310,325 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 			processStdin(stdinChs)
 		}()
 
+		if task.Parallel {
+			// run the local hooks of all the hosts before running the scripts in parallel.
+			for _, host := range hosts {
+				if err := runHostHooks(L, host, "before_connect", host.HooksBeforeConnect); err != nil {
+					return err
+				}
+			}
+		}
+
+		if task.Parallel {
+			task.barrier = newStepBarrier(len(hosts))
+		}
+
 		wg := &sync.WaitGroup{}
 		m := new(sync.Mutex)
+		errs := make([]error, len(hosts))
 		for i, host := range hosts {
 			if task.Parallel {
 				wg.Add(1)
-				go func(host *Host) {
-					err := runRemoteTaskScript(config, task, host, hosts, stdinChs[i], m)
+				go func(i int, host *Host) {
+					defer wg.Done()
+					errs[i] = runHostScript(config, task, host, hosts, afterConnectScripts[host.Name], stdinChs[i], m)
+				}(i, host)
+			} else {
+				if err := runHostHooks(L, host, "before_connect", host.HooksBeforeConnect); err != nil {
+					return err
+				}
+
+				err := runHostScript(config, task, host, hosts, afterConnectScripts[host.Name], stdinChs[i], m)
+
+				if hookErr := runHostHooks(L, host, "after_disconnect", host.HooksAfterDisconnect); hookErr != nil {
 					if err != nil {
-						fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
-						panic(err)
+						printError(hookErr)
+					} else {
+						err = hookErr
 					}
+				}
 
-					wg.Done()
-				}(host)
-			} else {
-				err := runRemoteTaskScript(config, task, host, hosts, stdinChs[i], m)
 				if err != nil {
-					return err
+					// the rest of the hosts don't run.
+					errs[i] = err
+					return taskHostsError(task, hosts[:i+1], errs[:i+1])
+				}
+
+				// don't go to the next host until the host becomes healthy.
+				if task.HealthCheck != nil {
+					if err := runHealthCheck(config, task, host); err != nil {
+						return err
+					}
 				}
 			}
 		}
 		wg.Wait()
+
+		if task.Parallel {
+			// the hooks run after all the scripts finish, even if some of them failed.
+			// an error of a hook fails the host like the sequential run does.
+			for i, host := range hosts {
+				if hookErr := runHostHooks(L, host, "after_disconnect", host.HooksAfterDisconnect); hookErr != nil {
+					if errs[i] != nil {
+						printError(hookErr)
+					} else {
+						errs[i] = hookErr
+					}
+				}
+			}
+		}
+
+		if err := taskHostsError(task, hosts, errs); err != nil {
+			return err
+		}
+
+		if err := runTaskHookScript(config, task, "after_all", task.AfterAll, hosts); err != nil {
+			return err
+		}
 	} else {
 		// run locally.
 		var hosts []*Host
 		if len(task.TargetsSlice()) == 0 {
 			hosts = []*Host{}
 		} else {
-			hosts = NewHostQuery().
+			query := NewHostQuery().
 				AppendSelections(task.TargetsSlice()).
 				AppendFilters(task.FiltersSlice()).
-				GetHostsOrderByName()
+				AppendExcludes(task.Excludes).
+				skipExpired().
+				SetLimit(task.Limit)
+			hosts = query.GetHostsOrderByName()
+			if err := query.Err(); err != nil {
+				return err
+			}
 		}
 
 		if len(task.Targets) >= 1 && len(hosts) == 0 {
 			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
 		}
 
+		printTargetHosts(task, hosts)
+
+		if planFlag {
+			return planTask(config, task, hosts)
+		}
+
+		if err := lock.acquireHosts(hosts); err != nil {
+			return err
+		}
+		defer printSharedValues()
+		defer printHostStates(hosts)
+
+		if err := evaluatePayloads(task, hosts); err != nil {
+			return err
+		}
+
+		if err := loadHostEnvFiles(hosts); err != nil {
+			return err
+		}
+
+		if err := runTaskHookScript(config, task, "before_all", task.BeforeAll, hosts); err != nil {
+			return err
+		}
+
 		wg := &sync.WaitGroup{}
 		m := new(sync.Mutex)
 
-		if len(hosts) == 0 {
-			// local no host task
-			// This pattern should run just exec. should not use magic to pipe stdin to multi targets.
-			err := runLocalTaskScript(config, task, nil, hosts, nil, m)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
+		if len(hosts) == 0 {
+			// local no host task
+			// This pattern should run just exec. should not use magic to pipe stdin to multi targets.
+			err := runHostScript(config, task, nil, hosts, "", nil, m)
+			if err != nil {
+				return err
+			}
+			return runTaskHookScript(config, task, "after_all", task.AfterAll, hosts)
+		}
+
+		// see https://github.com/kohkimakimoto/essh/issues/38
+		// handle stdin
+		stdinChs := make([]chan ([]byte), len(hosts))
+		for i, _ := range hosts {
+			stdinChs[i] = make(chan []byte, 256)
+		}
+		go func() {
+			processStdin(stdinChs)
+		}()
+
+		if task.Parallel {
+			task.barrier = newStepBarrier(len(hosts))
+		}
+
+		errs := make([]error, len(hosts))
+		for i, host := range hosts {
+			if task.Parallel {
+				wg.Add(1)
+				go func(i int, host *Host) {
+					defer wg.Done()
+					errs[i] = runHostScript(config, task, host, hosts, "", stdinChs[i], m)
+				}(i, host)
+			} else {
+				err := runHostScript(config, task, host, hosts, "", stdinChs[i], m)
+				if err != nil {
+					// the rest of the hosts don't run.
+					errs[i] = err
+					return taskHostsError(task, hosts[:i+1], errs[:i+1])
+				}
+			}
+		}
+		wg.Wait()
+
+		if err := taskHostsError(task, hosts, errs); err != nil {
+			return err
+		}
+
+		if err := runTaskHookScript(config, task, "after_all", task.AfterAll, hosts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planTask prints the execution plan of the task instead of running it.
+func planTask(config string, task *Task, hosts []*Host) error {
+	if err := evaluatePayloads(task, hosts); err != nil {
+		return err
+	}
+
+	if err := loadHostEnvFiles(hosts); err != nil {
+		return err
+	}
+
+	// the plan has the rendered scripts that may include the secrets.
+	if planOutput != nil {
+		return writeTaskPlan(newRedactWriter(planOutput), config, task, hosts)
+	}
+
+	stop := startPager()
+	defer stop()
+
+	return writeTaskPlan(newRedactWriter(os.Stdout), config, task, hosts)
+}
+
+// evaluatePayloads evaluates the task's payload_for function for each host before running scripts.
+// It must run sequentially because the lua state is not goroutine safe.
+func evaluatePayloads(task *Task, hosts []*Host) error {
+	if task.PayloadFor == nil {
+		return nil
+	}
+
+	for _, host := range hosts {
+		payload, err := task.PayloadFor(host)
+		if err != nil {
+			return err
+		}
+		task.HostPayloads[host.Name] = payload
+	}
+
+	return nil
+}
+
+// writeCompletionList writes hosts, tasks or tags for the completion code.
+func writeCompletionList(w io.Writer) {
+	if zshCompletionHostsFlag {
+		for _, host := range NewHostQuery().GetHostsOrderByName() {
+			if !host.Hidden || allFlag {
+				fmt.Fprintf(w, "%s\t%s\n", ColonEscape(host.Name), ColonEscape(host.DescriptionOrDefault()))
+			}
+		}
+		return
+	}
+
+	if bashCompletionHostsFlag {
+		for _, host := range NewHostQuery().GetHostsOrderByName() {
+			if !host.Hidden || allFlag {
+				fmt.Fprintf(w, "%s\n", ColonEscape(host.Name))
+			}
+		}
+		return
+	}
+
+	// show tasks for zsh completion
+	if zshCompletionTasksFlag {
+		for _, t := range NewTaskQuery().GetTasksOrderByName() {
+			hidden := t.Hidden
+			if !t.Disabled && (!hidden || allFlag) {
+				fmt.Fprintf(w, "%s\t%s\n", ColonEscape(t.PublicName()), ColonEscape(t.DescriptionOrDefault()))
+			}
+		}
+		return
+	}
+
+	if bashCompletionTasksFlag {
+		for _, t := range NewTaskQuery().GetTasksOrderByName() {
+			hidden := t.Hidden
+			if !t.Disabled && (!hidden || allFlag) {
+				fmt.Fprintf(w, "%s\n", ColonEscape(t.PublicName()))
+			}
+		}
+		return
+	}
+
+	if zshCompletionTagsFlag || bashCompletionTagsFlag {
+		for _, tag := range GetTags(Hosts) {
+			fmt.Fprintf(w, "%s\n", ColonEscape(tag))
+		}
+		for _, name := range GetGroupNames() {
+			fmt.Fprintf(w, "%s\n", ColonEscape(name))
+		}
+	}
+}
+
+// completionListKind returns a kind of the list that is requested by the completion code (or --prompt-info that is cached in the same way).
+// It returns an empty string if no list is requested.
+func completionListKind() string {
+	switch {
+	case promptInfo:
+		return "prompt-info:" + formatVar
+	case zshCompletionHostsFlag:
+		return "zsh-hosts"
+	case bashCompletionHostsFlag:
+		return "bash-hosts"
+	case zshCompletionTasksFlag:
+		return "zsh-tasks"
+	case bashCompletionTasksFlag:
+		return "bash-tasks"
+	case zshCompletionTagsFlag, bashCompletionTagsFlag:
+		return "tags"
+	}
+
+	return ""
+}
+
+// removeSeparator removes the end-of-options separator `--` at the index from args.
+func removeSeparator(args []string, index int) []string {
+	if index < 0 || index >= len(args) {
+		return args
+	}
+
+	ret := append([]string{}, args[:index]...)
+	return append(ret, args[index+1:]...)
+}
 
-		// see https://github.com/kohkimakimoto/essh/issues/38
-		// handle stdin
-		stdinChs := make([]chan ([]byte), len(hosts))
-		for i, _ := range hosts {
-			stdinChs[i] = make(chan []byte, 256)
-		}
-		go func() {
-			processStdin(stdinChs)
-		}()
+func parseLimit(s string) (int, error) {
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("--limit requires a non-negative number but got '%s'.", s)
+	}
 
-		for i, host := range hosts {
-			if task.Parallel {
-				wg.Add(1)
-				go func(host *Host) {
-					err := runLocalTaskScript(config, task, host, hosts, stdinChs[i], m)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
-						panic(err)
-					}
+	return limit, nil
+}
 
-					wg.Done()
-				}(host)
-			} else {
-				err := runLocalTaskScript(config, task, host, hosts, stdinChs[i], m)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		wg.Wait()
+func parseBenchCount(s string) (int, error) {
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("--bench-count requires a positive number but got '%s'.", s)
 	}
 
-	return nil
+	return count, nil
 }
 
-func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, afterConnectScript string, stdinCh chan []byte, m *sync.Mutex) error {
 	// setup ssh command args
 	var sshCommandArgs []string
 	if task.Pty {
@@ -1030,6 +2637,14 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 		sshCommandArgs = []string{"-F", sshConfigPath, host.Name}
 	}
 
+	if task.ForwardAgent {
+		sshCommandArgs = append([]string{"-A"}, sshCommandArgs...)
+	}
+
+	for _, forward := range task.RemoteForwards {
+		sshCommandArgs = append([]string{"-R", forward}, sshCommandArgs...)
+	}
+
 	// generate commands by using driver
 	if task.Driver == "" {
 		task.Driver = DefaultDriverName
@@ -1037,27 +2652,31 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 
 	driver := Drivers[task.Driver]
 	if driver == nil {
-		return fmt.Errorf("invalid driver name '%s'", task.Driver)
+		return &ConfigError{Err: fmt.Errorf("invalid driver name '%s'", task.Driver)}
 	}
 
 	if debugFlag {
-		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
+		debugf("driver: %s \n", driver.Name)
 	}
 
 	var script string
-	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
+	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host, hosts)
 	if err != nil {
 		return err
 	}
 	script += content
 
+	shell := remoteShell(task, host)
 	if task.User != "" {
-		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
+		script = "sudo -u " + ShellEscape(task.User) + " " + shell + " -l -c " + ShellEscape(script)
 	} else if task.Privileged {
-		script = "sudo bash -l -c " + ShellEscape(script)
+		script = "sudo " + shell + " -l -c " + ShellEscape(script)
 	}
 
-	sshCommandArgs = append(sshCommandArgs, "bash", "-c", ShellEscape(script))
+	// the host's after_connect hooks run as the login user before the script.
+	script = afterConnectScript + script
+
+	sshCommandArgs = append(sshCommandArgs, remoteScriptCommand(task, host, script)...)
 
 	if task.SSHOptions != nil {
 		sshCommandArgs = append(task.SSHOptions, sshCommandArgs[:]...)
@@ -1065,8 +2684,9 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 
 	cmd := exec.Command("ssh", sshCommandArgs[:]...)
 	if debugFlag {
-		fmt.Printf("[essh debug] real ssh command: %v \n", cmd.Args)
+		debugf("real ssh command: %v \n", cmd.Args)
 	}
+	printCommand(cmd)
 
 	prefix := ""
 	if task.UsePrefix {
@@ -1106,20 +2726,14 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 
 	// cmd.Stdin = os.Stdin
 
-	// see https://github.com/kohkimakimoto/essh/issues/38
-	if stdinCh == nil {
-		cmd.Stdin = os.Stdin
-	} else {
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return err
-		}
-		go handleInput(stdinCh, stdin)
+	if err := setTaskStdin(cmd, stdinCh, envFileInput(host)); err != nil {
+		return err
 	}
 
+	filters := outputFilters(task, host)
 	wg := &sync.WaitGroup{}
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stdout = os.Stdout
+	if len(hosts) <= 1 && prefix == "" && len(filters) == 0 && !hasSecrets() {
+		cmd.Stdout = newStateWriter(taskStdout(task, os.Stdout), host)
 	} else {
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
@@ -1127,12 +2741,12 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 		}
 		wg.Add(1)
 		go func() {
-			scanLines(stdout, os.Stdout, prefix, m)
+			scanLines(taskStdoutReader(task, stdout), os.Stdout, prefix, newLineFilter(filters, task.Name, host, "stdout"), m)
 			wg.Done()
 		}()
 	}
 
-	if len(hosts) <= 1 && prefix == "" {
+	if len(hosts) <= 1 && prefix == "" && len(filters) == 0 && !hasSecrets() {
 		cmd.Stderr = os.Stderr
 	} else {
 		stderr, err := cmd.StderrPipe()
@@ -1141,7 +2755,7 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 		}
 		wg.Add(1)
 		go func() {
-			scanLines(stderr, os.Stderr, prefix, m)
+			scanLines(stderr, os.Stderr, prefix, newLineFilter(filters, task.Name, host, "stderr"), m)
 			wg.Done()
 		}()
 	}
@@ -1153,52 +2767,68 @@ func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*
 
 	wg.Wait()
 
-	return cmd.Wait()
+	err = cmd.Wait()
+	flushStateWriter(cmd.Stdout)
+
+	return err
 }
 
 func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
-	var shell, flag string
-	if runtime.GOOS == "windows" {
-		shell = "cmd"
-		flag = "/C"
-	} else {
-		shell = "bash"
-		flag = "-c"
+	dir, err := localWorkDir(task, host)
+	if err != nil {
+		return err
 	}
 
-	// generate commands by using driver
-	if task.Driver == "" {
-		task.Driver = DefaultDriverName
-	}
+	var cmd *exec.Cmd
+	// cmd and PowerShell get the variables of the env_file as the environment variables.
+	var input []byte
+	if shell := localShell(task); shell != LOCAL_SHELL_BASH {
+		// the drivers generate POSIX shell scripts, so cmd and PowerShell run the task's script as it is.
+		c, cleanup, err := newNativeLocalCommand(shell, sshConfigPath, task, host, hosts)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		cmd = c
+	} else {
+		// generate commands by using driver
+		if task.Driver == "" {
+			task.Driver = DefaultDriverName
+		}
 
-	driver := Drivers[task.Driver]
-	if driver == nil {
-		return fmt.Errorf("invalid driver name '%s'", task.Driver)
-	}
+		driver := Drivers[task.Driver]
+		if driver == nil {
+			return &ConfigError{Err: fmt.Errorf("invalid driver name '%s'", task.Driver)}
+		}
 
-	if debugFlag {
-		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
-	}
+		if debugFlag {
+			debugf("driver: %s \n", driver.Name)
+		}
 
-	var script string
-	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
-	if err != nil {
-		return err
-	}
-	script += content
+		var script string
+		content, err := driver.GenerateRunnableContent(sshConfigPath, task, host, hosts)
+		if err != nil {
+			return err
+		}
+		script += content
+
+		if task.User != "" {
+			script = "cd " + ShellEscape(dir) + "\n" + script
+			script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
+		} else if task.Privileged {
+			script = "cd " + ShellEscape(dir) + "\n" + script
+			script = "sudo bash -l -c " + ShellEscape(script)
+		}
 
-	if task.User != "" {
-		script = "cd " + WorkingDir + "\n" + script
-		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
-	} else if task.Privileged {
-		script = "cd " + WorkingDir + "\n" + script
-		script = "sudo bash -l -c " + ShellEscape(script)
+		cmd = exec.Command("bash", "-c", script)
+		input = envFileInput(host)
 	}
 
-	cmd := exec.Command(shell, flag, script)
+	cmd.Dir = dir
 	if debugFlag {
-		fmt.Printf("[essh debug] real local command: %v \n", cmd.Args)
+		debugf("real local command: %v \n", cmd.Args)
 	}
+	printCommand(cmd)
 
 	prefix := ""
 	if host == nil && task.UsePrefix {
@@ -1243,20 +2873,14 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 
 	// cmd.Stdin = os.Stdin
 
-	// see https://github.com/kohkimakimoto/essh/issues/38
-	if stdinCh == nil {
-		cmd.Stdin = os.Stdin
-	} else {
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return err
-		}
-		go handleInput(stdinCh, stdin)
+	if err := setTaskStdin(cmd, stdinCh, input); err != nil {
+		return err
 	}
 
+	filters := outputFilters(task, host)
 	wg := &sync.WaitGroup{}
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stdout = os.Stdout
+	if len(hosts) <= 1 && prefix == "" && len(filters) == 0 && !hasSecrets() {
+		cmd.Stdout = newStateWriter(taskStdout(task, os.Stdout), host)
 	} else {
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
@@ -1264,12 +2888,12 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		}
 		wg.Add(1)
 		go func() {
-			scanLines(stdout, os.Stdout, prefix, m)
+			scanLines(taskStdoutReader(task, stdout), os.Stdout, prefix, newLineFilter(filters, task.Name, host, "stdout"), m)
 			wg.Done()
 		}()
 	}
 
-	if len(hosts) <= 1 && prefix == "" {
+	if len(hosts) <= 1 && prefix == "" && len(filters) == 0 && !hasSecrets() {
 		cmd.Stderr = os.Stderr
 	} else {
 		stderr, err := cmd.StderrPipe()
@@ -1278,7 +2902,7 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		}
 		wg.Add(1)
 		go func() {
-			scanLines(stderr, os.Stderr, prefix, m)
+			scanLines(stderr, os.Stderr, prefix, newLineFilter(filters, task.Name, host, "stderr"), m)
 			wg.Done()
 		}()
 	}
@@ -1290,7 +2914,10 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 
 	wg.Wait()
 
-	return cmd.Wait()
+	err = cmd.Wait()
+	flushStateWriter(cmd.Stdout)
+
+	return err
 }
 
 // this code is borrowed from https://github.com/fujiwara/nssh/blob/master/nssh.go
@@ -1340,15 +2967,20 @@ func handleInput(stdinCh chan []byte, dest io.WriteCloser) {
 }
 
 // this code is borrowed from https://github.com/fujiwara/nssh/blob/master/nssh.go
-func scanLines(src io.ReadCloser, dest io.Writer, prefix string, m *sync.Mutex) {
+func scanLines(src io.ReadCloser, dest io.Writer, prefix string, filter *lineFilter, m *sync.Mutex) {
 	scanner := bufio.NewScanner(src)
 	for scanner.Scan() {
+		line, ok := filter.apply(scanner.Text())
+		if !ok {
+			continue
+		}
+
 		// prevent mixing data in a line.
 		m.Lock()
 		if prefix != "" {
-			fmt.Fprintf(dest, "%s%s\n", color.FgCB(prefix), scanner.Text())
+			fmt.Fprintf(dest, "%s%s\n", color.FgCB(prefix), redact(line))
 		} else {
-			fmt.Fprintf(dest, "%s\n", scanner.Text())
+			fmt.Fprintf(dest, "%s\n", redact(line))
 		}
 		m.Unlock()
 	}
@@ -1359,65 +2991,67 @@ func scanLines(src io.ReadCloser, dest io.Writer, prefix string, m *sync.Mutex)
 }
 
 func runSSH(L *lua.LState, config string, args []string) (error, int) {
-	// hooks
-	hooks := map[string][]interface{}{}
+	// use free local ports for the local forwardings that specify port 0.
+	args, ports, err := allocateForwardPorts(args)
+	if err != nil {
+		return err, ExitErr
+	}
+	exportForwardPorts(ports)
 
 	// Limitation!
 	// hooks fires only when the hostname is just specified.
-	if len(args) == 1 {
-		hostname := args[0]
-		if host := Hosts[hostname]; host != nil {
-			hooks["before_connect"] = host.HooksBeforeConnect
-			hooks["after_disconnect"] = host.HooksAfterDisconnect
-			hooks["after_connect"] = host.HooksAfterConnect
-		}
+	var host *Host
+	if len(args) == 1 && !hooksDisabled() {
+		host = Hosts[args[0]]
 	}
 
-	// run before_connect hook
-	if before := hooks["before_connect"]; before != nil && len(before) > 0 {
-		if debugFlag {
-			fmt.Printf("[essh debug] run before_connect hook\n")
-		}
-		hookScript, err := getHookScript(L, before)
-		if err != nil {
-			return err, ExitErr
-		}
-		if debugFlag {
-			fmt.Printf("[essh debug] before_connect hook script: %s\n", hookScript)
-		}
-		if err := runCommand(hookScript); err != nil {
-			return err, ExitErr
+	if host != nil {
+		if err := runHostHooks(L, host, "before_connect", host.HooksBeforeConnect); err != nil {
+			return err, exitStatusOf(err)
 		}
 	}
 
-	// register after_disconnect hook
-	defer func() {
-		// after hook
-		if after := hooks["after_disconnect"]; after != nil && len(after) > 0 {
-			if debugFlag {
-				fmt.Printf("[essh debug] run after_disconnect hook\n")
-			}
-			hookScript, err := getHookScript(L, after)
+	for _, h := range sshArgsHosts(args) {
+		recordHostUsage(h.Name)
+	}
+
+	err, ex := runSSHCommand(L, config, args, host)
+
+	if host != nil {
+		if hookErr := runHostHooks(L, host, "after_disconnect", host.HooksAfterDisconnect); hookErr != nil {
 			if err != nil {
-				panic(err)
-			}
-			if debugFlag {
-				fmt.Printf("[essh debug] after_disconnect hook script: %s\n", hookScript)
-			}
-			if err := runCommand(hookScript); err != nil {
-				panic(err)
+				printError(hookErr)
+			} else {
+				err, ex = hookErr, exitStatusOf(hookErr)
 			}
 		}
-	}()
+	}
+
+	return err, ex
+}
+
+// runSSHCommand runs ssh command. If the host is not nil, its after_connect hooks run on the remote before the login shell.
+func runSSHCommand(L *lua.LState, config string, args []string, host *Host) (error, int) {
+	hosts := sshArgsHosts(args)
+	for _, h := range hosts {
+		// the expired hosts are excluded from tasks, but it is possible to login to them with a warning.
+		if h.Expired() {
+			fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: '%s' expired on %s", h.Name, h.Expires.Format(HostExpiresFormat)))
+		}
+	}
+
+	if err := prepareConnection(config, hosts); err != nil {
+		return err, ExitErr
+	}
 
 	// setup ssh command args
 	var sshCommandArgs []string
 
 	// run after_connect hook
-	if afterConnect := hooks["after_connect"]; afterConnect != nil && len(afterConnect) > 0 {
-		hookScript, err := getHookScript(L, afterConnect)
+	if host != nil && len(host.HooksAfterConnect) > 0 {
+		hookScript, err := getHookScript(L, host, host.HooksAfterConnect)
 		if err != nil {
-			return err, ExitErr
+			return &ConfigError{Err: fmt.Errorf("after_connect hook of '%s' failed: %v", host.Name, err)}, ExitConfigErr
 		}
 
 		script := hookScript
@@ -1450,7 +3084,7 @@ func runSSH(L *lua.LState, config string, args []string) (error, int) {
 	cmd.Stderr = os.Stderr
 
 	if debugFlag {
-		fmt.Printf("[essh debug] real ssh command: %v \n", cmd.Args)
+		debugf("real ssh command: %v \n", cmd.Args)
 	}
 
 	err := cmd.Run()
@@ -1461,10 +3095,58 @@ func runSSH(L *lua.LState, config string, args []string) (error, int) {
 	return nil, ex
 }
 
-func getHookScript(L *lua.LState, hooks []interface{}) (string, error) {
+// hooksDisabled reports whether the hooks of the hosts are suppressed by --no-hooks or ESSH_NO_HOOKS.
+func hooksDisabled() bool {
+	return noHooksFlag || os.Getenv("ESSH_NO_HOOKS") != ""
+}
+
+// runHostHooks runs the host's local hooks like before_connect and after_disconnect.
+func runHostHooks(L *lua.LState, host *Host, name string, hooks []interface{}) error {
+	if len(hooks) == 0 || hooksDisabled() {
+		return nil
+	}
+
+	if debugFlag {
+		debugf("run %s hook of '%s'\n", name, host.Name)
+	}
+
+	// an error of the hook functions is a config error, and a failure of the hook script is a connection error.
+	hookScript, err := getHookScript(L, host, hooks)
+	configErr := err != nil
+	if err == nil {
+		if debugFlag {
+			debugf("%s hook script: %s\n", name, hookScript)
+		}
+		err = runCommand(hookScript)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	switch host.HookFailure(name) {
+	case HookFailureWarn:
+		fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: %s hook of '%s' failed: %v", name, host.Name, err))
+		return nil
+	case HookFailureIgnore:
+		if debugFlag {
+			debugf("ignore the failure of %s hook of '%s': %v\n", name, host.Name, err)
+		}
+		return nil
+	}
+
+	err = fmt.Errorf("%s hook of '%s' failed: %v", name, host.Name, err)
+	if configErr {
+		return &ConfigError{Err: err}
+	}
+	return &ConnectionError{Host: host.Name, Err: err}
+}
+
+// getHookScript converts the hooks into a shell script. The hook functions are called with the host object.
+func getHookScript(L *lua.LState, host *Host, hooks []interface{}) (string, error) {
 	hookScript := ""
 	for _, hook := range hooks {
-		code, err := convertHook(L, hook)
+		code, err := convertHook(L, host, hook)
 		if err != nil {
 			return "", err
 		}
@@ -1474,29 +3156,29 @@ func getHookScript(L *lua.LState, hooks []interface{}) (string, error) {
 	return hookScript, nil
 }
 
-func convertHook(L *lua.LState, hook interface{}) (string, error) {
+func convertHook(L *lua.LState, host *Host, hook interface{}) (string, error) {
 	if hookFn, ok := hook.(*lua.LFunction); ok {
+		// a Lua error in the hook is returned as an error instead of panicking.
 		err := L.CallByParam(lua.P{
 			Fn:      hookFn,
 			NRet:    1,
-			Protect: false,
-		})
-
-		ret := L.Get(-1) // returned value
-		L.Pop(1)
-
+			Protect: true,
+		}, newLHost(L, host))
 		if err != nil {
 			return "", err
 		}
 
+		ret := L.Get(-1) // returned value
+		L.Pop(1)
+
 		if ret == lua.LNil {
 			return "", nil
 		} else if retStr, ok := toString(ret); ok {
 			return retStr, nil
 		} else if retFn, ok := toLFunction(ret); ok {
-			return convertHook(L, retFn)
+			return convertHook(L, host, retFn)
 		} else {
-			return "", fmt.Errorf("hook function return value must be string or function.")
+			return "", fmt.Errorf("hook function must return a string, a function or nil, but returned %s.", ret.Type())
 		}
 	} else if hookStr, ok := hook.(string); ok {
 		return hookStr, nil
@@ -1505,7 +3187,18 @@ func convertHook(L *lua.LState, hook interface{}) (string, error) {
 	}
 }
 
-func runCommand(command string) error {
+// prepareConnection does the things that are needed before connecting to the hosts.
+// It verifies the pinned host keys and gets short-lived certificates.
+func prepareConnection(config string, hosts []*Host) error {
+	if err := verifyHostKeys(config, hosts); err != nil {
+		return err
+	}
+
+	return signCertificates(hosts)
+}
+
+// shellCommand creates a command that runs the command string by the shell.
+func shellCommand(command string) *exec.Cmd {
 	var shell, flag string
 	if runtime.GOOS == "windows" {
 		shell = "cmd"
@@ -1514,7 +3207,117 @@ func runCommand(command string) error {
 		shell = "bash"
 		flag = "-c"
 	}
-	cmd := exec.Command(shell, flag, command)
+	return exec.Command(shell, flag, command)
+}
+
+// shellCommandWaitDelay is the time to wait for the output of the command after it is killed by the context.
+const shellCommandWaitDelay = 1 * time.Second
+
+// runCommandContext runs the command and kills its process group when the context is done.
+// The commands that the shell starts (like a pipeline) may keep the output open after the shell is killed,
+// so the output is read through the pipes that are closed if it doesn't end soon after the shell exits.
+func runCommandContext(ctx context.Context, cmd *exec.Cmd) error {
+	readers := []*os.File{}
+	writers := []*os.File{}
+	outputs := []*cutoffWriter{}
+	closePipes := func() {
+		for _, f := range append(readers, writers...) {
+			f.Close()
+		}
+	}
+
+	copies := &sync.WaitGroup{}
+	for _, w := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		if *w == nil {
+			continue
+		}
+		if _, ok := (*w).(*os.File); ok {
+			continue
+		}
+
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			closePipes()
+			return err
+		}
+		readers = append(readers, pr)
+		writers = append(writers, pw)
+
+		out := &cutoffWriter{w: *w}
+		outputs = append(outputs, out)
+		*w = pw
+
+		copies.Add(1)
+		go func(pr *os.File) {
+			defer copies.Done()
+			io.Copy(out, pr)
+		}(pr)
+	}
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		closePipes()
+		return err
+	}
+	// the command has its own copies of the writers.
+	for _, pw := range writers {
+		pw.Close()
+	}
+	writers = nil
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+
+	copied := make(chan struct{})
+	go func() {
+		copies.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-time.After(shellCommandWaitDelay):
+		// the output that comes after this is dropped.
+		for _, out := range outputs {
+			out.cut()
+		}
+	}
+	closePipes()
+
+	return err
+}
+
+// cutoffWriter is a writer that drops the data after it is cut.
+type cutoffWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	cutoff bool
+}
+
+func (w *cutoffWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cutoff {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+func (w *cutoffWriter) cut() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cutoff = true
+}
+
+func runCommand(command string) error {
+	cmd := shellCommand(command)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
@@ -1529,6 +3332,18 @@ func validateResources(tasks map[string]*Task, hosts map[string]*Host) error {
 		if _, ok := hosts[taskName]; ok {
 			return fmt.Errorf("Task '%s' is duplicated with hostname.", taskName)
 		}
+
+		// the health check runs between the hosts in serial mode.
+		if task.HealthCheck != nil && task.Parallel {
+			return fmt.Errorf("Task '%s' can't use health_check in parallel mode.", taskName)
+		}
+		if task.HealthCheck != nil && task.Backend == TASK_BACKEND_LOCAL {
+			return fmt.Errorf("Task '%s' can't use health_check with local backend.", taskName)
+		}
+
+		if err := validateStepExpects(task); err != nil {
+			return err
+		}
 	}
 
 	tags := GetTags(hosts)
@@ -1538,6 +3353,23 @@ func validateResources(tasks map[string]*Task, hosts map[string]*Host) error {
 		}
 	}
 
+	for _, name := range GetGroupNames() {
+		if _, ok := hosts[name]; ok {
+			return fmt.Errorf("Group '%s' is duplicated with hostname.", name)
+		}
+	}
+
+	for _, name := range GetRoleNames() {
+		if _, ok := hosts[name]; ok {
+			return fmt.Errorf("Role '%s' is duplicated with hostname.", name)
+		}
+		for _, tag := range tags {
+			if tag == name {
+				return fmt.Errorf("Role '%s' is duplicated with tag.", name)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -1575,45 +3407,119 @@ version ` + Version + ` (` + CommitHash + `)
 Copyright (c) Kohki Makimoto <kohki.makimoto@gmail.com>
 The MIT License (MIT)
 
+Subcommands:
+  The following subcommands are aliases of the options. (e.g. 'essh hosts' is same as 'essh --hosts')
+  hosts                         Same as --hosts.
+  tags                          Same as --tags.
+  tasks, task list              Same as --tasks.
+  exec                          Same as --exec.
+  describe <host>               Same as --describe <host>.
+  graph                         Same as --graph.
+  task run <task>               Run a task. (Same as 'essh <task>')
+  version                       Same as --version.
+  help                          Same as --help.
+
 Options:
   (General Options)
   --print                       Print generated ssh config.
+  --diff-config <file>          Compare the hosts and the tasks with the other config file. It exits with 1 if there are differences.
   --gen                         Only generate ssh config.
+  --gen-format <format>         (Using with --gen option) Generate the config in the format (ssh|json|yaml). json and yaml are the resolved model of the hosts.
+  --output <file>               (Using with --gen option) Write the generated config to the file. json and yaml are written to stdout without it.
   --working-dir <dir>           Change working directory.
   --config <file>               Load per-project configuration from the file.
   --color                       Force ANSI output.
   --no-color                    Disable ANSI output.
-  --debug                       Output debug log.
+  --debug                       Output debug log to stderr.
+  --debug-file <file>           Output debug log to the file instead of stderr.
+  --profile                     Print the time spent in evaluating Lua, fetching providers, generating the config and executing on each host to stderr.
+  --verbose                     Print the progress of the tasks like the hosts, the steps and the elapsed time. Repeat it (--verbose --verbose) to also print the commands that essh runs.
+  --no-cache                    Don't use the cached ssh_config and completion lists. Evaluate the config files.
+  --no-pager                    Don't pipe the long outputs of --print, --hosts and --tasks into $PAGER.
+  --no-hooks                    Don't run the hooks of the hosts. (also ESSH_NO_HOOKS=1)
+  --private-tmp                 Create the temporary ssh_config in ~/.essh/tmp that only you can access. (also ESSH_PRIVATE_TMP=1)
+  --refresh-providers           Fetch the host providers and update their caches.
+  --refresh-daemon [<interval>] Refresh the host providers at the interval to keep their caches warm. (default: 1m)
+  --pprof-addr <addr>           (Using with --refresh-daemon option) Serve the pprof endpoints and the runtime metrics at the address like localhost:6060.
   --global                      Force using global config ($HOME/.ssh/config.lua)
 
   (Manage Hosts, Tags And Tasks)
   --hosts                       List hosts.
-  --select <tag|host>           (Using with --hosts option) Get only the hosts filtered with tags or hosts.
-  --filter <tag|host>           (Using with --hosts option) Filter selected hosts with tags or hosts.
+  --select <tag|group|host>     (Using with --hosts option) Get only the hosts filtered with tags, groups or hosts.
+  --filter <tag|group|host>     (Using with --hosts option) Filter selected hosts with tags, groups or hosts.
+  --exclude <tag|group|host>    (Using with --hosts option) Exclude hosts with tags, groups, hosts or glob patterns of host names.
+  --limit <N>                   (Using with --hosts option) Show only the first N hosts.
+  --columns <columns>           (Using with --hosts option) Comma separated columns to display. (ex: name,tags,HostName,User)
   --ssh-config                  (Using with --hosts option) Output selected hosts as ssh_config format.
   --tasks                       List tasks.
-  --all                         (Using with --hosts or --tasks option) Show all that includes hidden objects.
+  --graph [<task>...]           Output a graph of the tasks and their target hosts in Graphviz DOT format.
+  --all                         (Using with --hosts, --tasks or completion) Show all that includes hidden objects.
+  --describe <host>             Show details of the host.
+  --show-command <host>         Print a ssh command line that connects to the host without essh.
+  --export <host>               Print a self-contained ssh_config of the host and its jump hosts.
+  --grep <pattern>              Search the names, descriptions, tags, props and ssh_config values of the hosts by the regular expression.
+  --whois <address>             Show the hosts whose HostName is the IP address or hostname.
+  --resolve                     (Using with --whois option) Resolve the address and HostNames by DNS to find the hosts that have the same IP address.
+  --ping [<host>...]            Check the connectivity of the hosts. The results are shown in the 'status' column of --hosts.
+  --console [<host>...]         Connect to the hosts at once and send the input lines to all of them. Use --select, --filter and --exclude to specify the hosts.
+  --bench [<host>...]           Measure the connection and command latencies of the hosts.
+  --bench-count <N>             (Using with --bench option) The number of connections to each host. (default: 10)
+  --doctor                      Check the environment for common problems like missing commands, broken config files and insecure key files.
   --tags                        List tags.
-  --quiet                       (Using with --hosts, --tasks or --tags option) Show only names. 
+  --roles                       List roles and their current sets.
+  --frequent                    List the hosts and tasks you use most.
+  --recent                      Select a host or a task you used recently, and connect to it or run it.
+  --prompt-info                 Output a summary of the current project for shell prompts. (ex: project=true hosts=12 tasks=5 env=production)
+  --switch-role <role> <set>    Switch the current set of the role.
+  --import-known-hosts          Output host definitions of the hosts in known_hosts files (default: ~/.ssh/known_hosts) that aren't defined yet.
+  --quiet                       (Using with --hosts, --tasks or --tags option) Show only names. With a task or --exec option, don't print the prefixes and the progress messages.
+  --format <format>             (Using with --hosts, --tasks or --tags option) Output format. table|json|prettyjson|yaml|csv|tsv|prometheus-sd
+
+  (Connect)
+  --one                         Connect to a host that is randomly selected from the hosts specified by --select, --filter and --exclude.
+  --socks <host> [<port>]       Open a socks proxy (ssh -D) through the host. It reconnects when the connection is closed. (default port: 1080)
+  --socks-stop [<host>]         Stop the socks proxies that are opened by --socks.
 
   (Execute Commands)
   --exec                        Execute commands with the hosts.
-  --target <tag|host>           (Using with --exec option) Target hosts to run the commands.
-  --filter <tag|host>           (Using with --exec option) Filter target hosts with tags or hosts.
+  --target <tag|group|host>     (Using with --exec option) Target hosts to run the commands.
+  --filter <tag|group|host>     (Using with --exec option) Filter target hosts with tags, groups or hosts.
+  --exclude <tag|group|host>    (Using with --exec option) Exclude hosts with tags, groups, hosts or glob patterns of host names.
+  --limit <N>                   (Using with --exec option) Run the commands only on the first N hosts.
   --backend remote|local        (Using with --exec option) Run the commands on local or remote hosts.
   --prefix                      (Using with --exec option) Enable outputing prefix.
   --prefix-string <prefix>      (Using with --exec option) Custom string of the prefix.
+  --output-filter <pattern>     (Using with --exec option) Drop the output lines that match the regular expression like MOTD and banners.
+  --chdir <dir>                 (Using with --exec and --backend local option) Directory to run the commands for each host. (ex: envs/{{.Host.Name}})
   --privileged                  (Using with --exec option) Run by the privileged user.
   --user <user>                 (Using with --exec option) Run by the specific user.
   --parallel                    (Using with --exec option) Run in parallel.
-  --pty                         (Using with --exec option) Allocate pseudo-terminal. (add ssh option "-t -t" internally)
+  --serialize-auth              (Using with --exec and --parallel option) Authenticate to the hosts one by one before running in parallel.
+  --multiplex-jump              (Using with --exec option) Share a master connection to the common jump host (ProxyJump) of the target hosts.
+  --pty, --tty                  (Using with --exec option) Allocate pseudo-terminal. (add ssh option "-t -t" internally)
+  --forward-agent               (Using with --exec option) Enable agent forwarding. (add ssh option "-A" internally)
+  --trace                       (Using with --exec option) Print each command with its expanded arguments before running it. (set -x)
   --script-file                 (Using with --exec option) Load commands from a file.
   --driver                      (Using with --exec option) Specify a driver.
+  --force-unlock <task>...      Release the locks of the tasks that are held by other runs.
+
+  (Transfer Files)
+  --scp                         Run scp with the generated ssh config. (ex: essh --scp -- ./file web01:/tmp)
+  --rsync                       Run rsync with the generated ssh config. (ex: essh --rsync -- -av ./dir web01:/tmp)
+  --resume                      (Using with --rsync option) Keep partially transferred files to resume the transfer. (add rsync option "--partial")
+  --preview                     (Using with --scp or --rsync option) Print the command line and the referred hosts without executing.
+  --plan                        (Using with a task or --exec option) Print the target hosts, the execution order and the rendered scripts without running the task.
+  --test [<task>...]            Compare the execution plans of the tasks with the golden files in .essh/golden without connecting to any host.
+  --update                      (Using with --test option) Update the golden files with the current execution plans.
 
   (Completion)
-  --zsh-completion              Output zsh completion code.
+  --zsh-completion              Output zsh completion code. (It also completes remote paths for 'escp' alias and --scp)
   --bash-completion             Output bash completion code.
+  --powershell-completion       Output PowerShell completion code. It also defines escp and ersync functions.
+  --completion-cache-ttl <ttl>  Cache hosts, tasks and tags for completion during the ttl (like '60', '5m').
+                                It can also be set by ESSH_COMPLETION_CACHE_TTL environment variable.
   --aliases                     Output aliases code.
+  --host-aliases                (Using with --aliases option) Also output the functions to connect to the hosts that have alias field.
 
   (Help)
   --version                     Print version.
@@ -1631,7 +3537,8 @@ func sprintByTemplate(tmplContent string) (string, error) {
 	}
 
 	dict := map[string]interface{}{
-		"Executable": Executable,
+		"Executable":  Executable,
+		"HostAliases": hostAliases(),
 	}
 
 	var b bytes.Buffer
@@ -1643,8 +3550,38 @@ func sprintByTemplate(tmplContent string) (string, error) {
 	return b.String(), nil
 }
 
+// argsOrSelectedHosts returns the hosts that are specified by the args.
+// If the args are empty, it returns the hosts specified by --select, --filter and --exclude.
+func argsOrSelectedHosts(args []string) ([]*Host, error) {
+	var hosts []*Host
+	if len(args) > 0 {
+		for _, name := range args {
+			host := Hosts[name]
+			if host == nil {
+				return nil, fmt.Errorf("host '%s' is not defined.", name)
+			}
+			hosts = append(hosts, host)
+		}
+	} else {
+		query := NewHostQuery().AppendSelections(selectVar).AppendFilters(filterVar).AppendExcludes(excludeVar).SetLimit(limitVar)
+		if !allFlag {
+			query = query.isVisible()
+		}
+		hosts = query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("There are not hosts to check. you must specify the valid hosts.")
+	}
+
+	return hosts, nil
+}
+
 func printError(err interface{}) {
-	fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
+	fmt.Fprintf(os.Stderr, color.FgRB("essh error: %s\n", redact(fmt.Sprint(err))))
 }
 
 func init() {
@@ -1678,36 +3615,36 @@ _essh_hosts() {
     local -a __essh_hosts
     PRE_IFS=$IFS
     IFS=$'\n'
-    __essh_hosts=($({{.Executable}} --zsh-completion-hosts | awk -F'\t' '{print $1":"$2}'))
+    __essh_hosts=($({{.Executable}} $allOption --zsh-completion-hosts | awk -F'\t' '{print $1":"$2}'))
     IFS=$PRE_IFS
-    _describe -t host "host" __essh_hosts
+    _describe -V -t host "host" __essh_hosts
 }
 
 _essh_hosts_global() {
     local -a __essh_hosts
     PRE_IFS=$IFS
     IFS=$'\n'
-    __essh_hosts=($({{.Executable}} --global --zsh-completion-hosts | awk -F'\t' '{print $1":"$2}'))
+    __essh_hosts=($({{.Executable}} --global $allOption --zsh-completion-hosts | awk -F'\t' '{print $1":"$2}'))
     IFS=$PRE_IFS
-    _describe -t host "host" __essh_hosts
+    _describe -V -t host "host" __essh_hosts
 }
 
 _essh_tasks() {
     local -a __essh_tasks
     PRE_IFS=$IFS
     IFS=$'\n'
-    __essh_tasks=($({{.Executable}} --zsh-completion-tasks | awk -F'\t' '{print $1":"$2}'))
+    __essh_tasks=($({{.Executable}} $allOption --zsh-completion-tasks | awk -F'\t' '{print $1":"$2}'))
     IFS=$PRE_IFS
-    _describe -t task "task" __essh_tasks
+    _describe -V -t task "task" __essh_tasks
 }
 
 _essh_tasks_global() {
     local -a __essh_tasks
     PRE_IFS=$IFS
     IFS=$'\n'
-    __essh_tasks=($({{.Executable}} --global --zsh-completion-tasks | awk -F'\t' '{print $1":"$2}'))
+    __essh_tasks=($({{.Executable}} --global $allOption --zsh-completion-tasks | awk -F'\t' '{print $1":"$2}'))
     IFS=$PRE_IFS
-    _describe -t task "task" __essh_tasks
+    _describe -V -t task "task" __essh_tasks
 }
 
 _essh_tags() {
@@ -1736,18 +3673,64 @@ _essh_options() {
         '--print:Print generated ssh config.'
         '--color:Force ANSI output.'
         '--no-color:Disable ANSI output.'
+        '--diff-config:Compare the hosts and the tasks with the other config file.'
         '--gen:Only generate ssh config.'
+        '--gen-format:Generate the config in the format.'
+        '--output:Write the generated config to the file.'
         '--working-dir:Change working directory.'
         '--config:Load per-project configuration from the file.'
         '--hosts:List hosts.'
+        '--describe:Show details of the host.'
+        '--show-command:Print a ssh command line that connects to the host without essh.'
+        '--export:Print a self-contained ssh_config of the host.'
+        '--grep:Search the hosts by the pattern.'
+        '--whois:Show the hosts that point to the address.'
+        '--resolve:Resolve the addresses by DNS. (with --whois)'
         '--tags:List tags.'
+        '--roles:List roles.'
+        '--frequent:List the most used hosts and tasks.'
+        '--recent:Select a recently used host or task to connect or run.'
+        '--prompt-info:Output a summary of the current project for shell prompts.'
+        '--switch-role:Switch the current set of the role.'
+        '--force-unlock:Release the locks of the tasks.'
+        '--import-known-hosts:Output host definitions from known_hosts.'
         '--tasks:List tasks.'
+        '--graph:Output a graph of the tasks in DOT format.'
         '--debug:Output debug log.'
+        '--debug-file:Output debug log to the file.'
+        '--profile:Print the time spent in each phase.'
+        '--verbose:Print the progress of the tasks. Repeat it to print more.'
+        '--quiet:Do not print the prefixes and the progress of the tasks.'
+        '--no-cache:Do not use the cached ssh_config and completion lists.'
+        '--no-pager:Do not pipe the outputs into the pager.'
+        '--no-hooks:Do not run the hooks of the hosts.'
+        '--private-tmp:Create the temporary ssh_config in the private directory.'
+        '--refresh-providers:Fetch the host providers and update their caches.'
+        '--refresh-daemon:Refresh the host providers at the interval.'
+        '--pprof-addr:Serve the pprof endpoints at the address.'
         '--global:Force using global config.'
         '--exec:Execute commands with the hosts.'
+        '--one:Connect to a randomly selected host.'
+        '--ping:Check the connectivity of the hosts.'
+        '--console:Connect to the hosts at once and send the input to all of them.'
+        '--bench:Measure the connection and command latencies of the hosts.'
+        '--bench-count:The number of connections to each host.'
+        '--doctor:Check the environment for common problems.'
+        '--socks:Open a socks proxy through the host.'
+        '--socks-stop:Stop the socks proxies.'
+        '--scp:Run scp with the generated ssh config.'
+        '--rsync:Run rsync with the generated ssh config.'
+        '--resume:Keep partially transferred files to resume rsync.'
+        '--preview:Print the scp or rsync command line without executing.'
+        '--plan:Print the execution plan of the task without running it.'
+        '--test:Compare the execution plans of the tasks with the golden files.'
+        '--update:Update the golden files. (with --test)'
         '--zsh-completion:Output zsh completion code.'
         '--bash-completion:Output bash completion code.'
+        '--powershell-completion:Output PowerShell completion code.'
+        '--completion-cache-ttl:Cache hosts, tasks and tags for completion.'
         '--aliases:Output aliases code.'
+        '--host-aliases:Output the aliases of the hosts that have alias field.'
      )
     _describe -t option "option" __essh_options
 }
@@ -1756,10 +3739,16 @@ _essh_hosts_options() {
     local -a __essh_options
     __essh_options=(
         '--debug:Output debug log.'
+        '--debug-file:Output debug log to the file.'
+        '--profile:Print the time spent in each phase.'
         '--quiet:Show only names.'
         '--all:Show all that includes hidden hosts.'
         '--select:Get only the hosts filtered with tags or hosts.'
         '--filter:Filter selected hosts with tags or hosts.'
+        '--exclude:Exclude hosts with tags, hosts or patterns.'
+        '--limit:Show only the first N hosts.'
+        '--columns:Comma separated columns to display.'
+        '--format:Output format.'
         '--ssh-config:Output selected hosts as ssh_config format.'
      )
     _describe -t option "option" __essh_options
@@ -1769,8 +3758,11 @@ _essh_tasks_options() {
     local -a __essh_options
     __essh_options=(
         '--debug:Output debug log.'
+        '--debug-file:Output debug log to the file.'
+        '--profile:Print the time spent in each phase.'
         '--quiet:Show only names.'
         '--all:Show all that includes hidden tasks.'
+        '--format:Output format.'
      )
     _describe -t option "option" __essh_options
 }
@@ -1779,7 +3771,10 @@ _essh_tags_options() {
     local -a __essh_options
     __essh_options=(
         '--debug:Output debug log.'
+        '--debug-file:Output debug log to the file.'
+        '--profile:Print the time spent in each phase.'
         '--quiet:Show only names.'
+        '--format:Output format.'
      )
     _describe -t option "option" __essh_options
 }
@@ -1788,15 +3783,27 @@ _essh_exec_options() {
     local -a __essh_options
     __essh_options=(
         '--debug:Output debug log.'
+        '--debug-file:Output debug log to the file.'
+        '--profile:Print the time spent in each phase.'
         '--backend:Run the commands on local or remote hosts.'
         '--target:Target hosts to run the commands.'
         '--filter:Filter target hosts with tags or hosts.'
+        '--exclude:Exclude hosts with tags, hosts or patterns.'
+        '--limit:Run the commands only on the first N hosts.'
         '--prefix:Disable outputting prefix.'
         '--prefix-string:Custom string of the prefix.'
+        '--output-filter:Drop the output lines that match the pattern.'
+        '--chdir:Directory to run the local commands for each host.'
         '--privileged:Run by the privileged user.'
         '--user:Run by the specific user.'
+        '--serialize-auth:Authenticate to the hosts one by one before running in parallel.'
+        '--multiplex-jump:Share a master connection to the common jump host.'
         '--parallel:Run in parallel.'
         '--pty:Allocate pseudo-terminal. (add ssh option "-t -t" internally)'
+        '--tty:Allocate pseudo-terminal. (same as --pty)'
+        '--forward-agent:Enable agent forwarding. (add ssh option "-A" internally)'
+        '--trace:Print each command before running it. (set -x)'
+        '--verbose:Print the progress of the task. Repeat it to print more.'
         '--script-file:Load commands from a file.'
         '--driver:Specify a driver.'
      )
@@ -1820,9 +3827,33 @@ _essh_backends() {
     _describe -t option "option" __essh_options
 }
 
+_essh_gen_formats() {
+    local -a __essh_options
+    __essh_options=(
+        'ssh'
+        'json'
+        'yaml'
+     )
+    _describe -t option "option" __essh_options
+}
+
+_essh_formats() {
+    local -a __essh_options
+    __essh_options=(
+        'table'
+        'json'
+        'prettyjson'
+        'yaml'
+        'csv'
+        'tsv'
+        'prometheus-sd'
+     )
+    _describe -t option "option" __essh_options
+}
+
 _essh () {
     local curcontext="$curcontext" state line
-    local last_arg arg execMode hostsMode tasksMode tagsMode globalMode
+    local last_arg arg execMode scpMode hostsMode tasksMode tagsMode globalMode allOption
 
     typeset -A opt_args
 
@@ -1851,9 +3882,15 @@ _essh () {
                     --global)
                         globalMode="on"
                         ;;
+                    --all)
+                        allOption="--all"
+                        ;;
                     --exec)
                         execMode="on"
                         ;;
+                    --scp)
+                        scpMode="on"
+                        ;;
                     --hosts)
                         hostsMode="on"
                         ;;
@@ -1878,12 +3915,19 @@ _essh () {
                       _essh_hosts
                     fi
                     ;;
-                --print|--help|--version|--gen)
+                --print|--help|--version|--gen|--grep|--whois)
                     ;;
-                --script-file|--config)
+                --script-file|--config|--debug-file|--output|--diff-config)
                     _files
                     ;;
-                --select|--target|--filter)
+                --describe|--show-command|--export|--socks|--socks-stop)
+                    if [ "$globalMode" = "on" ]; then
+                      _essh_hosts_global
+                    else
+                      _essh_hosts
+                    fi
+                    ;;
+                --select|--target|--filter|--exclude)
                     if [ "$globalMode" = "on" ]; then
                       _essh_hosts_global
                       _essh_tags_global
@@ -1897,8 +3941,16 @@ _essh () {
                 --backend)
                     _essh_backends
                     ;;
+                --format)
+                    _essh_formats
+                    ;;
+                --gen-format)
+                    _essh_gen_formats
+                    ;;
                 *)
-                    if [ "$execMode" = "on" ]; then
+                    if [ "$scpMode" = "on" ]; then
+                        _essh_scp
+                    elif [ "$execMode" = "on" ]; then
                         _essh_exec_options
                     elif [ "$hostsMode" = "on" ]; then
                         _essh_hosts_options
@@ -1920,6 +3972,30 @@ _essh () {
 }
 
 compdef _essh essh
+
+_essh_remote_paths() {
+    local host="${PREFIX%%:*}" rpath="${PREFIX#*:}"
+    local -a __essh_paths
+    __essh_paths=(${(f)"$({{.Executable}} $host -o BatchMode=yes -o ConnectTimeout=3 "ls -dp -- ${(q)rpath}*" 2>/dev/null)"})
+    compset -P '*:'
+    compadd -Q -S '' -- $__essh_paths
+}
+
+_essh_scp() {
+    local -a __essh_hosts
+    if [[ "$PREFIX" = *:* ]]; then
+        _essh_remote_paths
+    else
+        PRE_IFS=$IFS
+        IFS=$'\n'
+        __essh_hosts=($({{.Executable}} --zsh-completion-hosts | awk -F'\t' '{print $1":"$2}'))
+        IFS=$PRE_IFS
+        _describe -t host "host" __essh_hosts -S ':'
+        _files
+    fi
+}
+
+compdef _essh_scp escp
 `
 
 var BASH_COMPLETION = `# This is zsh completion code.
@@ -1927,19 +4003,19 @@ var BASH_COMPLETION = `# This is zsh completion code.
 #   eval "$(essh --bash-completion)"
 
 _essh_hosts() {
-    COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-hosts)" -- $cur) )
+    COMPREPLY=( $(compgen -W "$({{.Executable}} $allOption --bash-completion-hosts)" -- $cur) )
 }
 
 _essh_tasks() {
-    COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-tasks)" -- $cur) )
+    COMPREPLY=( $(compgen -W "$({{.Executable}} $allOption --bash-completion-tasks)" -- $cur) )
 }
 
 _essh_hosts_and_tasks() {
-    COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-hosts) $({{.Executable}} --bash-completion-tasks)" -- $cur) )
+    COMPREPLY=( $(compgen -W "$({{.Executable}} $allOption --bash-completion-hosts) $({{.Executable}} $allOption --bash-completion-tasks)" -- $cur) )
 }
 
 _essh_hosts_and_tags() {
-    COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-hosts) $({{.Executable}} --bash-completion-tags)" -- $cur) )
+    COMPREPLY=( $(compgen -W "$({{.Executable}} $allOption --bash-completion-hosts) $({{.Executable}} --bash-completion-tags)" -- $cur) )
 }
 
 _essh_registry_options() {
@@ -1955,13 +4031,39 @@ _essh_backends() {
     " -- $cur) )
 }
 
+_essh_gen_formats() {
+    COMPREPLY=( $(compgen -W "
+        ssh
+        json
+        yaml
+    " -- $cur) )
+}
+
+_essh_formats() {
+    COMPREPLY=( $(compgen -W "
+        table
+        json
+        prettyjson
+        yaml
+        csv
+        tsv
+        prometheus-sd
+    " -- $cur) )
+}
+
 _essh_hosts_options() {
     COMPREPLY=( $(compgen -W "
         --debug
+        --debug-file
+        --profile
         --quiet
         --all
         --select
         --filter
+        --exclude
+        --limit
+        --columns
+        --format
         --ssh-config
     " -- $cur) )
 }
@@ -1969,15 +4071,21 @@ _essh_hosts_options() {
 _essh_tasks_options() {
     COMPREPLY=( $(compgen -W "
         --debug
+        --debug-file
+        --profile
         --quiet
         --all
+        --format
     " -- $cur) )
 }
 
 _essh_tags_options() {
     COMPREPLY=( $(compgen -W "
         --debug
+        --debug-file
+        --profile
         --quiet
+        --format
     " -- $cur) )
 }
 
@@ -1985,15 +4093,27 @@ _essh_exec_options() {
     local -a __essh_options
     __essh_options=(
         '--debug:Output debug log.'
+        '--debug-file:Output debug log to the file.'
+        '--profile:Print the time spent in each phase.'
         '--backend:Run the commands on local or remote hosts.'
         '--target:Target hosts to run the commands.'
         '--filter:Filter target hosts with tags or hosts.'
+        '--exclude:Exclude hosts with tags, hosts or patterns.'
+        '--limit:Run the commands only on the first N hosts.'
         '--prefix:Disable outputing prefix.'
         '--prefix-string:Custom string of the prefix.'
+        '--output-filter:Drop the output lines that match the pattern.'
+        '--chdir:Directory to run the local commands for each host.'
         '--privileged:Run by the privileged user.'
         '--user:Run by the specific user.'
+        '--serialize-auth:Authenticate to the hosts one by one before running in parallel.'
+        '--multiplex-jump:Share a master connection to the common jump host.'
         '--parallel:Run in parallel.'
         '--pty:Allocate pseudo-terminal. (add ssh option "-t -t" internally)'
+        '--tty:Allocate pseudo-terminal. (same as --pty)'
+        '--forward-agent:Enable agent forwarding. (add ssh option "-A" internally)'
+        '--trace:Print each command before running it. (set -x)'
+        '--verbose:Print the progress of the task. Repeat it to print more.'
         '--script-file:Load commands from a file.'
         '--driver:Specify a driver.'
      )
@@ -2007,25 +4127,71 @@ _essh_options() {
         --print
         --color
         --no-color
+        --diff-config
         --gen
+        --gen-format
+        --output
         --global
         --working-dir
         --config
         --hosts
+        --describe
+        --show-command
+        --export
+        --grep
+        --whois
+        --resolve
         --tags
+        --roles
+        --frequent
+        --recent
+        --prompt-info
+        --switch-role
+        --force-unlock
+        --import-known-hosts
         --tasks
+        --graph
         --debug
+        --debug-file
+        --profile
+        --verbose
+        --quiet
+        --no-cache
+        --no-pager
+        --no-hooks
+        --private-tmp
+        --refresh-providers
+        --refresh-daemon
+        --pprof-addr
         --exec
+        --one
+        --ping
+        --console
+        --bench
+        --bench-count
+        --doctor
+        --socks
+        --socks-stop
+        --scp
+        --rsync
+        --resume
+        --preview
+        --plan
+        --test
+        --update
         --zsh-completion
         --bash-completion
+        --powershell-completion
+        --completion-cache-ttl
         --aliases
+        --host-aliases
     " -- $cur) )
 }
 
 _essh() {
     COMP_WORDBREAKS=${COMP_WORDBREAKS//:}
 
-    local last_arg arg execMode hostsMode tasksMode tagsMode
+    local last_arg arg execMode hostsMode tasksMode tagsMode allOption
 
     local cur=${COMP_WORDS[COMP_CWORD]}
     case "$COMP_CWORD" in
@@ -2043,6 +4209,9 @@ _essh() {
             last_arg="${COMP_WORDS[COMP_CWORD-1]}"
             for arg in ${COMP_WORDS[@]}; do
                 case $arg in
+                    --all)
+                        allOption="--all"
+                        ;;
                     --exec)
                         execMode="on"
                         ;;
@@ -2061,16 +4230,25 @@ _essh() {
             done
 
             case "$last_arg" in
-                --print|--help|--version|--gen)
+                --print|--help|--version|--gen|--grep|--whois)
+                    ;;
+                --script-file|--config|--debug-file|--output|--diff-config)
                     ;;
-                --script-file|--config)
+                --describe|--show-command|--export|--socks|--socks-stop)
+                    _essh_hosts
                     ;;
-                --select|--target|--filter)
+                --select|--target|--filter|--exclude)
                     _essh_hosts_and_tags
                     ;;
                 --backend)
                     _essh_backends
                     ;;
+                --format)
+                    _essh_formats
+                    ;;
+                --gen-format)
+                    _essh_gen_formats
+                    ;;
                 *)
                     if [ "$execMode" = "on" ]; then
                         _essh_hosts
@@ -2097,9 +4275,14 @@ var ALIASES_CODE = `# This is aliases code.
 # If you want to use it. write the following code in your '.zshrc'
 #   eval "$(essh --aliases)"
 function escp() {
-    {{.Executable}} --exec 'scp -F $ESSH_SSH_CONFIG' "$@"
+    {{.Executable}} --scp -- "$@"
 }
 function ersync() {
-    {{.Executable}} --exec 'rsync -e "ssh -F $ESSH_SSH_CONFIG"' "$@"
+    {{.Executable}} --rsync -- "$@"
+}
+{{range .HostAliases -}}
+function {{.Alias}}() {
+    {{$.Executable}} {{.Host}} "$@"
 }
+{{end -}}
 `
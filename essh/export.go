@@ -0,0 +1,35 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"strings"
+)
+
+// exportHostConfig writes a self-contained ssh_config of the host that can be pasted into ~/.ssh/config.
+// It has the blocks of the host and the hosts that it jumps through, and the options of the hosts that have
+// matching patterns and the connection settings are inlined into each block instead of "Host *".
+func exportHostConfig(L *lua.LState, w io.Writer, host *Host) {
+	hosts := []*Host{host}
+	for _, h := range sshConfigHosts(L, []string{host.Name}, NewHostQuery().GetHostsOrderByName()) {
+		if h != host && !strings.ContainsAny(h.Name, "*?!") {
+			hosts = append(hosts, h)
+		}
+	}
+
+	for i, h := range hosts {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Host %s\n", h.Name)
+		for _, config := range effectiveSSHConfig(h) {
+			for key, value := range config {
+				fmt.Fprintf(w, "    %s %s\n", key, value)
+			}
+		}
+		for _, forward := range h.RemoteForwardConfigs() {
+			fmt.Fprintf(w, "    RemoteForward %s\n", forward)
+		}
+	}
+}
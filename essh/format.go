@@ -0,0 +1,204 @@
+package essh
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/helper"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// output formats of the listings.
+const (
+	FormatTable      = "table"
+	FormatJSON       = "json"
+	FormatPrettyJSON = "prettyjson"
+	FormatYAML       = "yaml"
+	FormatCSV        = "csv"
+	FormatTSV        = "tsv"
+	// FormatPrometheusSD is the file_sd_config format of Prometheus. It is supported only by --hosts.
+	FormatPrometheusSD = "prometheus-sd"
+)
+
+var OutputFormats = []string{
+	FormatTable,
+	FormatJSON,
+	FormatPrettyJSON,
+	FormatYAML,
+	FormatCSV,
+	FormatTSV,
+	FormatPrometheusSD,
+}
+
+func validateFormat(format string) error {
+	for _, f := range OutputFormats {
+		if f == format {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid format '%s'. supported formats are table, json, prettyjson, yaml, csv, tsv and prometheus-sd.", format)
+}
+
+// Listing is a set of data to output in a specific format.
+// Header and Rows are used by the tabular formats (table, csv and tsv),
+// and Data is used by the structured formats (json, prettyjson and yaml).
+type Listing struct {
+	Header []string
+	Rows   [][]string
+	Data   interface{}
+}
+
+func (l *Listing) Append(row []string) {
+	l.Rows = append(l.Rows, row)
+}
+
+func (l *Listing) Write(w io.Writer, format string, noHeader bool) error {
+	switch format {
+	case "", FormatTable:
+		tb := helper.NewPlainTable(w)
+		if !noHeader {
+			tb.SetHeader(l.Header)
+		}
+		for _, row := range l.Rows {
+			tb.Append(row)
+		}
+		tb.Render()
+	case FormatJSON:
+		b, err := json.Marshal(l.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+	case FormatPrettyJSON:
+		b, err := json.MarshalIndent(l.Data, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+	case FormatYAML:
+		b, err := yaml.Marshal(l.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(w, string(b))
+	case FormatCSV, FormatTSV:
+		cw := csv.NewWriter(w)
+		if format == FormatTSV {
+			cw.Comma = '\t'
+		}
+		if !noHeader {
+			if err := cw.Write(l.Header); err != nil {
+				return err
+			}
+		}
+		if err := cw.WriteAll(l.Rows); err != nil {
+			return err
+		}
+	case FormatPrometheusSD:
+		return fmt.Errorf("'%s' format is supported only by --hosts.", format)
+	default:
+		return validateFormat(format)
+	}
+
+	return nil
+}
+
+// DefaultPrometheusPort is the port of the targets that don't have the 'prometheus_port' prop (node_exporter's port).
+var DefaultPrometheusPort = "9100"
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// WritePrometheusSD writes the hosts as the targets of Prometheus's file_sd_config.
+// The address of a target is the 'prometheus_target' prop, or HostName and the 'prometheus_port' prop.
+// The labels are the host name, the tags and the other props.
+func WritePrometheusSD(w io.Writer, hosts []*Host) error {
+	groups := []map[string]interface{}{}
+	for _, h := range hosts {
+		target := h.Props["prometheus_target"]
+		if target == "" {
+			address := h.SSHConfig["HostName"]
+			if address == "" {
+				address = h.Name
+			}
+			port := h.Props["prometheus_port"]
+			if port == "" {
+				port = DefaultPrometheusPort
+			}
+			target = net.JoinHostPort(address, port)
+		}
+
+		labels := map[string]string{}
+		for key, value := range h.Props {
+			if key == "prometheus_target" || key == "prometheus_port" {
+				continue
+			}
+			labels[invalidLabelChars.ReplaceAllString(key, "_")] = value
+		}
+		labels["essh_host"] = h.Name
+		// the tags are surrounded by commas like consul_sd's tags, so they can be matched by regex like ".*,web,.*".
+		labels["essh_tags"] = ""
+		if len(h.Tags) > 0 {
+			labels["essh_tags"] = "," + strings.Join(h.Tags, ",") + ","
+		}
+
+		groups = append(groups, map[string]interface{}{
+			"targets": []string{target},
+			"labels":  labels,
+		})
+	}
+
+	b, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(b))
+
+	return nil
+}
+
+func hostRecord(h *Host) map[string]interface{} {
+	expires := ""
+	if !h.Expires.IsZero() {
+		expires = h.Expires.Format(HostExpiresFormat)
+	}
+
+	return map[string]interface{}{
+		"name":        h.Name,
+		"description": h.Description,
+		"tags":        h.Tags,
+		"groups":      h.GroupNames(),
+		"hidden":      h.Hidden,
+		"expires":     expires,
+		"expired":     h.Expired(),
+		"props":       h.Props,
+		"ssh_config":  h.SSHConfig,
+	}
+}
+
+func taskRecord(t *Task) map[string]interface{} {
+	return map[string]interface{}{
+		"name":            t.PublicName(),
+		"description":     t.Description,
+		"hidden":          t.Hidden,
+		"disabled":        t.Disabled,
+		"backend":         t.Backend,
+		"targets":         t.Targets,
+		"dynamic_targets": t.TargetsFunc != nil,
+		"filters":         t.Filters,
+		"excludes":        t.Excludes,
+		"limit":           t.Limit,
+		"parallel":        t.Parallel,
+		"privileged":      t.Privileged,
+		"user":            t.User,
+		"pty":             t.Pty,
+		"forward_agent":   t.ForwardAgent,
+		"driver":          t.Driver,
+		"props":           t.Props,
+		"args":            t.Args,
+	}
+}
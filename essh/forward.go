@@ -0,0 +1,157 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sshOptionsWithArgument are the ssh's single letter options that take a value as the next argument.
+const sshOptionsWithArgument = "BbcDEeFIiJLlmOopQRSWw"
+
+// allocateForwardPorts replaces local port 0 in the ssh's local forwarding options (like "-L 0:localhost:80")
+// with free local ports. It returns the new args and the allocated ports.
+func allocateForwardPorts(args []string) ([]string, []int, error) {
+	ret := make([]string, 0, len(args))
+	ports := []int{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// the options end at the destination host. the rest is a remote command.
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			ret = append(ret, args[i:]...)
+			break
+		}
+
+		var spec string
+		separated := false
+		if arg == "-L" && i+1 < len(args) {
+			spec = args[i+1]
+			separated = true
+		} else if strings.HasPrefix(arg, "-L") && len(arg) > 2 {
+			spec = arg[2:]
+		} else {
+			ret = append(ret, arg)
+			if len(arg) == 2 && strings.ContainsRune(sshOptionsWithArgument, rune(arg[1])) && i+1 < len(args) {
+				ret = append(ret, args[i+1])
+				i++
+			}
+			continue
+		}
+
+		newSpec, port, err := allocateForwardPort(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if port > 0 {
+			ports = append(ports, port)
+		}
+
+		ret = append(ret, "-L"+newSpec)
+		if separated {
+			i++
+		}
+	}
+
+	return ret, ports, nil
+}
+
+// allocateForwardPort replaces the port 0 in a forwarding spec like "0:host:port" or "bind_address:0:host:port".
+func allocateForwardPort(spec string) (string, int, error) {
+	parts := strings.Split(spec, ":")
+
+	var index int
+	bindAddress := "127.0.0.1"
+	switch len(parts) {
+	case 3:
+		index = 0
+	case 4:
+		index = 1
+		if parts[0] != "" && parts[0] != "*" && parts[0] != "localhost" {
+			bindAddress = parts[0]
+		}
+	default:
+		// unix domain sockets or IPv6 addresses. it doesn't handle them.
+		return spec, 0, nil
+	}
+
+	if parts[index] != "0" {
+		return spec, 0, nil
+	}
+
+	port, err := freePort(bindAddress)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to find a free local port for forwarding '%s': %v", spec, err)
+	}
+	parts[index] = strconv.Itoa(port)
+
+	return strings.Join(parts, ":"), port, nil
+}
+
+func freePort(bindAddress string) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(bindAddress, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// parseRemoteForward parses a remote forwarding spec like "9000:localhost:3000" or "0.0.0.0:9000:localhost:3000"
+// and returns the listen and destination parts.
+func parseRemoteForward(spec string) (string, string, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", "", fmt.Errorf("invalid remote forward '%s'. it must be '[bind_address:]port:host:hostport'.", spec)
+	}
+
+	for _, port := range []string{parts[len(parts)-3], parts[len(parts)-1]} {
+		if _, err := strconv.Atoi(port); err != nil {
+			return "", "", fmt.Errorf("invalid remote forward '%s'. the port '%s' is not a number.", spec, port)
+		}
+	}
+
+	return strings.Join(parts[:len(parts)-2], ":"), strings.Join(parts[len(parts)-2:], ":"), nil
+}
+
+func toRemoteForwards(value lua.LValue) ([]string, error) {
+	forwards := []string{}
+	if str, ok := toString(value); ok {
+		forwards = append(forwards, str)
+	} else if tb, ok := toLTable(value); ok {
+		tb.ForEach(func(_ lua.LValue, v lua.LValue) {
+			forwards = append(forwards, lua.LVAsString(v))
+		})
+	} else {
+		return nil, fmt.Errorf("remote_forwards must be a string or a table.")
+	}
+
+	for _, spec := range forwards {
+		if _, _, err := parseRemoteForward(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	return forwards, nil
+}
+
+// exportForwardPorts sets the allocated ports to the environment variables that are inherited by the local hooks.
+func exportForwardPorts(ports []int) {
+	if len(ports) == 0 {
+		return
+	}
+
+	strs := []string{}
+	for _, port := range ports {
+		strs = append(strs, strconv.Itoa(port))
+		printProgress(VERBOSITY_NORMAL, "forwarding from local port %d", port)
+	}
+
+	os.Setenv("ESSH_FORWARD_PORT", strs[0])
+	os.Setenv("ESSH_FORWARD_PORTS", strings.Join(strs, ","))
+}
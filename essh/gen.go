@@ -0,0 +1,93 @@
+package essh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// output formats of --gen.
+const (
+	// GenFormatSSH is the OpenSSH config format. It is the default.
+	GenFormatSSH  = "ssh"
+	GenFormatJSON = "json"
+	GenFormatYAML = "yaml"
+)
+
+var GenFormats = []string{
+	GenFormatSSH,
+	GenFormatJSON,
+	GenFormatYAML,
+}
+
+func validateGenFormat(format string) error {
+	for _, f := range GenFormats {
+		if f == format {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid format '%s' of --gen-format. supported formats are ssh, json and yaml.", format)
+}
+
+// genSSHOutputFile returns the file of --output if --gen generates the ssh_config.
+func genSSHOutputFile() string {
+	if !genFlag || genOutputVar == "" || (genFormatVar != "" && genFormatVar != GenFormatSSH) {
+		return ""
+	}
+	return expandHomeDir(genOutputVar)
+}
+
+// genHostsModel returns the resolved model of the hosts that is consumed by the other systems.
+func genHostsModel(hosts []*Host) map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, h := range hosts {
+		records = append(records, hostRecord(h))
+	}
+
+	return map[string]interface{}{
+		"hosts":      records,
+		"connection": ConnectionSettings,
+	}
+}
+
+// writeGenHosts writes the resolved model of the hosts in json or yaml.
+func writeGenHosts(w io.Writer, format string, hosts []*Host) error {
+	switch format {
+	case GenFormatJSON:
+		b, err := json.MarshalIndent(genHostsModel(hosts), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+	case GenFormatYAML:
+		b, err := yaml.Marshal(genHostsModel(hosts))
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(w, string(b))
+	default:
+		return fmt.Errorf("unsupported format '%s'.", format)
+	}
+
+	return nil
+}
+
+// genHostsToFile writes the resolved model of the hosts to the file of --output, or stdout if it is empty.
+// The file is only readable by the user like the generated ssh_config.
+func genHostsToFile(path string, format string, hosts []*Host) error {
+	if path == "" {
+		return writeGenHosts(os.Stdout, format, hosts)
+	}
+
+	var b bytes.Buffer
+	if err := writeGenHosts(&b, format, hosts); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b.Bytes(), 0600)
+}
@@ -0,0 +1,52 @@
+package essh
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteTaskGraph writes a graph of the tasks and their target hosts in Graphviz DOT format.
+// Tasks that have dynamic targets (a targets function) are connected to a placeholder node,
+// because the hosts are resolved only when the task runs.
+func WriteTaskGraph(w io.Writer, tasks []*Task) error {
+	fmt.Fprintln(w, "digraph essh {")
+	fmt.Fprintln(w, "    rankdir=LR;")
+
+	hostNodes := map[string]bool{}
+	for _, task := range tasks {
+		taskNode := strconv.Quote("task:" + task.PublicName())
+		fmt.Fprintf(w, "    %s [shape=box, label=%s];\n", taskNode, strconv.Quote(task.PublicName()))
+
+		if task.TargetsFunc != nil {
+			fmt.Fprintf(w, "    %s -> %s [style=dashed];\n", taskNode, strconv.Quote("dynamic targets"))
+			continue
+		}
+
+		if len(task.TargetsSlice()) == 0 {
+			continue
+		}
+
+		query := NewHostQuery().
+			AppendSelections(task.TargetsSlice()).
+			AppendFilters(task.FiltersSlice()).
+			AppendExcludes(task.Excludes).
+			SetLimit(task.Limit)
+		hosts := query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			hostNode := strconv.Quote("host:" + host.Name)
+			if !hostNodes[hostNode] {
+				fmt.Fprintf(w, "    %s [shape=ellipse, label=%s];\n", hostNode, strconv.Quote(host.Name))
+				hostNodes[hostNode] = true
+			}
+
+			fmt.Fprintf(w, "    %s -> %s [label=%s];\n", taskNode, hostNode, strconv.Quote(task.Backend))
+		}
+	}
+
+	fmt.Fprintln(w, "}")
+	return nil
+}
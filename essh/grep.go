@@ -0,0 +1,87 @@
+package essh
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// GrepMatch is a field of a host that matches the pattern of --grep.
+type GrepMatch struct {
+	Host *Host
+	// Field is the name of the matched field like "description", "tags", "props.role" or "HostName".
+	Field string
+	Value string
+}
+
+// grepHosts searches the hosts' names, descriptions, tags, props and ssh_config values by the pattern.
+// The pattern is a regular expression that is matched case-insensitively.
+func grepHosts(hosts []*Host, pattern string) ([]*GrepMatch, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+	}
+	re := regexp.MustCompile("(?i)" + pattern)
+
+	matches := []*GrepMatch{}
+	for _, host := range hosts {
+		add := func(field, value string) {
+			if re.MatchString(value) {
+				matches = append(matches, &GrepMatch{Host: host, Field: field, Value: value})
+			}
+		}
+
+		add("name", host.Name)
+		add("description", host.Description)
+		for _, tag := range host.Tags {
+			add("tags", tag)
+		}
+
+		keys := []string{}
+		for key := range host.Props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add("props."+key, host.Props[key])
+		}
+
+		for _, config := range host.SortedSSHConfig() {
+			for key, value := range config {
+				add(key, value)
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+func grepListing(matches []*GrepMatch, quiet bool) *Listing {
+	listing := &Listing{Header: []string{"HOST", "FIELD", "VALUE"}}
+	if quiet {
+		listing.Header = []string{"NAME"}
+	}
+
+	records := []interface{}{}
+	seen := map[string]bool{}
+	for _, m := range matches {
+		if quiet {
+			// a host may match in several fields.
+			if !seen[m.Host.Name] {
+				seen[m.Host.Name] = true
+				listing.Append([]string{m.Host.Name})
+				records = append(records, m.Host.Name)
+			}
+			continue
+		}
+
+		listing.Append([]string{m.Host.Name, m.Field, m.Value})
+		records = append(records, map[string]interface{}{
+			"host":  m.Host.Name,
+			"field": m.Field,
+			"value": m.Value,
+		})
+	}
+	listing.Data = records
+
+	return listing
+}
@@ -3,6 +3,7 @@ package essh
 import (
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"sort"
 )
 
 type GroupType int
@@ -16,20 +17,52 @@ const (
 
 type Group struct {
 	Type    GroupType
+	Name    string
 	Hosts   map[string]*Host
 	Tasks   map[string]*Task
 	Drivers map[string]*Driver
 	LValues map[string]lua.LValue
+	// HostNames refers to the hosts that are defined outside of the group.
+	HostNames []string
 }
 
+// NamedGroups are groups that have names. They can be used to select hosts like tags.
+var NamedGroups map[string]*Group
+
 func NewGroup() *Group {
 	return &Group{
-		Type:    GroupTypeUndefined,
-		Hosts:   map[string]*Host{},
-		Tasks:   map[string]*Task{},
-		Drivers: map[string]*Driver{},
-		LValues: map[string]lua.LValue{},
+		Type:      GroupTypeUndefined,
+		Hosts:     map[string]*Host{},
+		HostNames: []string{},
+		Tasks:     map[string]*Task{},
+		Drivers:   map[string]*Driver{},
+		LValues:   map[string]lua.LValue{},
+	}
+}
+
+func (group *Group) HasHost(host *Host) bool {
+	if _, ok := group.Hosts[host.Name]; ok {
+		return true
+	}
+
+	for _, name := range group.HostNames {
+		if name == host.Name {
+			return true
+		}
 	}
+
+	return false
+}
+
+func GetGroupNames() []string {
+	names := []string{}
+	for name := range NamedGroups {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
 }
 
 func (group *Group) RegisterHost(host *Host) {
@@ -54,11 +87,32 @@ func (group *Group) RegisterDriver(driver *Driver) {
 }
 
 func esshGroup(L *lua.LState) int {
-	first := L.CheckTable(1)
-	j := registerGroup(L)
-	setupGroup(L, j, first)
-	L.Push(newLGroup(L, j))
-	return 1
+	first := L.CheckAny(1)
+	if tb, ok := toLTable(first); ok {
+		j := registerGroup(L)
+		setupGroup(L, j, tb)
+		L.Push(newLGroup(L, j))
+		return 1
+	}
+
+	name := L.CheckString(1)
+	if L.GetTop() == 1 {
+		// object or DSL style
+		g := registerNamedGroup(L, name)
+		L.Push(newLGroup(L, g))
+
+		return 1
+	} else if L.GetTop() == 2 {
+		// function style
+		tb := L.CheckTable(2)
+		g := registerNamedGroup(L, name)
+		setupGroup(L, g, tb)
+		L.Push(newLGroup(L, g))
+
+		return 1
+	}
+
+	panic("group requires 1 or 2 arguments")
 }
 
 func registerGroup(L *lua.LState) *Group {
@@ -66,6 +120,23 @@ func registerGroup(L *lua.LState) *Group {
 	return j
 }
 
+func registerNamedGroup(L *lua.LState, name string) *Group {
+	if debugFlag {
+		debugf("register group: %s\n", name)
+	}
+
+	if g := NamedGroups[name]; g != nil {
+		// same name group is merged into the existing group.
+		return g
+	}
+
+	g := NewGroup()
+	g.Name = name
+	NamedGroups[name] = g
+
+	return g
+}
+
 func setupGroup(L *lua.LState, group *Group, config *lua.LTable) {
 	// guarantee evaluating a key/value dictionary at first.
 	config.ForEach(func(k, v lua.LValue) {
@@ -163,6 +234,22 @@ func updateGroup(L *lua.LState, group *Group, key string, value lua.LValue) {
 				panic("group can use only one type of resources. \n")
 			}
 
+			if maxn := tb.MaxN(); maxn > 0 {
+				// array of host names that refers to the hosts defined outside of the group.
+				group.Type = GroupTypeHosts
+				group.HostNames = []string{}
+
+				for i := 1; i <= maxn; i++ {
+					name, ok := toString(tb.RawGetInt(i))
+					if !ok {
+						panic(fmt.Sprintf("expected string of host's name but got '%v'\n", tb.RawGetInt(i)))
+					}
+					group.HostNames = append(group.HostNames, name)
+				}
+
+				return
+			}
+
 			// initialize
 			group.Hosts = map[string]*Host{}
 
@@ -256,13 +343,20 @@ func applyGroupDefaultValues(L *lua.LState, group *Group) {
 	switch group.Type {
 	case GroupTypeHosts:
 		for _, h := range group.Hosts {
-			for k, v := range group.LValues {
-				if !isSkipKey(k) {
-					if h.LValues[k] == nil {
-						updateHost(L, h, k, v)
+			h := h
+			// the values of the host are known after the host's own config is applied.
+			applyDefaults := func(L *lua.LState) {
+				for k, v := range group.LValues {
+					if !isSkipKey(k) {
+						if h.LValues[k] == nil {
+							updateHost(L, h, k, v)
+						}
 					}
 				}
 			}
+			if !h.deferSetup(applyDefaults) {
+				applyDefaults(L)
+			}
 		}
 	case GroupTypeTasks:
 		for _, t := range group.Tasks {
@@ -318,7 +412,8 @@ func groupCall(L *lua.LState) int {
 
 	setupGroup(L, group, tb)
 
-	return 0
+	L.Push(L.CheckUserData(1))
+	return 1
 }
 
 func groupIndex(L *lua.LState) int {
@@ -326,6 +421,8 @@ func groupIndex(L *lua.LState) int {
 	index := L.CheckString(2)
 
 	switch index {
+	case "name":
+		L.Push(lua.LString(group.Name))
 	default:
 		v, ok := group.LValues[index]
 		if v == nil || !ok {
@@ -0,0 +1,140 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HealthCheck is a check that runs after the task's script finishes on each host in serial mode.
+// If it never passes, the task stops before running the script on the next host.
+type HealthCheck struct {
+	Command string
+	// Retries is the max number of the attempts.
+	Retries  int
+	Interval time.Duration
+	// Backend is a place where the command runs. "remote" runs it on the host and "local" runs it on the local machine.
+	Backend string
+}
+
+var (
+	DefaultHealthCheckRetries  = 10
+	DefaultHealthCheckInterval = 5 * time.Second
+)
+
+func toHealthCheck(value lua.LValue) (*HealthCheck, error) {
+	check := &HealthCheck{
+		Retries:  DefaultHealthCheckRetries,
+		Interval: DefaultHealthCheckInterval,
+		Backend:  TASK_BACKEND_REMOTE,
+	}
+
+	if s, ok := toString(value); ok {
+		check.Command = s
+		return check, nil
+	}
+
+	tb, ok := toLTable(value)
+	if !ok {
+		return nil, fmt.Errorf("health_check must be a string or a table.")
+	}
+
+	var err error
+	tb.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch key := lua.LVAsString(k); key {
+		case "command":
+			check.Command = lua.LVAsString(v)
+		case "retries":
+			n, ok := v.(lua.LNumber)
+			if !ok || n < 1 {
+				err = fmt.Errorf("retries of health_check must be a positive number.")
+				return
+			}
+			check.Retries = int(n)
+		case "interval":
+			d, perr := time.ParseDuration(lua.LVAsString(v))
+			if perr != nil {
+				err = fmt.Errorf("invalid interval of health_check: %v", perr)
+				return
+			}
+			check.Interval = d
+		case "backend":
+			check.Backend = lua.LVAsString(v)
+			if check.Backend != TASK_BACKEND_LOCAL && check.Backend != TASK_BACKEND_REMOTE {
+				err = fmt.Errorf("backend of health_check must be '%s' or '%s'.", TASK_BACKEND_LOCAL, TASK_BACKEND_REMOTE)
+				return
+			}
+		default:
+			err = fmt.Errorf("unsupported health_check's field '%s'.", key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if check.Command == "" {
+		return nil, fmt.Errorf("health_check requires a command.")
+	}
+
+	return check, nil
+}
+
+// runHealthCheck runs the health check of the task for the host until it passes.
+func runHealthCheck(config string, task *Task, host *Host) error {
+	check := task.HealthCheck
+
+	var output string
+	for i := 1; i <= check.Retries; i++ {
+		cmd := newHealthCheckCommand(config, task, host)
+		if debugFlag {
+			debugf("health check command: %v \n", cmd.Args)
+		}
+
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		output = strings.TrimSpace(out.String())
+
+		if i < check.Retries {
+			fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: health check of '%s' failed (%d/%d). retrying in %v...", host.Name, i, check.Retries, check.Interval))
+			time.Sleep(check.Interval)
+		}
+	}
+
+	if output != "" {
+		fmt.Fprintln(os.Stderr, output)
+	}
+
+	return fmt.Errorf("health check of '%s' didn't pass after %d attempts. the rollout is halted.", host.Name, check.Retries)
+}
+
+func newHealthCheckCommand(config string, task *Task, host *Host) *exec.Cmd {
+	check := task.HealthCheck
+	if check.Backend == TASK_BACKEND_LOCAL {
+		cmd := shellCommand(check.Command)
+		cmd.Env = append(os.Environ(),
+			"ESSH_SSH_CONFIG="+config,
+			"ESSH_HOSTNAME="+host.Name,
+			"ESSH_HOST_SSH_HOSTNAME="+host.SSHConfig["HostName"],
+		)
+		return cmd
+	}
+
+	args := append([]string{}, task.SSHOptions...)
+	args = append(args, "-F", config, host.Name, check.Command)
+
+	return exec.Command("ssh", args...)
+}
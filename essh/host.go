@@ -3,10 +3,14 @@ package essh
 import (
 	"bytes"
 	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
 	"github.com/yuin/gopher-lua"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 	"unicode"
 )
 
@@ -17,12 +21,33 @@ type Host struct {
 	HooksBeforeConnect   []interface{}
 	HooksAfterConnect    []interface{}
 	HooksAfterDisconnect []interface{}
+	HookFailures         map[string]string
 	Hidden               bool
+	Expires              time.Time
 	Tags                 []string
 	SSHConfig            map[string]string
+	Transfer             *TransferOptions
+	Certificate          *CertificateOptions
+	HostKey              string
+	WorkDir              string
+	RemoteShell          string
+	RemoteForwards       []string
+	OutputFilters        []*OutputFilter
+	EnvFile              string
+	EnvFileSecrets       []string
+	Alias                string
 	Registry             *Registry
 	Group                *Group
 	LValues              map[string]lua.LValue
+	// Source is a location "file:line" where the host is defined.
+	Source string
+	// envVars are the variables that are read from EnvFile before running tasks.
+	envVars []*EnvVar
+	// private is true if the host is defined inline in a task's "on". see registerTaskHosts.
+	private bool
+	// pending are the setups of the host that are deferred until the host is needed. see lazyHosts.
+	pending      []func(L *lua.LState)
+	materialized bool
 	// If you define same name hosts in multi time, stores it in layered structure that uses Parent and Child.
 	Parent *Host
 	Child  *Host
@@ -30,12 +55,18 @@ type Host struct {
 
 var Hosts map[string]*Host
 
+// lazyHosts defers evaluating the config tables of the hosts until the hosts are needed.
+// It is enabled when essh runs ssh command that needs only a few hosts,
+// so that it starts fast even if there are thousands of hosts.
+var lazyHosts bool
+
 func NewHost() *Host {
 	return &Host{
 		Props:                map[string]string{},
 		HooksBeforeConnect:   []interface{}{},
 		HooksAfterConnect:    []interface{}{},
 		HooksAfterDisconnect: []interface{}{},
+		HookFailures:         map[string]string{},
 		Tags:                 []string{},
 		SSHConfig:            map[string]string{},
 		LValues:              map[string]lua.LValue{},
@@ -68,6 +99,278 @@ func (h *Host) SortedSSHConfig() []map[string]string {
 	return values
 }
 
+// RemoteForwardConfigs returns the remote forwardings in ssh_config's RemoteForward format like "9000 localhost:3000".
+func (h *Host) RemoteForwardConfigs() []string {
+	configs := []string{}
+	for _, spec := range h.RemoteForwards {
+		listen, dest, err := parseRemoteForward(spec)
+		if err != nil {
+			continue
+		}
+		configs = append(configs, listen+" "+dest)
+	}
+
+	return configs
+}
+
+// sshArgsHosts returns the hosts that are specified in the ssh command args like "web01" or "user@web01".
+func sshArgsHosts(args []string) []*Host {
+	hosts := []*Host{}
+	for _, arg := range args {
+		name := arg
+		if at := strings.LastIndex(name, "@"); at >= 0 {
+			name = name[at+1:]
+		}
+
+		if host := Hosts[name]; host != nil {
+			hosts = append(hosts, host)
+			// ssh connects to only one host.
+			break
+		}
+	}
+
+	return hosts
+}
+
+// sshConfigHosts returns the hosts that are needed to run ssh command with the args.
+// They are the hosts that appear in the args (including "-J" option), the hosts that they jump through
+// and the hosts that have patterns in their names like "*.example.com".
+func sshConfigHosts(L *lua.LState, args []string, hosts []*Host) []*Host {
+	needed := map[string]bool{}
+
+	var add func(word string)
+	add = func(word string) {
+		for _, name := range strings.Split(word, ",") {
+			// "user@host:port" -> "host"
+			if at := strings.LastIndex(name, "@"); at >= 0 {
+				name = name[at+1:]
+			}
+			if colon := strings.Index(name, ":"); colon >= 0 {
+				name = name[:colon]
+			}
+
+			host := Hosts[name]
+			if host == nil || needed[name] {
+				continue
+			}
+			needed[name] = true
+			host.materialize(L)
+
+			if jump, ok := host.SSHConfig["ProxyJump"]; ok {
+				add(jump)
+			}
+			if command, ok := host.SSHConfig["ProxyCommand"]; ok {
+				for _, field := range strings.Fields(command) {
+					add(field)
+				}
+			}
+		}
+	}
+
+	for _, arg := range args {
+		add(arg)
+	}
+
+	ret := []*Host{}
+	for _, host := range hosts {
+		if needed[host.Name] || strings.ContainsAny(host.Name, "*?!") {
+			host.materialize(L)
+			ret = append(ret, host)
+		}
+	}
+
+	return ret
+}
+
+// materializeHosts materializes the hosts that are needed to run ssh command with the args,
+// or all the hosts for the other modes and the tasks.
+func materializeHosts(L *lua.LState, args []string) error {
+	return L.CallByParam(lua.P{
+		Fn: L.NewFunction(func(L *lua.LState) int {
+			if isSSHMode(args) {
+				sshConfigHosts(L, args, NewHostQuery().GetHostsOrderByName())
+			} else {
+				for _, host := range Hosts {
+					host.materialize(L)
+				}
+			}
+			return 0
+		}),
+		Protect: true,
+	})
+}
+
+// deferSetup defers fn until the host is needed while the hosts are loaded lazily.
+// It returns false if fn must be run now.
+func (h *Host) deferSetup(fn func(L *lua.LState)) bool {
+	if !lazyHosts || h.materialized {
+		return false
+	}
+
+	h.pending = append(h.pending, fn)
+	return true
+}
+
+// materialize runs the deferred setups of the host in the order they were defined.
+func (h *Host) materialize(L *lua.LState) {
+	if h.materialized {
+		return
+	}
+	h.materialized = true
+
+	// the error is reported with the location of the host, because it isn't raised where the host is defined.
+	defer func() {
+		if r := recover(); r != nil {
+			msg := fmt.Sprint(r)
+			if apiErr, ok := r.(*lua.ApiError); ok {
+				msg = apiErr.Object.String()
+			}
+			L.Error(lua.LString(h.Source+": "+strings.TrimSpace(msg)), 0)
+		}
+	}()
+
+	pending := h.pending
+	h.pending = nil
+	for _, fn := range pending {
+		fn(L)
+	}
+}
+
+// GroupNames returns names of the named groups that the host belongs to.
+func (h *Host) GroupNames() []string {
+	names := []string{}
+	for _, name := range GetGroupNames() {
+		if NamedGroups[name].HasHost(h) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// InGroup reports whether the host belongs to the named group.
+func (h *Host) InGroup(name string) bool {
+	if group := NamedGroups[name]; group != nil {
+		return group.HasHost(h)
+	}
+
+	return false
+}
+
+// HostExpiresFormat is a format of the host's "expires" field.
+const HostExpiresFormat = "2006-01-02"
+
+// Expired reports whether the host is expired. The host is available until the end of the day of "expires".
+func (h *Host) Expired() bool {
+	return !h.Expires.IsZero() && !time.Now().Before(h.Expires.AddDate(0, 0, 1))
+}
+
+// excludeExpiredHosts removes the expired hosts from the targets with a warning,
+// so that the short-lived hosts that are left in the config are never used silently.
+func excludeExpiredHosts(hosts []*Host) []*Host {
+	newHosts := []*Host{}
+	expired := []string{}
+	for _, host := range hosts {
+		if host.Expired() {
+			expired = append(expired, host.Name)
+			continue
+		}
+		newHosts = append(newHosts, host)
+	}
+
+	if len(expired) > 0 {
+		fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: skipped the expired hosts: %s", strings.Join(expired, ", ")))
+	}
+
+	return newHosts
+}
+
+// The policies when a hook fails.
+const (
+	HookFailureAbort  = "abort"
+	HookFailureWarn   = "warn"
+	HookFailureIgnore = "ignore"
+)
+
+// HookFailure returns the policy when the hook fails. A failing before_connect hook aborts the connection
+// and a failing after_disconnect hook is warned by default.
+func (h *Host) HookFailure(name string) string {
+	if policy, ok := h.HookFailures[name]; ok {
+		return policy
+	}
+
+	if name == "before_connect" {
+		return HookFailureAbort
+	}
+
+	return HookFailureWarn
+}
+
+func (h *Host) setHookFailure(name string, value lua.LValue) {
+	if value == lua.LNil {
+		return
+	}
+
+	policy, ok := toString(value)
+	if !ok || (policy != HookFailureAbort && policy != HookFailureWarn && policy != HookFailureIgnore) {
+		panic("invalid value of a host's field 'hooks_" + name + ".on_failure'. it must be 'abort', 'warn' or 'ignore'.")
+	}
+
+	h.HookFailures[name] = policy
+}
+
+// DefaultHostColumns are the columns that are displayed in the hosts list by default.
+var DefaultHostColumns = []string{"name", "description", "tags", "groups", "hidden"}
+
+// ColumnValue returns a value of the column to display in the hosts list.
+// A column that starts with an upper case character is regarded as an SSH config property,
+// otherwise it is an essh property or a key of the props.
+func (h *Host) ColumnValue(column string) string {
+	switch column {
+	case "name":
+		return h.Name
+	case "description":
+		return h.Description
+	case "tags":
+		return strings.Join(h.Tags, ",")
+	case "groups":
+		return strings.Join(h.GroupNames(), ",")
+	case "hidden":
+		if h.Hidden {
+			return "true"
+		}
+		return "false"
+	case "expires":
+		if h.Expires.IsZero() {
+			return ""
+		}
+		if h.Expired() {
+			return h.Expires.Format(HostExpiresFormat) + " (expired)"
+		}
+		return h.Expires.Format(HostExpiresFormat)
+	case "status":
+		return GetHostStatus(h.Name).String()
+	}
+
+	var firstChar rune
+	for _, c := range column {
+		firstChar = c
+		break
+	}
+
+	if unicode.IsUpper(firstChar) {
+		// ssh_config keywords are case-insensitive.
+		for key, value := range h.SSHConfig {
+			if strings.EqualFold(key, column) {
+				return value
+			}
+		}
+		return ""
+	}
+
+	return h.Props[strings.TrimPrefix(column, "props.")]
+}
+
 func (h *Host) DescriptionOrDefault() string {
 	if h.Description == "" {
 		return h.Name + " host"
@@ -76,8 +379,14 @@ func (h *Host) DescriptionOrDefault() string {
 	return h.Description
 }
 
-var hostsTemplate = `{{range $i, $host := .Hosts -}}
-Host {{$host.Name}}{{range $ii, $param := $host.SortedSSHConfig}}{{range $k, $v := $param}}
+var hostsTemplate = `{{range $i, $block := .Blocks -}}
+Host {{$block.Pattern}}{{range $ii, $param := $block.Params}}{{range $k, $v := $param}}
+    {{$k}} {{$v}}{{end}}{{end}}{{range $ii, $forward := $block.RemoteForwards}}
+    RemoteForward {{$forward}}{{end}}
+
+{{end -}}
+{{if .Connection -}}
+Host *{{range $i, $param := .Connection}}{{range $k, $v := $param}}
     {{$k}} {{$v}}{{end}}{{end}}
 
 {{end -}}`
@@ -88,7 +397,10 @@ func GenHostsConfig(enabledHosts []*Host) ([]byte, error) {
 		return nil, err
 	}
 
-	input := map[string]interface{}{"Hosts": enabledHosts}
+	input := map[string]interface{}{
+		"Blocks":     compactHostsConfig(enabledHosts),
+		"Connection": SortedConnectionSettings(),
+	}
 	var b bytes.Buffer
 	if err := tmpl.Execute(&b, input); err != nil {
 		return nil, err
@@ -134,6 +446,11 @@ func HostnameAlignString(host *Host, hosts []*Host) func(string) string {
 func esshHost(L *lua.LState) int {
 	value := L.CheckAny(1)
 	if tb, ok := toLTable(value); ok {
+		// inline style that defines a private host of a task like 'on = { host { name = "tmp", ... } }'
+		if name, ok := toString(tb.RawGetString("name")); ok {
+			L.Push(newLHost(L, newPrivateHost(L, name, tb)))
+			return 1
+		}
 
 		hostsTb := L.NewTable()
 		tb.ForEach(func(k, v lua.LValue) {
@@ -177,14 +494,34 @@ func esshHost(L *lua.LState) int {
 	}
 }
 
+// newPrivateHost creates a host that isn't registered until the task that has it runs.
+func newPrivateHost(L *lua.LState, name string, config *lua.LTable) *Host {
+	h := NewHost()
+	h.Name = name
+	h.Registry = CurrentRegistry
+	h.Source = strings.TrimSuffix(L.Where(1), ":")
+	h.private = true
+
+	hostConfig := L.NewTable()
+	config.ForEach(func(k, v lua.LValue) {
+		if k.String() != "name" {
+			hostConfig.RawSet(k, v)
+		}
+	})
+	setupHost(L, h, hostConfig)
+
+	return h
+}
+
 func registerHost(L *lua.LState, name string) *Host {
 	if debugFlag {
-		fmt.Printf("[essh debug] register host: %s\n", name)
+		debugf("register host: %s\n", name)
 	}
 
 	h := NewHost()
 	h.Name = name
 	h.Registry = CurrentRegistry
+	h.Source = strings.TrimSuffix(L.Where(1), ":")
 
 	if host := Hosts[h.Name]; host != nil {
 		// detect same name host
@@ -198,6 +535,10 @@ func registerHost(L *lua.LState, name string) *Host {
 }
 
 func setupHost(L *lua.LState, h *Host, config *lua.LTable) {
+	if h.deferSetup(func(L *lua.LState) { setupHost(L, h, config) }) {
+		return
+	}
+
 	config.ForEach(func(k, v lua.LValue) {
 		if kstr, ok := toString(k); ok {
 			updateHost(L, h, kstr, v)
@@ -206,6 +547,10 @@ func setupHost(L *lua.LState, h *Host, config *lua.LTable) {
 }
 
 func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
+	if h.deferSetup(func(L *lua.LState) { updateHost(L, h, key, value) }) {
+		return
+	}
+
 	h.LValues[key] = value
 
 	var firstChar rune
@@ -253,6 +598,7 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			}
 
 			h.HooksBeforeConnect = hooks
+			h.setHookFailure("before_connect", tb.RawGetString("on_failure"))
 		} else {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
@@ -265,6 +611,10 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			}
 
 			h.HooksAfterConnect = hooks
+			// the hooks run in the remote script, so essh can't handle their failures.
+			if tb.RawGetString("on_failure") != lua.LNil {
+				L.RaiseError("hooks_after_connect of the host '%s' doesn't support 'on_failure'.", h.Name)
+			}
 		} else {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
@@ -277,6 +627,7 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			}
 
 			h.HooksAfterDisconnect = hooks
+			h.setHookFailure("after_disconnect", tb.RawGetString("on_failure"))
 		} else {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
@@ -286,6 +637,62 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
+	case "remote_shell":
+		shellStr, ok := toString(value)
+		if !ok {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+		if err := validateRemoteShell(shellStr); err != nil {
+			L.RaiseError("%v", err)
+		}
+		h.RemoteShell = shellStr
+	case "env_file":
+		if pathStr, ok := toString(value); ok {
+			h.EnvFile = pathStr
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+	case "env_file_secrets":
+		if secretsTb, ok := toLTable(value); ok {
+			h.EnvFileSecrets = []string{}
+			secretsTb.ForEach(func(_ lua.LValue, v lua.LValue) {
+				if vs, ok := toString(v); ok {
+					h.EnvFileSecrets = append(h.EnvFileSecrets, vs)
+				} else {
+					L.RaiseError("env_file_secrets must be a list of the variable names.")
+				}
+			})
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+	case "output_filters":
+		filters, err := toOutputFilters(L, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		h.OutputFilters = filters
+	case "alias":
+		alias, err := toHostAlias(h, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		h.Alias = alias
+	case "work_dir":
+		if dirStr, ok := toString(value); ok {
+			h.WorkDir = dirStr
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+	case "expires":
+		expiresStr, ok := toString(value)
+		if !ok {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+		expires, err := time.ParseInLocation(HostExpiresFormat, expiresStr, time.Local)
+		if err != nil {
+			panic("invalid value of a host's field '" + key + "'. it must be a date like '2024-12-31'.")
+		}
+		h.Expires = expires
 
 	case "hidden":
 		if hiddenBool, ok := toBool(value); ok {
@@ -310,6 +717,76 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
 
+	case "identity_file":
+		if path, ok := toString(value); ok {
+			if _, err := os.Stat(expandHomeDir(path)); err != nil {
+				L.RaiseError("identity_file of the host '%s' is invalid: %v", h.Name, err)
+			}
+			h.SSHConfig["IdentityFile"] = path
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
+	case "forward_agent":
+		if b, ok := toBool(value); ok {
+			if b {
+				h.SSHConfig["ForwardAgent"] = "yes"
+			} else {
+				h.SSHConfig["ForwardAgent"] = "no"
+			}
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
+	case "port":
+		port, err := strconv.Atoi(lua.LVAsString(value))
+		if err != nil || port < 1 || port > 65535 {
+			L.RaiseError("port of the host '%s' must be a number between 1 and 65535: %v", h.Name, value)
+		}
+		h.SSHConfig["Port"] = strconv.Itoa(port)
+
+	case "certificate":
+		if tb, ok := toLTable(value); ok {
+			cert, err := toCertificateOptions(tb)
+			if err != nil {
+				L.RaiseError("%v", err)
+			}
+			h.Certificate = cert
+			if _, ok := h.SSHConfig["IdentityFile"]; !ok {
+				h.SSHConfig["IdentityFile"] = cert.IdentityFile
+			}
+			h.SSHConfig["CertificateFile"] = cert.CertificateFile()
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
+	case "host_key":
+		if key, ok := toString(value); ok {
+			if err := h.setHostKey(key); err != nil {
+				L.RaiseError("%v", err)
+			}
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
+	case "remote_forwards":
+		forwards, err := toRemoteForwards(value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		h.RemoteForwards = forwards
+
+	case "transfer":
+		if tb, ok := toLTable(value); ok {
+			transfer, err := toTransferOptions(tb)
+			if err != nil {
+				L.RaiseError("%v", err)
+			}
+			h.Transfer = transfer
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
 	default:
 		panic("unsupported host's field '" + key + "'.")
 
@@ -363,6 +840,15 @@ func hostIndex(L *lua.LState) int {
 		return 1
 	}
 
+	if index == "state" {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(newLHostState(L, hostState(host.Name)))
+			return 1
+		}))
+		return 1
+	}
+
+	host.materialize(L)
 	v, ok := host.LValues[index]
 	if v == nil || !ok {
 		v = lua.LNil
@@ -0,0 +1,53 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"regexp"
+)
+
+// aliasNameRegexp is the names that can be used as the shell functions in bash and zsh.
+var aliasNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// toHostAlias converts the value of the host's alias field to the name of the shell function.
+// true uses the host name, and a string uses it as the name.
+func toHostAlias(h *Host, value lua.LValue) (string, error) {
+	name := ""
+	if b, ok := toBool(value); ok {
+		if !b {
+			return "", nil
+		}
+		name = h.Name
+	} else if s, ok := toString(value); ok {
+		name = s
+	} else {
+		return "", fmt.Errorf("invalid value of a host's field 'alias'.")
+	}
+
+	if !aliasNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("'%s' can't be used as the alias of the host '%s'. specify the name like alias = \"web01\".", name, h.Name)
+	}
+
+	return name, nil
+}
+
+// hostAliases returns the aliases of the hosts for --aliases. They are defined only by --host-aliases,
+// because the config files must be evaluated to get them.
+func hostAliases() []map[string]string {
+	aliases := []map[string]string{}
+	if !hostAliasesFlag {
+		return aliases
+	}
+
+	for _, h := range NewHostQuery().GetHostsOrderByName() {
+		if h.Alias == "" {
+			continue
+		}
+		aliases = append(aliases, map[string]string{
+			"Alias": h.Alias,
+			"Host":  ShellEscape(h.Name),
+		})
+	}
+
+	return aliases
+}
@@ -0,0 +1,146 @@
+package essh
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxHostLineLength is a max length of a "Host" line of the generated ssh_config.
+// Old versions of OpenSSH can't read a long line, so a group that has many hosts is split into several sections.
+const maxHostLineLength = 1000
+
+// HostConfigBlock is a "Host" section of the generated ssh_config.
+type HostConfigBlock struct {
+	Patterns       []string
+	Params         []map[string]string
+	RemoteForwards []string
+}
+
+func (b *HostConfigBlock) Pattern() string {
+	return strings.Join(b.Patterns, " ")
+}
+
+// compactHostsConfig factors the options that have the same value in several hosts into sections
+// like "Host web01 web02 web03", so that the generated ssh_config is small even if there are thousands of hosts.
+// ssh uses the first obtained value of each option. Every option of a host is written in only one section,
+// so the order of the sections doesn't change the values. The hosts that have patterns in their names
+// (and the hosts that match the patterns) keep their own sections in the original order.
+func compactHostsConfig(hosts []*Host) []*HostConfigBlock {
+	patterns := []string{}
+	for _, host := range hosts {
+		if strings.ContainsAny(host.Name, "*?!") {
+			patterns = append(patterns, strings.FieldsFunc(host.Name, func(r rune) bool { return r == ',' || r == ' ' })...)
+		}
+	}
+
+	groupable := func(host *Host) bool {
+		for _, pattern := range patterns {
+			// a negated pattern may match any host.
+			if strings.HasPrefix(pattern, "!") {
+				return false
+			}
+			if pattern == host.Name {
+				return false
+			}
+			if matched, _ := filepath.Match(pattern, host.Name); matched {
+				return false
+			}
+		}
+		return true
+	}
+
+	// collect the hosts that have the same option.
+	sharedHosts := map[string][]string{}
+	for _, host := range hosts {
+		if !groupable(host) {
+			continue
+		}
+		for key, value := range host.SSHConfig {
+			option := key + " " + value
+			sharedHosts[option] = append(sharedHosts[option], host.Name)
+		}
+	}
+
+	// merge the options that are shared by the same hosts into a group.
+	groups := map[string]*HostConfigBlock{}
+	grouped := map[string]bool{}
+	for option, names := range sharedHosts {
+		if len(names) < 2 {
+			continue
+		}
+
+		id := strings.Join(names, " ")
+		group := groups[id]
+		if group == nil {
+			group = &HostConfigBlock{Patterns: names}
+			groups[id] = group
+		}
+
+		kv := strings.SplitN(option, " ", 2)
+		group.Params = append(group.Params, map[string]string{kv[0]: kv[1]})
+		for _, name := range names {
+			grouped[name+" "+kv[0]] = true
+		}
+	}
+
+	blocks := []*HostConfigBlock{}
+	for _, host := range hosts {
+		block := &HostConfigBlock{
+			Patterns:       []string{host.Name},
+			Params:         []map[string]string{},
+			RemoteForwards: host.RemoteForwardConfigs(),
+		}
+		for _, param := range host.SortedSSHConfig() {
+			for key := range param {
+				if !grouped[host.Name+" "+key] {
+					block.Params = append(block.Params, param)
+				}
+			}
+		}
+
+		if len(block.Params) > 0 || len(block.RemoteForwards) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+
+	ids := []string{}
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		group := groups[id]
+		sort.Slice(group.Params, func(i, j int) bool { return paramKey(group.Params[i]) < paramKey(group.Params[j]) })
+		blocks = append(blocks, splitHostConfigBlock(group)...)
+	}
+
+	return blocks
+}
+
+func paramKey(param map[string]string) string {
+	for key := range param {
+		return key
+	}
+	return ""
+}
+
+// splitHostConfigBlock splits a section that has a long "Host" line.
+func splitHostConfigBlock(block *HostConfigBlock) []*HostConfigBlock {
+	blocks := []*HostConfigBlock{}
+
+	patterns := []string{}
+	length := 0
+	for _, pattern := range block.Patterns {
+		if len(patterns) > 0 && length+len(pattern)+1 > maxHostLineLength {
+			blocks = append(blocks, &HostConfigBlock{Patterns: patterns, Params: block.Params})
+			patterns = []string{}
+			length = 0
+		}
+		patterns = append(patterns, pattern)
+		length += len(pattern) + 1
+	}
+
+	return append(blocks, &HostConfigBlock{Patterns: patterns, Params: block.Params})
+}
@@ -0,0 +1,190 @@
+package essh
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func hostConfigTestHost(name string, config map[string]string) *Host {
+	h := NewHost()
+	h.Name = name
+	for key, value := range config {
+		h.SSHConfig[key] = value
+	}
+	return h
+}
+
+// hostConfigTestBlocks renders the blocks like the sections of ssh_config to compare them easily.
+func hostConfigTestBlocks(blocks []*HostConfigBlock) []string {
+	ret := []string{}
+	for _, block := range blocks {
+		lines := []string{"Host " + block.Pattern()}
+		for _, param := range block.Params {
+			for key, value := range param {
+				lines = append(lines, key+" "+value)
+			}
+		}
+		for _, forward := range block.RemoteForwards {
+			lines = append(lines, "RemoteForward "+forward)
+		}
+		ret = append(ret, strings.Join(lines, "; "))
+	}
+	return ret
+}
+
+func TestCompactHostsConfig(t *testing.T) {
+	cases := []struct {
+		name  string
+		hosts []*Host
+		want  []string
+	}{
+		{
+			name: "no shared options",
+			hosts: []*Host{
+				hostConfigTestHost("web01", map[string]string{"HostName": "192.168.0.11"}),
+				hostConfigTestHost("web02", map[string]string{"HostName": "192.168.0.12"}),
+			},
+			want: []string{
+				"Host web01; HostName 192.168.0.11",
+				"Host web02; HostName 192.168.0.12",
+			},
+		},
+		{
+			name: "shared options are grouped",
+			hosts: []*Host{
+				hostConfigTestHost("web01", map[string]string{"HostName": "192.168.0.11", "User": "deploy", "Port": "2222"}),
+				hostConfigTestHost("web02", map[string]string{"HostName": "192.168.0.12", "User": "deploy", "Port": "2222"}),
+				hostConfigTestHost("db01", map[string]string{"HostName": "192.168.0.21", "User": "deploy"}),
+			},
+			want: []string{
+				"Host web01; HostName 192.168.0.11",
+				"Host web02; HostName 192.168.0.12",
+				"Host db01; HostName 192.168.0.21",
+				"Host web01 web02; Port 2222",
+				"Host web01 web02 db01; User deploy",
+			},
+		},
+		{
+			name: "a host whose options are all shared has no own section",
+			hosts: []*Host{
+				hostConfigTestHost("web01", map[string]string{"User": "deploy"}),
+				hostConfigTestHost("web02", map[string]string{"User": "deploy"}),
+			},
+			want: []string{
+				"Host web01 web02; User deploy",
+			},
+		},
+		{
+			name: "the options that have different values are not grouped",
+			hosts: []*Host{
+				hostConfigTestHost("web01", map[string]string{"User": "deploy"}),
+				hostConfigTestHost("web02", map[string]string{"User": "admin"}),
+			},
+			want: []string{
+				"Host web01; User deploy",
+				"Host web02; User admin",
+			},
+		},
+		{
+			name: "patterned hosts and the hosts that match them are excluded",
+			hosts: []*Host{
+				hostConfigTestHost("*.example.com", map[string]string{"User": "deploy"}),
+				hostConfigTestHost("web01.example.com", map[string]string{"User": "deploy"}),
+				hostConfigTestHost("web01", map[string]string{"User": "deploy"}),
+				hostConfigTestHost("web02", map[string]string{"User": "deploy"}),
+			},
+			want: []string{
+				"Host *.example.com; User deploy",
+				"Host web01.example.com; User deploy",
+				"Host web01 web02; User deploy",
+			},
+		},
+		{
+			name: "a negated pattern excludes all the hosts",
+			hosts: []*Host{
+				hostConfigTestHost("* !bastion", map[string]string{"ProxyJump": "bastion"}),
+				hostConfigTestHost("web01", map[string]string{"User": "deploy"}),
+				hostConfigTestHost("web02", map[string]string{"User": "deploy"}),
+			},
+			want: []string{
+				"Host * !bastion; ProxyJump bastion",
+				"Host web01; User deploy",
+				"Host web02; User deploy",
+			},
+		},
+		{
+			name: "remote forwards are kept in the host's section",
+			hosts: []*Host{
+				func() *Host {
+					h := hostConfigTestHost("web01", map[string]string{"User": "deploy"})
+					h.RemoteForwards = []string{"8080:localhost:80"}
+					return h
+				}(),
+				hostConfigTestHost("web02", map[string]string{"User": "deploy"}),
+			},
+			want: []string{
+				"Host web01; RemoteForward 8080 localhost:80",
+				"Host web01 web02; User deploy",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		got := hostConfigTestBlocks(compactHostsConfig(c.hosts))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\nexpected %q\n     got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestSplitHostConfigBlock(t *testing.T) {
+	names := func(n int, width int) []string {
+		ret := []string{}
+		for i := 0; i < n; i++ {
+			ret = append(ret, fmt.Sprintf("h%0*d", width-1, i))
+		}
+		return ret
+	}
+	params := []map[string]string{{"User": "deploy"}}
+
+	cases := []struct {
+		name     string
+		patterns []string
+		// sizes are the numbers of the patterns in the split blocks.
+		sizes []int
+	}{
+		{name: "one pattern", patterns: []string{"web01"}, sizes: []int{1}},
+		{name: "short line", patterns: names(10, 9), sizes: []int{10}},
+		// each pattern takes 10 characters with the space, so a line has 100 patterns at most.
+		{name: "exactly the max length", patterns: names(100, 9), sizes: []int{100}},
+		{name: "one more than the max length", patterns: names(101, 9), sizes: []int{100, 1}},
+		{name: "several lines", patterns: names(250, 9), sizes: []int{100, 100, 50}},
+		{name: "a pattern that is longer than the max length", patterns: []string{strings.Repeat("a", 1200), "web01"}, sizes: []int{1, 1}},
+	}
+
+	for _, c := range cases {
+		blocks := splitHostConfigBlock(&HostConfigBlock{Patterns: c.patterns, Params: params})
+
+		sizes := []int{}
+		patterns := []string{}
+		for _, block := range blocks {
+			sizes = append(sizes, len(block.Patterns))
+			patterns = append(patterns, block.Patterns...)
+			if len(block.Patterns) > 1 && len(block.Pattern()) > maxHostLineLength {
+				t.Errorf("%s: the line is longer than %d: %d", c.name, maxHostLineLength, len(block.Pattern()))
+			}
+			if !reflect.DeepEqual(block.Params, params) {
+				t.Errorf("%s: the params are not kept: %v", c.name, block.Params)
+			}
+		}
+
+		if !reflect.DeepEqual(sizes, c.sizes) {
+			t.Errorf("%s: expected the blocks of %v patterns but got %v", c.name, c.sizes, sizes)
+		}
+		if !reflect.DeepEqual(patterns, c.patterns) {
+			t.Errorf("%s: the patterns are changed", c.name)
+		}
+	}
+}
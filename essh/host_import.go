@@ -0,0 +1,231 @@
+package essh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// importedHost is a pair of a name and an address that is read from a hosts file or a zone file.
+type importedHost struct {
+	Name    string
+	Address string
+}
+
+// esshImportEtcHosts registers the hosts from the entries of /etc/hosts.
+func esshImportEtcHosts(L *lua.LState) int {
+	opts := L.OptTable(1, L.NewTable())
+	path := "/etc/hosts"
+	if v, ok := toString(opts.RawGetString("path")); ok {
+		path = v
+	}
+
+	entries, err := readEtcHosts(path)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(registerImportedHosts(L, opts, entries))
+	return 1
+}
+
+// esshImportZone registers the hosts from the A and AAAA records of a DNS zone file.
+func esshImportZone(L *lua.LState) int {
+	opts := L.CheckTable(1)
+	path, ok := toString(opts.RawGetString("path"))
+	if !ok {
+		L.RaiseError("import_zone requires 'path'.")
+	}
+	origin, _ := toString(opts.RawGetString("origin"))
+
+	entries, err := readZoneFile(path, origin)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(registerImportedHosts(L, opts, entries))
+	return 1
+}
+
+// registerImportedHosts registers the hosts that match the 'pattern' option with the 'host' option as their config.
+func registerImportedHosts(L *lua.LState, opts *lua.LTable, entries []*importedHost) *lua.LTable {
+	var pattern *regexp.Regexp
+	if v, ok := toString(opts.RawGetString("pattern")); ok {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			L.RaiseError("invalid pattern: %v", err)
+		}
+		pattern = re
+	}
+
+	config, _ := toLTable(opts.RawGetString("host"))
+
+	hostsTb := L.NewTable()
+	for _, entry := range entries {
+		if pattern != nil && !pattern.MatchString(entry.Name) {
+			continue
+		}
+		// the first address of the name is used.
+		if hostsTb.RawGetString(entry.Name) != lua.LNil {
+			continue
+		}
+
+		h := registerHost(L, entry.Name)
+		if config != nil {
+			setupHost(L, h, config)
+		}
+		updateHost(L, h, "HostName", lua.LString(entry.Address))
+		hostsTb.RawSetString(entry.Name, newLHost(L, h))
+	}
+
+	return hostsTb
+}
+
+// readEtcHosts reads the names and the addresses from a hosts file.
+// The loopback, multicast and unspecified addresses are skipped.
+func readEtcHosts(path string) ([]*importedHost, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*importedHost{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			entries = append(entries, &importedHost{Name: name, Address: fields[0]})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// readZoneFile reads the names and the addresses from the A and AAAA records of a zone file.
+// The names are fully qualified without the trailing dots.
+func readZoneFile(path string, origin string) ([]*importedHost, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	origin = strings.TrimSuffix(origin, ".")
+	owner := ""
+	entries := []*importedHost{}
+
+	// the records in parentheses (like SOA) continue to the closing parenthesis.
+	record := ""
+	depth := 0
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+
+		if depth > 0 {
+			record += " " + line
+		} else {
+			record = line
+		}
+		depth += strings.Count(line, "(") - strings.Count(line, ")")
+		if depth > 0 {
+			continue
+		}
+
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(record))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: $ORIGIN requires a domain name.", path, n)
+			}
+			origin = strings.TrimSuffix(qualifyZoneName(fields[1], origin), ".")
+			continue
+		case "$TTL", "$INCLUDE", "$GENERATE":
+			continue
+		}
+
+		// a record that starts with a blank has the same owner as the previous record.
+		if record[0] != ' ' && record[0] != '\t' {
+			owner = qualifyZoneName(fields[0], origin)
+			fields = fields[1:]
+		}
+
+		// skip the ttl and the class.
+		for len(fields) > 0 && (isZoneTTL(fields[0]) || isZoneClass(fields[0])) {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 || owner == "" {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "A", "AAAA":
+			if net.ParseIP(fields[1]) == nil {
+				return nil, fmt.Errorf("%s:%d: invalid address '%s'.", path, n, fields[1])
+			}
+			entries = append(entries, &importedHost{Name: strings.TrimSuffix(owner, "."), Address: fields[1]})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func qualifyZoneName(name string, origin string) string {
+	if name == "@" {
+		return origin + "."
+	}
+	if strings.HasSuffix(name, ".") || origin == "" {
+		return name
+	}
+	return name + "." + origin + "."
+}
+
+var zoneTTLRegexp = regexp.MustCompile(`(?i)^[0-9]+[smhdw]?([0-9]+[smhdw])*$`)
+
+func isZoneTTL(s string) bool {
+	return zoneTTLRegexp.MatchString(s)
+}
+
+func isZoneClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package essh
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KnownHostsDir is a directory that stores known_hosts files of the hosts that have host_key.
+func KnownHostsDir() string {
+	return filepath.Join(UserDataDir, "known_hosts")
+}
+
+// KnownHostsFile returns a known_hosts file that is used only for the host.
+func (h *Host) KnownHostsFile() string {
+	return filepath.Join(KnownHostsDir(), h.Name)
+}
+
+// setHostKey pins the host key. The key is a public key like "ssh-ed25519 AAAA..." or a fingerprint like "SHA256:...".
+// The host is connected with the essh managed known_hosts file and strict host key checking.
+func (h *Host) setHostKey(key string) error {
+	key = strings.TrimSpace(key)
+	if !isHostKeyFingerprint(key) && len(strings.Fields(key)) < 2 {
+		return fmt.Errorf("host_key of the host '%s' must be a public key like 'ssh-ed25519 AAAA...' or a fingerprint like 'SHA256:...'.", h.Name)
+	}
+
+	h.HostKey = key
+	h.SSHConfig["HostKeyAlias"] = h.Name
+	h.SSHConfig["UserKnownHostsFile"] = h.KnownHostsFile()
+	h.SSHConfig["StrictHostKeyChecking"] = "yes"
+
+	return nil
+}
+
+func isHostKeyFingerprint(key string) bool {
+	return strings.HasPrefix(key, "SHA256:")
+}
+
+// writeKnownHosts writes known_hosts files of the hosts that pin a public key.
+// The hosts that pin a fingerprint are written by verifyHostKeys when they are connected.
+func writeKnownHosts(hosts []*Host) error {
+	for _, host := range hosts {
+		if host.HostKey == "" || isHostKeyFingerprint(host.HostKey) {
+			continue
+		}
+
+		fields := strings.Fields(host.HostKey)
+		if err := writeKnownHostsFile(host, fields[0]+" "+fields[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeKnownHostsFile(host *Host, key string) error {
+	if err := os.MkdirAll(KnownHostsDir(), os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(host.KnownHostsFile(), []byte(host.Name+" "+key+"\n"), 0600)
+}
+
+// verifyHostKeys gets the host keys and writes the key that matches the pinned fingerprint.
+// If no key matches, it returns an error and doesn't connect to the host.
+// The key that was verified before is used as it is, so the hosts are scanned only at the first connection.
+func verifyHostKeys(config string, hosts []*Host) error {
+	for _, host := range hosts {
+		if !isHostKeyFingerprint(host.HostKey) {
+			continue
+		}
+
+		if key := matchedHostKey(host, readKnownHostsFile(host)); key != "" {
+			if debugFlag {
+				debugf("use the verified host key of '%s'\n", host.Name)
+			}
+			continue
+		}
+
+		var key string
+		var err error
+		if isProxiedHost(host) {
+			key, err = scanHostKeysThroughProxy(config, host)
+		} else {
+			key, err = scanHostKeys(host)
+		}
+		if err != nil {
+			return err
+		}
+
+		if key == "" {
+			return fmt.Errorf("host key verification failed. '%s' doesn't have the host key %s.", host.Name, host.HostKey)
+		}
+
+		if err := writeKnownHostsFile(host, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isProxiedHost reports whether the host is connected through ProxyJump or ProxyCommand.
+// ssh-keyscan can't connect to it directly.
+func isProxiedHost(host *Host) bool {
+	for key := range host.SSHConfig {
+		if strings.EqualFold(key, "ProxyJump") || strings.EqualFold(key, "ProxyCommand") {
+			return true
+		}
+	}
+	return false
+}
+
+// scanHostKeys gets the host keys by ssh-keyscan and returns the key that matches the pinned fingerprint.
+func scanHostKeys(host *Host) (string, error) {
+	hostname := host.Name
+	if v, ok := host.SSHConfig["HostName"]; ok {
+		hostname = v
+	}
+	args := []string{}
+	if port, ok := host.SSHConfig["Port"]; ok {
+		args = append(args, "-p", port)
+	}
+	args = append(args, hostname)
+
+	if debugFlag {
+		debugf("scan host keys of '%s': ssh-keyscan %s\n", host.Name, strings.Join(args, " "))
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("ssh-keyscan", args...)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to scan host keys of '%s': %v", host.Name, err)
+	}
+
+	return matchedHostKey(host, stdout.String()), nil
+}
+
+// ProxiedHostKeyAlgorithms are the host key algorithms that are tried in order to get the host key through the proxy.
+var ProxiedHostKeyAlgorithms = []string{
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"rsa-sha2-512",
+}
+
+// ProxiedHostKeyScanTimeout is the time limit of a connection to get the host key through the proxy.
+const ProxiedHostKeyScanTimeout = 30 * time.Second
+
+// scanHostKeysThroughProxy gets the host keys by ssh with the generated config, so that the host is connected
+// through its ProxyJump or ProxyCommand. ssh records the host key that it receives into a temporary known_hosts file
+// before the authentication, so the result of the authentication doesn't matter.
+// ssh receives only one key per connection, so it connects for each algorithm until the key matches.
+func scanHostKeysThroughProxy(config string, host *Host) (string, error) {
+	dir, err := ioutil.TempDir("", "essh.known_hosts.")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	for i, algorithm := range ProxiedHostKeyAlgorithms {
+		file := filepath.Join(dir, strconv.Itoa(i))
+		args := []string{
+			"-F", config,
+			"-o", "BatchMode=yes",
+			"-o", "ConnectTimeout=10",
+			"-o", "ControlPath=none",
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "HashKnownHosts=no",
+			"-o", "UserKnownHostsFile=" + file,
+			"-o", "HostKeyAlias=" + host.Name,
+			"-o", "HostKeyAlgorithms=" + algorithm,
+			// the host isn't trusted yet, so nothing is sent to it and no session is opened.
+			"-o", "PreferredAuthentications=none",
+			"-o", "PubkeyAuthentication=no",
+			"-o", "ForwardAgent=no",
+			"-o", "ForwardX11=no",
+			"-o", "ClearAllForwardings=yes",
+			"-N",
+			host.Name,
+		}
+
+		if debugFlag {
+			debugf("scan host keys of '%s' through the proxy: ssh %s\n", host.Name, strings.Join(args, " "))
+		}
+
+		// the error is ignored because the authentication fails after the key is recorded.
+		// ssh with -N doesn't exit if the host allows the authentication "none", so it is killed after the timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), ProxiedHostKeyScanTimeout)
+		runCommandContext(ctx, exec.Command("ssh", args...))
+		cancel()
+
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if key := matchedHostKey(host, string(b)); key != "" {
+			return key, nil
+		}
+	}
+
+	return "", nil
+}
+
+// readKnownHostsFile returns the content of the known_hosts file of the host. It returns "" if the file doesn't exist.
+func readKnownHostsFile(host *Host) string {
+	b, err := ioutil.ReadFile(host.KnownHostsFile())
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// matchedHostKey returns the key like "ssh-ed25519 AAAA..." in the known_hosts formatted content
+// that matches the pinned fingerprint of the host. It returns "" if no key matches.
+func matchedHostKey(host *Host, content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fp, err := hostKeyFingerprint(fields[2]); err == nil && fp == host.HostKey {
+			return fields[1] + " " + fields[2]
+		}
+	}
+
+	return ""
+}
+
+// hostKeyFingerprint returns the SHA256 fingerprint of the base64 encoded public key in the same format as ssh-keygen -l.
+func hostKeyFingerprint(encodedKey string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
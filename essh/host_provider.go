@@ -0,0 +1,510 @@
+package essh
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// HostProvider is a source of hosts that are fetched dynamically (like cloud APIs and inventory systems).
+// The providers are fetched concurrently after the config file is evaluated (before the override config files).
+type HostProvider struct {
+	Name    string
+	Type    string
+	Timeout time.Duration
+	// CacheTTL is a duration to use the cached hosts without fetching. 0 means that it fetches every time.
+	// The cache that is older than it is still used, and it is refreshed in the background.
+	CacheTTL time.Duration
+	Options  map[string]interface{}
+	Source   string
+	Registry *Registry
+	Fetched  bool
+}
+
+var HostProviders []*HostProvider
+
+var DefaultHostProviderTimeout = 30 * time.Second
+
+var DefaultRefreshInterval = time.Minute
+
+// ProvidedHost is a host that a provider returns. Config has the same keys as the host's config in Lua.
+type ProvidedHost struct {
+	Name   string                 `json:"name"`
+	Config map[string]interface{} `json:"config"`
+}
+
+// hostProviderFetchers are the functions to fetch hosts by the provider's type.
+var hostProviderFetchers = map[string]func(ctx context.Context, p *HostProvider) ([]*ProvidedHost, error){
+	"command": fetchCommandHosts,
+	"consul":  fetchConsulHosts,
+	"mdns":    fetchMDNSHosts,
+	"json":    fetchJSONHosts,
+	"zabbix":  fetchZabbixHosts,
+}
+
+func esshHostProvider(L *lua.LState) int {
+	typ := L.CheckString(1)
+	if L.GetTop() == 2 {
+		// function style
+		registerHostProvider(L, typ, L.CheckTable(2))
+		return 0
+	}
+
+	// DSL style
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		registerHostProvider(L, typ, L.CheckTable(1))
+		return 0
+	}))
+	return 1
+}
+
+func registerHostProvider(L *lua.LState, typ string, config *lua.LTable) {
+	if _, ok := hostProviderFetchers[typ]; !ok {
+		L.RaiseError("unsupported host provider '%s'.", typ)
+	}
+
+	p := &HostProvider{
+		Name:     typ,
+		Type:     typ,
+		Timeout:  DefaultHostProviderTimeout,
+		Options:  map[string]interface{}{},
+		Source:   strings.TrimSuffix(L.Where(1), ":"),
+		Registry: CurrentRegistry,
+	}
+
+	config.ForEach(func(k, v lua.LValue) {
+		key := lua.LVAsString(k)
+		switch key {
+		case "name":
+			p.Name = lua.LVAsString(v)
+		case "timeout":
+			d, err := time.ParseDuration(lua.LVAsString(v))
+			if err != nil {
+				L.RaiseError("invalid timeout of the host provider '%s': %v", p.Name, err)
+			}
+			p.Timeout = d
+		case "cache_ttl":
+			d, err := time.ParseDuration(lua.LVAsString(v))
+			if err != nil {
+				L.RaiseError("invalid cache_ttl of the host provider '%s': %v", p.Name, err)
+			}
+			p.CacheTTL = d
+		default:
+			p.Options[key] = toProviderOption(v)
+		}
+	})
+
+	if debugFlag {
+		debugf("register host provider: %s (%s)\n", p.Name, p.Type)
+	}
+
+	HostProviders = append(HostProviders, p)
+}
+
+// toProviderOption converts a Lua value to a Go value, because the providers are fetched in other goroutines
+// that can't touch the Lua state.
+func toProviderOption(value lua.LValue) interface{} {
+	tb, ok := toLTable(value)
+	if !ok {
+		return lua.LVAsString(value)
+	}
+
+	if tb.MaxN() > 0 {
+		list := []string{}
+		tb.ForEach(func(_ lua.LValue, v lua.LValue) {
+			list = append(list, lua.LVAsString(v))
+		})
+		return list
+	}
+
+	m := map[string]string{}
+	tb.ForEach(func(k lua.LValue, v lua.LValue) {
+		m[lua.LVAsString(k)] = lua.LVAsString(v)
+	})
+	return m
+}
+
+func (p *HostProvider) StringOption(key string) string {
+	if s, ok := p.Options[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// loadHostProviders fetches the hosts of the providers that aren't fetched yet, and registers them.
+// A provider that fails is reported and skipped, so the other providers' hosts are still available.
+// If refresh is true, it fetches the providers that have cache_ttl ignoring their caches. It returns false if any provider fails.
+func loadHostProviders(L *lua.LState, refresh bool) bool {
+	providers := []*HostProvider{}
+	for _, p := range HostProviders {
+		if p.Fetched {
+			continue
+		}
+		p.Fetched = true
+
+		if p.CacheTTL > 0 && !refresh {
+			if hosts, modTime, ok := p.readCache(); ok {
+				if debugFlag {
+					debugf("use host provider cache: %s\n", p.cacheFile())
+				}
+
+				if time.Since(modTime) > p.CacheTTL {
+					p.refreshInBackground()
+				}
+
+				registerProvidedHosts(L, p, hosts)
+				continue
+			}
+		}
+
+		providers = append(providers, p)
+	}
+
+	if len(providers) == 0 {
+		return true
+	}
+
+	results := make([][]*ProvidedHost, len(providers))
+	errs := make([]error, len(providers))
+
+	wg := &sync.WaitGroup{}
+	for i, p := range providers {
+		wg.Add(1)
+		go func(i int, p *HostProvider) {
+			defer wg.Done()
+
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+			defer cancel()
+
+			results[i], errs[i] = hostProviderFetchers[p.Type](ctx, p)
+			if ctx.Err() == context.DeadlineExceeded {
+				errs[i] = fmt.Errorf("timed out after %v", p.Timeout)
+			}
+
+			if debugFlag {
+				debugf("fetched host provider '%s' in %v\n", p.Name, time.Since(start))
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	ok := true
+	for i, p := range providers {
+		if refresh {
+			os.Remove(p.cacheFile() + ".lock")
+		}
+
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: host provider '%s' failed: %v", p.Name, errs[i]))
+			ok = false
+			continue
+		}
+
+		if p.CacheTTL > 0 {
+			if err := p.writeCache(results[i]); err != nil && debugFlag {
+				debugf("failed to save host provider cache: %v\n", err)
+			}
+		}
+
+		if refresh {
+			printProgress(VERBOSITY_NORMAL, "refreshed host provider '%s' (%d hosts)", p.Name, len(results[i]))
+		}
+
+		registerProvidedHosts(L, p, results[i])
+	}
+
+	return ok
+}
+
+// HostProvidersCacheDir is a directory that stores the hosts fetched by the providers that have cache_ttl.
+func HostProvidersCacheDir() string {
+	return filepath.Join(UserDataDir, "cache", "providers")
+}
+
+// cacheFile returns a path of the cache. It is keyed by the provider's settings, so changing the settings invalidates the cache.
+func (p *HostProvider) cacheFile() string {
+	options, _ := json.Marshal(p.Options)
+	sum := sha256.Sum256([]byte(p.Type + "\n" + p.Name + "\n" + string(options)))
+	return filepath.Join(HostProvidersCacheDir(), hex.EncodeToString(sum[:])+".json")
+}
+
+func (p *HostProvider) readCache() ([]*ProvidedHost, time.Time, bool) {
+	fi, err := os.Stat(p.cacheFile())
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+
+	b, err := ioutil.ReadFile(p.cacheFile())
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+
+	hosts := []*ProvidedHost{}
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return nil, time.Time{}, false
+	}
+
+	return hosts, fi.ModTime(), true
+}
+
+func (p *HostProvider) writeCache(hosts []*ProvidedHost) error {
+	b, err := json.Marshal(hosts)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(HostProvidersCacheDir(), os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p.cacheFile(), b, os.FileMode(0600))
+}
+
+// refreshInBackground starts "essh --refresh-providers" that isn't waited, so that the current command doesn't block on fetching.
+// The lock file prevents starting many refreshes while a refresh is running.
+func (p *HostProvider) refreshInBackground() {
+	lockFile := p.cacheFile() + ".lock"
+	if fi, err := os.Stat(lockFile); err == nil && time.Since(fi.ModTime()) < p.Timeout {
+		return
+	}
+	if err := ioutil.WriteFile(lockFile, []byte{}, 0644); err != nil {
+		return
+	}
+
+	cmd := exec.Command(Executable, refreshProvidersArgs()...)
+	cmd.Dir = WorkingDir
+	if debugFlag {
+		debugf("refresh host providers in the background: %v\n", cmd.Args)
+	}
+
+	if err := cmd.Start(); err != nil && debugFlag {
+		debugf("failed to refresh host providers: %v\n", err)
+	}
+}
+
+// refreshProvidersArgs returns the args of essh that refreshes the providers with the same config files.
+func refreshProvidersArgs() []string {
+	args := []string{"--refresh-providers"}
+	if globalFlag {
+		args = append(args, "--global")
+	}
+	if configVar != "" {
+		args = append(args, "--config", WorkingDirConfigFile)
+	}
+
+	return args
+}
+
+// runRefreshDaemon runs "essh --refresh-providers" at the interval to keep the caches of the providers warm.
+// If pprofAddr is not empty, it also serves the pprof endpoints and the runtime metrics at the address.
+func runRefreshDaemon(interval time.Duration, pprofAddr string) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	publishRefreshDaemonStats()
+	if pprofAddr != "" {
+		stop, err := startPprofServer(pprofAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	for {
+		cmd := exec.Command(Executable, refreshProvidersArgs()...)
+		cmd.Dir = WorkingDir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if debugFlag {
+			debugf("refresh host providers: %v\n", cmd.Args)
+		}
+
+		start := time.Now()
+		err := cmd.Run()
+		refreshCount.Add(1)
+		refreshLastDuration.Set(time.Since(start).Seconds())
+		if err != nil {
+			refreshFailures.Add(1)
+			fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: failed to refresh host providers: %v", err))
+		}
+
+		select {
+		case <-sigCh:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func registerProvidedHosts(L *lua.LState, p *HostProvider, hosts []*ProvidedHost) {
+	for _, ph := range hosts {
+		if err := validateProvidedHost(ph); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: host provider '%s' returned an invalid host: %v", p.Name, err))
+			continue
+		}
+
+		h := registerHost(L, ph.Name)
+		h.Registry = p.Registry
+		h.Source = "host provider '" + p.Name + "' (" + p.Source + ")"
+
+		tb := L.NewTable()
+		for key, value := range ph.Config {
+			tb.RawSetString(key, toProvidedLValue(L, value))
+		}
+		setupHost(L, h, tb)
+	}
+}
+
+// validateProvidedHost checks the name and the ssh_config of a host that a provider returned.
+// They are written in the ssh_config that essh generates, so whitespace or a control character in them
+// could add arbitrary directives like ProxyCommand.
+func validateProvidedHost(ph *ProvidedHost) error {
+	if ph.Name == "" || containsSpaceOrControl(ph.Name) {
+		return fmt.Errorf("%q is not a valid host name", ph.Name)
+	}
+
+	for key, value := range ph.Config {
+		var firstChar rune
+		for _, c := range key {
+			firstChar = c
+			break
+		}
+		if !unicode.IsUpper(firstChar) {
+			continue
+		}
+
+		for _, c := range key {
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+				return fmt.Errorf("'%s' has an invalid ssh_config key %q", ph.Name, key)
+			}
+		}
+		if s, ok := value.(string); ok && containsSpaceOrControl(s) {
+			return fmt.Errorf("'%s' has an invalid value of %s: %q", ph.Name, key, s)
+		}
+	}
+
+	return nil
+}
+
+func containsSpaceOrControl(s string) bool {
+	for _, c := range s {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func toProvidedLValue(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case string:
+		return lua.LString(v)
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		// ssh config values are strings.
+		return lua.LString(strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		tb := L.NewTable()
+		for _, e := range v {
+			tb.Append(toProvidedLValue(L, e))
+		}
+		return tb
+	case []string:
+		tb := L.NewTable()
+		for _, e := range v {
+			tb.Append(lua.LString(e))
+		}
+		return tb
+	case map[string]interface{}:
+		tb := L.NewTable()
+		for k, e := range v {
+			tb.RawSetString(k, toProvidedLValue(L, e))
+		}
+		return tb
+	case map[string]string:
+		tb := L.NewTable()
+		for k, e := range v {
+			tb.RawSetString(k, lua.LString(e))
+		}
+		return tb
+	}
+
+	return lua.LNil
+}
+
+// parseProvidedHosts parses a JSON that is an array of hosts that have "name" like [{"name": "web01", "HostName": "..."}],
+// or an object that maps the names to the hosts like {"web01": {"HostName": "..."}}.
+func parseProvidedHosts(b []byte) ([]*ProvidedHost, error) {
+	hosts := []*ProvidedHost{}
+
+	var list []map[string]interface{}
+	if err := json.Unmarshal(b, &list); err == nil {
+		for _, config := range list {
+			name, ok := config["name"].(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("a host doesn't have 'name': %v", config)
+			}
+			delete(config, "name")
+			hosts = append(hosts, &ProvidedHost{Name: name, Config: config})
+		}
+		return hosts, nil
+	}
+
+	var m map[string]map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid hosts JSON: %v", err)
+	}
+
+	names := []string{}
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hosts = append(hosts, &ProvidedHost{Name: name, Config: m[name]})
+	}
+	return hosts, nil
+}
+
+// fetchCommandHosts runs a command that outputs the hosts in JSON.
+func fetchCommandHosts(ctx context.Context, p *HostProvider) ([]*ProvidedHost, error) {
+	command := p.StringOption("command")
+	if command == "" {
+		return nil, fmt.Errorf("'command' is required.")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := shellCommand(command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runCommandContext(ctx, cmd); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	return parseProvidedHosts(stdout.Bytes())
+}
@@ -0,0 +1,134 @@
+package essh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// consulServiceEntry is an entry of Consul's /v1/health/service API.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Tags    []string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+// fetchConsulHosts gets the healthy instances of a service from Consul's catalog.
+// The hosts are named by the nodes and tagged by the datacenter and the service.
+func fetchConsulHosts(ctx context.Context, p *HostProvider) ([]*ProvidedHost, error) {
+	service := p.StringOption("service")
+	if service == "" {
+		return nil, fmt.Errorf("'service' is required.")
+	}
+
+	address := p.StringOption("address")
+	if address == "" {
+		address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	query := url.Values{"passing": {"1"}}
+	if dc := p.StringOption("datacenter"); dc != "" {
+		query.Set("dc", dc)
+	}
+	if tag := p.StringOption("tag"); tag != "" {
+		query.Set("tag", tag)
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(address, "/")+"/v1/health/service/"+url.PathEscape(service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.StringOption("token")
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: %s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	entries := []*consulServiceEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("invalid response of consul: %v", err)
+	}
+
+	// a node that has several instances of the service gets the names that have the service IDs.
+	instances := map[string]int{}
+	for _, e := range entries {
+		instances[e.Node.Node]++
+	}
+
+	prefix := p.StringOption("prefix")
+	hosts := []*ProvidedHost{}
+	for _, e := range entries {
+		name := prefix + e.Node.Node
+		if instances[e.Node.Node] > 1 {
+			name += "-" + e.Service.ID
+		}
+
+		hostname := e.Service.Address
+		if hostname == "" {
+			hostname = e.Node.Address
+		}
+
+		props := map[string]interface{}{
+			"consul_node":         e.Node.Node,
+			"consul_service_id":   e.Service.ID,
+			"consul_service_tags": strings.Join(e.Service.Tags, ","),
+			"consul_service_port": strconv.Itoa(e.Service.Port),
+		}
+		for key, value := range e.Service.Meta {
+			props[key] = value
+		}
+
+		config := map[string]interface{}{
+			"HostName": hostname,
+			"tags":     []string{e.Node.Datacenter, e.Service.Service},
+			"props":    props,
+		}
+		if user := p.StringOption("user"); user != "" {
+			config["User"] = user
+		}
+
+		hosts = append(hosts, &ProvidedHost{Name: name, Config: config})
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,173 @@
+package essh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fetchJSONHosts gets the hosts from a generic JSON API.
+// The 'mapping' option maps the host's fields (like "name", "HostName", "tags" and "props.env") to the paths in the items.
+func fetchJSONHosts(ctx context.Context, p *HostProvider) ([]*ProvidedHost, error) {
+	url := p.StringOption("url")
+	if url == "" {
+		return nil, fmt.Errorf("'url' is required.")
+	}
+
+	mapping, ok := p.Options["mapping"].(map[string]string)
+	if !ok || mapping["name"] == "" {
+		return nil, fmt.Errorf("'mapping' requires 'name'.")
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if headers, ok := p.Options["headers"].(map[string]string); ok {
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+
+	items := lookupJSONPath(data, p.StringOption("items"))
+	if len(items) == 1 {
+		if list, ok := items[0].([]interface{}); ok {
+			items = list
+		}
+	}
+
+	return mapJSONHosts(items, mapping), nil
+}
+
+// mapJSONHosts converts the items to the hosts by the mapping. The items that don't have a name are skipped.
+func mapJSONHosts(items []interface{}, mapping map[string]string) []*ProvidedHost {
+	hosts := []*ProvidedHost{}
+	for _, item := range items {
+		name := ""
+		if values := lookupJSONPath(item, mapping["name"]); len(values) > 0 {
+			name = jsonValueString(values[0])
+		}
+		if name == "" {
+			continue
+		}
+
+		config := map[string]interface{}{}
+		props := map[string]interface{}{}
+		for key, path := range mapping {
+			values := lookupJSONPath(item, path)
+			if key == "name" || len(values) == 0 {
+				continue
+			}
+
+			if key == "tags" {
+				tags := []string{}
+				for _, v := range flattenJSONValues(values) {
+					if s := jsonValueString(v); s != "" {
+						tags = append(tags, s)
+					}
+				}
+				config["tags"] = tags
+			} else if strings.HasPrefix(key, "props.") {
+				props[strings.TrimPrefix(key, "props.")] = jsonValueString(values[0])
+			} else if b, ok := values[0].(bool); ok {
+				config[key] = b
+			} else {
+				config[key] = jsonValueString(values[0])
+			}
+		}
+		if len(props) > 0 {
+			config["props"] = props
+		}
+
+		hosts = append(hosts, &ProvidedHost{Name: name, Config: config})
+	}
+
+	return hosts
+}
+
+// lookupJSONPath gets the values at the dot-separated path like "data.hosts". "*" matches all the elements of an array
+// (or all the values of an object), so "groups.*.name" gets the names of all the groups. An empty path returns the value itself.
+func lookupJSONPath(value interface{}, path string) []interface{} {
+	values := []interface{}{value}
+	if path == "" {
+		return values
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		next := []interface{}{}
+		for _, v := range values {
+			switch vv := v.(type) {
+			case map[string]interface{}:
+				if key == "*" {
+					for _, e := range vv {
+						next = append(next, e)
+					}
+				} else if e, ok := vv[key]; ok && e != nil {
+					next = append(next, e)
+				}
+			case []interface{}:
+				if key == "*" {
+					next = append(next, vv...)
+				} else if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(vv) {
+					next = append(next, vv[i])
+				}
+			}
+		}
+		values = next
+	}
+
+	return values
+}
+
+func flattenJSONValues(values []interface{}) []interface{} {
+	flat := []interface{}{}
+	for _, v := range values {
+		if list, ok := v.([]interface{}); ok {
+			flat = append(flat, flattenJSONValues(list)...)
+		} else {
+			flat = append(flat, v)
+		}
+	}
+	return flat
+}
+
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+
+	b, _ := json.Marshal(value)
+	return string(b)
+}
@@ -0,0 +1,306 @@
+package essh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS resource record types that are used by the mdns provider.
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+)
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// dnsRecord is a resource record of a DNS message. Only the fields of the types that are used by the mdns provider are set.
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Target string
+	Port   uint16
+	IP     net.IP
+}
+
+// fetchMDNSHosts browses a service (_ssh._tcp by default) over mDNS and gets the machines that advertise it.
+// The responses are collected for the 'wait' duration.
+func fetchMDNSHosts(ctx context.Context, p *HostProvider) ([]*ProvidedHost, error) {
+	service := p.StringOption("service")
+	if service == "" {
+		service = "_ssh._tcp"
+	}
+	domain := p.StringOption("domain")
+	if domain == "" {
+		domain = "local"
+	}
+	question := strings.TrimSuffix(service, ".") + "." + strings.Trim(domain, ".") + "."
+
+	wait := 2 * time.Second
+	if v := p.StringOption("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wait: %v", err)
+		}
+		wait = d
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the responders send the responses to the source port of the one-shot query by unicast.
+	query := newMDNSQuery(question)
+	if _, err := conn.WriteToUDP(query, mdnsAddr); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	records := []*dnsRecord{}
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+
+		rrs, err := parseDNSMessage(buf[:n])
+		if err != nil {
+			// ignore the broken responses from the other machines.
+			continue
+		}
+		records = append(records, rrs...)
+	}
+
+	return mdnsHosts(records, question, p.StringOption("user")), nil
+}
+
+// mdnsHosts resolves the service instances to the hosts by the SRV and A/AAAA records.
+func mdnsHosts(records []*dnsRecord, question string, user string) []*ProvidedHost {
+	addresses := map[string]net.IP{}
+	for _, rr := range records {
+		if rr.Type != dnsTypeA && rr.Type != dnsTypeAAAA {
+			continue
+		}
+		name := strings.ToLower(rr.Name)
+		// prefer the IPv4 addresses.
+		if current, ok := addresses[name]; !ok || (current.To4() == nil && rr.IP.To4() != nil) {
+			addresses[name] = rr.IP
+		}
+	}
+
+	hosts := []*ProvidedHost{}
+	seen := map[string]bool{}
+	for _, rr := range records {
+		if rr.Type != dnsTypeSRV || !strings.HasSuffix(strings.ToLower(rr.Name), strings.ToLower(question)) {
+			continue
+		}
+
+		target := strings.ToLower(rr.Target)
+		if !isValidDNSHostName(target) {
+			// the target is written in the ssh_config, so a name that may break it is never used.
+			if debugFlag {
+				debugf("ignore the invalid mdns target: %q\n", rr.Target)
+			}
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(target, "."), ".local")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		hostname := strings.TrimSuffix(target, ".")
+		if ip, ok := addresses[target]; ok {
+			hostname = ip.String()
+		}
+
+		config := map[string]interface{}{
+			"HostName": hostname,
+			"tags":     []string{"mdns"},
+			"props": map[string]interface{}{
+				"mdns_instance": strings.TrimSuffix(strings.TrimSuffix(rr.Name, "."), "."+strings.TrimSuffix(question, ".")),
+				"mdns_hostname": strings.TrimSuffix(target, "."),
+			},
+		}
+		if rr.Port != 0 && rr.Port != 22 {
+			config["Port"] = strconv.Itoa(int(rr.Port))
+		}
+		if user != "" {
+			config["User"] = user
+		}
+
+		hosts = append(hosts, &ProvidedHost{Name: name, Config: config})
+	}
+
+	return hosts
+}
+
+// isValidDNSHostName reports whether all the labels of the name consist of only letters, digits and hyphens.
+func isValidDNSHostName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// newMDNSQuery builds a DNS message that asks the PTR records of the name.
+func newMDNSQuery(name string) []byte {
+	msg := make([]byte, 12)
+	// QDCOUNT
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+
+	// QTYPE PTR, QCLASS IN with the unicast-response bit.
+	msg = append(msg, 0, dnsTypePTR, 0x80, 0x01)
+
+	return msg
+}
+
+// parseDNSMessage parses the resource records of a DNS message.
+func parseDNSMessage(msg []byte) ([]*dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("too short message")
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+		if off > len(msg) {
+			return nil, fmt.Errorf("too short question")
+		}
+	}
+
+	records := []*dnsRecord{}
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, fmt.Errorf("too short record")
+		}
+
+		rr := &dnsRecord{Name: name, Type: binary.BigEndian.Uint16(msg[off:])}
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, fmt.Errorf("too short rdata")
+		}
+		rdata := msg[off : off+rdlen]
+
+		switch rr.Type {
+		case dnsTypeA, dnsTypeAAAA:
+			if len(rdata) != net.IPv4len && len(rdata) != net.IPv6len {
+				return nil, fmt.Errorf("invalid address")
+			}
+			rr.IP = net.IP(append([]byte{}, rdata...))
+		case dnsTypePTR:
+			rr.Target, _, err = readDNSName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				return nil, fmt.Errorf("invalid srv record")
+			}
+			rr.Port = binary.BigEndian.Uint16(rdata[4:])
+			rr.Target, _, err = readDNSName(msg, off+6)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		records = append(records, rr)
+		off += rdlen
+	}
+
+	return records, nil
+}
+
+// maxDNSNameLength is the maximum length of a domain name in the wire format.
+const maxDNSNameLength = 255
+
+// readDNSName reads a possibly compressed domain name at the offset and returns the name and the offset after it.
+// The number of the compression pointers is limited, so the pointers that loop are an error.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	size := 1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("invalid name")
+		}
+
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, fmt.Errorf("invalid name pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case length&0xC0 != 0:
+			// 0x40 and 0x80 are the reserved label types.
+			return "", 0, fmt.Errorf("invalid label type")
+		default:
+			size += 1 + length
+			if off+1+length > len(msg) || size > maxDNSNameLength {
+				return "", 0, fmt.Errorf("invalid label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package essh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func dnsTestName(name string) []byte {
+	b := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsTestHeader(qdcount, ancount int) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], uint16(qdcount))
+	binary.BigEndian.PutUint16(b[6:], uint16(ancount))
+	return b
+}
+
+func dnsTestRecord(name []byte, typ uint16, rdata []byte) []byte {
+	b := append([]byte{}, name...)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed, typ)
+	binary.BigEndian.PutUint16(fixed[2:], 1)
+	binary.BigEndian.PutUint32(fixed[4:], 120)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	b = append(b, fixed...)
+	return append(b, rdata...)
+}
+
+func dnsTestMessage(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadDNSName(t *testing.T) {
+	longName := strings.Repeat(strings.Repeat("a", 63)+".", 4)
+
+	cases := []struct {
+		name string
+		msg  []byte
+		off  int
+		want string
+		next int
+		err  bool
+	}{
+		{name: "plain", msg: dnsTestName("web1.local."), want: "web1.local.", next: 12},
+		{name: "root", msg: []byte{0}, want: ".", next: 1},
+		{name: "offset", msg: append([]byte{0xff, 0xff}, dnsTestName("local.")...), off: 2, want: "local.", next: 9},
+		{name: "pointer", msg: append(dnsTestName("local."), 4, 'w', 'e', 'b', '1', 0xC0, 0), off: 7, want: "web1.local.", next: 14},
+		{name: "pointer to pointer", msg: append(dnsTestName("local."), 0xC0, 0, 0xC0, 7), off: 9, want: "local.", next: 11},
+		{name: "empty message", msg: []byte{}, err: true},
+		{name: "offset out of range", msg: []byte{0}, off: 1, err: true},
+		{name: "missing terminator", msg: []byte{4, 'w', 'e', 'b', '1'}, err: true},
+		{name: "truncated label", msg: []byte{5, 'l', 'o'}, err: true},
+		{name: "truncated pointer", msg: []byte{0xC0}, err: true},
+		{name: "pointer out of range", msg: []byte{0xC0, 0x10}, err: true},
+		{name: "pointer to itself", msg: []byte{0xC0, 0}, err: true},
+		{name: "looping pointers", msg: []byte{0xC0, 2, 0xC0, 0}, err: true},
+		{name: "looping pointer after label", msg: []byte{1, 'a', 0xC0, 0}, err: true},
+		{name: "reserved label type 0x40", msg: []byte{0x41, 'a', 0}, err: true},
+		{name: "reserved label type 0x80", msg: []byte{0x81, 'a', 0}, err: true},
+		{name: "too long name", msg: dnsTestName(longName), err: true},
+	}
+
+	for _, c := range cases {
+		got, next, err := readDNSName(c.msg, c.off)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error but got %q", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if got != c.want || next != c.next {
+			t.Errorf("%s: expected (%q, %d) but got (%q, %d)", c.name, c.want, c.next, got, next)
+		}
+	}
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	question := append(dnsTestName("_ssh._tcp.local."), 0, dnsTypePTR, 0, 1)
+	// the name of the question is at the offset 12.
+	service := []byte{0xC0, 12}
+	instance := append([]byte{4, 'w', 'e', 'b', '1'}, service...)
+	srv := append([]byte{0, 0, 0, 0, 0, 22}, dnsTestName("web1.local.")...)
+
+	msg := dnsTestMessage(
+		dnsTestHeader(1, 4),
+		question,
+		dnsTestRecord(service, dnsTypePTR, instance),
+		dnsTestRecord(instance, dnsTypeSRV, srv),
+		dnsTestRecord(dnsTestName("web1.local."), dnsTypeA, []byte{192, 168, 0, 11}),
+		dnsTestRecord(dnsTestName("web1.local."), 16, []byte{3, 'a', '=', 'b'}),
+	)
+
+	records, err := parseDNSMessage(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []*dnsRecord{
+		{Name: "_ssh._tcp.local.", Type: dnsTypePTR, Target: "web1._ssh._tcp.local."},
+		{Name: "web1._ssh._tcp.local.", Type: dnsTypeSRV, Target: "web1.local.", Port: 22},
+		{Name: "web1.local.", Type: dnsTypeA, IP: net.IP{192, 168, 0, 11}},
+		{Name: "web1.local.", Type: 16},
+	}
+	if !reflect.DeepEqual(records, want) {
+		for i, r := range records {
+			t.Logf("record %d: %+v", i, r)
+		}
+		t.Errorf("unexpected records")
+	}
+}
+
+func TestParseDNSMessageMalformed(t *testing.T) {
+	a := dnsTestRecord(dnsTestName("web1.local."), dnsTypeA, []byte{192, 168, 0, 11})
+
+	cases := []struct {
+		name string
+		msg  []byte
+	}{
+		{name: "empty", msg: []byte{}},
+		{name: "short header", msg: make([]byte, 11)},
+		{name: "missing question", msg: dnsTestHeader(1, 0)},
+		{name: "truncated question", msg: dnsTestMessage(dnsTestHeader(1, 0), dnsTestName("local."), []byte{0, 12})},
+		{name: "missing record", msg: dnsTestHeader(0, 1)},
+		{name: "more records than the message has", msg: dnsTestMessage(dnsTestHeader(0, 2), a)},
+		{name: "truncated record", msg: dnsTestMessage(dnsTestHeader(0, 1), a[:len(a)-6])},
+		{name: "truncated rdata", msg: dnsTestMessage(dnsTestHeader(0, 1), a[:len(a)-1])},
+		{name: "invalid address", msg: dnsTestMessage(dnsTestHeader(0, 1), dnsTestRecord(dnsTestName("web1.local."), dnsTypeA, []byte{192, 168, 0}))},
+		{name: "short srv", msg: dnsTestMessage(dnsTestHeader(0, 1), dnsTestRecord(dnsTestName("web1.local."), dnsTypeSRV, []byte{0, 0, 0, 0, 0, 22}))},
+		{name: "looping name of record", msg: dnsTestMessage(dnsTestHeader(0, 1), dnsTestRecord([]byte{0xC0, 12}, dnsTypeA, []byte{192, 168, 0, 11}))},
+		{name: "looping pointer in ptr", msg: dnsTestMessage(dnsTestHeader(0, 1), dnsTestRecord([]byte{0}, dnsTypePTR, []byte{0xC0, 23}))},
+		{name: "looping pointer in srv", msg: dnsTestMessage(dnsTestHeader(0, 1), dnsTestRecord([]byte{0}, dnsTypeSRV, []byte{0, 0, 0, 0, 0, 22, 0xC0, 29}))},
+	}
+
+	for _, c := range cases {
+		if records, err := parseDNSMessage(c.msg); err == nil {
+			t.Errorf("%s: expected an error but got %v", c.name, records)
+		}
+	}
+}
+
+func TestMDNSHostsRejectsInvalidTarget(t *testing.T) {
+	records := []*dnsRecord{
+		{Name: "web1._ssh._tcp.local.", Type: dnsTypeSRV, Target: "web1.local.", Port: 22},
+		{Name: "evil._ssh._tcp.local.", Type: dnsTypeSRV, Target: "evil\nHost *\n  ProxyCommand sh -c 'touch /tmp/pwned'.local.", Port: 22},
+		{Name: "evil2._ssh._tcp.local.", Type: dnsTypeSRV, Target: "evil2 ProxyCommand=id.local.", Port: 22},
+		{Name: "evil3._ssh._tcp.local.", Type: dnsTypeSRV, Target: "evil_3.local.", Port: 22},
+		{Name: "web1.local.", Type: dnsTypeA, IP: net.IP{192, 168, 0, 11}},
+	}
+
+	hosts := mdnsHosts(records, "_ssh._tcp.local.", "")
+	if len(hosts) != 1 || hosts[0].Name != "web1" {
+		for i, h := range hosts {
+			t.Logf("host %d: %q", i, h.Name)
+		}
+		t.Fatalf("expected only the host 'web1'")
+	}
+	if hostname := hosts[0].Config["HostName"]; hostname != "192.168.0.11" {
+		t.Errorf("expected the HostName '192.168.0.11' but got %v", hostname)
+	}
+}
+
+func TestValidateProvidedHost(t *testing.T) {
+	cases := []struct {
+		name string
+		host *ProvidedHost
+		err  bool
+	}{
+		{name: "valid", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"HostName": "192.168.0.11", "Port": 2222.0, "tags": []string{"web"}}}},
+		{name: "props may have spaces", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"props": map[string]interface{}{"description": "the web server"}}}},
+		{name: "empty name", host: &ProvidedHost{Name: ""}, err: true},
+		{name: "newline in name", host: &ProvidedHost{Name: "web01\nHost *\n  ProxyCommand sh -c id"}, err: true},
+		{name: "space in name", host: &ProvidedHost{Name: "web01 web02"}, err: true},
+		{name: "newline in value", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"HostName": "192.168.0.11\nProxyCommand sh -c id"}}, err: true},
+		{name: "space in value", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"HostName": "192.168.0.11 ProxyCommand=id"}}, err: true},
+		{name: "tab in value", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"User": "deploy\tProxyCommand=id"}}, err: true},
+		{name: "control character in value", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"User": "deploy\x00"}}, err: true},
+		{name: "newline in key", host: &ProvidedHost{Name: "web01", Config: map[string]interface{}{"User\nProxyCommand": "id"}}, err: true},
+	}
+
+	for _, c := range cases {
+		err := validateProvidedHost(c.host)
+		if c.err && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if !c.err && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+}
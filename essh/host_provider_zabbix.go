@@ -0,0 +1,206 @@
+package essh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// zabbixClient is a client of Zabbix's JSON-RPC API.
+type zabbixClient struct {
+	URL  string
+	Auth string
+	ctx  context.Context
+}
+
+type zabbixHost struct {
+	HostID      string `json:"hostid"`
+	Host        string `json:"host"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Interfaces  []struct {
+		IP    string `json:"ip"`
+		DNS   string `json:"dns"`
+		UseIP string `json:"useip"`
+		Main  string `json:"main"`
+		Type  string `json:"type"`
+	} `json:"interfaces"`
+	// HostGroups are the groups of Zabbix 6.2 or later, and Groups are the ones of the older versions.
+	HostGroups []struct {
+		Name string `json:"name"`
+	} `json:"hostgroups"`
+	Groups []struct {
+		Name string `json:"name"`
+	} `json:"groups"`
+}
+
+var invalidTagChars = regexp.MustCompile(`[\s/]+`)
+
+// fetchZabbixHosts gets the monitored hosts from Zabbix. The host groups are converted to the tags.
+func fetchZabbixHosts(ctx context.Context, p *HostProvider) ([]*ProvidedHost, error) {
+	url := p.StringOption("url")
+	if url == "" {
+		return nil, fmt.Errorf("'url' is required.")
+	}
+	if !strings.HasSuffix(url, ".php") {
+		url = strings.TrimSuffix(url, "/") + "/api_jsonrpc.php"
+	}
+
+	client := &zabbixClient{URL: url, Auth: p.StringOption("token"), ctx: ctx}
+	if client.Auth == "" {
+		if p.StringOption("username") == "" {
+			return nil, fmt.Errorf("'token' or 'username' is required.")
+		}
+
+		var auth string
+		if err := client.call("user.login", map[string]interface{}{
+			"username": p.StringOption("username"),
+			"password": p.StringOption("password"),
+		}, &auth); err != nil {
+			return nil, err
+		}
+		client.Auth = auth
+		defer client.call("user.logout", []interface{}{}, nil)
+	}
+
+	params := map[string]interface{}{
+		"output":           []string{"hostid", "host", "name", "description"},
+		"selectInterfaces": []string{"ip", "dns", "useip", "main", "type"},
+		"selectHostGroups": []string{"name"},
+		"filter":           map[string]interface{}{"status": "0"},
+	}
+
+	hosts := []*zabbixHost{}
+	if err := client.call("host.get", params, &hosts); err != nil {
+		if !strings.Contains(err.Error(), "selectHostGroups") {
+			return nil, err
+		}
+		// the versions before 6.2 don't have selectHostGroups.
+		delete(params, "selectHostGroups")
+		params["selectGroups"] = []string{"name"}
+		if err := client.call("host.get", params, &hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	group := p.StringOption("group")
+	provided := []*ProvidedHost{}
+	for _, h := range hosts {
+		tags := []string{}
+		matched := group == ""
+		for _, g := range append(h.HostGroups, h.Groups...) {
+			tags = append(tags, invalidTagChars.ReplaceAllString(g.Name, "-"))
+			if g.Name == group {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		config := map[string]interface{}{
+			"HostName":    h.address(),
+			"description": h.Name,
+			"tags":        tags,
+			"props": map[string]interface{}{
+				"zabbix_hostid":      h.HostID,
+				"zabbix_description": h.Description,
+			},
+		}
+		if user := p.StringOption("user"); user != "" {
+			config["User"] = user
+		}
+
+		provided = append(provided, &ProvidedHost{Name: h.Host, Config: config})
+	}
+
+	return provided, nil
+}
+
+// address returns the address of the main agent interface, or the first interface.
+func (h *zabbixHost) address() string {
+	if len(h.Interfaces) == 0 {
+		return h.Host
+	}
+
+	iface := h.Interfaces[0]
+	for _, i := range h.Interfaces {
+		// type 1 is the agent interface.
+		if i.Type == "1" && i.Main == "1" {
+			iface = i
+			break
+		}
+	}
+
+	if iface.UseIP == "1" && iface.IP != "" {
+		return iface.IP
+	}
+	if iface.DNS != "" {
+		return iface.DNS
+	}
+	return iface.IP
+}
+
+func (c *zabbixClient) call(method string, params interface{}, result interface{}) error {
+	body := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	}
+	if c.Auth != "" && method != "user.login" {
+		body["auth"] = c.Auth
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json-rpc")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("zabbix: %s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	res := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+			Data    string `json:"data"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return fmt.Errorf("invalid response of zabbix: %v", err)
+	}
+
+	if res.Error != nil {
+		return fmt.Errorf("zabbix: %s %s %s", method, res.Error.Message, res.Error.Data)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(res.Result, result)
+}
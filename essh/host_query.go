@@ -2,6 +2,7 @@ package essh
 
 import (
 	"github.com/yuin/gopher-lua"
+	"path"
 	"sort"
 )
 
@@ -9,7 +10,14 @@ type HostQuery struct {
 	Datasource map[string]*Host
 	Selections []string
 	Filters    []string
+	Excludes   []string
 	Hidden     *bool
+	// Limit caps the number of the hosts. 0 means no limit.
+	Limit int
+	// SkipExpired removes the expired hosts before the limit is applied.
+	SkipExpired bool
+	// err is an error to resolve the roles in the selections.
+	err error
 }
 
 func NewHostQuery() *HostQuery {
@@ -17,6 +25,7 @@ func NewHostQuery() *HostQuery {
 		Datasource: Hosts,
 		Selections: []string{},
 		Filters:    []string{},
+		Excludes:   []string{},
 		Hidden:     nil,
 	}
 }
@@ -46,6 +55,33 @@ func (hostQuery *HostQuery) AppendFilters(filters []string) *HostQuery {
 	return hostQuery
 }
 
+func (hostQuery *HostQuery) AppendExclude(exclude string) *HostQuery {
+	hostQuery.Excludes = append(hostQuery.Excludes, exclude)
+	return hostQuery
+}
+
+func (hostQuery *HostQuery) AppendExcludes(excludes []string) *HostQuery {
+	hostQuery.Excludes = append(hostQuery.Excludes, excludes...)
+	return hostQuery
+}
+
+func (hostQuery *HostQuery) SetLimit(limit int) *HostQuery {
+	hostQuery.Limit = limit
+	return hostQuery
+}
+
+func (hostQuery *HostQuery) skipExpired() *HostQuery {
+	hostQuery.SkipExpired = true
+	return hostQuery
+}
+
+// materialize materializes all the hosts of the datasource to query them by their values.
+func (hostQuery *HostQuery) materialize(L *lua.LState) {
+	for _, host := range hostQuery.Datasource {
+		host.materialize(L)
+	}
+}
+
 func (hostQuery *HostQuery) isHidden() *HostQuery {
 	b := true
 	hostQuery.Hidden = &b
@@ -67,6 +103,10 @@ func (hostQuery *HostQuery) GetHosts() []*Host {
 		hosts = hostQuery.filterHosts(hosts, filter)
 	}
 
+	for _, exclude := range hostQuery.Excludes {
+		hosts = hostQuery.excludeHosts(hosts, exclude)
+	}
+
 	if hostQuery.Hidden != nil {
 		newHosts := []*Host{}
 		hidden := hostQuery.Hidden
@@ -96,11 +136,24 @@ func (h NameSortableHosts) Less(i, j int) bool {
 	return h[i].Name < h[j].Name
 }
 
+// Err returns the error that occurred in getting the hosts, like a failure of a role's targets function.
+func (hostQuery *HostQuery) Err() error {
+	return hostQuery.err
+}
+
 func (hostQuery *HostQuery) GetHostsOrderByName() []*Host {
 	hosts := hostQuery.GetHosts()
 
 	sort.Sort(NameSortableHosts(hosts))
 
+	if hostQuery.SkipExpired {
+		hosts = excludeExpiredHosts(hosts)
+	}
+
+	if hostQuery.Limit > 0 && len(hosts) > hostQuery.Limit {
+		hosts = hosts[:hostQuery.Limit]
+	}
+
 	return hosts
 }
 
@@ -110,7 +163,11 @@ func (hostQuery *HostQuery) selectHosts(hosts []*Host) []*Host {
 	}
 
 	newHosts := []*Host{}
-	selections := hostQuery.Selections
+	selections, err := expandRoles(hostQuery.Selections)
+	if err != nil {
+		hostQuery.err = err
+		return newHosts
+	}
 
 	for _, host := range hosts {
 		selected := false
@@ -128,6 +185,19 @@ func (hostQuery *HostQuery) selectHosts(hosts []*Host) []*Host {
 			continue
 		}
 
+	B3:
+		for _, selection := range selections {
+			if host.InGroup(selection) {
+				newHosts = append(newHosts, host)
+				selected = true
+				break B3
+			}
+		}
+
+		if selected {
+			continue
+		}
+
 	B2:
 		for _, tag := range host.Tags {
 			for _, selection := range selections {
@@ -145,7 +215,7 @@ func (hostQuery *HostQuery) selectHosts(hosts []*Host) []*Host {
 func (hostQuery *HostQuery) filterHosts(hosts []*Host, filter string) []*Host {
 	newHosts := []*Host{}
 	for _, host := range hosts {
-		if host.Name == filter {
+		if host.Name == filter || host.InGroup(filter) {
 			newHosts = append(newHosts, host)
 			continue
 		}
@@ -161,6 +231,32 @@ func (hostQuery *HostQuery) filterHosts(hosts []*Host, filter string) []*Host {
 	return newHosts
 }
 
+// excludeHosts removes the hosts that match the name, tag, group or glob pattern of the host name.
+func (hostQuery *HostQuery) excludeHosts(hosts []*Host, exclude string) []*Host {
+	newHosts := []*Host{}
+
+B:
+	for _, host := range hosts {
+		if host.Name == exclude || host.InGroup(exclude) {
+			continue
+		}
+
+		if matched, err := path.Match(exclude, host.Name); err == nil && matched {
+			continue
+		}
+
+		for _, tag := range host.Tags {
+			if tag == exclude {
+				continue B
+			}
+		}
+
+		newHosts = append(newHosts, host)
+	}
+
+	return newHosts
+}
+
 func (hostQuery *HostQuery) getHostsList() []*Host {
 	hostsSlice := []*Host{}
 	for _, host := range hostQuery.Datasource {
@@ -282,12 +378,16 @@ func hostQueryIndex(L *lua.LState) int {
 	case "get":
 		L.Push(L.NewFunction(func(L *lua.LState) int {
 			hostQuery := checkHostQuery(L)
+			hostQuery.materialize(L)
 
 			lhosts := L.NewTable()
 			for _, host := range hostQuery.GetHosts() {
 				lhost := newLHost(L, host)
 				lhosts.Append(lhost)
 			}
+			if err := hostQuery.Err(); err != nil {
+				L.RaiseError("%v", err)
+			}
 
 			L.Push(lhosts)
 			return 1
@@ -298,8 +398,12 @@ func hostQueryIndex(L *lua.LState) int {
 		L.Push(L.NewFunction(func(L *lua.LState) int {
 			L.Push(L.NewFunction(func(L *lua.LState) int {
 				hostQuery := checkHostQuery(L)
+				hostQuery.materialize(L)
 
 				hosts := hostQuery.GetHosts()
+				if err := hostQuery.Err(); err != nil {
+					L.RaiseError("%v", err)
+				}
 				if len(hosts) > 0 {
 					L.Push(newLHost(L, hosts[0]))
 					return 1
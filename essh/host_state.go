@@ -0,0 +1,238 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ControlLinePrefix is the prefix of the control lines that the scripts output to communicate with essh
+// like "##essh:set key=value".
+const ControlLinePrefix = "##essh:"
+
+var controlLineRegexp = regexp.MustCompile(`^##essh:(set|publish) ([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// hostStates are the states of the hosts that are set by the control lines in the current run.
+var hostStates = map[string]map[string]string{}
+var hostStatesMutex sync.Mutex
+
+// handleControlLine sets the host's state or publishes the value by the line of the script's stdout on the host.
+// It returns false if the line isn't a control line.
+func handleControlLine(host string, line string) bool {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasPrefix(line, ControlLinePrefix) {
+		return false
+	}
+
+	// the invalid line is dropped too not to output a half-parsed value.
+	matches := controlLineRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		printError(fmt.Errorf("invalid control line '%s'. it must be like '%sset key=value' or '%spublish key=value'.", line, ControlLinePrefix, ControlLinePrefix))
+		return true
+	}
+
+	command, key, value := matches[1], matches[2], matches[3]
+	switch command {
+	case "set":
+		setHostState(host, key, value)
+	case "publish":
+		publishValue(host, key, value)
+	}
+
+	return true
+}
+
+func setHostState(host string, key string, value string) {
+	hostStatesMutex.Lock()
+	defer hostStatesMutex.Unlock()
+
+	if debugFlag {
+		debugf("set state of '%s': %s=%s\n", host, key, redact(value))
+	}
+
+	state, ok := hostStates[host]
+	if !ok {
+		state = map[string]string{}
+		hostStates[host] = state
+	}
+	state[key] = value
+}
+
+// hostState returns a copy of the state of the host.
+func hostState(host string) map[string]string {
+	hostStatesMutex.Lock()
+	defer hostStatesMutex.Unlock()
+
+	state := map[string]string{}
+	for key, value := range hostStates[host] {
+		state[key] = value
+	}
+	return state
+}
+
+// allHostStates returns a copy of the states of all the hosts.
+func allHostStates() map[string]map[string]string {
+	hostStatesMutex.Lock()
+	defer hostStatesMutex.Unlock()
+
+	states := map[string]map[string]string{}
+	for host, state := range hostStates {
+		states[host] = map[string]string{}
+		for key, value := range state {
+			states[host][key] = value
+		}
+	}
+	return states
+}
+
+// hostStateVars returns the environment variables like "ESSH_STATE_KEY" of the host's state sorted by the keys.
+func hostStateVars(host *Host) []*EnvVar {
+	if host == nil {
+		return nil
+	}
+
+	state := hostState(host.Name)
+	keys := []string{}
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	vars := []*EnvVar{}
+	for _, key := range keys {
+		vars = append(vars, &EnvVar{Key: "ESSH_STATE_" + strings.ToUpper(key), Value: state[key]})
+	}
+	return vars
+}
+
+func newLHostState(L *lua.LState, state map[string]string) *lua.LTable {
+	tb := L.NewTable()
+	for key, value := range state {
+		tb.RawSetString(key, lua.LString(value))
+	}
+	return tb
+}
+
+// printHostStates prints the states of the hosts as the summary of the task.
+func printHostStates(hosts []*Host) {
+	for _, host := range hosts {
+		state := hostState(host.Name)
+		if len(state) == 0 {
+			continue
+		}
+
+		keys := []string{}
+		for key := range state {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := []string{}
+		for _, key := range keys {
+			pairs = append(pairs, key+"="+redact(state[key]))
+		}
+		printProgress(VERBOSITY_VERBOSE, "state of '%s': %s", host.Name, strings.Join(pairs, " "))
+	}
+}
+
+// stateWriter passes the output of the script through to the writer except the control lines.
+// It holds the bytes at the beginning of a line only while they may be a control line,
+// so that the output like prompts isn't delayed.
+type stateWriter struct {
+	w         io.Writer
+	host      string
+	pending   []byte
+	control   bool
+	lineStart bool
+}
+
+// newStateWriter returns the writer as it is for the scripts that run without hosts, so that they can use the terminal.
+func newStateWriter(w io.Writer, host *Host) io.Writer {
+	if host == nil {
+		return w
+	}
+	return &stateWriter{w: w, host: host.Name, lineStart: true}
+}
+
+func (w *stateWriter) Write(p []byte) (int, error) {
+	var out bytes.Buffer
+	for _, b := range p {
+		if w.pending != nil {
+			w.pending = append(w.pending, b)
+			if w.control {
+				if b == '\n' {
+					w.setState()
+					w.lineStart = true
+				}
+				continue
+			}
+
+			if bytes.Equal(w.pending, []byte(ControlLinePrefix)) {
+				w.control = true
+				continue
+			}
+			if bytes.HasPrefix([]byte(ControlLinePrefix), w.pending) {
+				continue
+			}
+
+			out.Write(w.pending)
+			w.pending = nil
+			w.lineStart = b == '\n'
+			continue
+		}
+
+		if w.lineStart && b == ControlLinePrefix[0] {
+			w.pending = []byte{b}
+			w.lineStart = false
+			continue
+		}
+
+		out.WriteByte(b)
+		w.lineStart = b == '\n'
+	}
+
+	if out.Len() > 0 {
+		if _, err := w.w.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush handles the held bytes after the script finished.
+func (w *stateWriter) Flush() error {
+	if w.pending == nil {
+		return nil
+	}
+
+	if w.control {
+		w.setState()
+		return nil
+	}
+
+	_, err := w.w.Write(w.pending)
+	w.pending = nil
+	return err
+}
+
+func (w *stateWriter) setState() {
+	line := strings.TrimRight(string(w.pending), "\n")
+	w.pending = nil
+	w.control = false
+
+	handleControlLine(w.host, line)
+}
+
+// flushStateWriter flushes the writer if it is a stateWriter.
+func flushStateWriter(w io.Writer) {
+	if sw, ok := w.(*stateWriter); ok {
+		if err := sw.Flush(); err != nil {
+			printError(err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package essh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxPingConcurrency is the maximum number of the hosts that are checked at the same time by --ping.
+var MaxPingConcurrency = 16
+
+// HostStatus is a result of the latest connectivity check (--ping) of a host.
+type HostStatus struct {
+	OK        bool      `json:"ok"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+	// Latency is a time to connect and authenticate to the host.
+	Latency time.Duration `json:"latency"`
+}
+
+// String returns a short text for the STATUS column like "ok 45ms (5m0s ago)".
+func (s *HostStatus) String() string {
+	if s == nil {
+		return "-"
+	}
+
+	ago := truncateDuration(time.Since(s.CheckedAt), time.Second)
+	if !s.OK {
+		return fmt.Sprintf("failed (%s ago)", ago)
+	}
+
+	return fmt.Sprintf("ok %s (%s ago)", formatLatency(s.Latency), ago)
+}
+
+// HostStatusFile is a state file that stores the results of the connectivity checks.
+func HostStatusFile() string {
+	return filepath.Join(UserDataDir, "host_status.json")
+}
+
+var hostStatuses map[string]*HostStatus
+
+// GetHostStatus returns the latest status of the host. It returns nil if the host has never been checked.
+func GetHostStatus(name string) *HostStatus {
+	if hostStatuses == nil {
+		hostStatuses = loadHostStatuses()
+	}
+
+	return hostStatuses[name]
+}
+
+func loadHostStatuses() map[string]*HostStatus {
+	statuses := map[string]*HostStatus{}
+
+	b, err := ioutil.ReadFile(HostStatusFile())
+	if err != nil {
+		return statuses
+	}
+
+	if err := json.Unmarshal(b, &statuses); err != nil && debugFlag {
+		debugf("failed to load %s: %v\n", HostStatusFile(), err)
+	}
+
+	return statuses
+}
+
+func saveHostStatuses(statuses map[string]*HostStatus) error {
+	b, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(UserDataDir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(HostStatusFile(), b, os.FileMode(0600))
+}
+
+// pingHost checks whether essh can connect and authenticate to the host without any prompts.
+func pingHost(config string, host *Host) *HostStatus {
+	cmd := exec.Command("ssh",
+		"-F", config,
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		host.Name,
+		"true",
+	)
+
+	if debugFlag {
+		debugf("real ssh command: %v \n", cmd.Args)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	status := &HostStatus{CheckedAt: time.Now()}
+	err := cmd.Run()
+	status.Latency = time.Since(status.CheckedAt)
+	if err != nil {
+		status.Error = err.Error()
+
+		// the last line of the ssh's stderr is the most descriptive message like "Connection refused".
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+			status.Error = last
+		}
+	} else {
+		status.OK = true
+	}
+
+	return status
+}
+
+// runPing checks the connectivity of the hosts in parallel and saves the results to the state file.
+// It returns false if any host is unreachable.
+func runPing(config string, hosts []*Host, format string) (bool, error) {
+	results := make([]*HostStatus, len(hosts))
+
+	// limit the number of the ssh processes not to exhaust the file descriptors and the processes.
+	sem := make(chan struct{}, MaxPingConcurrency)
+	wg := &sync.WaitGroup{}
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host *Host) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = pingHost(config, host)
+		}(i, host)
+	}
+	wg.Wait()
+
+	statuses := loadHostStatuses()
+
+	listing := &Listing{Header: []string{"NAME", "STATUS", "LATENCY", "ERROR"}}
+	records := []interface{}{}
+	latencies := []time.Duration{}
+	ok := true
+	for i, host := range hosts {
+		status := results[i]
+		statuses[host.Name] = status
+
+		result := "ok"
+		if status.OK {
+			latencies = append(latencies, status.Latency)
+		} else {
+			result = "failed"
+			ok = false
+		}
+
+		listing.Append([]string{host.Name, result, formatLatency(status.Latency), status.Error})
+		records = append(records, map[string]interface{}{
+			"name":       host.Name,
+			"ok":         status.OK,
+			"checked_at": status.CheckedAt,
+			"latency_ms": status.Latency.Nanoseconds() / int64(time.Millisecond),
+			"error":      status.Error,
+		})
+	}
+	listing.Data = records
+
+	hostStatuses = statuses
+	if err := saveHostStatuses(statuses); err != nil {
+		return false, err
+	}
+
+	if err := listing.Write(os.Stdout, format, false); err != nil {
+		return false, err
+	}
+
+	// the summary is only for humans. it isn't output with the structured formats.
+	if (format == "" || format == FormatTable) && len(latencies) > 0 {
+		fmt.Println()
+		writeLatencySummary(os.Stdout, latencies)
+	}
+
+	return ok, nil
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%dms", d.Nanoseconds()/int64(time.Millisecond))
+}
+
+// latencyBuckets are upper bounds of the latency histogram buckets.
+var latencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+}
+
+// writeLatencySummary writes percentiles and a histogram of the latencies of the reachable hosts.
+func writeLatencySummary(w io.Writer, latencies []time.Duration) {
+	sorted := sortedLatencies(latencies)
+
+	fmt.Fprintf(w, "latency: min %s, p50 %s, p90 %s, max %s (%d hosts)\n",
+		formatLatency(sorted[0]),
+		formatLatency(percentile(sorted, 50)),
+		formatLatency(percentile(sorted, 90)),
+		formatLatency(sorted[len(sorted)-1]),
+		len(sorted),
+	)
+
+	counts := make([]int, len(latencyBuckets)+1)
+	for _, d := range sorted {
+		i := sort.Search(len(latencyBuckets), func(i int) bool { return d < latencyBuckets[i] })
+		counts[i]++
+	}
+
+	max := 0
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+
+	// the longest bar has 40 characters.
+	const width = 40
+	for i, c := range counts {
+		label := ""
+		if i < len(latencyBuckets) {
+			label = "< " + formatLatency(latencyBuckets[i])
+		} else {
+			label = ">= " + formatLatency(latencyBuckets[len(latencyBuckets)-1])
+		}
+
+		bar := strings.Repeat("#", (c*width+max-1)/max)
+		fmt.Fprintf(w, "  %-9s %4d %s\n", label, c, bar)
+	}
+}
@@ -0,0 +1,153 @@
+package essh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KnownHost is a host that is suggested from a known_hosts file.
+type KnownHost struct {
+	Name     string
+	HostName string
+	Port     string
+}
+
+// DefaultKnownHostsFile returns the path of the user's known_hosts file.
+func DefaultKnownHostsFile() string {
+	return filepath.Join(userHomeDir(), ".ssh", "known_hosts")
+}
+
+// readKnownHosts reads the hosts from a known_hosts file. The hashed entries, the markers (like @cert-authority),
+// the patterns and the loopback addresses are skipped. It also returns the number of the hashed entries.
+// The name of a host is the first host name of the entry (or the address if the entry has no names).
+func readKnownHosts(path string) ([]*KnownHost, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	hosts := []*KnownHost{}
+	hashed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		if strings.HasPrefix(line, "|") {
+			hashed++
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		var name, address, port string
+		for _, pattern := range strings.Split(fields[0], ",") {
+			if strings.ContainsAny(pattern, "*?!") {
+				continue
+			}
+
+			host, p := pattern, ""
+			if strings.HasPrefix(pattern, "[") {
+				h, hp, err := net.SplitHostPort(pattern)
+				if err != nil {
+					continue
+				}
+				host, p = h, hp
+			}
+			if host == "localhost" {
+				continue
+			}
+			if p != "" {
+				port = p
+			}
+
+			if ip := net.ParseIP(host); ip != nil {
+				if !ip.IsLoopback() && address == "" {
+					address = host
+				}
+			} else if name == "" {
+				name = host
+			}
+		}
+
+		if name == "" {
+			name = address
+		}
+		if name == "" {
+			continue
+		}
+
+		h := &KnownHost{Name: name, HostName: name, Port: port}
+		if port != "" && port != "22" {
+			h.Name = name + "-" + port
+		} else {
+			h.Port = ""
+		}
+		hosts = append(hosts, h)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return hosts, hashed, nil
+}
+
+// runImportKnownHosts prints the Lua snippets of the hosts in the known_hosts files that aren't defined yet.
+func runImportKnownHosts(w io.Writer, files []string) error {
+	if len(files) == 0 {
+		files = []string{DefaultKnownHostsFile()}
+	}
+
+	// the hosts that are defined by the names or HostName aren't suggested.
+	defined := map[string]bool{}
+	for _, h := range Hosts {
+		defined[h.Name] = true
+		if hostname := h.SSHConfig["HostName"]; hostname != "" {
+			defined[hostname+":"+h.SSHConfig["Port"]] = true
+		}
+	}
+
+	hashed := 0
+	for _, file := range files {
+		hosts, n, err := readKnownHosts(expandHomeDir(file))
+		if err != nil {
+			return err
+		}
+		hashed += n
+
+		for _, h := range hosts {
+			if defined[h.Name] || defined[h.HostName+":"+h.Port] {
+				continue
+			}
+			defined[h.Name] = true
+			defined[h.HostName+":"+h.Port] = true
+
+			fmt.Fprintf(w, "host %s {\n", strconv.Quote(h.Name))
+			fmt.Fprintf(w, "    HostName = %s,\n", strconv.Quote(h.HostName))
+			if h.Port != "" {
+				fmt.Fprintf(w, "    Port = %s,\n", strconv.Quote(h.Port))
+			}
+			fmt.Fprintf(w, "}\n\n")
+		}
+	}
+
+	if hashed > 0 {
+		fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: skipped %d hashed entries. (HashKnownHosts is enabled)", hashed))
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package essh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// shells that run the local scripts of tasks.
+const (
+	LOCAL_SHELL_BASH       = "bash"
+	LOCAL_SHELL_CMD        = "cmd"
+	LOCAL_SHELL_POWERSHELL = "powershell"
+	LOCAL_SHELL_PWSH       = "pwsh"
+)
+
+var LocalShells = []string{
+	LOCAL_SHELL_BASH,
+	LOCAL_SHELL_CMD,
+	LOCAL_SHELL_POWERSHELL,
+	LOCAL_SHELL_PWSH,
+}
+
+func validateLocalShell(shell string) error {
+	for _, s := range LocalShells {
+		if s == shell {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid local_shell '%s'. supported shells are bash, cmd, powershell and pwsh.", shell)
+}
+
+// localShell returns the shell that runs the task's local scripts. The default is cmd on Windows and bash on the others.
+func localShell(task *Task) string {
+	if task.LocalShell != "" {
+		return task.LocalShell
+	}
+	if runtime.GOOS == "windows" {
+		return LOCAL_SHELL_CMD
+	}
+	return LOCAL_SHELL_BASH
+}
+
+// newNativeLocalCommand creates a command that runs the task's script in cmd or PowerShell.
+// The drivers generate POSIX shell scripts, so the script is written to a temporary file as it is,
+// and the environment variables are set to the process instead of "export".
+// The returned function removes the temporary file.
+func newNativeLocalCommand(shell string, sshConfigPath string, task *Task, host *Host, hosts []*Host) (*exec.Cmd, func(), error) {
+	if task.Privileged || task.User != "" || task.Interpreter != "" {
+		return nil, nil, fmt.Errorf("privileged, user and interpreter are not supported with local_shell '%s'.", shell)
+	}
+
+	code := []string{}
+	if task.File != "" {
+		b, err := GetContentFromPath(task.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		code = append(code, string(b))
+	} else {
+		for _, s := range task.Script {
+			code = append(code, s["code"])
+		}
+	}
+
+	ext := ".ps1"
+	if shell == LOCAL_SHELL_CMD {
+		ext = ".bat"
+	}
+
+	// the script is written in a temporary directory, because cmd and PowerShell need the extension of the file.
+	tmpDir, err := ioutil.TempDir("", "essh.script.")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	scriptPath := filepath.Join(tmpDir, "script"+ext)
+
+	content := strings.Join(code, "\n")
+	if shell == LOCAL_SHELL_CMD {
+		// cmd requires CRLF line endings and echoes the commands by default.
+		content = strings.Replace(strings.Replace(content, "\r\n", "\n", -1), "\n", "\r\n", -1)
+		if !task.Trace {
+			content = "@echo off\r\n" + content
+		}
+	} else if task.Trace {
+		content = "Set-PSDebug -Trace 1\n" + content
+	}
+	if err := ioutil.WriteFile(scriptPath, []byte(content), 0600); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	var cmd *exec.Cmd
+	if shell == LOCAL_SHELL_CMD {
+		cmd = exec.Command("cmd", append([]string{"/C", scriptPath}, task.Args...)...)
+	} else {
+		cmd = exec.Command(shell, append([]string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", scriptPath}, task.Args...)...)
+	}
+	cmd.Env = append(os.Environ(), taskEnviron(sshConfigPath, task, host, hosts)...)
+
+	return cmd, cleanup, nil
+}
+
+// taskEnviron returns the same environment variables as the "environment" template of the drivers.
+func taskEnviron(sshConfigPath string, task *Task, host *Host, hosts []*Host) []string {
+	debug := ""
+	if debugFlag {
+		debug = "1"
+	}
+
+	env := []string{
+		"ESSH_TASK_NAME=" + task.Name,
+		"ESSH_RUN_ID=" + RunID,
+		"ESSH_SSH_CONFIG=" + sshConfigPath,
+		"ESSH_DEBUG=" + debug,
+		"ESSH_PAYLOAD=" + task.PayloadForHost(host),
+	}
+	for key, value := range task.Props {
+		env = append(env, "ESSH_TASK_PROPS_"+EnvKeyEscape(strings.ToUpper(key))+"="+value)
+	}
+	for i, arg := range task.Args {
+		env = append(env, "ESSH_TASK_ARGS_"+strconv.Itoa(i+1)+"="+arg)
+	}
+	env = append(env, "ESSH_TASK_ARGS_COUNT="+strconv.Itoa(len(task.Args)))
+	for _, v := range sharedValueVars() {
+		env = append(env, v.Key+"="+v.Value)
+	}
+
+	if host == nil {
+		return env
+	}
+
+	index := 0
+	for i, h := range hosts {
+		if h == host {
+			index = i + 1
+			break
+		}
+	}
+
+	env = append(env,
+		"ESSH_HOSTNAME="+host.Name,
+		"ESSH_HOST_HOSTNAME="+host.Name,
+		"ESSH_HOST_TAGS="+strings.Join(host.Tags, ","),
+		"ESSH_HOST_INDEX="+strconv.Itoa(index),
+		"ESSH_HOST_COUNT="+strconv.Itoa(len(hosts)),
+	)
+	for key, value := range host.SSHConfig {
+		env = append(env, "ESSH_HOST_SSH_"+strings.ToUpper(key)+"="+value)
+	}
+	for key, value := range host.Props {
+		env = append(env, "ESSH_HOST_PROPS_"+EnvKeyEscape(strings.ToUpper(key))+"="+value)
+	}
+	for _, tag := range host.Tags {
+		env = append(env, "ESSH_HOST_TAGS_"+EnvKeyEscape(strings.ToUpper(tag))+"=1")
+	}
+	for _, v := range host.envVars {
+		env = append(env, v.Key+"="+v.Value)
+	}
+	for _, v := range hostStateVars(host) {
+		env = append(env, v.Key+"="+v.Value)
+	}
+
+	return env
+}
@@ -0,0 +1,833 @@
+package essh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskLock is a lock that prevents running a task (or running tasks on the same hosts) concurrently.
+// The lock is stored in a backend that is shared by the operators, like Redis and Consul.
+type TaskLock struct {
+	// Backend is one of "file", "redis" and "consul".
+	Backend string
+	// Scope is "task" or "host". "host" locks each target host, so the tasks that have the same hosts exclude each other.
+	Scope string
+	// Address is an address of the Redis server ("host:port") or the Consul agent ("http://host:port").
+	Address string
+	// Path is a directory of the lock files.
+	Path     string
+	Password string
+	Token    string
+	// TTL is a duration that the lock expires after it is refreshed last. 0 means that it never expires.
+	// The running task refreshes its lock periodically, so the lock expires only if the run is killed or lost.
+	TTL time.Duration
+}
+
+// LockInfo is metadata of the holder of a lock.
+type LockInfo struct {
+	Key        string    `json:"key"`
+	Task       string    `json:"task"`
+	User       string    `json:"user"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	RunID      string    `json:"run_id"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	// RefreshedAt is the last time that the run refreshed the lock.
+	RefreshedAt time.Time `json:"refreshed_at,omitempty"`
+}
+
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d, run id %s) since %s", info.User, info.Hostname, info.PID, info.RunID, info.AcquiredAt.Format(time.RFC3339))
+}
+
+func (info *LockInfo) Expired(ttl time.Duration) bool {
+	last := info.AcquiredAt
+	if info.RefreshedAt.After(last) {
+		last = info.RefreshedAt
+	}
+	return ttl > 0 && time.Since(last) > ttl
+}
+
+// Locker is a backend of the locks.
+type Locker interface {
+	// Create creates the lock only if it doesn't exist. It returns false if the lock already exists.
+	Create(key string, info *LockInfo) (bool, error)
+	// Get returns the holder of the lock. It returns nil if the lock doesn't exist.
+	Get(key string) (*LockInfo, error)
+	// Delete deletes the lock. If runID isn't empty, it deletes the lock only if the run holds it.
+	Delete(key string, runID string) error
+	// Refresh updates the lock only if the run of the info holds it.
+	Refresh(key string, info *LockInfo) error
+}
+
+var (
+	DefaultLockBackend = "file"
+	DefaultLockTTL     = 5 * time.Minute
+)
+
+func toTaskLock(value lua.LValue) (*TaskLock, error) {
+	lock := &TaskLock{
+		Backend: DefaultLockBackend,
+		Scope:   "task",
+		TTL:     DefaultLockTTL,
+	}
+
+	if b, ok := value.(lua.LBool); ok {
+		if !bool(b) {
+			return nil, nil
+		}
+		return lock, nil
+	}
+
+	tb, ok := toLTable(value)
+	if !ok {
+		return nil, fmt.Errorf("lock must be a boolean or a table.")
+	}
+
+	var err error
+	tb.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch key := lua.LVAsString(k); key {
+		case "backend":
+			lock.Backend = lua.LVAsString(v)
+		case "scope":
+			lock.Scope = lua.LVAsString(v)
+		case "address":
+			lock.Address = lua.LVAsString(v)
+		case "path":
+			lock.Path = lua.LVAsString(v)
+		case "password":
+			lock.Password = lua.LVAsString(v)
+		case "token":
+			lock.Token = lua.LVAsString(v)
+		case "ttl":
+			d, perr := time.ParseDuration(lua.LVAsString(v))
+			if perr != nil {
+				err = fmt.Errorf("invalid ttl of lock: %v", perr)
+				return
+			}
+			lock.TTL = d
+		default:
+			err = fmt.Errorf("unsupported lock's field '%s'.", key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if lock.Scope != "task" && lock.Scope != "host" {
+		return nil, fmt.Errorf("scope of lock must be 'task' or 'host'.")
+	}
+
+	if _, err := lock.Locker(); err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+func (l *TaskLock) Locker() (Locker, error) {
+	switch l.Backend {
+	case "file":
+		dir := l.Path
+		if dir == "" {
+			dir = filepath.Join(UserDataDir, "locks")
+		}
+		return &fileLocker{Dir: dir}, nil
+	case "redis":
+		if l.Address == "" {
+			return nil, fmt.Errorf("redis lock requires an address.")
+		}
+		return &redisLocker{Address: l.Address, Password: l.Password}, nil
+	case "consul":
+		address := l.Address
+		if address == "" {
+			address = "http://127.0.0.1:8500"
+		}
+		return &consulLocker{Address: strings.TrimSuffix(address, "/"), Token: l.Token}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported lock backend '%s'.", l.Backend)
+}
+
+// lockKeys returns the keys of the locks that the task acquires.
+func lockKeys(task *Task, hosts []*Host) []string {
+	if task.Lock.Scope == "host" {
+		keys := []string{}
+		for _, host := range hosts {
+			keys = append(keys, "essh/lock/host/"+host.Name)
+		}
+		// acquire in the same order to avoid deadlocks between the tasks that have the same hosts.
+		sort.Strings(keys)
+		return keys
+	}
+
+	return []string{"essh/lock/task/" + task.Name}
+}
+
+// prepareLockKey returns the key of the lock that the task of "host" scope acquires until the hosts are resolved.
+func prepareLockKey(task *Task) string {
+	return "essh/lock/prepare/" + task.Name
+}
+
+// lockHolder holds the locks of a run of the task, and refreshes them until they are released.
+type lockHolder struct {
+	task   *Task
+	locker Locker
+	infos  map[string]*LockInfo
+	stop   chan struct{}
+	mutex  sync.Mutex
+}
+
+// heldLocks are the locks that are released when essh is stopped by a signal. see trapSignals.
+var (
+	heldLocks      = map[*lockHolder]bool{}
+	heldLocksMutex sync.Mutex
+)
+
+// acquireTaskLock acquires the lock of the task before running the prepare function, so that the task isn't prepared concurrently.
+// The hosts of "host" scope are resolved after the prepare function, so it acquires the lock of the task's preparation
+// until acquireHosts replaces it with the locks of the hosts. --plan doesn't run the task, so it doesn't lock.
+func acquireTaskLock(task *Task) (*lockHolder, error) {
+	if task.Lock == nil || planFlag {
+		return &lockHolder{}, nil
+	}
+
+	locker, err := task.Lock.Locker()
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+
+	h := &lockHolder{
+		task:   task,
+		locker: locker,
+		infos:  map[string]*LockInfo{},
+		stop:   make(chan struct{}),
+	}
+
+	key := prepareLockKey(task)
+	if task.Lock.Scope != "host" {
+		key = lockKeys(task, nil)[0]
+	}
+	if err := h.acquire(key); err != nil {
+		return nil, err
+	}
+
+	// the locks are released even if essh is stopped by a signal, because the deferred functions don't run.
+	trapSignalsOnce.Do(trapSignals)
+	heldLocksMutex.Lock()
+	heldLocks[h] = true
+	heldLocksMutex.Unlock()
+
+	if task.Lock.TTL > 0 {
+		go h.refreshPeriodically(task.Lock.TTL / 3)
+	}
+
+	return h, nil
+}
+
+// acquire acquires the lock of the key. The lock that is held by another run is reported as a connection error,
+// in the same way as the backend that can't be connected, because the run can be retried later.
+func (h *lockHolder) acquire(key string) error {
+	info, err := acquireLock(h.locker, key, h.task)
+	if err != nil {
+		return &ConnectionError{Err: err}
+	}
+
+	h.mutex.Lock()
+	h.infos[key] = info
+	h.mutex.Unlock()
+	return nil
+}
+
+// acquireHosts acquires the locks of the hosts of "host" scope, and releases the lock of the task's preparation.
+func (h *lockHolder) acquireHosts(hosts []*Host) error {
+	if h.locker == nil || h.task.Lock.Scope != "host" {
+		return nil
+	}
+
+	for _, key := range lockKeys(h.task, hosts) {
+		if err := h.acquire(key); err != nil {
+			return err
+		}
+	}
+
+	h.releaseKey(prepareLockKey(h.task))
+	return nil
+}
+
+func (h *lockHolder) releaseKey(key string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.infos[key]; !ok {
+		return
+	}
+	delete(h.infos, key)
+
+	if err := h.locker.Delete(key, RunID); err != nil {
+		printError(fmt.Errorf("failed to release the lock '%s': %v", key, err))
+	}
+}
+
+// release releases all the locks. It can be called more than once.
+func (h *lockHolder) release() {
+	if h.locker == nil {
+		return
+	}
+
+	heldLocksMutex.Lock()
+	if !heldLocks[h] {
+		heldLocksMutex.Unlock()
+		return
+	}
+	delete(heldLocks, h)
+	heldLocksMutex.Unlock()
+
+	close(h.stop)
+
+	h.mutex.Lock()
+	keys := []string{}
+	for key := range h.infos {
+		keys = append(keys, key)
+	}
+	h.mutex.Unlock()
+
+	for _, key := range keys {
+		h.releaseKey(key)
+	}
+}
+
+// refreshPeriodically refreshes the locks not to expire while the task is running.
+func (h *lockHolder) refreshPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mutex.Lock()
+		for key, info := range h.infos {
+			info.RefreshedAt = time.Now()
+			if err := h.locker.Refresh(key, info); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: failed to refresh the lock '%s': %v", key, err))
+			}
+		}
+		h.mutex.Unlock()
+	}
+}
+
+// releaseHeldLocks releases the locks of all the runs.
+func releaseHeldLocks() {
+	heldLocksMutex.Lock()
+	holders := []*lockHolder{}
+	for h := range heldLocks {
+		holders = append(holders, h)
+	}
+	heldLocksMutex.Unlock()
+
+	for _, h := range holders {
+		h.release()
+	}
+}
+
+func acquireLock(locker Locker, key string, task *Task) (*LockInfo, error) {
+	info := newLockInfo(key, task)
+
+	// retry once after deleting an expired lock.
+	for i := 0; i < 2; i++ {
+		ok, err := locker.Create(key, info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire the lock '%s': %v", key, err)
+		}
+		if ok {
+			if debugFlag {
+				debugf("acquired the lock '%s'\n", key)
+			}
+			return info, nil
+		}
+
+		holder, err := locker.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the lock '%s': %v", key, err)
+		}
+		if holder == nil {
+			// the lock was released just now.
+			continue
+		}
+
+		if !holder.Expired(task.Lock.TTL) {
+			return nil, fmt.Errorf("'%s' is locked by %s. use --force-unlock %s to release it.", key, holder, task.Name)
+		}
+
+		if debugFlag {
+			debugf("the lock '%s' is expired. delete it.\n", key)
+		}
+		if err := locker.Delete(key, holder.RunID); err != nil {
+			return nil, fmt.Errorf("failed to delete the expired lock '%s': %v", key, err)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to acquire the lock '%s'.", key)
+}
+
+// forceUnlockTask releases the locks of the task regardless of the holders.
+func forceUnlockTask(task *Task) error {
+	if task.Lock == nil {
+		return fmt.Errorf("task '%s' doesn't have a lock.", task.Name)
+	}
+
+	locker, err := task.Lock.Locker()
+	if err != nil {
+		return err
+	}
+
+	hosts := []*Host{}
+	if task.Lock.Scope == "host" && len(task.TargetsSlice()) > 0 {
+		query := NewHostQuery().
+			AppendSelections(task.TargetsSlice()).
+			AppendFilters(task.FiltersSlice()).
+			AppendExcludes(task.Excludes)
+		hosts = query.GetHostsOrderByName()
+		if err := query.Err(); err != nil {
+			return err
+		}
+	}
+
+	keys := lockKeys(task, hosts)
+	if task.Lock.Scope == "host" {
+		keys = append(keys, prepareLockKey(task))
+	}
+
+	for _, key := range keys {
+		holder, err := locker.Get(key)
+		if err != nil {
+			return err
+		}
+		if holder == nil {
+			continue
+		}
+
+		if err := locker.Delete(key, ""); err != nil {
+			return err
+		}
+		fmt.Printf("released the lock '%s' held by %s\n", key, holder)
+	}
+
+	return nil
+}
+
+func newLockInfo(key string, task *Task) *LockInfo {
+	hostname, _ := os.Hostname()
+
+	username := os.Getenv("USER")
+	if u, err := user.Current(); username == "" && err == nil {
+		username = u.Username
+	}
+
+	return &LockInfo{
+		Key:        key,
+		Task:       task.Name,
+		User:       username,
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+		RunID:      RunID,
+		AcquiredAt: time.Now(),
+	}
+}
+
+// fileLocker stores the locks as files. It works among the operators if the directory is on a shared file system.
+type fileLocker struct {
+	Dir string
+}
+
+func (l *fileLocker) path(key string) string {
+	return filepath.Join(l.Dir, strings.Replace(key, "/", "_", -1)+".lock")
+}
+
+func (l *fileLocker) Create(key string, info *LockInfo) (bool, error) {
+	if err := os.MkdirAll(l.Dir, os.FileMode(0755)); err != nil {
+		return false, err
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.OpenFile(l.path(key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		os.Remove(l.path(key))
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (l *fileLocker) Get(key string) (*LockInfo, error) {
+	b, err := ioutil.ReadFile(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	info := &LockInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (l *fileLocker) Delete(key string, runID string) error {
+	if runID != "" {
+		holder, err := l.Get(key)
+		if err != nil || holder == nil || holder.RunID != runID {
+			return err
+		}
+	}
+
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *fileLocker) Refresh(key string, info *LockInfo) error {
+	holder, err := l.Get(key)
+	if err != nil {
+		return err
+	}
+	if holder == nil || holder.RunID != info.RunID {
+		return errLockLost
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(l.path(key), b, os.FileMode(0600))
+}
+
+// errLockLost is returned when the run refreshes the lock that is deleted or held by another run.
+var errLockLost = fmt.Errorf("the lock is released or held by another run.")
+
+// redisLocker stores the locks in Redis. It talks RESP directly to avoid adding a client library.
+type redisLocker struct {
+	Address  string
+	Password string
+}
+
+// compareAndDelete deletes the key only if the value is the same, so a run never deletes the lock of another run.
+const redisCompareAndDelete = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// compareAndSet sets the key only if the value is the same, so a run never overwrites the lock of another run.
+const redisCompareAndSet = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("set", KEYS[1], ARGV[2]) else return 0 end`
+
+func (l *redisLocker) do(args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", l.Address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	r := bufio.NewReader(conn)
+	if l.Password != "" {
+		if _, err := redisCommand(conn, r, "AUTH", l.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	return redisCommand(conn, r, args...)
+}
+
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(r)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	}
+
+	return nil, fmt.Errorf("unsupported redis reply: %s", line)
+}
+
+func (l *redisLocker) Create(key string, info *LockInfo) (bool, error) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+
+	reply, err := l.do("SET", key, string(b), "NX")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+func (l *redisLocker) Get(key string) (*LockInfo, error) {
+	reply, err := l.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	info := &LockInfo{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(reply)), info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (l *redisLocker) Delete(key string, runID string) error {
+	if runID == "" {
+		_, err := l.do("DEL", key)
+		return err
+	}
+
+	holder, err := l.do("GET", key)
+	if err != nil || holder == nil {
+		return err
+	}
+
+	info := &LockInfo{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(holder)), info); err != nil || info.RunID != runID {
+		return err
+	}
+
+	_, err = l.do("EVAL", redisCompareAndDelete, "1", key, fmt.Sprint(holder))
+	return err
+}
+
+func (l *redisLocker) Refresh(key string, info *LockInfo) error {
+	holder, err := l.do("GET", key)
+	if err != nil {
+		return err
+	}
+	if holder == nil {
+		return errLockLost
+	}
+
+	current := &LockInfo{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(holder)), current); err != nil {
+		return err
+	}
+	if current.RunID != info.RunID {
+		return errLockLost
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	reply, err := l.do("EVAL", redisCompareAndSet, "1", key, fmt.Sprint(holder), string(b))
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return errLockLost
+	}
+
+	return nil
+}
+
+// consulLocker stores the locks in Consul's KV store with the check-and-set operations.
+type consulLocker struct {
+	Address string
+	Token   string
+}
+
+func (l *consulLocker) request(method string, key string, query url.Values, body []byte) ([]byte, int, error) {
+	u := l.Address + "/v1/kv/" + key
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if l.Token != "" {
+		req.Header.Set("X-Consul-Token", l.Token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, resp.StatusCode, fmt.Errorf("consul: %s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return b, resp.StatusCode, nil
+}
+
+func (l *consulLocker) Create(key string, info *LockInfo) (bool, error) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+
+	// cas=0 puts the key only if it doesn't exist.
+	ret, _, err := l.request("PUT", key, url.Values{"cas": {"0"}}, b)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(ret)) == "true", nil
+}
+
+// get returns the holder and the modify index of the key.
+func (l *consulLocker) get(key string) (*LockInfo, string, error) {
+	ret, status, err := l.request("GET", key, nil, nil)
+	if err != nil || status == http.StatusNotFound {
+		return nil, "", err
+	}
+
+	entries := []struct {
+		ModifyIndex int64
+		Value       []byte
+	}{}
+	if err := json.Unmarshal(ret, &entries); err != nil {
+		return nil, "", err
+	}
+	if len(entries) == 0 {
+		return nil, "", nil
+	}
+
+	info := &LockInfo{}
+	if err := json.Unmarshal(entries[0].Value, info); err != nil {
+		return nil, "", err
+	}
+
+	return info, strconv.FormatInt(entries[0].ModifyIndex, 10), nil
+}
+
+func (l *consulLocker) Get(key string) (*LockInfo, error) {
+	info, _, err := l.get(key)
+	return info, err
+}
+
+func (l *consulLocker) Delete(key string, runID string) error {
+	if runID == "" {
+		_, _, err := l.request("DELETE", key, nil, nil)
+		return err
+	}
+
+	info, index, err := l.get(key)
+	if err != nil || info == nil || info.RunID != runID {
+		return err
+	}
+
+	// the cas index makes sure that the lock isn't changed by another run.
+	_, _, err = l.request("DELETE", key, url.Values{"cas": {index}}, nil)
+	return err
+}
+
+func (l *consulLocker) Refresh(key string, info *LockInfo) error {
+	current, index, err := l.get(key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.RunID != info.RunID {
+		return errLockLost
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	// the cas index makes sure that the lock isn't changed by another run.
+	ret, _, err := l.request("PUT", key, url.Values{"cas": {index}}, b)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(ret)) != "true" {
+		return errLockLost
+	}
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package essh
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	cases := []struct {
+		reply string
+		want  interface{}
+		err   bool
+	}{
+		{reply: "+OK\r\n", want: "OK"},
+		{reply: ":1\r\n", want: int64(1)},
+		{reply: "$5\r\nhello\r\n", want: "hello"},
+		{reply: "$0\r\n\r\n", want: ""},
+		{reply: "$-1\r\n", want: nil},
+		{reply: "-ERR wrong\r\n", err: true},
+		{reply: "\r\n", err: true},
+		{reply: "*1\r\n", err: true},
+		{reply: ":abc\r\n", err: true},
+		{reply: "$10\r\nshort\r\n", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := readRedisReply(bufio.NewReader(strings.NewReader(c.reply)))
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error but got %v", c.reply, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.reply, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: expected %#v but got %#v", c.reply, c.want, got)
+		}
+	}
+}
+
+// fakeRedis is a Redis server that supports only the commands that redisLocker uses.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	data     map[string]string
+	mutex    sync.Mutex
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeRedis{listener: listener, password: password, data: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+
+		if strings.ToUpper(args[0]) == "AUTH" {
+			if args[1] != s.password {
+				fmt.Fprint(conn, "-ERR invalid password\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+			continue
+		}
+		if !authed {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		fmt.Fprint(conn, s.do(args))
+	}
+}
+
+func (s *fakeRedis) do(args []string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bulk := func(key string) string {
+		value, ok := s.data[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		if len(args) == 4 && args[3] == "NX" {
+			if _, ok := s.data[args[1]]; ok {
+				return "$-1\r\n"
+			}
+		}
+		s.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		return bulk(args[1])
+	case "DEL":
+		if _, ok := s.data[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(s.data, args[1])
+		return ":1\r\n"
+	case "EVAL":
+		key := args[3]
+		if s.data[key] != args[4] {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case redisCompareAndDelete:
+			delete(s.data, key)
+			return ":1\r\n"
+		case redisCompareAndSet:
+			s.data[key] = args[5]
+			return "+OK\r\n"
+		}
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	for i := 0; i < n; i++ {
+		arg, err := readRedisReply(r)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fmt.Sprint(arg))
+	}
+	return args, nil
+}
+
+// fakeConsul is a Consul KV store that supports only the operations that consulLocker uses.
+type fakeConsul struct {
+	index   int64
+	entries map[string]*fakeConsulEntry
+	token   string
+	mutex   sync.Mutex
+}
+
+type fakeConsulEntry struct {
+	ModifyIndex int64
+	Value       []byte
+}
+
+func newFakeConsul(token string) *httptest.Server {
+	s := &fakeConsul{entries: map[string]*fakeConsulEntry{}, token: token}
+	return httptest.NewServer(s)
+}
+
+func (s *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Header.Get("X-Consul-Token") != s.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	entry := s.entries[key]
+
+	// cas=0 matches only the key that doesn't exist.
+	casMatched := func() bool {
+		cas := r.URL.Query().Get("cas")
+		if cas == "" {
+			return true
+		}
+		index, _ := strconv.ParseInt(cas, 10, 64)
+		if entry == nil {
+			return index == 0
+		}
+		return entry.ModifyIndex == index
+	}
+
+	switch r.Method {
+	case "GET":
+		if entry == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Key": key, "ModifyIndex": entry.ModifyIndex, "Value": base64.StdEncoding.EncodeToString(entry.Value)},
+		})
+	case "PUT":
+		if !casMatched() {
+			fmt.Fprint(w, "false")
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		s.index++
+		s.entries[key] = &fakeConsulEntry{ModifyIndex: s.index, Value: b}
+		fmt.Fprint(w, "true")
+	case "DELETE":
+		if !casMatched() {
+			fmt.Fprint(w, "false")
+			return
+		}
+		delete(s.entries, key)
+		fmt.Fprint(w, "true")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testLocker runs the operations that every locker must support.
+func testLocker(t *testing.T, locker Locker) {
+	key := "essh/lock/task/deploy"
+	mine := &LockInfo{Key: key, Task: "deploy", RunID: "run1"}
+	other := &LockInfo{Key: key, Task: "deploy", RunID: "run2"}
+
+	if holder, err := locker.Get(key); err != nil || holder != nil {
+		t.Fatalf("expected no holder but got %v, %v", holder, err)
+	}
+
+	if ok, err := locker.Create(key, mine); err != nil || !ok {
+		t.Fatalf("expected to create the lock but got %v, %v", ok, err)
+	}
+	if ok, err := locker.Create(key, other); err != nil || ok {
+		t.Fatalf("expected not to create the existing lock but got %v, %v", ok, err)
+	}
+
+	holder, err := locker.Get(key)
+	if err != nil || holder == nil || holder.RunID != "run1" {
+		t.Fatalf("expected the holder run1 but got %v, %v", holder, err)
+	}
+
+	// the other run can't refresh and delete the lock.
+	if err := locker.Refresh(key, other); err != errLockLost {
+		t.Errorf("expected errLockLost but got %v", err)
+	}
+	if err := locker.Delete(key, "run2"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if holder, _ := locker.Get(key); holder == nil || holder.RunID != "run1" {
+		t.Fatalf("expected that the lock is kept but got %v", holder)
+	}
+
+	mine.Hostname = "refreshed"
+	if err := locker.Refresh(key, mine); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if holder, _ := locker.Get(key); holder == nil || holder.Hostname != "refreshed" {
+		t.Errorf("expected the refreshed lock but got %v", holder)
+	}
+
+	if err := locker.Delete(key, "run1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if holder, err := locker.Get(key); err != nil || holder != nil {
+		t.Fatalf("expected that the lock is deleted but got %v, %v", holder, err)
+	}
+	if err := locker.Refresh(key, mine); err != errLockLost {
+		t.Errorf("expected errLockLost but got %v", err)
+	}
+
+	// force unlock
+	if ok, err := locker.Create(key, other); err != nil || !ok {
+		t.Fatalf("expected to create the lock but got %v, %v", ok, err)
+	}
+	if err := locker.Delete(key, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if holder, err := locker.Get(key); err != nil || holder != nil {
+		t.Fatalf("expected that the lock is deleted but got %v, %v", holder, err)
+	}
+}
+
+func TestFileLocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "essh-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testLocker(t, &fileLocker{Dir: dir})
+}
+
+func TestRedisLocker(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.listener.Close()
+
+	testLocker(t, &redisLocker{Address: s.listener.Addr().String(), Password: "secret"})
+
+	locker := &redisLocker{Address: s.listener.Addr().String(), Password: "wrong"}
+	if _, err := locker.Get("essh/lock/task/deploy"); err == nil {
+		t.Errorf("expected an error of the wrong password")
+	}
+}
+
+func TestConsulLocker(t *testing.T) {
+	s := newFakeConsul("token")
+	defer s.Close()
+
+	testLocker(t, &consulLocker{Address: s.URL, Token: "token"})
+
+	locker := &consulLocker{Address: s.URL}
+	if _, err := locker.Get("essh/lock/task/deploy"); err == nil {
+		t.Errorf("expected an error of the missing token")
+	}
+}
@@ -29,12 +29,21 @@ func InitLuaState(L *lua.LState) {
 	L.SetGlobal("task", L.NewFunction(esshTask))
 	L.SetGlobal("driver", L.NewFunction(esshDriver))
 	L.SetGlobal("group", L.NewFunction(esshGroup))
+	L.SetGlobal("connection", L.NewFunction(esshConnection))
+	L.SetGlobal("host_provider", L.NewFunction(esshHostProvider))
+	L.SetGlobal("role", L.NewFunction(esshRole))
 
 	// modules
 	L.PreloadModule("json", gluajson.Loader)
 	L.PreloadModule("fs", gluafs.Loader)
-	L.PreloadModule("yaml", gluayaml.Loader)
-	L.PreloadModule("template", gluatemplate.Loader)
+	L.PreloadModule("yaml", aliasLoader(gluayaml.Loader, map[string]string{
+		"decode": "parse",
+		"encode": "dump",
+	}))
+	L.PreloadModule("template", aliasLoader(gluatemplate.Loader, map[string]string{
+		"render":      "dostring",
+		"render_file": "dofile",
+	}))
 	L.PreloadModule("question", gluaquestion.Loader)
 	L.PreloadModule("env", gluaenv.Loader)
 	L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
@@ -50,22 +59,50 @@ func InitLuaState(L *lua.LState) {
 
 	L.SetFuncs(lessh, map[string]lua.LGFunction{
 		// aliases global function.
-		"host":   esshHost,
-		"task":   esshTask,
-		"driver": esshDriver,
-		"group":  esshGroup,
+		"host":       esshHost,
+		"task":       esshTask,
+		"driver":     esshDriver,
+		"group":      esshGroup,
+		"connection": esshConnection,
+
+		"host_provider": esshHostProvider,
+		"role":          esshRole,
 
 		// utility functions
 		"debug":            esshDebug,
 		"select_hosts":     esshSelectHosts,
 		"current_registry": esshCurrentRegistry,
+		"import_etc_hosts": esshImportEtcHosts,
+		"import_zone":      esshImportZone,
+		"require_version":  esshRequireVersion,
+		"secret":           esshSecret,
+		"secret_env":       esshSecretEnv,
+		"secret_command":   esshSecretCommand,
 	})
 }
 
+// aliasLoader wraps a module loader to provide alternative names of the module's functions.
+// It lets libraries expose a consistent api like 'json.encode/decode' and 'yaml.encode/decode'.
+func aliasLoader(loader lua.LGFunction, aliases map[string]string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		ret := loader(L)
+
+		if mod, ok := toLTable(L.Get(-1)); ok {
+			for alias, name := range aliases {
+				if mod.RawGetString(alias) == lua.LNil {
+					mod.RawSetString(alias, mod.RawGetString(name))
+				}
+			}
+		}
+
+		return ret
+	}
+}
+
 func esshDebug(L *lua.LState) int {
 	msg := L.CheckString(1)
 	if debugFlag {
-		fmt.Printf("[essh debug] %s\n", msg)
+		debugf("%s\n", msg)
 	}
 
 	return 0
@@ -0,0 +1,166 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"regexp"
+	"sync"
+)
+
+// OutputFilter is an entry of output_filters. A pattern drops the lines that match it.
+// A Lua function receives each line and can transform, drop or annotate it.
+type OutputFilter struct {
+	Pattern *regexp.Regexp
+	Fn      *lua.LFunction
+	L       *lua.LState
+}
+
+// GlobalOutputFilters are essh.output_filters. They are applied to the output of all the tasks after the task's and the host's ones.
+var GlobalOutputFilters []*OutputFilter
+
+// luaOutputFilterMutex serializes the calls of the Lua functions, because the output of the hosts is read concurrently
+// and the Lua state is not goroutine safe.
+var luaOutputFilterMutex sync.Mutex
+
+// toOutputFilters converts a pattern, a function or a table of them of output_filters to the filters.
+func toOutputFilters(L *lua.LState, value lua.LValue) ([]*OutputFilter, error) {
+	errInvalid := fmt.Errorf("output_filters must be a pattern, a function or a table of them.")
+
+	values := []lua.LValue{}
+	if tb, ok := toLTable(value); ok {
+		tb.ForEach(func(_ lua.LValue, v lua.LValue) {
+			values = append(values, v)
+		})
+	} else {
+		values = append(values, value)
+	}
+
+	filters := []*OutputFilter{}
+	for _, v := range values {
+		if fn, ok := v.(*lua.LFunction); ok {
+			filters = append(filters, &OutputFilter{Fn: fn, L: L})
+		} else if s, ok := toString(v); ok {
+			compiled, err := compileOutputFilters([]string{s})
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, compiled...)
+		} else {
+			return nil, errInvalid
+		}
+	}
+
+	return filters, nil
+}
+
+func compileOutputFilters(patterns []string) ([]*OutputFilter, error) {
+	filters := []*OutputFilter{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of output_filters '%s': %v", pattern, err)
+		}
+		filters = append(filters, &OutputFilter{Pattern: re})
+	}
+
+	return filters, nil
+}
+
+// outputFilters returns the filters of the output of the task's script on the host.
+// They are the task's output_filters, the host's ones and essh.output_filters.
+func outputFilters(task *Task, host *Host) []*OutputFilter {
+	filters := append([]*OutputFilter{}, task.OutputFilters...)
+	if host != nil {
+		filters = append(filters, host.OutputFilters...)
+	}
+	return append(filters, GlobalOutputFilters...)
+}
+
+// lineFilter applies the output filters to the lines of a stream of the task's script on the host.
+// It also takes the control lines like "##essh:set key=value" out of the stdout.
+type lineFilter struct {
+	filters []*OutputFilter
+	task    string
+	host    string
+	stream  string
+}
+
+// newLineFilter returns the filter of the stream ("stdout" or "stderr").
+// It returns nil if there are no filters and no host to take the control lines.
+func newLineFilter(filters []*OutputFilter, task string, host *Host, stream string) *lineFilter {
+	if len(filters) == 0 && host == nil {
+		return nil
+	}
+
+	f := &lineFilter{filters: filters, task: task, stream: stream}
+	if host != nil {
+		f.host = host.Name
+	}
+	return f
+}
+
+// apply returns the line to output. It returns false if the line is dropped.
+func (f *lineFilter) apply(line string) (string, bool) {
+	if f == nil {
+		return line, true
+	}
+
+	if f.host != "" && f.stream == "stdout" && handleControlLine(f.host, line) {
+		return "", false
+	}
+
+	for _, filter := range f.filters {
+		if filter.Pattern != nil {
+			if filter.Pattern.MatchString(line) {
+				return "", false
+			}
+			continue
+		}
+
+		var ok bool
+		line, ok = f.call(filter, line)
+		if !ok {
+			return "", false
+		}
+	}
+
+	return line, true
+}
+
+// call calls the Lua function of the filter with the line and the context like function(line, ctx).
+// The function returns a string to replace the line, false to drop it, or nil to keep it as it is.
+func (f *lineFilter) call(filter *OutputFilter, line string) (string, bool) {
+	luaOutputFilterMutex.Lock()
+	defer luaOutputFilterMutex.Unlock()
+
+	L := filter.L
+	ctx := L.NewTable()
+	ctx.RawSetString("task", lua.LString(f.task))
+	ctx.RawSetString("host", lua.LString(f.host))
+	ctx.RawSetString("stream", lua.LString(f.stream))
+
+	err := L.CallByParam(lua.P{
+		Fn:      filter.Fn,
+		NRet:    1,
+		Protect: true,
+	}, lua.LString(line), ctx)
+	if err != nil {
+		// the line is kept not to lose the output by a broken filter.
+		printError(fmt.Errorf("output_filters function failed: %v", err))
+		return line, true
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	switch v := ret.(type) {
+	case lua.LBool:
+		if !bool(v) {
+			return "", false
+		}
+	case lua.LString:
+		return string(v), true
+	}
+
+	return line, true
+}
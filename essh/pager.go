@@ -0,0 +1,74 @@
+package essh
+
+import (
+	"github.com/mattn/go-isatty"
+	"os"
+	"os/exec"
+)
+
+// DefaultPager is used when neither ESSH_PAGER nor PAGER is set.
+const DefaultPager = "less"
+
+// pagerCommand returns the pager that pipes long outputs. It is empty if the pager is disabled.
+func pagerCommand() string {
+	if noPagerFlag || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return ""
+	}
+
+	pager, ok := os.LookupEnv("ESSH_PAGER")
+	if !ok {
+		pager, ok = os.LookupEnv("PAGER")
+	}
+	if !ok {
+		pager = DefaultPager
+	}
+	if pager == "cat" {
+		return ""
+	}
+
+	return pager
+}
+
+// startPager replaces os.Stdout with a pipe to the pager like git does.
+// The returned function must be called to wait for the pager to exit and restore os.Stdout.
+// If the pager is disabled or fails to start, it does nothing.
+func startPager() func() {
+	pager := pagerCommand()
+	if pager == "" {
+		return func() {}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		// quit if the output fits on one screen, keep colors and don't clear the screen.
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		if debugFlag {
+			debugf("failed to start pager: %v\n", err)
+		}
+		return func() {}
+	}
+	r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	return func() {
+		w.Close()
+		cmd.Wait()
+		os.Stdout = stdout
+	}
+}
@@ -0,0 +1,168 @@
+package essh
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// writeTaskPlan writes what the task will do without running it: the target hosts, the execution order,
+// the users that run the scripts, the payloads and the scripts that are rendered by the driver for each host.
+func writeTaskPlan(w io.Writer, config string, task *Task, hosts []*Host) error {
+	backend := task.Backend
+	if backend == "" {
+		backend = TASK_BACKEND_LOCAL
+	}
+
+	fmt.Fprintf(w, "Task:        %s\n", task.PublicName())
+	fmt.Fprintf(w, "Description: %s\n", task.Description)
+	fmt.Fprintf(w, "Backend:     %s\n", backend)
+	if !task.IsRemoteTask() {
+		fmt.Fprintf(w, "Local shell: %s\n", localShell(task))
+	}
+	if len(task.Args) > 0 {
+		fmt.Fprintf(w, "Args:        %s\n", ShellQuote(task.Args))
+	}
+
+	runAs := "(login user)"
+	if !task.IsRemoteTask() {
+		runAs = "(current user)"
+	}
+	if task.User != "" {
+		runAs = task.User + " (sudo)"
+	} else if task.Privileged {
+		runAs = "root (sudo)"
+	}
+	fmt.Fprintf(w, "Run as:      %s\n", runAs)
+
+	if task.Lock != nil {
+		fmt.Fprintf(w, "Lock:        %s (scope: %s)\n", task.Lock.Backend, task.Lock.Scope)
+	}
+	if task.Prepare != nil {
+		fmt.Fprintf(w, "Prepare:     skipped (the plan shows the task before its prepare function runs)\n")
+	}
+
+	fmt.Fprintf(w, "Hosts:       %d\n", len(hosts))
+	for i, host := range hosts {
+		fmt.Fprintf(w, "    %d. %s", i+1, host.Name)
+		if hostname := host.SSHConfig["HostName"]; hostname != "" {
+			fmt.Fprintf(w, " (%s)", hostname)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(hosts) > 1 {
+		if task.Parallel {
+			fmt.Fprintf(w, "Execution:   parallel (all the hosts at once)\n")
+		} else {
+			execution := "serial (in the order of the hosts)"
+			if task.HealthCheck != nil && task.IsRemoteTask() {
+				execution += fmt.Sprintf(", health check '%s' after each host", task.HealthCheck.Command)
+			}
+			fmt.Fprintf(w, "Execution:   %s\n", execution)
+		}
+	}
+
+	for _, hook := range []struct {
+		title  string
+		script []map[string]string
+	}{{"Before all (local)", task.BeforeAll}, {"After all (local)", task.AfterAll}} {
+		if len(hook.script) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", hook.title)
+		for _, step := range hook.script {
+			for _, line := range strings.Split(strings.TrimRight(step["code"], "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+
+	if len(hosts) == 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "==> local\n")
+		return writeTaskPlanScript(w, config, task, nil, hosts)
+	}
+
+	for i, host := range hosts {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "==> %s (%d/%d)\n", host.Name, i+1, len(hosts))
+		if err := writeTaskPlanScript(w, config, task, host, hosts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTaskPlanScript(w io.Writer, config string, task *Task, host *Host, hosts []*Host) error {
+	if segments := scriptSegments(task); segments != nil {
+		// the local and remote steps run in order.
+		for _, segment := range segments {
+			fmt.Fprintf(w, "Steps (%s):\n", segment.Backend)
+			if err := writeTaskPlanScript(w, config, segment, host, hosts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !task.IsRemoteTask() {
+		dir, err := localWorkDir(task, host)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Work dir: %s\n", dir)
+	}
+
+	if payload := task.PayloadForHost(host); payload != "" {
+		fmt.Fprintf(w, "Payload: %s\n", payload)
+	}
+
+	var script string
+	if shell := localShell(task); !task.IsRemoteTask() && shell != LOCAL_SHELL_BASH {
+		// cmd and PowerShell get the variables as the environment variables.
+		env := taskEnviron(config, task, host, hosts)
+		sort.Strings(env)
+		fmt.Fprintf(w, "Environment:\n")
+		for _, e := range env {
+			fmt.Fprintf(w, "    %s\n", e)
+		}
+
+		code := []string{}
+		if task.File != "" {
+			b, err := GetContentFromPath(task.File)
+			if err != nil {
+				return err
+			}
+			code = append(code, string(b))
+		} else {
+			for _, s := range task.Script {
+				code = append(code, s["code"])
+			}
+		}
+		script = strings.Join(code, "\n")
+	} else {
+		if task.Driver == "" {
+			task.Driver = DefaultDriverName
+		}
+		driver := Drivers[task.Driver]
+		if driver == nil {
+			return fmt.Errorf("invalid driver name '%s'", task.Driver)
+		}
+
+		content, err := driver.GenerateRunnableContent(config, task, host, hosts)
+		if err != nil {
+			return err
+		}
+		script = content
+	}
+
+	fmt.Fprintf(w, "Script:\n")
+	for _, line := range strings.Split(strings.TrimRight(script, "\n"), "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+
+	return nil
+}
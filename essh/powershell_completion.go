@@ -0,0 +1,154 @@
+package essh
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var zshOptionRegexp = regexp.MustCompile(`'(--[a-z0-9-]+):((?:[^'\\]|\\.)*)'`)
+
+// PowerShellOption is an option that is completed by the PowerShell completion code.
+type PowerShellOption struct {
+	Name        string
+	Description string
+}
+
+// powerShellOptions returns the options with their descriptions. They are taken from the zsh completion code
+// not to maintain the same list twice.
+func powerShellOptions() []*PowerShellOption {
+	seen := map[string]bool{}
+	options := []*PowerShellOption{}
+	for _, m := range zshOptionRegexp.FindAllStringSubmatch(ZSH_COMPLETION, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		options = append(options, &PowerShellOption{
+			Name:        m[1],
+			Description: strings.Replace(m[2], "\\:", ":", -1),
+		})
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Name < options[j].Name
+	})
+
+	return options
+}
+
+// PowerShellQuote quotes the string in a single-quoted string of PowerShell.
+func PowerShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func sprintPowerShellCompletion() (string, error) {
+	tmpl, err := template.New("T").Funcs(template.FuncMap{
+		"PowerShellQuote": PowerShellQuote,
+	}).Parse(POWERSHELL_COMPLETION)
+	if err != nil {
+		return "", err
+	}
+
+	dict := map[string]interface{}{
+		"Executable": Executable,
+		"Options":    powerShellOptions(),
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, dict); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+var POWERSHELL_COMPLETION = `# This is PowerShell completion code.
+# If you want to use it. write the following code in your profile ($PROFILE)
+#   essh --powershell-completion | Out-String | Invoke-Expression
+
+function escp {
+    & {{PowerShellQuote .Executable}} --scp -- @args
+}
+
+function ersync {
+    & {{PowerShellQuote .Executable}} --rsync -- @args
+}
+
+Register-ArgumentCompleter -Native -CommandName essh -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $essh = {{PowerShellQuote .Executable}}
+    $elements = @($commandAst.CommandElements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | ForEach-Object { $_.ToString() })
+    $prev = ''
+    if ($elements.Count -gt 1) {
+        $prev = $elements[-1]
+    }
+    $allOption = @()
+    if ($elements -contains '--all') {
+        $allOption = @('--all')
+    }
+
+    function Get-EsshList($flag) {
+        & $essh @allOption $flag 2>$null | ForEach-Object {
+            $fields = $_ -split "` + "`" + `t", 2
+            $name = $fields[0] -replace '\\:', ':'
+            $description = $name
+            if ($fields.Count -gt 1 -and $fields[1]) {
+                $description = $fields[1] -replace '\\:', ':'
+            }
+            [PSCustomObject]@{ Name = $name; Description = $description }
+        }
+    }
+
+    function New-EsshResults($items, $type) {
+        $items | Where-Object { $_.Name -like "$wordToComplete*" } | ForEach-Object {
+            [System.Management.Automation.CompletionResult]::new($_.Name, $_.Name, $type, $_.Description)
+        }
+    }
+
+    function ConvertTo-EsshItems($names) {
+        $names | ForEach-Object { [PSCustomObject]@{ Name = $_; Description = $_ } }
+    }
+
+    switch ($prev) {
+        { $_ -in '--select', '--target', '--filter', '--exclude' } {
+            New-EsshResults (@(Get-EsshList '--zsh-completion-hosts') + @(Get-EsshList '--zsh-completion-tags')) 'ParameterValue'
+            return
+        }
+        { $_ -in '--describe', '--show-command', '--export', '--socks', '--socks-stop' } {
+            New-EsshResults (Get-EsshList '--zsh-completion-hosts') 'ParameterValue'
+            return
+        }
+        '--backend' {
+            New-EsshResults (ConvertTo-EsshItems @('local', 'remote')) 'ParameterValue'
+            return
+        }
+        '--format' {
+            New-EsshResults (ConvertTo-EsshItems @('table', 'json', 'prettyjson', 'yaml', 'csv', 'tsv', 'prometheus-sd')) 'ParameterValue'
+            return
+        }
+        '--gen-format' {
+            New-EsshResults (ConvertTo-EsshItems @('ssh', 'json', 'yaml')) 'ParameterValue'
+            return
+        }
+        { $_ -in '--config', '--script-file', '--debug-file', '--output', '--diff-config', '--working-dir' } {
+            # complete the paths by default.
+            return
+        }
+    }
+
+    if ($wordToComplete -like '-*') {
+        $options = @(
+{{- range .Options}}
+            [PSCustomObject]@{ Name = {{PowerShellQuote .Name}}; Description = {{PowerShellQuote .Description}} }
+{{- end}}
+        )
+        New-EsshResults $options 'ParameterName'
+        return
+    }
+
+    New-EsshResults (@(Get-EsshList '--zsh-completion-hosts') + @(Get-EsshList '--zsh-completion-tasks')) 'ParameterValue'
+}
+`
@@ -0,0 +1,62 @@
+package essh
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+)
+
+// The metrics of --refresh-daemon. They are served at /debug/vars with the runtime metrics.
+var (
+	refreshCount        = new(expvar.Int)
+	refreshFailures     = new(expvar.Int)
+	refreshLastDuration = new(expvar.Float)
+)
+
+var publishStatsOnce sync.Once
+
+// publishRefreshDaemonStats publishes the metrics of --refresh-daemon. expvar can't publish the same name twice.
+func publishRefreshDaemonStats() {
+	publishStatsOnce.Do(func() {
+		stats := expvar.NewMap("refresh_daemon")
+		stats.Set("refreshes", refreshCount)
+		stats.Set("failures", refreshFailures)
+		stats.Set("last_duration_seconds", refreshLastDuration)
+	})
+}
+
+// startPprofServer serves the pprof endpoints (/debug/pprof/) and the runtime metrics (/debug/vars)
+// for profiling the long-running process. It returns the function to stop the server.
+func startPprofServer(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed && debugFlag {
+			debugf("pprof server stopped: %v\n", err)
+		}
+	}()
+
+	printProgress(VERBOSITY_NORMAL, "serving pprof at http://%s/debug/pprof/", ln.Addr().String())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
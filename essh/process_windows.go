@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package essh
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills only the command on Windows.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// detachProcessGroup does nothing on Windows.
+func detachProcessGroup(cmd *exec.Cmd) {
+}
@@ -0,0 +1,87 @@
+package essh
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The phases of an invocation that are measured by --profile.
+const (
+	PROFILE_LUA        = "lua"
+	PROFILE_PROVIDERS  = "providers"
+	PROFILE_GENERATION = "generation"
+	PROFILE_EXECUTION  = "execution"
+)
+
+// Profile records the time that essh spends in each phase to find why an invocation is slow.
+// The methods can be called with nil, so the callers don't have to check --profile.
+type Profile struct {
+	Start   time.Time
+	Records []*ProfileRecord
+	mutex   sync.Mutex
+}
+
+// ProfileRecord is the total time of a phase. Host is set for the execution on each host.
+type ProfileRecord struct {
+	Phase    string
+	Host     string
+	Duration time.Duration
+}
+
+// profile is created by --profile.
+var profile *Profile
+
+func NewProfile() *Profile {
+	return &Profile{
+		Start:   time.Now(),
+		Records: []*ProfileRecord{},
+	}
+}
+
+// Add adds the time since the start to the phase. A phase that runs several times like
+// evaluating the config files is summed up.
+func (p *Profile) Add(phase string, host string, start time.Time) {
+	if p == nil {
+		return
+	}
+	d := time.Since(start)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, r := range p.Records {
+		if r.Phase == phase && r.Host == host {
+			r.Duration += d
+			return
+		}
+	}
+	p.Records = append(p.Records, &ProfileRecord{Phase: phase, Host: host, Duration: d})
+}
+
+// Write writes the report of the phases in the order that they ran, and the total time of the invocation.
+func (p *Profile) Write(w io.Writer) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	total := time.Since(p.Start)
+	listing := &Listing{Header: []string{"PHASE", "HOST", "TIME", "RATIO"}}
+	for _, r := range p.Records {
+		listing.Append([]string{r.Phase, r.Host, roundDuration(r.Duration, time.Microsecond).String(), profileRatio(r.Duration, total)})
+	}
+	listing.Append([]string{"total", "", roundDuration(total, time.Microsecond).String(), profileRatio(total, total)})
+
+	return listing.Write(w, FormatTable, false)
+}
+
+func profileRatio(d time.Duration, total time.Duration) string {
+	if total <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(d)/float64(total)*100)
+}
@@ -0,0 +1,75 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PromptInfo is a compact summary of the current project for shell prompts.
+type PromptInfo struct {
+	// Project is true if the working directory has a per-project config file.
+	Project bool
+	Hosts   int
+	Tasks   int
+	// Environment is the value of essh.environment like "production".
+	Environment string
+}
+
+func newPromptInfo(lessh *lua.LTable) *PromptInfo {
+	info := &PromptInfo{}
+
+	if _, err := os.Stat(WorkingDirConfigFile); err == nil {
+		info.Project = true
+	}
+
+	for _, host := range Hosts {
+		if !host.Hidden {
+			info.Hosts++
+		}
+	}
+
+	for _, t := range NewTaskQuery().GetTasksOrderByName() {
+		if !t.Disabled && !t.Hidden {
+			info.Tasks++
+		}
+	}
+
+	if env, ok := toString(lessh.RawGetString("environment")); ok {
+		info.Environment = env
+	}
+
+	return info
+}
+
+// writePromptInfo writes the info as "project=true hosts=12 tasks=5 env=production" that is easy to parse in shell scripts,
+// or in the format specified by --format.
+func writePromptInfo(w io.Writer, info *PromptInfo, format string) error {
+	keys := []string{"project", "hosts", "tasks", "env"}
+	values := []string{strconv.FormatBool(info.Project), strconv.Itoa(info.Hosts), strconv.Itoa(info.Tasks), info.Environment}
+
+	if format == "" {
+		pairs := []string{}
+		for i, key := range keys {
+			pairs = append(pairs, key+"="+values[i])
+		}
+		fmt.Fprintln(w, strings.Join(pairs, " "))
+		return nil
+	}
+
+	listing := &Listing{
+		Header: []string{"PROJECT", "HOSTS", "TASKS", "ENV"},
+		Rows:   [][]string{values},
+		Data: map[string]interface{}{
+			"project": info.Project,
+			"hosts":   info.Hosts,
+			"tasks":   info.Tasks,
+			"env":     info.Environment,
+		},
+	}
+
+	return listing.Write(w, format, false)
+}
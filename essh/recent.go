@@ -0,0 +1,84 @@
+package essh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRecentCount is the number of the entries that --recent shows without --limit.
+const DefaultRecentCount = 10
+
+// recentEntries returns the defined hosts and tasks that have been used, ordered by the time they were used last.
+func recentEntries(usage *Usage) []*UsageEntry {
+	entries := frequentEntries(usage)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsedAt.After(entries[j].LastUsedAt)
+	})
+
+	return entries
+}
+
+// selectRecentEntry shows the entries with the numbers and reads the number of the entry to select.
+// It returns nil if nothing is selected.
+func selectRecentEntry(r io.Reader, w io.Writer, entries []*UsageEntry) (*UsageEntry, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("there are no hosts and tasks that have been used.")
+	}
+
+	width := 0
+	for _, e := range entries {
+		if len(e.Name) > width {
+			width = len(e.Name)
+		}
+	}
+
+	for i, e := range entries {
+		fmt.Fprintf(w, "%3d) %-*s  %s  %s\n", i+1, width, e.Name, e.Kind, color.FgY(usedAgo(e.LastUsedAt)))
+	}
+	fmt.Fprintf(w, "select [1-%d]: ", len(entries))
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(line)
+	if err != nil || n < 1 || n > len(entries) {
+		return nil, fmt.Errorf("invalid selection '%s'.", line)
+	}
+
+	return entries[n-1], nil
+}
+
+// usedAgo formats the time like "3 hours ago".
+func usedAgo(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return agoString(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return agoString(int(d/time.Hour), "hour")
+	default:
+		return agoString(int(d/(24*time.Hour)), "day")
+	}
+}
+
+func agoString(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s ago", unit)
+	}
+	return fmt.Sprintf("%d %ss ago", n, unit)
+}
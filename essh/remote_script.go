@@ -0,0 +1,68 @@
+package essh
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// encodings of the scripts that are sent to the remote hosts.
+const (
+	SCRIPT_ENCODING_NONE   = "none"
+	SCRIPT_ENCODING_BASE64 = "base64"
+)
+
+// shells that run the scripts on the remote hosts.
+const (
+	REMOTE_SHELL_BASH = "bash"
+	REMOTE_SHELL_SH   = "sh"
+	// REMOTE_SHELL_AUTO uses bash if the remote host has it, otherwise sh.
+	REMOTE_SHELL_AUTO = "auto"
+)
+
+func validateScriptEncoding(encoding string) error {
+	if encoding != SCRIPT_ENCODING_NONE && encoding != SCRIPT_ENCODING_BASE64 {
+		return fmt.Errorf("invalid script_encoding '%s'. supported encodings are none and base64.", encoding)
+	}
+
+	return nil
+}
+
+func validateRemoteShell(shell string) error {
+	if shell != REMOTE_SHELL_BASH && shell != REMOTE_SHELL_SH && shell != REMOTE_SHELL_AUTO {
+		return fmt.Errorf("invalid remote_shell '%s'. supported shells are bash, sh and auto.", shell)
+	}
+
+	return nil
+}
+
+// remoteShell returns the shell command that runs the task's script on the host.
+// The task's remote_shell overrides the host's one. The default is bash.
+func remoteShell(task *Task, host *Host) string {
+	shell := task.RemoteShell
+	if shell == "" && host != nil {
+		shell = host.RemoteShell
+	}
+
+	switch shell {
+	case REMOTE_SHELL_SH:
+		return "sh"
+	case REMOTE_SHELL_AUTO:
+		// it is evaluated by the login shell on the remote host.
+		return `"$(command -v bash || echo sh)"`
+	default:
+		return "bash"
+	}
+}
+
+// remoteScriptCommand returns the remote command of ssh that runs the script.
+// By default, the script is passed to the shell as a quoted argument. With the base64 encoding, it is passed as
+// a base64 string and decoded on the remote host, so the script is sent as it is regardless of its content
+// like CR characters. The script still gets the stdin of ssh.
+func remoteScriptCommand(task *Task, host *Host, script string) []string {
+	shell := remoteShell(task, host)
+	if task.ScriptEncoding == SCRIPT_ENCODING_BASE64 {
+		return []string{shell, "-c", `"$(echo ` + base64.StdEncoding.EncodeToString([]byte(script)) + ` | base64 -d)"`}
+	}
+
+	return []string{shell, "-c", ShellEscape(script)}
+}
@@ -0,0 +1,143 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// esshRequireVersion raises an error if the version of Essh doesn't satisfy the constraints like ">= 1.5.0, < 2.0".
+// The dev builds satisfy any constraints.
+func esshRequireVersion(L *lua.LState) int {
+	constraints := L.CheckString(1)
+
+	ok, err := checkVersion(Version, constraints)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	if !ok {
+		L.RaiseError("this config requires essh %s, but the version is %s. please update essh.", constraints, Version)
+	}
+
+	return 0
+}
+
+var versionConstraintRegexp = regexp.MustCompile(`^(=|!=|>=|<=|>|<|~>)?\s*v?([0-9]+(\.[0-9]+)*(-[0-9A-Za-z.-]+)?)$`)
+
+// checkVersion reports whether the version satisfies all the comma-separated constraints.
+// The operators are "=", "!=", ">", ">=", "<", "<=" and "~>" (">= 1.5, < 2.0" for "~> 1.5").
+func checkVersion(version string, constraints string) (bool, error) {
+	// the dev builds don't have the versions, but the constraints are still validated.
+	current, err := parseVersion(version)
+	if err != nil && debugFlag {
+		debugf("skip checking the version '%s': %v\n", version, err)
+	}
+
+	for _, c := range strings.Split(constraints, ",") {
+		m := versionConstraintRegexp.FindStringSubmatch(strings.TrimSpace(c))
+		if m == nil {
+			return false, fmt.Errorf("invalid version constraint '%s'.", strings.TrimSpace(c))
+		}
+
+		required, err := parseVersion(m[2])
+		if err != nil {
+			return false, err
+		}
+		if current == nil {
+			continue
+		}
+
+		cmp := compareVersions(current, required)
+		var ok bool
+		switch m[1] {
+		case "", "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case "~>":
+			// the last segment of the required version can be incremented.
+			upper := &parsedVersion{Segments: append([]int{}, required.Segments...)}
+			if len(upper.Segments) > 1 {
+				upper.Segments = upper.Segments[:len(upper.Segments)-1]
+			}
+			upper.Segments[len(upper.Segments)-1]++
+			ok = cmp >= 0 && compareVersions(current, upper) < 0
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+type parsedVersion struct {
+	Segments   []int
+	Prerelease string
+}
+
+func parseVersion(s string) (*parsedVersion, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+
+	v := &parsedVersion{}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.Prerelease = s[i+1:]
+		s = s[:i]
+	}
+
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version '%s'.", s)
+		}
+		v.Segments = append(v.Segments, n)
+	}
+
+	return v, nil
+}
+
+// compareVersions compares the versions by the segments. The missing segments are 0,
+// and a pre-release version is lower than the release.
+func compareVersions(a, b *parsedVersion) int {
+	for i := 0; i < len(a.Segments) || i < len(b.Segments); i++ {
+		var x, y int
+		if i < len(a.Segments) {
+			x = a.Segments[i]
+		}
+		if i < len(b.Segments) {
+			y = b.Segments[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case a.Prerelease == b.Prerelease:
+		return 0
+	case a.Prerelease == "":
+		return 1
+	case b.Prerelease == "":
+		return -1
+	case a.Prerelease < b.Prerelease:
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,267 @@
+package essh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Role is a logical name of a set of hosts (like "active-web") that is resolved at runtime.
+// A role has named sets of hosts (like "blue" and "green") and the current set is stored in a state file,
+// so that switching the targets of the tasks is a single state change by --switch-role.
+// A role can also be resolved by a Lua function.
+type Role struct {
+	Name        string
+	Description string
+	// Sets are the host names, tags or groups of each set.
+	Sets        map[string][]string
+	Default     string
+	TargetsFunc func() ([]string, error)
+	Registry    *Registry
+	Source      string
+	// targets are cached after the role is resolved once.
+	targets []string
+}
+
+var Roles map[string]*Role
+
+func esshRole(L *lua.LState) int {
+	name := L.CheckString(1)
+	if L.GetTop() == 2 {
+		// function style
+		registerRole(L, name, L.CheckTable(2))
+		return 0
+	}
+
+	// DSL style
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		registerRole(L, name, L.CheckTable(1))
+		return 0
+	}))
+	return 1
+}
+
+func registerRole(L *lua.LState, name string, config *lua.LTable) {
+	if debugFlag {
+		debugf("register role: %s\n", name)
+	}
+
+	r := &Role{
+		Name:     name,
+		Sets:     map[string][]string{},
+		Registry: CurrentRegistry,
+		Source:   strings.TrimSuffix(L.Where(1), ":"),
+	}
+
+	config.ForEach(func(k, v lua.LValue) {
+		key := lua.LVAsString(k)
+		switch key {
+		case "description":
+			r.Description = lua.LVAsString(v)
+		case "default":
+			r.Default = lua.LVAsString(v)
+		case "sets":
+			tb, ok := toLTable(v)
+			if !ok {
+				L.RaiseError("sets of the role '%s' must be a table.", name)
+			}
+			tb.ForEach(func(setName, targets lua.LValue) {
+				r.Sets[lua.LVAsString(setName)] = toTargets(targets)
+			})
+		case "targets":
+			fn, ok := v.(*lua.LFunction)
+			if !ok {
+				L.RaiseError("targets of the role '%s' must be a function.", name)
+			}
+			r.TargetsFunc = func() ([]string, error) {
+				err := L.CallByParam(lua.P{
+					Fn:      fn,
+					NRet:    1,
+					Protect: true,
+				}, lua.LString(name))
+				if err != nil {
+					return nil, err
+				}
+
+				ret := L.Get(-1) // returned value
+				L.Pop(1)
+
+				return toTargets(ret), nil
+			}
+		default:
+			L.RaiseError("unsupported role's field '%s'.", key)
+		}
+	})
+
+	if r.TargetsFunc == nil && len(r.Sets) == 0 {
+		L.RaiseError("role '%s' requires 'sets' or 'targets'.", name)
+	}
+
+	if r.Default != "" {
+		if _, ok := r.Sets[r.Default]; !ok {
+			L.RaiseError("default '%s' of the role '%s' is not in the sets.", r.Default, name)
+		}
+	}
+
+	Roles[name] = r
+}
+
+// toTargets converts a string or an array table of strings to the targets.
+func toTargets(value lua.LValue) []string {
+	targets := []string{}
+	if s, ok := toString(value); ok {
+		targets = append(targets, s)
+	} else if tb, ok := toLTable(value); ok {
+		tb.ForEach(func(_, v lua.LValue) {
+			if s, ok := toString(v); ok {
+				targets = append(targets, s)
+			}
+		})
+	}
+
+	return targets
+}
+
+func GetRoleNames() []string {
+	names := []string{}
+	for name := range Roles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// SetNames returns the sorted names of the role's sets.
+func (r *Role) SetNames() []string {
+	names := []string{}
+	for name := range r.Sets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// StateFile is a file that stores the current sets of the roles. The roles that are defined
+// in the per-project config use the per-project data directory.
+func (r *Role) StateFile() string {
+	if r.Registry != nil && r.Registry.Type == RegistryTypeLocal {
+		return filepath.Join(WorkingDataDir, "roles.json")
+	}
+
+	return filepath.Join(UserDataDir, "roles.json")
+}
+
+// CurrentSet returns the name of the current set. It returns the default set
+// (or the first set by name) if the role has never been switched.
+func (r *Role) CurrentSet() string {
+	if set, ok := loadRoleStates(r.StateFile())[r.Name]; ok {
+		if _, ok := r.Sets[set]; ok {
+			return set
+		}
+	}
+
+	if r.Default != "" {
+		return r.Default
+	}
+
+	if names := r.SetNames(); len(names) > 0 {
+		return names[0]
+	}
+
+	return ""
+}
+
+// Targets resolves the host names, tags or groups of the role.
+func (r *Role) Targets() ([]string, error) {
+	if r.targets != nil {
+		return r.targets, nil
+	}
+
+	if r.TargetsFunc != nil {
+		targets, err := r.TargetsFunc()
+		if err != nil {
+			return nil, &ConfigError{Err: fmt.Errorf("failed to resolve the role '%s': %v", r.Name, err)}
+		}
+		r.targets = targets
+	} else {
+		r.targets = r.Sets[r.CurrentSet()]
+	}
+
+	if debugFlag {
+		debugf("role '%s' is resolved to %v\n", r.Name, r.targets)
+	}
+
+	return r.targets, nil
+}
+
+// Switch changes the current set of the role and saves it to the state file.
+func (r *Role) Switch(set string) error {
+	if r.TargetsFunc != nil {
+		return fmt.Errorf("role '%s' is resolved by a function. it can't be switched.", r.Name)
+	}
+
+	if _, ok := r.Sets[set]; !ok {
+		return fmt.Errorf("role '%s' doesn't have the set '%s'. available sets: %s", r.Name, set, strings.Join(r.SetNames(), ", "))
+	}
+
+	file := r.StateFile()
+	states := loadRoleStates(file)
+	states[r.Name] = set
+
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	r.targets = nil
+
+	return writeFileAtomic(file, b, os.FileMode(0600))
+}
+
+func loadRoleStates(file string) map[string]string {
+	states := map[string]string{}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return states
+	}
+
+	if err := json.Unmarshal(b, &states); err != nil && debugFlag {
+		debugf("failed to load %s: %v\n", file, err)
+	}
+
+	return states
+}
+
+// expandRoles replaces the role names in the selections with the role's targets.
+func expandRoles(selections []string) ([]string, error) {
+	expanded := []string{}
+	for _, selection := range selections {
+		role := Roles[selection]
+		if role == nil {
+			expanded = append(expanded, selection)
+			continue
+		}
+
+		targets, err := role.Targets()
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, targets...)
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,126 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"time"
+)
+
+// RunInfo is metadata of an essh invocation that is passed to the global lifecycle hooks
+// (essh.on_before_run and essh.on_after_run).
+type RunInfo struct {
+	ID   string
+	Mode string
+	Args []string
+	// Task is a name of the task that runs. It is empty except the task mode.
+	Task       string
+	StartedAt  time.Time
+	ExitStatus int
+	Finished   bool
+}
+
+// newRunInfo detects the running mode from the flags and args. It returns nil if essh doesn't run anything.
+func newRunInfo(args []string) *RunInfo {
+	run := &RunInfo{
+		ID:        RunID,
+		Args:      args,
+		StartedAt: time.Now(),
+	}
+
+	switch {
+	case scpFlag:
+		run.Mode = "scp"
+	case rsyncFlag:
+		run.Mode = "rsync"
+	case socksVar != "":
+		run.Mode = "socks"
+	case pingFlag:
+		run.Mode = "ping"
+	case benchFlag:
+		run.Mode = "bench"
+	case execFlag:
+		run.Mode = "exec"
+	case len(args) > 0 && GetEnabledTask(args[0]) != nil:
+		run.Mode = "task"
+		run.Task = args[0]
+	case len(args) > 0 || oneFlag:
+		run.Mode = "ssh"
+	default:
+		return nil
+	}
+
+	return run
+}
+
+func newLRunInfo(L *lua.LState, run *RunInfo) *lua.LTable {
+	tb := L.NewTable()
+	tb.RawSetString("id", lua.LString(run.ID))
+	tb.RawSetString("mode", lua.LString(run.Mode))
+	tb.RawSetString("working_dir", lua.LString(WorkingDir))
+	tb.RawSetString("started_at", lua.LNumber(run.StartedAt.Unix()))
+
+	largs := L.NewTable()
+	for _, arg := range run.Args {
+		largs.Append(lua.LString(redact(arg)))
+	}
+	tb.RawSetString("args", largs)
+
+	if run.Task != "" {
+		tb.RawSetString("task", lua.LString(run.Task))
+	}
+
+	if run.Finished {
+		tb.RawSetString("exit_status", lua.LNumber(run.ExitStatus))
+		tb.RawSetString("duration", lua.LNumber(time.Since(run.StartedAt).Seconds()))
+
+		states := L.NewTable()
+		for host, state := range allHostStates() {
+			states.RawSetString(host, newLHostState(L, state))
+		}
+		tb.RawSetString("states", states)
+		tb.RawSetString("shared", newLSharedValues(L))
+	}
+
+	return tb
+}
+
+// hasLifecycleHooks reports whether the config files define any global lifecycle hooks.
+func hasLifecycleHooks(lessh *lua.LTable) bool {
+	return lessh.RawGetString("on_before_run") != lua.LNil || lessh.RawGetString("on_after_run") != lua.LNil
+}
+
+// runLifecycleHook calls a global lifecycle hook like essh.on_before_run with the run metadata.
+// It returns an error if the hook returns false, so that on_before_run can cancel the invocation.
+func runLifecycleHook(L *lua.LState, lessh *lua.LTable, name string, run *RunInfo) error {
+	value := lessh.RawGetString(name)
+	if value == lua.LNil {
+		return nil
+	}
+
+	fn, ok := value.(*lua.LFunction)
+	if !ok {
+		return &ConfigError{Err: fmt.Errorf("%s have to be a function.", name)}
+	}
+
+	if debugFlag {
+		debugf("run %s hook\n", name)
+	}
+
+	err := L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, newLRunInfo(L, run))
+	if err != nil {
+		return &ConfigError{Err: err}
+	}
+
+	ret := L.Get(-1) // returned value
+	L.Pop(1)
+
+	if retB, ok := ret.(lua.LBool); ok && !bool(retB) {
+		return fmt.Errorf("returned false from the %s hook.", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package essh
+
+import (
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SecretMask replaces the secret values in the outputs.
+const SecretMask = "***"
+
+// Secrets are the values that are registered by essh.secret and essh.secret_env.
+// They are masked in the debug log, the error messages, the output of the tasks
+// and the data that is passed to the lifecycle hooks.
+var Secrets map[string]bool
+
+var secretReplacer *strings.Replacer
+
+// registerSecret registers the value to be masked. An empty value is ignored.
+func registerSecret(value string) {
+	if value == "" || Secrets[value] {
+		return
+	}
+	Secrets[value] = true
+
+	values := []string{}
+	for s := range Secrets {
+		values = append(values, s)
+	}
+	// replace the longer values first, because a secret may contain another one.
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+
+	pairs := []string{}
+	for _, s := range values {
+		pairs = append(pairs, s, SecretMask)
+	}
+	secretReplacer = strings.NewReplacer(pairs...)
+}
+
+// hasSecrets reports whether any secret is registered.
+func hasSecrets() bool {
+	return secretReplacer != nil
+}
+
+// redact masks the secrets in the string.
+func redact(s string) string {
+	if secretReplacer == nil {
+		return s
+	}
+	return secretReplacer.Replace(s)
+}
+
+// redactWriter masks the secrets in the data that is written at once.
+// The secrets that are split into several writes are not masked, so it is used with the writers that write each line.
+type redactWriter struct {
+	w io.Writer
+}
+
+func newRedactWriter(w io.Writer) io.Writer {
+	if !hasSecrets() {
+		return w
+	}
+	return &redactWriter{w: w}
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func esshSecret(L *lua.LState) int {
+	value := L.CheckString(1)
+	registerSecret(value)
+
+	L.Push(lua.LString(value))
+	return 1
+}
+
+func esshSecretEnv(L *lua.LState) int {
+	name := L.CheckString(1)
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	registerSecret(value)
+
+	L.Push(lua.LString(value))
+	return 1
+}
+
+// esshSecretCommand runs the command that gets a secret from a secret store like Vault or a keyring,
+// and returns its stdout without the trailing newlines as a secret.
+func esshSecretCommand(L *lua.LState) int {
+	command := L.CheckString(1)
+
+	cmd := shellCommand(command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		L.RaiseError("secret_command '%s' failed: %v", command, err)
+	}
+
+	value := strings.TrimRight(string(out), "\r\n")
+	registerSecret(value)
+
+	L.Push(lua.LString(value))
+	return 1
+}
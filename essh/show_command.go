@@ -0,0 +1,141 @@
+package essh
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// effectiveSSHConfig returns the ssh_config options that ssh applies to the host with the generated ssh_config.
+// They are the host's options, the options of the hosts that have matching patterns in their names like "*.example.com"
+// and the connection settings. The first obtained value is used for each option like ssh does.
+func effectiveSSHConfig(host *Host) []map[string]string {
+	values := []map[string]string{}
+	seen := map[string]bool{}
+
+	add := func(config map[string]string) {
+		keys := []string{}
+		for key := range config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if seen[strings.ToLower(key)] {
+				continue
+			}
+			seen[strings.ToLower(key)] = true
+			values = append(values, map[string]string{key: config[key]})
+		}
+	}
+
+	add(host.SSHConfig)
+	for _, h := range NewHostQuery().GetHostsOrderByName() {
+		if h != host && matchHostPatterns(h.Name, host.Name) {
+			add(h.SSHConfig)
+		}
+	}
+	add(ConnectionSettings)
+
+	return values
+}
+
+// matchHostPatterns reports whether the name matches the patterns of ssh_config's "Host" like "*.example.com !db.example.com".
+func matchHostPatterns(patterns string, name string) bool {
+	if !strings.ContainsAny(patterns, "*?!") {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range strings.FieldsFunc(patterns, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.HasPrefix(pattern, "!") {
+			if ok, _ := filepath.Match(pattern[1:], name); ok {
+				return false
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// jumpHosts returns the hosts of the ProxyJump. It returns false if any of the jump hosts isn't defined in essh.
+func jumpHosts(jump string) ([]*Host, bool) {
+	hosts := []*Host{}
+	for _, hop := range strings.Split(jump, ",") {
+		host := Hosts[strings.TrimSpace(hop)]
+		if host == nil {
+			return nil, false
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, true
+}
+
+// standaloneSSHArgs returns the args of ssh command that connects to the host without the generated ssh_config.
+// The options are inlined by "-o", and ProxyJump through the essh hosts is converted to ProxyCommand
+// that runs ssh command with the jump hosts' options.
+func standaloneSSHArgs(host *Host, visited map[string]bool) ([]string, error) {
+	if visited[host.Name] {
+		return nil, fmt.Errorf("ProxyJump of '%s' is circular.", host.Name)
+	}
+	visited[host.Name] = true
+	defer delete(visited, host.Name)
+
+	args := []string{"ssh"}
+	for _, config := range effectiveSSHConfig(host) {
+		for key, value := range config {
+			if strings.EqualFold(key, "ProxyJump") {
+				if hops, ok := jumpHosts(value); ok {
+					command, err := jumpProxyCommand(hops, visited)
+					if err != nil {
+						return nil, err
+					}
+					key, value = "ProxyCommand", command
+				}
+			}
+			args = append(args, "-o", key+"="+value)
+		}
+	}
+	for _, forward := range host.RemoteForwardConfigs() {
+		args = append(args, "-o", "RemoteForward="+forward)
+	}
+
+	return append(args, host.Name), nil
+}
+
+// jumpProxyCommand returns ProxyCommand that connects through the jump hosts in order.
+func jumpProxyCommand(hops []*Host, visited map[string]bool) (string, error) {
+	last := hops[len(hops)-1]
+
+	args, err := standaloneSSHArgs(last, visited)
+	if err != nil {
+		return "", err
+	}
+	if len(hops) > 1 {
+		// the previous hops are used as the jump hosts of the last hop.
+		command, err := jumpProxyCommand(hops[:len(hops)-1], visited)
+		if err != nil {
+			return "", err
+		}
+		// the last hop's own proxy is ignored like ssh does.
+		proxied := []string{args[0], "-o", "ProxyCommand=" + command}
+		for i := 1; i < len(args)-1; i += 2 {
+			if !strings.HasPrefix(args[i+1], "ProxyCommand=") && !strings.HasPrefix(args[i+1], "ProxyJump=") {
+				proxied = append(proxied, args[i], args[i+1])
+			}
+		}
+		args = append(proxied, args[len(args)-1])
+	}
+
+	// the tokens like "%h" in the command are expanded by the outer ssh, so escape them for the inner ssh.
+	// "%h:%p" is the address of the target that is expanded by the outer ssh.
+	command := strings.Replace(ShellQuote(args[:len(args)-1]), "%", "%%", -1)
+
+	return command + " -W %h:%p " + ShellQuote(args[len(args)-1:]), nil
+}
@@ -0,0 +1,151 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var DefaultSocksPort = 1080
+
+// SocksDir is a directory that stores pid files of the running socks proxies.
+func SocksDir() string {
+	return filepath.Join(UserDataDir, "socks")
+}
+
+func socksPidFile(hostname string) string {
+	return filepath.Join(SocksDir(), hostname+".pid")
+}
+
+// runSocks opens a dynamic (-D) socks proxy through the host.
+// It reconnects when the ssh connection is closed until essh receives SIGINT or SIGTERM.
+func runSocks(config string, hostname string, port int) error {
+	if Hosts[hostname] == nil {
+		return fmt.Errorf("host '%s' is not defined.", hostname)
+	}
+
+	if err := os.MkdirAll(SocksDir(), os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	pidFile := socksPidFile(hostname)
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(pidFile)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	wait := time.Second
+	for {
+		cmd := exec.Command("ssh",
+			"-F", config,
+			"-N",
+			"-D", strconv.Itoa(port),
+			"-o", "ExitOnForwardFailure=yes",
+			"-o", "ServerAliveInterval=30",
+			hostname,
+		)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if debugFlag {
+			debugf("real ssh command: %v \n", cmd.Args)
+		}
+
+		printProgress(VERBOSITY_NORMAL, "socks proxy on localhost:%d through '%s'", port, hostname)
+
+		startedAt := time.Now()
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		doneCh := make(chan error, 1)
+		go func() {
+			doneCh <- cmd.Wait()
+		}()
+
+		select {
+		case <-sigCh:
+			cmd.Process.Signal(syscall.SIGTERM)
+			<-doneCh
+			return nil
+		case err := <-doneCh:
+			// reset the backoff when the connection was kept for a while.
+			if time.Since(startedAt) > time.Minute {
+				wait = time.Second
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("essh: socks proxy through '%s' was closed (%v). reconnecting in %v...", hostname, err, wait))
+		}
+
+		select {
+		case <-sigCh:
+			return nil
+		case <-time.After(wait):
+		}
+
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
+}
+
+// stopSocks stops the running socks proxies. If hostname is empty, it stops all the proxies.
+func stopSocks(hostname string) error {
+	var pidFiles []string
+	if hostname != "" {
+		pidFiles = []string{socksPidFile(hostname)}
+	} else {
+		files, err := filepath.Glob(filepath.Join(SocksDir(), "*.pid"))
+		if err != nil {
+			return err
+		}
+		pidFiles = files
+	}
+
+	if len(pidFiles) == 0 {
+		return fmt.Errorf("there are no running socks proxies.")
+	}
+
+	for _, pidFile := range pidFiles {
+		name := strings.TrimSuffix(filepath.Base(pidFile), ".pid")
+
+		b, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return fmt.Errorf("socks proxy through '%s' is not running.", name)
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return fmt.Errorf("invalid pid file %s: %v", pidFile, err)
+		}
+
+		process, err := os.FindProcess(pid)
+		if err == nil {
+			err = process.Signal(syscall.SIGTERM)
+		}
+		if err != nil {
+			// the process has gone. remove the stale pid file.
+			os.Remove(pidFile)
+			if debugFlag {
+				debugf("removed stale pid file: %s\n", pidFile)
+			}
+			continue
+		}
+
+		printProgress(VERBOSITY_NORMAL, "stopped socks proxy through '%s'", name)
+	}
+
+	return nil
+}
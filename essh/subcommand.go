@@ -0,0 +1,189 @@
+package essh
+
+import (
+	"strings"
+)
+
+// Subcommand is an alternative form of the command line options.
+// The first argument that matches a subcommand is expanded to the options,
+// so that `essh hosts --select web` behaves the same as `essh --hosts --select web`.
+type Subcommand struct {
+	Name        string
+	Options     []string
+	Description string
+	// Subcommands are the nested subcommands like `essh task run`.
+	Subcommands []*Subcommand
+}
+
+var Subcommands = []*Subcommand{
+	{Name: "hosts", Options: []string{"--hosts"}, Description: "List hosts."},
+	{Name: "tags", Options: []string{"--tags"}, Description: "List tags."},
+	{Name: "tasks", Options: []string{"--tasks"}, Description: "List tasks."},
+	{Name: "exec", Options: []string{"--exec"}, Description: "Execute commands with the hosts."},
+	{Name: "describe", Options: []string{"--describe"}, Description: "Show details of a host."},
+	{Name: "graph", Options: []string{"--graph"}, Description: "Output a graph of the tasks in DOT format."},
+	{
+		Name:        "task",
+		Description: "Manage tasks.",
+		Subcommands: []*Subcommand{
+			{Name: "list", Options: []string{"--tasks"}, Description: "List tasks."},
+			// `essh task run foo` is expanded to `essh foo`.
+			{Name: "run", Options: []string{}, Description: "Run a task."},
+		},
+	},
+	{Name: "version", Options: []string{"--version"}, Description: "Print version."},
+	{Name: "help", Options: []string{"--help"}, Description: "Print help."},
+}
+
+func findSubcommand(subcommands []*Subcommand, name string) *Subcommand {
+	for _, sub := range subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// ExpandedSubcommand is a subcommand that is expanded to the options in the arguments.
+type ExpandedSubcommand struct {
+	Name string
+	// Words are the arguments that are replaced with the options like ["task", "run"].
+	Words   []string
+	Options []string
+}
+
+// expandSubcommand replaces a subcommand in the arguments with the corresponding options.
+// It returns the expanded arguments and the subcommand, or the arguments as they are and nil.
+// The options before the subcommand are kept as they are.
+// The first argument that is neither an option nor a subcommand stops expanding,
+// because it is a host or a task name.
+func expandSubcommand(osArgs []string) ([]string, *ExpandedSubcommand) {
+	for i := 0; i < len(osArgs); i++ {
+		arg := osArgs[i]
+		if arg == "--" {
+			return osArgs, nil
+		}
+
+		if strings.HasPrefix(arg, "-") {
+			if optionRequiresArgument(arg) {
+				// skip the option's value.
+				i++
+			}
+			continue
+		}
+
+		sub := findSubcommand(Subcommands, arg)
+		if sub == nil {
+			return osArgs, nil
+		}
+
+		name := sub.Name
+		words := []string{arg}
+		rest := osArgs[i+1:]
+		if sub.Subcommands != nil {
+			if len(rest) == 0 {
+				return osArgs, nil
+			}
+			nested := findSubcommand(sub.Subcommands, rest[0])
+			if nested == nil {
+				return osArgs, nil
+			}
+			sub = nested
+			words = append(words, rest[0])
+			rest = rest[1:]
+		}
+
+		expanded := append([]string{}, osArgs[:i]...)
+		expanded = append(expanded, sub.Options...)
+		return append(expanded, rest...), &ExpandedSubcommand{Name: name, Words: words, Options: sub.Options}
+	}
+
+	return osArgs, nil
+}
+
+// subcommandIsShadowed reports whether a host or a task has the same name as the subcommand.
+// The host or the task takes precedence over the subcommand.
+func subcommandIsShadowed(sub *ExpandedSubcommand) bool {
+	if sub == nil {
+		return false
+	}
+	return Hosts[sub.Name] != nil || GetEnabledTask(sub.Name) != nil
+}
+
+// restoreSubcommand reverts the options that the subcommand is expanded to, and puts the words of the subcommand
+// back at the head of the arguments, so the arguments are the same as the ones that are parsed without expanding it.
+// It is used instead of parsing the arguments again, because the config is already loaded.
+func restoreSubcommand(sub *ExpandedSubcommand, args []string) []string {
+	words := append([]string{}, sub.Words...)
+	for _, option := range sub.Options {
+		for i, o := range usedOptions {
+			if o == option {
+				usedOptions = append(usedOptions[:i:i], usedOptions[i+1:]...)
+				break
+			}
+		}
+
+		// the option is also in the command line.
+		if hasUsedOption(option) {
+			continue
+		}
+
+		switch option {
+		case "--hosts":
+			hostsFlag = false
+		case "--tags":
+			tagsFlag = false
+		case "--tasks":
+			tasksFlag = false
+		case "--exec":
+			execFlag = false
+		case "--graph":
+			graphFlag = false
+		case "--describe":
+			// the value of --describe is the argument after the subcommand.
+			words = append(words, describeVar)
+			describeVar = ""
+		}
+	}
+
+	return append(words, args...)
+}
+
+func hasUsedOption(option string) bool {
+	for _, o := range usedOptions {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// optionsWithArgument are the options that take a value as the next argument.
+var optionsWithArgument = []string{
+	"--select",
+	"--target",
+	"--filter",
+	"--exclude",
+	"--limit",
+	"--bench-count",
+	"--columns",
+	"--format",
+	"--describe",
+	"--user",
+	"--prefix-string",
+	"--driver",
+	"--backend",
+	"--working-dir",
+	"--config",
+	"--completion-cache-ttl",
+	"--socks",
+}
+
+func optionRequiresArgument(arg string) bool {
+	for _, o := range optionsWithArgument {
+		if o == arg {
+			return true
+		}
+	}
+	return false
+}
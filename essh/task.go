@@ -1,8 +1,15 @@
 package essh
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
 )
 
 type Task struct {
@@ -15,12 +22,54 @@ type Task struct {
 	Script      []map[string]string
 	File        string
 	Backend     string
+	LocalShell  string
 	Targets     []string
+	TargetsFunc func() ([]string, error)
 	Filters     []string
+	Excludes    []string
+	Limit       int
 	Parallel    bool
-	Privileged  bool
-	User        string
-	SSHOptions  []string
+	// PrivateHosts are the hosts that are defined inline in "on". They are registered only while the task runs.
+	PrivateHosts []*Host
+	// SerializeAuth authenticates to the hosts one by one before running the task in parallel.
+	SerializeAuth bool
+	// MultiplexJump shares a master connection to the common jump host (ProxyJump) of the target hosts.
+	MultiplexJump bool
+	Privileged    bool
+	User          string
+	SSHOptions    []string
+	ForwardAgent  bool
+	// Interpreter is a command like "python3" that runs the script instead of the shell.
+	Interpreter string
+	// RemoteShell is a shell that runs the script on the remote hosts. It overrides the hosts' remote_shell.
+	RemoteShell string
+	// ScriptEncoding is an encoding of the script that is sent to the remote hosts. "none" or "base64".
+	ScriptEncoding string
+	// Trace prints each command of the script with its expanded arguments by "set -x".
+	Trace bool
+	// OutputFilters are the patterns of the lines that are dropped from the output of the script.
+	OutputFilters []*OutputFilter
+	// RemoteForwards are specs of ssh's -R option to be used while the task's script is running.
+	RemoteForwards []string
+	Payload        string
+	PayloadFor     func(*Host) (string, error)
+	// payloads that are evaluated by PayloadFor for each host.
+	HostPayloads map[string]string
+	// BeforeAll and AfterAll are scripts that run once on the local machine before and after running the task for all the hosts.
+	BeforeAll []map[string]string
+	AfterAll  []map[string]string
+	// Expect fails the run on each host if the result of the script doesn't match it.
+	Expect *TaskExpect
+	// capture receives the stdout of the script to check the expectations.
+	capture io.Writer
+	// barrier makes the hosts wait for each other at the steps that have "wait" in parallel mode.
+	barrier *stepBarrier
+	// HealthCheck runs after the script finishes on each host in serial mode.
+	HealthCheck *HealthCheck
+	// Lock prevents running the task concurrently.
+	Lock *TaskLock
+	// WorkDir is a directory where the local scripts run. It is a text template like "envs/{{.Host.Name}}".
+	WorkDir string
 	// deprecated? use only hidden?
 	Disabled  bool
 	Hidden    bool
@@ -50,13 +99,17 @@ const (
 
 func NewTask() *Task {
 	return &Task{
-		Targets: []string{},
-		Filters: []string{},
-		Backend: TASK_BACKEND_LOCAL,
+		Props:      map[string]string{},
+		Targets:    []string{},
+		Filters:    []string{},
+		Excludes:   []string{},
+		Backend:    TASK_BACKEND_LOCAL,
 		SSHOptions: []string{},
-		Script:  []map[string]string{},
-		Args:    []string{},
-		LValues: map[string]lua.LValue{},
+		Script:     []map[string]string{},
+		Args:       []string{},
+		LValues:    map[string]lua.LValue{},
+
+		HostPayloads: map[string]string{},
 	}
 }
 
@@ -94,6 +147,16 @@ func (t *Task) FiltersSlice() []string {
 	return []string{}
 }
 
+func (t *Task) PayloadForHost(host *Host) string {
+	if host != nil {
+		if payload, ok := t.HostPayloads[host.Name]; ok {
+			return payload
+		}
+	}
+
+	return t.Payload
+}
+
 func (t *Task) DescriptionOrDefault() string {
 	if t.Description == "" {
 		return t.Name + " task"
@@ -135,7 +198,7 @@ func esshTask(L *lua.LState) int {
 
 func registerTask(L *lua.LState, name string) *Task {
 	if debugFlag {
-		fmt.Printf("[essh debug] register task: %s\n", name)
+		debugf("register task: %s\n", name)
 	}
 
 	t := NewTask()
@@ -153,6 +216,30 @@ func registerTask(L *lua.LState, name string) *Task {
 	return t
 }
 
+// registerTaskHosts registers the private hosts that are defined inline in the task's "on" field.
+// They are registered only while the task runs, so the prepare function can create or modify them,
+// and the other tasks and the hosts list never see them.
+func registerTaskHosts(task *Task) ([]*Host, error) {
+	hosts := []*Host{}
+	for _, h := range task.PrivateHosts {
+		if _, ok := Hosts[h.Name]; ok {
+			unregisterTaskHosts(hosts)
+			return nil, fmt.Errorf("private host '%s' of the task '%s' is duplicated with another host.", h.Name, task.Name)
+		}
+
+		Hosts[h.Name] = h
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
+
+func unregisterTaskHosts(hosts []*Host) {
+	for _, h := range hosts {
+		delete(Hosts, h.Name)
+	}
+}
+
 func setupTask(L *lua.LState, t *Task, config *lua.LTable) {
 	config.ForEach(func(k, v lua.LValue) {
 		if kstr, ok := toString(k); ok {
@@ -248,11 +335,84 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 				L.RaiseError("backend must be '%s' or '%s'.", TASK_BACKEND_LOCAL, TASK_BACKEND_REMOTE)
 			}
 		}
+	case "local_shell":
+		shellStr, ok := toString(value)
+		if !ok {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+		if err := validateLocalShell(shellStr); err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.LocalShell = shellStr
+	case "interpreter":
+		if interpreterStr, ok := toString(value); ok {
+			task.Interpreter = interpreterStr
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "output_filters":
+		filters, err := toOutputFilters(L, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.OutputFilters = filters
+	case "remote_shell":
+		shellStr, ok := toString(value)
+		if !ok {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+		if err := validateRemoteShell(shellStr); err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.RemoteShell = shellStr
+	case "script_encoding":
+		encodingStr, ok := toString(value)
+		if !ok {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+		if err := validateScriptEncoding(encodingStr); err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.ScriptEncoding = encodingStr
 	case "targets":
-		if targetsStr, ok := toString(value); ok {
+		if targetsFn, ok := value.(*lua.LFunction); ok {
+			// targets are resolved at runtime.
+			task.Targets = []string{}
+			task.TargetsFunc = func() ([]string, error) {
+				err := L.CallByParam(lua.P{
+					Fn:      targetsFn,
+					NRet:    1,
+					Protect: true,
+				}, newLTask(L, task))
+				if err != nil {
+					return nil, &ConfigError{Err: err}
+				}
+
+				ret := L.Get(-1) // returned value
+				L.Pop(1)
+
+				targets := []string{}
+				if ret == lua.LNil {
+					return targets, nil
+				} else if targetsStr, ok := toString(ret); ok {
+					return []string{targetsStr}, nil
+				} else if targetsSlice, ok := toSlice(ret); ok {
+					for _, target := range targetsSlice {
+						if targetStr, ok := target.(string); ok {
+							targets = append(targets, targetStr)
+						}
+					}
+					return targets, nil
+				}
+
+				return nil, &ConfigError{Err: fmt.Errorf("targets function must return a string or array table of strings.")}
+			}
+		} else if targetsStr, ok := toString(value); ok {
 			task.Targets = []string{targetsStr}
+			task.TargetsFunc = nil
 		} else if targetsSlice, ok := toSlice(value); ok {
 			task.Targets = []string{}
+			task.TargetsFunc = nil
 
 			for _, target := range targetsSlice {
 				if targetStr, ok := target.(string); ok {
@@ -276,18 +436,63 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "excludes":
+		if excludesStr, ok := toString(value); ok {
+			task.Excludes = []string{excludesStr}
+		} else if excludesSlice, ok := toSlice(value); ok {
+			task.Excludes = []string{}
+
+			for _, exclude := range excludesSlice {
+				if excludeStr, ok := exclude.(string); ok {
+					task.Excludes = append(task.Excludes, excludeStr)
+				}
+			}
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "limit":
+		// the limit is a number of the hosts, so it must be a positive integer.
+		if limitNum, ok := toFloat64(value); ok && limitNum >= 1 && limitNum == float64(int(limitNum)) {
+			task.Limit = int(limitNum)
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "description":
 		if descStr, ok := toString(value); ok {
 			task.Description = descStr
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "work_dir":
+		if dirStr, ok := toString(value); ok {
+			task.WorkDir = dirStr
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "pty":
 		if ptyBool, ok := toBool(value); ok {
 			task.Pty = ptyBool
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "remote_forwards":
+		forwards, err := toRemoteForwards(value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.RemoteForwards = forwards
+	case "forward_agent":
+		if b, ok := toBool(value); ok {
+			task.ForwardAgent = b
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "trace":
+		if b, ok := toBool(value); ok {
+			task.Trace = b
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "driver":
 		if driverStr, ok := toString(value); ok {
 			task.Driver = driverStr
@@ -312,6 +517,18 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "multiplex_jump":
+		if b, ok := toBool(value); ok {
+			task.MultiplexJump = b
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "serialize_auth":
+		if b, ok := toBool(value); ok {
+			task.SerializeAuth = b
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "ssh_options":
 		if sshOptionsSlice, ok := toSlice(value); ok {
 			task.SSHOptions = []string{}
@@ -343,6 +560,18 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		if task.File != "" && len(task.Script) > 0 {
 			L.RaiseError("invalid task definition: can't use 'script_file' and 'script' at the same time.")
 		}
+	case "before_all":
+		script, err := toScript(L, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.BeforeAll = script
+	case "after_all":
+		script, err := toScript(L, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.AfterAll = script
 	case "script_file":
 		if fileStr, ok := toString(value); ok {
 			task.File = fileStr
@@ -368,10 +597,10 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 				err := L.CallByParam(lua.P{
 					Fn:      prepareFn,
 					NRet:    1,
-					Protect: false,
+					Protect: true,
 				}, newLTask(L, task))
 				if err != nil {
-					return err
+					return &ConfigError{Err: err}
 				}
 
 				ret := L.Get(-1) // returned value
@@ -412,6 +641,83 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "on":
+		// the same as "targets", but it can have the private hosts that are defined inline by "host { name = ... }".
+		tb, ok := toLTable(value)
+		if !ok {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+
+		task.Targets = []string{}
+		task.TargetsFunc = nil
+		task.PrivateHosts = []*Host{}
+
+		maxn := tb.MaxN()
+		for i := 1; i <= maxn; i++ {
+			v := tb.RawGetInt(i)
+			if targetStr, ok := toString(v); ok {
+				task.Targets = append(task.Targets, targetStr)
+			} else if ud, ok := v.(*lua.LUserData); ok {
+				h, ok := ud.Value.(*Host)
+				if !ok {
+					panic("invalid value of a task's field '" + key + "'.")
+				}
+				task.Targets = append(task.Targets, h.Name)
+				if h.private {
+					task.PrivateHosts = append(task.PrivateHosts, h)
+				}
+			} else {
+				panic("invalid value of a task's field '" + key + "'.")
+			}
+		}
+	case "expect":
+		expect, err := toTaskExpect(value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.Expect = expect
+	case "lock":
+		lock, err := toTaskLock(value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.Lock = lock
+	case "health_check":
+		check, err := toHealthCheck(value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.HealthCheck = check
+	case "payload":
+		payload, err := toPayload(value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.Payload = payload
+	case "payload_for":
+		if payloadForFn, ok := value.(*lua.LFunction); ok {
+			task.PayloadFor = func(host *Host) (string, error) {
+				err := L.CallByParam(lua.P{
+					Fn:      payloadForFn,
+					NRet:    1,
+					Protect: true,
+				}, newLHost(L, host))
+				if err != nil {
+					return "", err
+				}
+
+				ret := L.Get(-1) // returned value
+				L.Pop(1)
+
+				if ret == lua.LNil {
+					return task.Payload, nil
+				}
+
+				return toPayload(ret)
+			}
+		} else {
+			L.RaiseError("payload_for have to be a function.")
+		}
 	case "args":
 		if argsSlice, ok := toSlice(value); ok {
 			task.Args = []string{}
@@ -429,18 +735,45 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 	}
 }
 
+// toPayload converts a payload value to a string.
+// If the value is a table, it is serialized to JSON.
+func toPayload(value lua.LValue) (string, error) {
+	if str, ok := toString(value); ok {
+		return str, nil
+	} else if _, ok := toLTable(value); ok {
+		b, err := json.Marshal(toGoValue(value))
+		if err != nil {
+			return "", fmt.Errorf("'payload' couldn't be serialized to JSON: %v", err)
+		}
+		return string(b), nil
+	}
+
+	return "", fmt.Errorf("'payload' got a invalid value.")
+}
+
 func toScript(L *lua.LState, value lua.LValue) ([]map[string]string, error) {
 	ret := []map[string]string{}
 
 	if tb, ok := toLTable(value); ok {
 		maxn := tb.MaxN()
 		if maxn == 0 { // table
-			if tb.RawGetString("code") == lua.LNil {
-				return nil, fmt.Errorf("if a 'script' entry is table, it has to have 'code' property.")
+			if tb.RawGetString("code") == lua.LNil && tb.RawGetString(TASK_BACKEND_LOCAL) == lua.LNil && tb.RawGetString(TASK_BACKEND_REMOTE) == lua.LNil {
+				return nil, fmt.Errorf("if a 'script' entry is table, it has to have 'code', 'local' or 'remote' property.")
 			}
 
 			m := map[string]string{}
 			tb.ForEach(func(k, v lua.LValue) {
+				if k.String() == "expect" {
+					expect, err := toTaskExpect(v)
+					if err != nil {
+						panic(err)
+					}
+					for key, value := range expect.stepProps() {
+						m[key] = value
+					}
+					return
+				}
+
 				vs, ok := toString(v)
 				if !ok {
 					vb, ok := toBool(v)
@@ -460,6 +793,18 @@ func toScript(L *lua.LState, value lua.LValue) ([]map[string]string, error) {
 				m[ks] = vs
 			})
 
+			// a step like { local = "make" } runs on the backend regardless of the task's backend.
+			for _, backend := range []string{TASK_BACKEND_LOCAL, TASK_BACKEND_REMOTE} {
+				if code, ok := m[backend]; ok {
+					if _, ok := m["backend"]; ok {
+						return nil, fmt.Errorf("a 'script' entry can't have both 'local' and 'remote' properties.")
+					}
+					delete(m, backend)
+					m["code"] = code
+					m["backend"] = backend
+				}
+			}
+
 			ret = append(ret, m)
 		} else { // array
 			for i := 1; i <= maxn; i++ {
@@ -499,3 +844,44 @@ func toScript(L *lua.LState, value lua.LValue) ([]map[string]string, error) {
 
 	return nil, fmt.Errorf("'script' got a invalid value.")
 }
+
+// localWorkDir returns a directory where the local script runs for the host. It is the task's work_dir (or --chdir),
+// the host's work_dir, or the working directory. A relative path is resolved from the working directory.
+func localWorkDir(task *Task, host *Host) (string, error) {
+	dir := task.WorkDir
+	if dir == "" && host != nil {
+		dir = host.WorkDir
+	}
+	if dir == "" {
+		return WorkingDir, nil
+	}
+
+	tmpl, err := template.New("T").Funcs(template.FuncMap{
+		"ShellEscape":  ShellEscape,
+		"ToUpper":      strings.ToUpper,
+		"ToLower":      strings.ToLower,
+		"EnvKeyEscape": EnvKeyEscape,
+	}).Parse(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid work_dir '%s': %v", dir, err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, map[string]interface{}{"Host": host, "Task": task}); err != nil {
+		return "", fmt.Errorf("invalid work_dir '%s': %v", dir, err)
+	}
+
+	dir = expandHomeDir(b.String())
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(WorkingDir, dir)
+	}
+
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		if host != nil {
+			return "", fmt.Errorf("work_dir of '%s' is not a directory: %s", host.Name, dir)
+		}
+		return "", fmt.Errorf("work_dir is not a directory: %s", dir)
+	}
+
+	return dir, nil
+}
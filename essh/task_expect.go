@@ -0,0 +1,138 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/Songmu/wrapcommander"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TaskExpect is an expectation of the result of the task's script. The run fails if the result doesn't match it
+// even if the script exits with 0.
+type TaskExpect struct {
+	// ExitCode is the expected exit status. The default is 0.
+	ExitCode      int
+	StdoutMatches *regexp.Regexp
+}
+
+func toTaskExpect(value lua.LValue) (*TaskExpect, error) {
+	tb, ok := toLTable(value)
+	if !ok {
+		return nil, fmt.Errorf("expect must be a table.")
+	}
+
+	expect := &TaskExpect{}
+
+	var err error
+	tb.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch key := lua.LVAsString(k); key {
+		case "exit_code":
+			n, ok := v.(lua.LNumber)
+			if !ok {
+				err = fmt.Errorf("exit_code of expect must be a number.")
+				return
+			}
+			expect.ExitCode = int(n)
+		case "stdout_matches":
+			// "^" and "$" match at the beginning and end of each line.
+			re, rerr := regexp.Compile("(?m)" + lua.LVAsString(v))
+			if rerr != nil {
+				err = fmt.Errorf("invalid stdout_matches of expect: %v", rerr)
+				return
+			}
+			expect.StdoutMatches = re
+		default:
+			err = fmt.Errorf("unsupported expect's field '%s'.", key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expect, nil
+}
+
+// stepProps converts the expectation into the properties of a script's step like "expect.exit_code".
+func (e *TaskExpect) stepProps() map[string]string {
+	props := map[string]string{
+		"expect.exit_code": strconv.Itoa(e.ExitCode),
+	}
+	if e.StdoutMatches != nil {
+		props["expect.stdout_matches"] = e.stdoutPattern()
+	}
+
+	return props
+}
+
+// stepExpect returns the expectation of the script's step. It returns nil if the step doesn't have it.
+func stepExpect(step map[string]string) *TaskExpect {
+	code, ok := step["expect.exit_code"]
+	if !ok {
+		return nil
+	}
+
+	expect := &TaskExpect{}
+	expect.ExitCode, _ = strconv.Atoi(code)
+	if pattern, ok := step["expect.stdout_matches"]; ok {
+		expect.StdoutMatches = regexp.MustCompile("(?m)" + pattern)
+	}
+
+	return expect
+}
+
+// stdoutPattern returns the pattern of stdout_matches as it is written in the config.
+func (e *TaskExpect) stdoutPattern() string {
+	return strings.TrimPrefix(e.StdoutMatches.String(), "(?m)")
+}
+
+// check checks the result of the script that finished with the error of exec.Cmd.Wait.
+func (e *TaskExpect) check(err error, stdout string) error {
+	code := 0
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+		code = wrapcommander.ResolveExitCode(err)
+	}
+
+	if code != e.ExitCode {
+		return fmt.Errorf("expected exit status %d, but got %d", e.ExitCode, code)
+	}
+
+	if e.StdoutMatches != nil && !e.StdoutMatches.MatchString(stdout) {
+		return fmt.Errorf("stdout doesn't match '%s'", e.stdoutPattern())
+	}
+
+	return nil
+}
+
+// captureReader writes the data that is read from the reader to the capture.
+type captureReader struct {
+	io.Reader
+	io.Closer
+}
+
+// taskStdout returns the destination of the script's stdout. If the task's output is captured to check
+// the expectations, it also writes to the capture.
+func taskStdout(task *Task, w io.Writer) io.Writer {
+	if task.capture == nil {
+		return w
+	}
+	return io.MultiWriter(w, task.capture)
+}
+
+// taskStdoutReader returns the reader of the script's stdout that also writes to the capture.
+func taskStdoutReader(task *Task, r io.ReadCloser) io.ReadCloser {
+	if task.capture == nil {
+		return r
+	}
+	return &captureReader{Reader: io.TeeReader(r, task.capture), Closer: r}
+}
@@ -0,0 +1,145 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SharedValue is a value that a script published by "##essh:publish key=value".
+// It is shared with the scripts on all the hosts that run after it in the current run.
+type SharedValue struct {
+	Value string
+	Host  string
+}
+
+var sharedValues = map[string]*SharedValue{}
+var sharedValuesMutex sync.Mutex
+
+func publishValue(host string, key string, value string) {
+	sharedValuesMutex.Lock()
+	defer sharedValuesMutex.Unlock()
+
+	if debugFlag {
+		debugf("'%s' published %s=%s\n", host, key, redact(value))
+	}
+
+	sharedValues[key] = &SharedValue{Value: value, Host: host}
+}
+
+// allSharedValues returns a copy of the published values.
+func allSharedValues() map[string]*SharedValue {
+	sharedValuesMutex.Lock()
+	defer sharedValuesMutex.Unlock()
+
+	values := map[string]*SharedValue{}
+	for key, v := range sharedValues {
+		values[key] = &SharedValue{Value: v.Value, Host: v.Host}
+	}
+	return values
+}
+
+// sharedValueVars returns the environment variables like "ESSH_SHARED_KEY" of the published values sorted by the keys.
+func sharedValueVars() []*EnvVar {
+	values := allSharedValues()
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	vars := []*EnvVar{}
+	for _, key := range keys {
+		vars = append(vars, &EnvVar{Key: "ESSH_SHARED_" + strings.ToUpper(key), Value: values[key].Value})
+	}
+	return vars
+}
+
+func newLSharedValues(L *lua.LState) *lua.LTable {
+	tb := L.NewTable()
+	for key, v := range allSharedValues() {
+		tb.RawSetString(key, lua.LString(v.Value))
+	}
+	return tb
+}
+
+// printSharedValues prints the published values as the summary of the task.
+func printSharedValues() {
+	values := allSharedValues()
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		printProgress(VERBOSITY_VERBOSE, "'%s' published %s=%s", values[key].Host, key, redact(values[key].Value))
+	}
+}
+
+// stepWaits reports whether the step waits for all the target hosts to finish the previous steps.
+func stepWaits(step map[string]string) bool {
+	return step["wait"] == "true"
+}
+
+// stepBarrier makes the hosts of a parallel task wait for each other at the steps that have "wait".
+// A host that finishes or fails leaves the barrier, so that the other hosts don't wait for it forever.
+// If a host fails, the steps that wait fail on the other hosts, because the failed host may not publish the values
+// that they wait for.
+type stepBarrier struct {
+	parties int
+	arrived map[int]int
+	// failed is the first host that left the barrier with an error.
+	failed string
+	mutex  *sync.Mutex
+	cond   *sync.Cond
+}
+
+func newStepBarrier(parties int) *stepBarrier {
+	m := new(sync.Mutex)
+	return &stepBarrier{
+		parties: parties,
+		arrived: map[int]int{},
+		mutex:   m,
+		cond:    sync.NewCond(m),
+	}
+}
+
+// wait blocks until all the hosts arrive at the step or leave. It returns an error if a host has failed.
+func (b *stepBarrier) wait(step int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.arrived[step]++
+	b.cond.Broadcast()
+	for b.arrived[step] < b.parties && b.failed == "" {
+		b.cond.Wait()
+	}
+
+	if b.failed != "" {
+		return fmt.Errorf("the task failed on '%s'", b.failed)
+	}
+	return nil
+}
+
+// leave removes the host from the barrier after it finishes all the steps or fails with the error.
+func (b *stepBarrier) leave(host *Host, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.parties--
+	if err != nil && b.failed == "" && host != nil {
+		b.failed = host.Name
+	}
+	b.cond.Broadcast()
+}
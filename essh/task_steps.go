@@ -0,0 +1,230 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// scriptSegments splits the task's script into the consecutive steps that run on the same backend.
+// A step that has its own expectation is also split to check its result.
+// A step that waits for the other hosts is also split to start a segment.
+// Each segment is a copy of the task that has the steps, the backend and the step's expectation.
+// The privileged and user of the task apply only to the steps on the task's backend.
+// It returns nil if the script doesn't need to be split.
+func scriptSegments(task *Task) []*Task {
+	defaultBackend := taskBackend(task)
+
+	split := false
+	for _, step := range task.Script {
+		if stepBackend(task, step) != defaultBackend || stepExpect(step) != nil || stepWaits(step) {
+			split = true
+			break
+		}
+	}
+	if !split || task.File != "" {
+		return nil
+	}
+
+	segments := []*Task{}
+	var segment *Task
+	for _, step := range task.Script {
+		expect := stepExpect(step)
+		if segment == nil || segment.Backend != stepBackend(task, step) || segment.Expect != nil || expect != nil || stepWaits(step) {
+			t := *task
+			t.Backend = stepBackend(task, step)
+			t.Script = []map[string]string{}
+			t.Expect = expect
+			if t.Backend != defaultBackend {
+				t.Privileged = false
+				t.User = ""
+			}
+			segment = &t
+			segments = append(segments, segment)
+		}
+		segment.Script = append(segment.Script, step)
+	}
+
+	return segments
+}
+
+func taskBackend(task *Task) string {
+	if task.IsRemoteTask() {
+		return TASK_BACKEND_REMOTE
+	}
+	return TASK_BACKEND_LOCAL
+}
+
+func stepBackend(task *Task, step map[string]string) string {
+	if b := step["backend"]; b != "" {
+		return b
+	}
+	return taskBackend(task)
+}
+
+// validateStepExpects checks that the steps that have their own expectations don't split a session of the steps.
+// A step that has an expectation runs in its own process on the backend to check its result, so it can't use
+// the shell's state (like the variables and the working directory) of the previous steps.
+func validateStepExpects(task *Task) error {
+	if task.File != "" {
+		return nil
+	}
+
+	for i, step := range task.Script {
+		if i == 0 || stepExpect(step) == nil || stepWaits(step) {
+			continue
+		}
+		prev := task.Script[i-1]
+		if stepBackend(task, prev) == stepBackend(task, step) && stepExpect(prev) == nil {
+			return fmt.Errorf("Task '%s' can't use expect on the step %d that follows a step without expect on the same backend, because the step doesn't get the shell's state of the previous step.", task.PublicName(), i+1)
+		}
+	}
+
+	return nil
+}
+
+// runHostScript runs the task's script for the host. If the task has both local and remote steps,
+// they run in order on each backend. The stdin is passed only to the first segment.
+// The expectations of the steps are checked after each step, and the task's one is checked with
+// the stdout of all the steps.
+func runHostScript(config string, task *Task, host *Host, hosts []*Host, afterConnectScript string, stdinCh chan []byte, m *sync.Mutex) error {
+	printProgress(VERBOSITY_VERBOSE, "running the task '%s' on %s", task.Name, hostProgress(host, hosts))
+	start := time.Now()
+
+	err := runHostSegments(config, task, host, hosts, afterConnectScript, stdinCh, m)
+	if host != nil {
+		profile.Add(PROFILE_EXECUTION, host.Name, start)
+	} else {
+		profile.Add(PROFILE_EXECUTION, "local", start)
+	}
+	if err != nil {
+		printProgress(VERBOSITY_VERBOSE, "the task '%s' failed on %s in %v", task.Name, hostProgress(host, hosts), elapsed(start))
+	} else {
+		printProgress(VERBOSITY_VERBOSE, "the task '%s' finished on %s in %v", task.Name, hostProgress(host, hosts), elapsed(start))
+	}
+
+	return err
+}
+
+// runHostSegments runs the segments of the task's script for the host in order.
+func runHostSegments(config string, task *Task, host *Host, hosts []*Host, afterConnectScript string, stdinCh chan []byte, m *sync.Mutex) (retErr error) {
+	defer func() {
+		task.barrier.leave(host, retErr)
+	}()
+
+	segments := scriptSegments(task)
+	if segments == nil {
+		segments = []*Task{task}
+	}
+
+	name, on := "", ""
+	if host != nil {
+		name, on = host.Name, fmt.Sprintf(" on '%s'", host.Name)
+	}
+
+	var output bytes.Buffer
+	var err error
+	var last *Task
+	step := 0
+	connected := false
+	for i, segment := range segments {
+		if i > 0 && stdinCh != nil {
+			stdinCh = make(chan []byte)
+			close(stdinCh)
+		}
+
+		if stepWaits(segment.Script[0]) {
+			printProgress(VERBOSITY_VERY_VERBOSE, "waiting for the other hosts before the step %d%s", step+1, on)
+			if err := task.barrier.wait(step); err != nil {
+				return &CommandError{Host: name, Err: fmt.Errorf("the step %d of the task '%s' was canceled%s: %v", step+1, task.Name, on, err)}
+			}
+		}
+
+		var stepOutput bytes.Buffer
+		segExpect := segment.Expect
+		if segment == task {
+			segExpect = nil
+		}
+
+		t := *segment
+		if verbosity() == VERBOSITY_QUIET {
+			t.UsePrefix = false
+		}
+		writers := []io.Writer{}
+		if task.Expect != nil {
+			writers = append(writers, &output)
+		}
+		if segExpect != nil {
+			writers = append(writers, &stepOutput)
+		}
+		if len(writers) > 0 {
+			t.capture = io.MultiWriter(writers...)
+		}
+
+		if t.IsRemoteTask() {
+			if host == nil {
+				return &ConfigError{Err: fmt.Errorf("remote steps of the task '%s' need target hosts.", task.Name)}
+			}
+			// the after_connect hooks run only once at the beginning of the first remote step.
+			hookScript := afterConnectScript
+			if connected {
+				hookScript = ""
+			}
+			connected = true
+			err = runRemoteTaskScript(config, &t, host, hosts, hookScript, stdinCh, m)
+		} else {
+			err = runLocalTaskScript(config, &t, host, hosts, stdinCh, m)
+		}
+		step += len(segment.Script)
+
+		if segExpect != nil {
+			if err = segExpect.check(err, stepOutput.String()); err != nil {
+				return &CommandError{Host: name, Err: fmt.Errorf("expectation of the step %d of the task '%s' failed%s: %v", step, task.Name, on, err)}
+			}
+		}
+		if err != nil && i < len(segments)-1 {
+			return taskScriptError(&t, host, err)
+		}
+		last = &t
+	}
+
+	if task.Expect != nil {
+		if err = task.Expect.check(err, output.String()); err != nil {
+			return &CommandError{Host: name, Err: fmt.Errorf("expectation of the task '%s' failed%s: %v", task.Name, on, err)}
+		}
+	}
+
+	return taskScriptError(last, host, err)
+}
+
+// runTaskHookScript runs the task's before_all or after_all script once on the local machine.
+// It gets the same environment variables as the local script without a host.
+func runTaskHookScript(config string, task *Task, name string, script []map[string]string, hosts []*Host) error {
+	if len(script) == 0 {
+		return nil
+	}
+
+	if debugFlag {
+		debugf("run %s of the task '%s'\n", name, task.Name)
+	}
+	printProgress(VERBOSITY_VERY_VERBOSE, "running %s of the task '%s'", name, task.Name)
+
+	t := *task
+	t.Backend = TASK_BACKEND_LOCAL
+	t.File = ""
+	t.Script = script
+	t.Interpreter = ""
+	t.Privileged = false
+	t.User = ""
+	t.Expect = nil
+	t.UsePrefix = false
+	t.barrier = nil
+
+	if err := runHostSegments(config, &t, nil, hosts, "", nil, new(sync.Mutex)); err != nil {
+		return &CommandError{Err: fmt.Errorf("%s of the task '%s' failed: %v", name, task.Name, err)}
+	}
+
+	return nil
+}
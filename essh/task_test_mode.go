@@ -0,0 +1,125 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// planOutput is a destination of the execution plans instead of the stdout. It is used by --test.
+var planOutput io.Writer
+
+// goldenFile returns a path of the golden file of the task for --test.
+func goldenFile(name string) string {
+	return filepath.Join(WorkingDataDir, "golden", strings.Replace(name, string(filepath.Separator), "_", -1)+".golden")
+}
+
+// renderTaskPlan renders the execution plan of the task without connecting to any host.
+// The values that change in each run (like the run id) are replaced with placeholders.
+func renderTaskPlan(config string, task *Task, L *lua.LState) (string, error) {
+	var b bytes.Buffer
+	planOutput = &b
+	defer func() { planOutput = nil }()
+
+	if err := runTask(config, task, []string{}, L); err != nil {
+		return "", err
+	}
+
+	plan := b.String()
+	plan = strings.Replace(plan, RunID, "{{RUN_ID}}", -1)
+	plan = strings.Replace(plan, config, "{{SSH_CONFIG}}", -1)
+	plan = strings.Replace(plan, WorkingDir, "{{WORKING_DIR}}", -1)
+
+	return plan, nil
+}
+
+// runTaskTests compares the execution plans of the tasks with their golden files. If update is true,
+// it writes the plans to the golden files instead. It returns false if any test fails.
+func runTaskTests(w io.Writer, config string, names []string, update bool, L *lua.LState) (bool, error) {
+	tasks := []*Task{}
+	if len(names) == 0 {
+		for _, t := range NewTaskQuery().GetTasksOrderByName() {
+			if !t.Disabled {
+				tasks = append(tasks, t)
+			}
+		}
+	} else {
+		for _, name := range names {
+			t := GetEnabledTask(name)
+			if t == nil {
+				return false, fmt.Errorf("task '%s' is not defined.", name)
+			}
+			tasks = append(tasks, t)
+		}
+	}
+
+	passed := true
+	for _, t := range tasks {
+		file := goldenFile(t.PublicName())
+
+		plan, err := renderTaskPlan(config, t, L)
+		if err != nil {
+			passed = false
+			fmt.Fprintf(w, "FAIL %s: %v\n", t.PublicName(), err)
+			continue
+		}
+
+		if update {
+			if err := os.MkdirAll(filepath.Dir(file), os.FileMode(0755)); err != nil {
+				return false, err
+			}
+			if err := ioutil.WriteFile(file, []byte(plan), os.FileMode(0644)); err != nil {
+				return false, err
+			}
+			fmt.Fprintf(w, "UPDATE %s: %s\n", t.PublicName(), file)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			passed = false
+			fmt.Fprintf(w, "FAIL %s: golden file %s doesn't exist. run with --update to create it.\n", t.PublicName(), file)
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		if line, expected, actual, ok := diffLines(string(b), plan); !ok {
+			passed = false
+			fmt.Fprintf(w, "FAIL %s: the plan differs from %s at line %d\n", t.PublicName(), file, line)
+			fmt.Fprintf(w, "    - %s\n", expected)
+			fmt.Fprintf(w, "    + %s\n", actual)
+			continue
+		}
+
+		fmt.Fprintf(w, "PASS %s\n", t.PublicName())
+	}
+
+	return passed, nil
+}
+
+// diffLines returns the first line that differs between the texts.
+func diffLines(expected string, actual string) (int, string, string, bool) {
+	e := strings.Split(expected, "\n")
+	a := strings.Split(actual, "\n")
+
+	for i := 0; i < len(e) || i < len(a); i++ {
+		el, al := "(end of file)", "(end of file)"
+		if i < len(e) {
+			el = e[i]
+		}
+		if i < len(a) {
+			al = a[i]
+		}
+		if el != al {
+			return i + 1, el, al, false
+		}
+	}
+
+	return 0, "", "", true
+}
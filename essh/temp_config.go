@@ -0,0 +1,214 @@
+package essh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TempSSHConfigPrefix is the prefix of the names of the temporary ssh_config files.
+// The name has the pid of the essh process that created it, like "essh.ssh_config.1234.567890".
+const TempSSHConfigPrefix = "essh.ssh_config."
+
+// PreviewSSHConfigPrefix is the prefix of the names of the ssh_config files that are kept by --preview.
+// They are used by the previewed commands, so they are not removed as the orphaned files.
+const PreviewSSHConfigPrefix = TempSSHConfigPrefix + "preview."
+
+// OrphanedTempSSHConfigAge is the age of the temporary ssh_config files that can be removed
+// if the process that created it is not running. It is also the interval to look for the orphaned files.
+const OrphanedTempSSHConfigAge = time.Hour
+
+var (
+	tempSSHConfigs      = map[string]bool{}
+	tempSSHConfigsMutex sync.Mutex
+	trapSignalsOnce     sync.Once
+	// interruptHandled is not 0 while SIGINT is handled by the function like --console, and trapSignals ignores it.
+	interruptHandled int32
+)
+
+// privateTmpEnabled reports whether the temporary files are created in the private directory by --private-tmp or ESSH_PRIVATE_TMP.
+func privateTmpEnabled() bool {
+	return privateTmpFlag || os.Getenv("ESSH_PRIVATE_TMP") != ""
+}
+
+// tempSSHConfigDir returns the directory of the temporary ssh_config files.
+// The generated config reveals the topology of the hosts and the user names, so it is created in the per-user
+// runtime directory (XDG_RUNTIME_DIR) if it is available instead of the system temporary directory.
+// The private directory is only accessible by the user, so the other users can't see even the names of the files.
+func tempSSHConfigDir() (string, error) {
+	var dir string
+	if privateTmpEnabled() {
+		dir = filepath.Join(UserDataDir, "tmp")
+	} else if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		dir = filepath.Join(runtimeDir, "essh")
+	} else {
+		return os.TempDir(), nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// the directory may be created by the old version with the other permission.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// newTempSSHConfig creates an empty temporary ssh_config file with 0600 permission.
+// It is removed by removeTempSSHConfig, or when essh is stopped by a signal.
+func newTempSSHConfig() (string, error) {
+	dir, err := tempSSHConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	prefix := TempSSHConfigPrefix
+	if previewFlag {
+		prefix = PreviewSSHConfigPrefix
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, fmt.Sprintf("%s%d.", prefix, os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	if err := tmpFile.Chmod(0600); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	tempSSHConfigsMutex.Lock()
+	tempSSHConfigs[tmpFile.Name()] = true
+	tempSSHConfigsMutex.Unlock()
+
+	trapSignalsOnce.Do(trapSignals)
+
+	return tmpFile.Name(), nil
+}
+
+// removeTempSSHConfig removes the temporary ssh_config file.
+func removeTempSSHConfig(path string) {
+	tempSSHConfigsMutex.Lock()
+	delete(tempSSHConfigs, path)
+	tempSSHConfigsMutex.Unlock()
+
+	os.Remove(path)
+}
+
+// keepTempSSHConfig keeps the temporary ssh_config file even if essh is stopped by a signal.
+func keepTempSSHConfig(path string) {
+	tempSSHConfigsMutex.Lock()
+	delete(tempSSHConfigs, path)
+	tempSSHConfigsMutex.Unlock()
+}
+
+// trapSignals removes the temporary ssh_config files and releases the locks of the tasks when essh receives
+// SIGINT, SIGTERM or SIGHUP, because the deferred functions don't run in that case. After removing them, the signal is sent
+// again with the default behavior, so that essh exits in the same way as before.
+// The functions that handle the signals by themselves (like --socks) still receive it.
+func trapSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		sig := <-sigCh
+		for sig == os.Interrupt && atomic.LoadInt32(&interruptHandled) != 0 {
+			sig = <-sigCh
+		}
+
+		tempSSHConfigsMutex.Lock()
+		for path := range tempSSHConfigs {
+			os.Remove(path)
+			delete(tempSSHConfigs, path)
+		}
+		tempSSHConfigsMutex.Unlock()
+
+		releaseHeldLocks()
+
+		signal.Stop(sigCh)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(sig)
+		}
+	}()
+}
+
+// removeOrphanedTempSSHConfigs removes the temporary ssh_config files that were left by the essh processes
+// killed by SIGKILL or crashed. The files of the running processes and the files kept by --preview are kept.
+// It looks for them only in the directory of the temporary ssh_config files and at most once per OrphanedTempSSHConfigAge,
+// because the directory may be the system temporary directory that has many files.
+func removeOrphanedTempSSHConfigs() {
+	stamp := filepath.Join(UserDataDir, "tmp_cleaned_at")
+	if fi, err := os.Stat(stamp); err == nil && time.Since(fi.ModTime()) < OrphanedTempSSHConfigAge {
+		return
+	}
+	if err := ioutil.WriteFile(stamp, []byte{}, 0644); err != nil && debugFlag {
+		debugf("failed to write %s: %v\n", stamp, err)
+	}
+
+	dir, err := tempSSHConfigDir()
+	if err != nil {
+		return
+	}
+	removeOrphanedTempSSHConfigsIn(dir)
+}
+
+func removeOrphanedTempSSHConfigsIn(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), TempSSHConfigPrefix) || strings.HasPrefix(f.Name(), PreviewSSHConfigPrefix) {
+			continue
+		}
+		if time.Since(f.ModTime()) < OrphanedTempSSHConfigAge {
+			continue
+		}
+
+		// the old files don't have the pid in their names. they are removed by the age.
+		if pid, ok := tempSSHConfigPid(f.Name()); ok && processExists(pid) {
+			continue
+		}
+
+		path := filepath.Join(dir, f.Name())
+		if err := os.Remove(path); err == nil && debugFlag {
+			debugf("removed orphaned config file: %s\n", path)
+		}
+	}
+}
+
+// tempSSHConfigPid returns the pid of the process that created the temporary ssh_config file.
+func tempSSHConfigPid(name string) (int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(name, TempSSHConfigPrefix), ".", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
+
+// processExists reports whether the process is running. A process of the other user also exists.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,257 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/Songmu/wrapcommander"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// TransferOptions are host's settings that are translated into scp and rsync flags.
+type TransferOptions struct {
+	// BWLimit is a bandwidth limit in KB/s.
+	BWLimit  int
+	Compress bool
+	// Resume keeps partially transferred files to resume the transfer by the next run. It is used only by rsync.
+	Resume bool
+}
+
+func toTransferOptions(tb *lua.LTable) (*TransferOptions, error) {
+	transfer := &TransferOptions{}
+
+	var err error
+	tb.ForEach(func(key lua.LValue, value lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch lua.LVAsString(key) {
+		case "bwlimit":
+			var limit int
+			limit, err = parseBWLimit(lua.LVAsString(value))
+			transfer.BWLimit = limit
+		case "compress":
+			if b, ok := toBool(value); ok {
+				transfer.Compress = b
+			} else {
+				err = fmt.Errorf("transfer's compress must be a boolean.")
+			}
+		case "resume":
+			if b, ok := toBool(value); ok {
+				transfer.Resume = b
+			} else {
+				err = fmt.Errorf("transfer's resume must be a boolean.")
+			}
+		default:
+			err = fmt.Errorf("unsupported transfer's field '%s'.", lua.LVAsString(key))
+		}
+	})
+
+	return transfer, err
+}
+
+// parseBWLimit parses a bandwidth limit like "500", "500k", "10m" or "1g" and returns it in KB/s.
+// A number without any suffix is KB/s as well as rsync's --bwlimit.
+func parseBWLimit(s string) (int, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	unit := 1
+	switch {
+	case strings.HasSuffix(str, "k"):
+		str = strings.TrimSuffix(str, "k")
+	case strings.HasSuffix(str, "m"):
+		str = strings.TrimSuffix(str, "m")
+		unit = 1024
+	case strings.HasSuffix(str, "g"):
+		str = strings.TrimSuffix(str, "g")
+		unit = 1024 * 1024
+	}
+
+	n, err := strconv.Atoi(str)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bwlimit '%s'. it must be a positive number with an optional suffix k, m or g.", s)
+	}
+
+	return n * unit, nil
+}
+
+// transferOptionsFor merges the transfer options of the hosts.
+// The lowest bandwidth limit is used, and compression and resuming are enabled if any host enables them.
+func transferOptionsFor(hosts []*Host) *TransferOptions {
+	merged := &TransferOptions{}
+	for _, host := range hosts {
+		if host.Transfer == nil {
+			continue
+		}
+		if host.Transfer.BWLimit > 0 && (merged.BWLimit == 0 || host.Transfer.BWLimit < merged.BWLimit) {
+			merged.BWLimit = host.Transfer.BWLimit
+		}
+		if host.Transfer.Compress {
+			merged.Compress = true
+		}
+		if host.Transfer.Resume {
+			merged.Resume = true
+		}
+	}
+
+	return merged
+}
+
+// Flags returns the command flags for scp or rsync.
+func (t *TransferOptions) Flags(name string) []string {
+	flags := []string{}
+	switch name {
+	case "scp":
+		if t.BWLimit > 0 {
+			// scp's -l is Kbit/s.
+			flags = append(flags, "-l", strconv.Itoa(t.BWLimit*8))
+		}
+		if t.Compress {
+			flags = append(flags, "-C")
+		}
+	case "rsync":
+		if t.BWLimit > 0 {
+			flags = append(flags, "--bwlimit="+strconv.Itoa(t.BWLimit))
+		}
+		if t.Compress {
+			flags = append(flags, "-z")
+		}
+		if t.Resume {
+			flags = append(flags, "--partial")
+		}
+	}
+
+	return flags
+}
+
+// newTransferCommand creates a scp or rsync command that uses the generated ssh config.
+// The args are passed to the command directly without a shell, so they don't need any escaping.
+func newTransferCommand(name string, config string, args []string) (*exec.Cmd, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("--%s requires %s command args.", name, name)
+	}
+
+	var commandArgs []string
+	switch name {
+	case "scp":
+		commandArgs = []string{"-F", config}
+	case "rsync":
+		commandArgs = []string{"-e", "ssh -F " + ShellEscape(config)}
+	default:
+		return nil, fmt.Errorf("unsupported transfer command '%s'.", name)
+	}
+	// put the flags of the hosts' transfer settings before the args, so that the args can override them.
+	transfer := transferOptionsFor(transferHosts(args))
+	if resumeFlag {
+		transfer.Resume = true
+	}
+	commandArgs = append(commandArgs, transfer.Flags(name)...)
+	commandArgs = append(commandArgs, args...)
+
+	cmd := exec.Command(name, commandArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd, nil
+}
+
+func runTransfer(L *lua.LState, name string, config string, args []string) (error, int) {
+	hosts := transferHosts(args)
+
+	// the hooks fire for each remote host of the transfer like a remote task.
+	for _, host := range hosts {
+		if err := runHostHooks(L, host, "before_connect", host.HooksBeforeConnect); err != nil {
+			return err, ExitErr
+		}
+	}
+
+	err, ex := runTransferCommand(name, config, args, hosts)
+
+	for _, host := range hosts {
+		if hookErr := runHostHooks(L, host, "after_disconnect", host.HooksAfterDisconnect); hookErr != nil {
+			if err != nil {
+				printError(hookErr)
+			} else {
+				err, ex = hookErr, ExitErr
+			}
+		}
+	}
+
+	return err, ex
+}
+
+func runTransferCommand(name string, config string, args []string, hosts []*Host) (error, int) {
+	if err := prepareConnection(config, hosts); err != nil {
+		return err, ExitErr
+	}
+
+	cmd, err := newTransferCommand(name, config, args)
+	if err != nil {
+		return err, ExitErr
+	}
+
+	if debugFlag {
+		debugf("real %s command: %v \n", name, cmd.Args)
+	}
+
+	err = cmd.Run()
+	ex := wrapcommander.ResolveExitCode(err)
+
+	// same as ssh, scp and rsync print their own errors.
+	return nil, ex
+}
+
+// previewTransfer prints the command line and the hosts that are referred by the args without executing it.
+func previewTransfer(w io.Writer, name string, config string, args []string) error {
+	cmd, err := newTransferCommand(name, config, args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, ShellQuote(cmd.Args))
+
+	for _, host := range transferHosts(args) {
+		kvs := []string{}
+		for _, kvpair := range host.SortedSSHConfig() {
+			for key, value := range kvpair {
+				kvs = append(kvs, key+"="+value)
+			}
+		}
+		fmt.Fprintf(w, "# %s: %s\n", host.Name, strings.Join(kvs, " "))
+	}
+
+	return nil
+}
+
+// transferHosts returns the hosts that are referred by the args like "web01:/path" or "user@web01:/path".
+func transferHosts(args []string) []*Host {
+	hosts := []*Host{}
+	seen := map[string]bool{}
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		i := strings.Index(arg, ":")
+		if i <= 0 {
+			continue
+		}
+
+		name := arg[:i]
+		if at := strings.LastIndex(name, "@"); at >= 0 {
+			name = name[at+1:]
+		}
+
+		if host := Hosts[name]; host != nil && !seen[name] {
+			seen[name] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
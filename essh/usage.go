@@ -0,0 +1,190 @@
+package essh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage is the statistics of the hosts and tasks that the user has used. It is stored only in the local state file
+// and is never sent anywhere.
+type Usage struct {
+	Hosts map[string]*UsageStat `json:"hosts"`
+	Tasks map[string]*UsageStat `json:"tasks"`
+}
+
+type UsageStat struct {
+	Count      int       `json:"count"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// UsageEntry is a host or a task in the list of --frequent.
+type UsageEntry struct {
+	Kind string
+	Name string
+	*UsageStat
+}
+
+// UsageFile is a state file that stores the usage statistics.
+func UsageFile() string {
+	return filepath.Join(UserDataDir, "usage.json")
+}
+
+func loadUsage() *Usage {
+	usage := &Usage{}
+
+	b, err := ioutil.ReadFile(UsageFile())
+	if err == nil {
+		if err := json.Unmarshal(b, usage); err != nil && debugFlag {
+			debugf("failed to load %s: %v\n", UsageFile(), err)
+		}
+	}
+
+	if usage.Hosts == nil {
+		usage.Hosts = map[string]*UsageStat{}
+	}
+	if usage.Tasks == nil {
+		usage.Tasks = map[string]*UsageStat{}
+	}
+
+	return usage
+}
+
+func saveUsage(usage *Usage) error {
+	b, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(UserDataDir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(UsageFile(), b, os.FileMode(0600))
+}
+
+// recordHostUsage counts a connection to the host. The failures are ignored because the statistics are not essential.
+func recordHostUsage(name string) {
+	usage := loadUsage()
+	usage.Hosts[name] = usage.Hosts[name].next()
+	if err := saveUsage(usage); err != nil && debugFlag {
+		debugf("failed to save %s: %v\n", UsageFile(), err)
+	}
+}
+
+// recordTaskUsage counts a run of the task.
+func recordTaskUsage(name string) {
+	usage := loadUsage()
+	usage.Tasks[name] = usage.Tasks[name].next()
+	if err := saveUsage(usage); err != nil && debugFlag {
+		debugf("failed to save %s: %v\n", UsageFile(), err)
+	}
+}
+
+func (s *UsageStat) next() *UsageStat {
+	count := 1
+	if s != nil {
+		count = s.Count + 1
+	}
+
+	return &UsageStat{Count: count, LastUsedAt: time.Now()}
+}
+
+func (s *UsageStat) count() int {
+	if s == nil {
+		return 0
+	}
+	return s.Count
+}
+
+// frequentEntries returns the defined hosts and tasks that have been used, ordered by the counts.
+func frequentEntries(usage *Usage) []*UsageEntry {
+	entries := []*UsageEntry{}
+	for name, stat := range usage.Hosts {
+		if Hosts[name] != nil {
+			entries = append(entries, &UsageEntry{Kind: "host", Name: name, UsageStat: stat})
+		}
+	}
+	for name, stat := range usage.Tasks {
+		if GetEnabledTask(name) != nil {
+			entries = append(entries, &UsageEntry{Kind: "task", Name: name, UsageStat: stat})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].LastUsedAt.After(entries[j].LastUsedAt)
+	})
+
+	return entries
+}
+
+// frequentListing returns the listing of --frequent.
+func frequentListing(entries []*UsageEntry, quiet bool) *Listing {
+	listing := &Listing{Header: []string{"TYPE", "NAME", "COUNT", "LAST USED"}}
+	if quiet {
+		listing.Header = []string{"NAME"}
+	}
+
+	records := []interface{}{}
+	for _, e := range entries {
+		if quiet {
+			listing.Append([]string{e.Name})
+			records = append(records, e.Name)
+			continue
+		}
+
+		listing.Append([]string{e.Kind, e.Name, strconv.Itoa(e.Count), e.LastUsedAt.Format("2006-01-02 15:04:05")})
+		records = append(records, map[string]interface{}{
+			"type":         e.Kind,
+			"name":         e.Name,
+			"count":        e.Count,
+			"last_used_at": e.LastUsedAt,
+		})
+	}
+	listing.Data = records
+
+	return listing
+}
+
+// orderCompletionByUsage orders the lines of the completion list of the hosts or the tasks by the usage.
+// The lines that have the same count keep the order by the names. It is applied to the list that is read from
+// the completion cache too, so that the cache isn't invalidated every time the user connects to a host.
+func orderCompletionByUsage(content string, kind string) string {
+	var stats map[string]*UsageStat
+	switch kind {
+	case "zsh-hosts", "bash-hosts":
+		stats = loadUsage().Hosts
+	case "zsh-tasks", "bash-tasks":
+		stats = loadUsage().Tasks
+	default:
+		return content
+	}
+
+	counts := map[string]int{}
+	for name, stat := range stats {
+		counts[ColonEscape(name)] = stat.count()
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	count := func(line string) int {
+		// the zsh completion has the description after the name.
+		name := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 2)[0]
+		return counts[name]
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return count(lines[i]) > count(lines[j])
+	})
+
+	return strings.Join(lines, "")
+}
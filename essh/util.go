@@ -1,12 +1,15 @@
 package essh
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 func userHomeDir() string {
@@ -20,12 +23,42 @@ func userHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+// expandHomeDir expands a leading "~" in the path to the user's home directory.
+func expandHomeDir(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return userHomeDir() + path[1:]
+	}
+	return path
+}
+
 func ShellEscape(s string) string {
 	return "'" + strings.Replace(s, "'", "'\"'\"'", -1) + "'"
 }
 
+// EnvKeyEscape converts a string to be usable as a part of environment variable name.
+// The characters that are not allowed in a variable name (like "-", "." and spaces) are replaced with "_".
 func EnvKeyEscape(s string) string {
-	return strings.Replace(strings.Replace(s, "-", "_", -1), ".", "_", -1)
+	return strings.Map(func(r rune) rune {
+		if r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// ShellQuote joins the args into a command line. An arg is quoted only if it contains characters that need quoting.
+func ShellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !(('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || strings.ContainsRune("_-./:@=,+%", r))
+		}) < 0 {
+			quoted[i] = arg
+		} else {
+			quoted[i] = ShellEscape(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
 }
 
 func ColonEscape(s string) string {
@@ -37,7 +70,7 @@ func GetContentFromPath(shellPath string) ([]byte, error) {
 	if strings.HasPrefix(shellPath, "http://") || strings.HasPrefix(shellPath, "https://") {
 		// get script from remote using http.
 		if debugFlag {
-			fmt.Printf("[essh debug] get script using http from '%s'\n", shellPath)
+			debugf("get script using http from '%s'\n", shellPath)
 		}
 
 		var httpClient *http.Client = &http.Client{}
@@ -72,3 +105,69 @@ func GetContentFromPath(shellPath string) ([]byte, error) {
 
 	return scriptContent, nil
 }
+
+// generateRunID generates an identifier of the essh invocation.
+// It is used to correlate logs of the scripts that run in the same invocation.
+func generateRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405")
+	}
+
+	return fmt.Sprintf("%s-%x", time.Now().Format("20060102150405"), b)
+}
+
+// roundDuration rounds the duration to the nearest multiple of m like Duration.Round that requires Go 1.9.
+func roundDuration(d, m time.Duration) time.Duration {
+	if m <= 0 {
+		return d
+	}
+	r := d % m
+	if d < 0 {
+		r = -r
+		if r+r < m {
+			return d + r
+		}
+		return d - m + r
+	}
+	if r+r < m {
+		return d - r
+	}
+	return d + m - r
+}
+
+// truncateDuration rounds the duration toward zero to a multiple of m like Duration.Truncate that requires Go 1.9.
+func truncateDuration(d, m time.Duration) time.Duration {
+	if m <= 0 {
+		return d
+	}
+	return d / m * m
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory and renames it to the path,
+// so that the other processes never read a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmpFile.Write(data); err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The verbosity levels of essh's own messages. They don't affect the output of the scripts.
+const (
+	// VERBOSITY_QUIET suppresses the prefixes and the progress messages.
+	VERBOSITY_QUIET  = -1
+	VERBOSITY_NORMAL = 0
+	// VERBOSITY_VERBOSE prints the headers of the hosts and the steps, and the elapsed time.
+	VERBOSITY_VERBOSE = 1
+	// VERBOSITY_VERY_VERBOSE also prints the commands that essh runs and the phases of the tasks.
+	VERBOSITY_VERY_VERBOSE = 2
+)
+
+// verbosity returns the verbosity level that is set by --quiet and --verbose.
+func verbosity() int {
+	if quietFlag {
+		return VERBOSITY_QUIET
+	}
+	if verboseVar > VERBOSITY_VERY_VERBOSE {
+		return VERBOSITY_VERY_VERBOSE
+	}
+	return verboseVar
+}
+
+// printProgress prints essh's progress message to stderr if the verbosity is the level or higher.
+func printProgress(level int, format string, a ...interface{}) {
+	if verbosity() < level {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", color.FgGB("essh: "+format, a...))
+}
+
+// printCommand prints the command that essh runs. A long script in the last argument is abbreviated.
+func printCommand(cmd *exec.Cmd) {
+	if verbosity() < VERBOSITY_VERY_VERBOSE {
+		return
+	}
+
+	args := cmd.Args
+	summary := ShellQuote(args)
+	if last := args[len(args)-1]; len(args) > 1 && (strings.Contains(last, "\n") || len(last) > 80) {
+		summary = ShellQuote(args[:len(args)-1]) + fmt.Sprintf(" <script: %d bytes>", len(last))
+	}
+	printProgress(VERBOSITY_VERY_VERBOSE, "running: %s", summary)
+}
+
+// printTargetHosts prints the target hosts of the task in the very verbose mode.
+func printTargetHosts(task *Task, hosts []*Host) {
+	if len(hosts) == 0 {
+		return
+	}
+
+	names := []string{}
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	printProgress(VERBOSITY_VERY_VERBOSE, "target hosts of the task '%s': %s", task.Name, strings.Join(names, ", "))
+}
+
+// stepHeaders returns the shell code that prints the header of each step to stderr.
+// They are used by the drivers in the verbose mode. A script that has only one step doesn't have the header.
+func stepHeaders(scripts []map[string]string) []string {
+	if len(scripts) < 2 {
+		return nil
+	}
+
+	headers := []string{}
+	for i, script := range scripts {
+		header := fmt.Sprintf("essh: step %d/%d", i+1, len(scripts))
+		if description := script["description"]; description != "" {
+			header += ": " + description
+		}
+		headers = append(headers, "printf '%s\\n' "+ShellEscape(header)+" >&2")
+	}
+	return headers
+}
+
+// hostProgress returns the label of the host like "'web01' (1/3)" for the progress messages.
+func hostProgress(host *Host, hosts []*Host) string {
+	if host == nil {
+		return "local"
+	}
+	for i, h := range hosts {
+		if h == host {
+			return fmt.Sprintf("'%s' (%d/%d)", host.Name, i+1, len(hosts))
+		}
+	}
+	return fmt.Sprintf("'%s'", host.Name)
+}
+
+// elapsed formats the elapsed time for the progress messages.
+func elapsed(start time.Time) time.Duration {
+	return roundDuration(time.Since(start), time.Millisecond)
+}
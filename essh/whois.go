@@ -0,0 +1,132 @@
+package essh
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWhoisResolveTimeout is a timeout of the DNS lookups of --whois --resolve.
+const DefaultWhoisResolveTimeout = 5 * time.Second
+
+// WhoisMatch is a host that points to the address of --whois.
+type WhoisMatch struct {
+	Host *Host
+	// HostName is the HostName of the host, or its name if the HostName isn't set.
+	HostName string
+	// Address is the address that matched. It is an IP address if it is found by DNS resolution.
+	Address string
+}
+
+func hostAddress(host *Host) string {
+	if hostname := host.SSHConfig["HostName"]; hostname != "" {
+		return hostname
+	}
+	return host.Name
+}
+
+// whoisHosts finds the hosts whose HostName is the address. If resolve is true, the address and the HostNames
+// are resolved by DNS, and the hosts that share an IP address with the address are also found.
+func whoisHosts(hosts []*Host, address string, resolve bool) []*WhoisMatch {
+	matches := []*WhoisMatch{}
+
+	var addrs map[string]bool
+	var resolved map[*Host][]string
+	if resolve {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultWhoisResolveTimeout)
+		defer cancel()
+
+		addrs = map[string]bool{}
+		for _, ip := range lookupAddresses(ctx, address) {
+			addrs[ip] = true
+		}
+		resolved = lookupHostAddresses(ctx, hosts)
+	}
+
+	for _, host := range hosts {
+		hostname := hostAddress(host)
+		if strings.EqualFold(hostname, address) {
+			matches = append(matches, &WhoisMatch{Host: host, HostName: hostname, Address: hostname})
+			continue
+		}
+
+		for _, ip := range resolved[host] {
+			if addrs[ip] {
+				matches = append(matches, &WhoisMatch{Host: host, HostName: hostname, Address: ip})
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// lookupAddresses returns the IP addresses of the name. If the name is an IP address, it returns the name as it is.
+func lookupAddresses(ctx context.Context, name string) []string {
+	if ip := net.ParseIP(name); ip != nil {
+		return []string{ip.String()}
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+	if err != nil {
+		return []string{}
+	}
+
+	ips := []string{}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
+
+// lookupHostAddresses resolves the HostNames of the hosts in parallel.
+func lookupHostAddresses(ctx context.Context, hosts []*Host) map[*Host][]string {
+	resolved := map[*Host][]string{}
+
+	m := new(sync.Mutex)
+	wg := &sync.WaitGroup{}
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host *Host) {
+			defer wg.Done()
+			ips := lookupAddresses(ctx, hostAddress(host))
+
+			m.Lock()
+			defer m.Unlock()
+			resolved[host] = ips
+		}(host)
+	}
+	wg.Wait()
+
+	return resolved
+}
+
+func whoisListing(matches []*WhoisMatch, quiet bool) *Listing {
+	listing := &Listing{Header: []string{"NAME", "HOSTNAME", "ADDRESS"}}
+	if quiet {
+		listing.Header = []string{"NAME"}
+	}
+
+	records := []interface{}{}
+	for _, m := range matches {
+		if quiet {
+			listing.Append([]string{m.Host.Name})
+			records = append(records, m.Host.Name)
+			continue
+		}
+
+		listing.Append([]string{m.Host.Name, m.HostName, m.Address})
+		records = append(records, map[string]interface{}{
+			"name":     m.Host.Name,
+			"hostname": m.HostName,
+			"address":  m.Address,
+		})
+	}
+	listing.Data = records
+
+	return listing
+}